@@ -2,9 +2,9 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 )
 
 /*
@@ -22,6 +22,14 @@ type AddBlockReq struct {
 	Block       Block  `json:"block"`
 }
 
+/*
+	AdminReq is a request for an admin only operation
+	that doesn't need any other parameters.
+*/
+type AdminReq struct {
+	AdminLabKey string `json:"admin_lab_key"`
+}
+
 type AddUserReq struct {
 	AdminLabKey string `json:"admin_lab_key"`
 	LabKey      string `json:"lab_key"`
@@ -39,175 +47,204 @@ type AddUserReq struct {
 	the new database.
 */
 
-func migrateAddLabeledBlockHandler(w http.ResponseWriter, r *http.Request) {
-	parseFormErr := r.ParseForm()
-	if parseFormErr != nil {
-		http.Error(w, parseFormErr.Error(), 400)
-		return
-	}
-
-	fmt.Println("got a request to upload a block")
+func (s *Server) migrateAddLabeledBlockHandler(w http.ResponseWriter, r *http.Request) {
 	var addBlockReq AddBlockReq
-
-	jsonDataFromHTTP, readBodyErr := ioutil.ReadAll(r.Body)
-	if readBodyErr != nil {
-		http.Error(w, readBodyErr.Error(), 400)
+	if !s.decodeRequest(w, r, &addBlockReq, "admin_lab_key", "block") {
 		return
 	}
 
-	fmt.Println()
-	unmarshalErr := json.Unmarshal(jsonDataFromHTTP, &addBlockReq)
-	if unmarshalErr != nil {
-		http.Error(w, unmarshalErr.Error(), 400)
-		return
-	}
-
-	fmt.Println(addBlockReq)
+	annotateRequest(r, addBlockReq.Block.LabKey, addBlockReq.Block.Coder, addBlockReq.Block.ID)
 
 	// make sure the lab is one of the approved labs
-	if !mainConfig.labIsAdmin(addBlockReq.AdminLabKey) {
-		http.Error(w, ErrLabNotRegistered.Error(), 400)
-		fmt.Println("Unauthorized Lab Key")
+	if !s.config.labIsAdmin(addBlockReq.AdminLabKey) {
+		writeError(w, r, ErrAdminKeyRequired, 403)
+		requestLogger(r).Warn("unauthorized lab key")
 		return
 	}
 
 	var block = addBlockReq.Block
 
-	workItem := workItemMap[block.ID]
+	workItem, _ := s.workItem(block.ID)
 	request := IDSRequest{
 		LabKey:   block.LabKey,
 		LabName:  block.LabName,
 		Username: block.Coder,
 	}
 
-	fmt.Printf("\n\n\n\nThe block:")
-	fmt.Println(block)
 	if block.Training {
 
-		user, getUserErr := labsDB.getUser(block.LabKey, block.Coder)
+		user, getUserErr := s.getUser(block.LabKey, block.Coder)
 		if getUserErr != nil {
-			fmt.Println("getUser failed")
-			http.Error(w, getUserErr.Error(), 400)
+			writeError(w, r, getUserErr, 400)
 			return
 		}
 		user.addCompleteTrainBlock(block)
-		fmt.Println("got past:   user.addCompleteTrainBlock(block)")
 
-		setUserErr := labsDB.setUser(user)
+		setUserErr := s.setUser(user)
 		if setUserErr != nil {
-			fmt.Println("setUser failed")
-			http.Error(w, getUserErr.Error(), 400)
+			writeError(w, r, setUserErr, 500)
 			return
 		}
 
 	} else if block.Reliability {
 
-		user, getUserErr := labsDB.getUser(block.LabKey, block.Coder)
+		user, getUserErr := s.getUser(block.LabKey, block.Coder)
 		if getUserErr != nil {
-			fmt.Println("getUser failed")
-			http.Error(w, getUserErr.Error(), 400)
+			writeError(w, r, getUserErr, 400)
 			return
 		}
 
 		user.addCompleteRelBlock(block)
-		fmt.Println("got past:    user.addCompleteRelBlock(block)")
 
-		setUserErr := labsDB.setUser(user)
+		setUserErr := s.setUser(user)
 		if setUserErr != nil {
-			fmt.Println("setUser failed")
-			http.Error(w, getUserErr.Error(), 400)
+			writeError(w, r, setUserErr, 500)
 			return
 		}
 	}
 
-	addBlockErr := labelsDB.addBlock(block)
+	addBlockErr := s.addLabeledBlock(block)
 	if addBlockErr != nil {
-		http.Error(w, addBlockErr.Error(), 400)
+		writeError(w, r, addBlockErr, 400)
+		return
+	}
+	inactivateErr := s.inactivateWorkItem(workItem, request)
+	if inactivateErr != nil {
+		writeError(w, r, inactivateErr, 500)
 		return
 	}
-	inactivateWorkItem(workItem, request)
-
 }
 
-func migrateAddUserHandler(w http.ResponseWriter, r *http.Request) {
-	parseFormErr := r.ParseForm()
-	if parseFormErr != nil {
-		http.Error(w, parseFormErr.Error(), 400)
+func (s *Server) migrateAddUserHandler(w http.ResponseWriter, r *http.Request) {
+	var addUserReq AddUserReq
+	if !s.decodeRequest(w, r, &addUserReq) {
 		return
 	}
 
-	fmt.Println("got a request to add a user to the database")
-	var addUserReq AddUserReq
+	annotateRequest(r, addUserReq.LabKey, addUserReq.User, "")
 
-	jsonDataFromHTTP, readBodyErr := ioutil.ReadAll(r.Body)
-	if readBodyErr != nil {
-		http.Error(w, readBodyErr.Error(), 400)
+	// make sure the lab is one of the approved labs
+	if !s.config.labIsAdmin(addUserReq.AdminLabKey) {
+		writeError(w, r, ErrAdminKeyRequired, 403)
+		requestLogger(r).Warn("unauthorized lab key")
 		return
 	}
 
-	fmt.Println()
-	unmarshalErr := json.Unmarshal(jsonDataFromHTTP, &addUserReq)
-	if unmarshalErr != nil {
-		http.Error(w, unmarshalErr.Error(), 400)
+	addUserErr := s.addUser(addUserReq.LabKey, addUserReq.LabName, addUserReq.User)
+	if addUserErr != nil {
+		writeError(w, r, addUserErr, 500)
 		return
 	}
+}
 
-	fmt.Println(addUserReq)
+func (s *Server) migrateSetActiveWorkItemHandler(w http.ResponseWriter, r *http.Request) {
+	var addItemReq AddBlockReq
+	if !s.decodeRequest(w, r, &addItemReq, "admin_lab_key", "lab_key", "username", "block_id") {
+		return
+	}
+
+	annotateRequest(r, addItemReq.LabKey, addItemReq.Username, addItemReq.ItemID)
 
 	// make sure the lab is one of the approved labs
-	if !mainConfig.labIsAdmin(addUserReq.AdminLabKey) {
-		http.Error(w, ErrLabNotRegistered.Error(), 400)
-		fmt.Println("Unauthorized Lab Key")
+	if !s.config.labIsAdmin(addItemReq.AdminLabKey) {
+		writeError(w, r, ErrAdminKeyRequired, 403)
+		requestLogger(r).Warn("unauthorized lab key")
 		return
 	}
 
-	labsDB.addUser(addUserReq.LabKey, addUserReq.LabName, addUserReq.User)
-}
+	user, getUserErr := s.getUser(addItemReq.LabKey, addItemReq.Username)
+	if getUserErr != nil {
+		writeError(w, r, getUserErr, 400)
+		return
+	}
 
-func migrateSetActiveWorkItemHandler(w http.ResponseWriter, r *http.Request) {
-	parseFormErr := r.ParseForm()
-	if parseFormErr != nil {
-		http.Error(w, parseFormErr.Error(), 400)
+	user.addWorkItem(addItemReq.ItemID)
+
+	setUserErr := s.setUser(user)
+	if setUserErr != nil {
+		writeError(w, r, setUserErr, 400)
 		return
 	}
 
-	fmt.Println("got a request to add active work item to user")
-	var addItemReq AddBlockReq
+}
 
-	jsonDataFromHTTP, readBodyErr := ioutil.ReadAll(r.Body)
-	if readBodyErr != nil {
-		http.Error(w, readBodyErr.Error(), 400)
+/*
+	rebuildIndexesHandler drops and rebuilds the LabelsDB's
+	lab, coder and CLAN file indexes from the Labels bucket.
+*/
+func (s *Server) rebuildIndexesHandler(w http.ResponseWriter, r *http.Request) {
+	var adminReq AdminReq
+	if !s.decodeRequest(w, r, &adminReq) {
 		return
 	}
+	annotateRequest(r, adminReq.AdminLabKey, "", "")
 
-	fmt.Println()
-	unmarshalErr := json.Unmarshal(jsonDataFromHTTP, &addItemReq)
-	if unmarshalErr != nil {
-		http.Error(w, unmarshalErr.Error(), 400)
+	if !s.config.labIsAdmin(adminReq.AdminLabKey) {
+		writeError(w, r, ErrAdminKeyRequired, 403)
+		requestLogger(r).Warn("unauthorized lab key")
 		return
 	}
 
-	fmt.Println(addItemReq)
+	numGroups, rebuildErr := s.labels.rebuildIndexes()
+	if rebuildErr != nil {
+		writeError(w, r, rebuildErr, 500)
+		return
+	}
 
-	// make sure the lab is one of the approved labs
-	if !mainConfig.labIsAdmin(addItemReq.AdminLabKey) {
-		http.Error(w, ErrLabNotRegistered.Error(), 400)
-		fmt.Println("Unauthorized Lab Key")
+	json.NewEncoder(w).Encode(map[string]int{"indexed_block_groups": numGroups})
+}
+
+/*
+	snapshotHandler sends a consistent snapshot of all three
+	databases to the client as a tarball. The snapshot is written
+	to a temporary file first, so the read transactions it takes
+	aren't held open for as long as the download takes.
+*/
+func (s *Server) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	var adminReq AdminReq
+	if !s.decodeRequest(w, r, &adminReq) {
 		return
 	}
+	annotateRequest(r, adminReq.AdminLabKey, "", "")
 
-	user, getUserErr := labsDB.getUser(addItemReq.LabKey, addItemReq.Username)
-	if getUserErr != nil {
-		http.Error(w, getUserErr.Error(), 400)
+	if !s.config.labIsAdmin(adminReq.AdminLabKey) {
+		writeError(w, r, ErrAdminKeyRequired, 403)
+		requestLogger(r).Warn("unauthorized lab key")
 		return
 	}
 
-	user.addWorkItem(addItemReq.ItemID)
+	dbs, storesErr := s.boltDBs()
+	if storesErr != nil {
+		writeError(w, r, storesErr, 501)
+		return
+	}
 
-	setUserErr := labsDB.setUser(user)
-	if setUserErr != nil {
-		http.Error(w, setUserErr.Error(), 400)
+	tmpDir, tmpErr := os.MkdirTemp("", "idsserver-snapshot")
+	if tmpErr != nil {
+		writeError(w, r, tmpErr, 500)
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	snapshotPath, snapshotErr := writeSnapshotFile(tmpDir, dbs)
+	if snapshotErr != nil {
+		writeError(w, r, snapshotErr, 500)
+		return
+	}
+	snapshot, openErr := os.Open(snapshotPath)
+	if openErr != nil {
+		writeError(w, r, openErr, 500)
+		return
+	}
+	defer snapshot.Close()
+	info, statErr := snapshot.Stat()
+	if statErr != nil {
+		writeError(w, r, statErr, 500)
 		return
 	}
 
+	dispositionString := "attachment; filename=" + filepath.Base(snapshotPath)
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", dispositionString)
+	http.ServeContent(w, r, snapshotPath, info.ModTime(), snapshot)
 }
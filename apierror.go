@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// ErrAdminKeyRequired means an admin only endpoint was called without the admin key
+var ErrAdminKeyRequired = errors.New("Admin lab key required")
+
+/*
+APIError is the body of every error response. Code is
+stable, so clients can tell errors apart without matching
+the Message, which is for people. Details, when there
+are any, say more about what was wrong.
+*/
+type APIError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// errorKind is the code and HTTP status an error is sent with
+type errorKind struct {
+	code   string
+	status int
+}
+
+/*
+errorKinds are the codes and statuses of the errors the handlers
+send back. Don't change the codes, clients rely on them.
+*/
+var errorKinds = map[error]errorKind{
+	// labsdb.go
+	ErrUserDoesntExist:         {"user_not_found", http.StatusNotFound},
+	ErrLabDoesntExist:          {"lab_not_found", http.StatusNotFound},
+	ErrUserNotAssignedWorkItem: {"work_item_not_assigned", http.StatusConflict},
+	ErrLabNotRegistered:        {"lab_not_registered", http.StatusUnauthorized},
+	ErrTrainBlockNotFound:      {"training_block_not_found", http.StatusNotFound},
+	ErrReliaBlockNotFound:      {"reliability_block_not_found", http.StatusNotFound},
+
+	// workdb.go
+	ErrRanOutOfItems:       {"no_blocks_available", http.StatusNotFound},
+	ErrWorkItemDoesntExist: {"work_item_not_found", http.StatusNotFound},
+
+	// labelsdb.go
+	ErrCouldntFindLabeledBlock: {"labeled_block_not_found", http.StatusNotFound},
+	ErrBlockGroupFull:          {"block_fully_coded", http.StatusConflict},
+	ErrBlockAlreadyCodedByUser: {"block_already_coded_by_user", http.StatusConflict},
+	ErrAddBlockFailed:          {"add_block_failed", http.StatusInternalServerError},
+	ErrLabNotInBlockGroup:      {"lab_not_in_block_group", http.StatusNotFound},
+	ErrInstanceNotInGroup:      {"instance_not_found", http.StatusNotFound},
+	ErrLabPassLimitReached:     {"lab_pass_limit_reached", http.StatusConflict},
+	ErrCoderPassLimitReached:   {"coder_pass_limit_reached", http.StatusConflict},
+
+	ErrAdminKeyRequired:       {"admin_key_required", http.StatusForbidden},
+	ErrBlockChecksumMismatch:  {"block_checksum_mismatch", http.StatusConflict},
+	ErrClipDoesntExist:        {"clip_not_found", http.StatusNotFound},
+	ErrMissingClanFile:        {"missing_clan_file", http.StatusBadRequest},
+	ErrNoTimeBullet:           {"no_time_bullet", http.StatusBadRequest},
+	ErrTrainingAndReliability: {"training_and_reliability", http.StatusBadRequest},
+	ErrNoBlocksDir:            {"no_blocks_dir", http.StatusServiceUnavailable},
+	ErrImportFormat:           {"import_format", http.StatusBadRequest},
+	ErrImportUnknownType:      {"import_unknown_type", http.StatusBadRequest},
+	ErrImportMissingField:     {"import_missing_field", http.StatusBadRequest},
+	ErrImportTypeMismatch:     {"import_type_mismatch", http.StatusBadRequest},
+	ErrWorkMapNotLoaded:       {"work_map_not_loaded", http.StatusServiceUnavailable},
+	ErrManifestNotLoaded:      {"manifest_not_loaded", http.StatusServiceUnavailable},
+	ErrNotBoltStore:           {"snapshot_not_supported", http.StatusNotImplemented},
+	ErrRepairWhileRunning:     {"repair_while_running", http.StatusConflict},
+
+	// decode.go
+	ErrMalformedRequest:  {"malformed_request", http.StatusBadRequest},
+	ErrUnknownField:      {"unknown_field", http.StatusBadRequest},
+	ErrRequestTooLarge:   {"request_too_large", http.StatusRequestEntityTooLarge},
+	ErrMissingFields:     {"missing_fields", http.StatusBadRequest},
+	ErrUnknownDeleteType: {"unknown_delete_type", http.StatusBadRequest},
+	ErrMethodNotAllowed:  {"method_not_allowed", http.StatusMethodNotAllowed},
+	ErrBadCursor:         {"bad_cursor", http.StatusBadRequest},
+	ErrUnknownPageFormat: {"unknown_format", http.StatusBadRequest},
+}
+
+/*
+statusCodes are the codes of errors that aren't in errorKinds,
+by the status the handler sent them with
+*/
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "request_too_large",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+/*
+errorKindOf finds the code and status of an error. Errors
+that aren't known are sent with the status the handler
+chose, and a code for that status.
+*/
+func errorKindOf(err error, status int) errorKind {
+	for known, kind := range errorKinds {
+		if errors.Is(err, known) {
+			return kind
+		}
+	}
+	if code, exists := statusCodes[status]; exists {
+		return errorKind{code, status}
+	}
+	return errorKind{"error", status}
+}
+
+/*
+writeError sends err as an APIError. status is only used for
+errors without a known kind (so a handler passes the status it
+would want for an unexpected error).
+*/
+func writeError(w http.ResponseWriter, r *http.Request, err error, status int) {
+	writeErrorDetails(w, r, err, status, nil)
+}
+
+// writeErrorDetails is writeError with Details
+func writeErrorDetails(w http.ResponseWriter, r *http.Request, err error, status int, details interface{}) {
+	kind := errorKindOf(err, status)
+	if kind.status >= 500 {
+		requestLogger(r).Error("request failed", "code", kind.code, "error", err)
+	} else {
+		requestLogger(r).Debug("request rejected", "code", kind.code, "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(kind.status)
+	json.NewEncoder(w).Encode(APIError{Code: kind.code, Message: err.Error(), Details: details})
+}
+
+/*
+recoverPanics turns a panic in a handler into a 500, instead
+of the connection being dropped, and logs it with the stack
+*/
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// http.ErrAbortHandler is how a handler means to abort
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			requestLogger(r).Error("handler panicked", "panic", fmt.Sprint(recovered),
+				"stack", string(debug.Stack()))
+			writeError(w, r, errors.New("Internal server error"), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
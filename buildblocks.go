@@ -0,0 +1,532 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SeedlingsBabylab/idsserver/chat"
+)
+
+var (
+	// ErrNoTimeBullet means a main tier in a conversation
+	// block has no time bullet, so it can't be sliced
+	ErrNoTimeBullet = errors.New("Tier has no time bullet")
+
+	// ErrTrainingAndReliability means blocks were to be built as both
+	// training and reliability blocks, which the manifest can't have
+	ErrTrainingAndReliability = errors.New("Blocks can't be both --training and --reliability")
+)
+
+/*
+labelsCSVHeader is the header of the <clan_file>_labels.csv
+in each block zip (the same one makeblocks.py wrote)
+*/
+var labelsCSVHeader = []string{"date", "coder", "clan_file", "audiofile", "block",
+	"timestamp", "clip", "tier", "label", "multi-tier-parent",
+	"dont_share", "training", "reliability"}
+
+/*
+blockClip is a single clip of a conversation block, one
+physical line of a main tier (continuation lines of a tier
+are clips of their own, marked multiline)
+*/
+type blockClip struct {
+	Index     int
+	Tier      string
+	Multiline bool
+	// the timestamp of the closest clip before
+	// this one that isn't multiline
+	MultiTierParent string
+	Bullet          chat.Bullet
+}
+
+/*
+conversationClips splits a "Conversation N" gem into clips
+*/
+func conversationClips(gem *chat.Gem) ([]blockClip, error) {
+	var clips []blockClip
+	parent := ""
+	for _, utt := range gem.Utterances {
+		for i, physical := range utt.Main.PhysicalLines() {
+			bullet, hasBullet := chat.FirstBullet(physical)
+			if !hasBullet {
+				return nil, fmt.Errorf("%v: %s: *%s: %s", ErrNoTimeBullet, gem.Label, utt.Speaker(), physical)
+			}
+			clip := blockClip{Index: len(clips) + 1, Tier: utt.Speaker(), Multiline: i > 0, Bullet: bullet}
+			if clip.Multiline {
+				clip.MultiTierParent = parent
+			} else {
+				parent = bullet.Timestamp()
+			}
+			clips = append(clips, clip)
+		}
+	}
+	return clips, nil
+}
+
+/*
+BlockSource is a CLAN file and the audio it was transcribed from
+*/
+type BlockSource struct {
+	ClanPath  string
+	AudioPath string
+}
+
+/*
+findBlockSources walks dataDir for directories that hold just
+a .cha file and its audio (the layout makeblocks.py expected)
+*/
+func findBlockSources(dataDir string) ([]BlockSource, error) {
+	var sources []BlockSource
+	err := filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		var source BlockSource
+		var files int
+		for _, entry := range entries {
+			if entry.IsDir() {
+				// only the leaf directories
+				return nil
+			}
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			files++
+			switch strings.ToLower(filepath.Ext(entry.Name())) {
+			case ".cha":
+				source.ClanPath = filepath.Join(path, entry.Name())
+			case ".wav", ".mp3":
+				source.AudioPath = filepath.Join(path, entry.Name())
+			}
+		}
+		if files == 2 && source.ClanPath != "" && source.AudioPath != "" {
+			sources = append(sources, source)
+		}
+		return nil
+	})
+	return sources, err
+}
+
+/*
+BuiltBlock is a block zip written by build-blocks.
+ClanFile is the name of the CLAN file without ".cha",
+the same as in the manifest.
+*/
+type BuiltBlock struct {
+	ClanFile string `json:"clanfile"`
+	Index    int    `json:"block_index"`
+	Path     string `json:"block_path"`
+	Clips    int    `json:"clips"`
+}
+
+/*
+BuildBlocksReport is what build-blocks did. Skipped are
+the CLAN files and blocks that weren't built, and why,
+and Existing the blocks that were already registered.
+*/
+type BuildBlocksReport struct {
+	Blocks     []BuiltBlock `json:"blocks"`
+	Skipped    []string     `json:"skipped"`
+	Manifest   string       `json:"manifest"`
+	Registered int          `json:"registered"`
+	Existing   []string     `json:"existing"`
+}
+
+/*
+buildSourceBlocks selects the conversation blocks of the
+source with the rules, and builds them (see buildSelectedBlocks)
+*/
+func (s *Server) buildSourceBlocks(source BlockSource, outDir string, training, reliability bool, rules BlockRules, report *BuildBlocksReport) error {
+	transcript, err := chat.ParseFile(source.ClanPath)
+	if err != nil {
+		return err
+	}
+	clanFile := filepath.Base(source.ClanPath)
+	clanName := strings.TrimSuffix(clanFile, filepath.Ext(clanFile))
+
+	selection := rules.selectBlocks(clanName, transcript)
+	return s.buildSelectedBlocks(source, transcript, selection, outDir, training, reliability, report)
+}
+
+/*
+buildSelectedBlocks writes a zip for every selected block to
+
+	outDir/<clan file>/<block number>.zip
+
+Each zip has a WAV for every clip (1.wav, 2.wav, ...) and the
+<clan file>_labels.csv for the coders to fill in.
+
+Blocks that are already in the work item map, or whose zip is
+already there, aren't built: coders may have labeled that zip,
+and rebuilding it (with other rules, say) would change it under
+the labels and their recorded checksum.
+*/
+func (s *Server) buildSelectedBlocks(source BlockSource, transcript *chat.File, selection *BlockSelection,
+	outDir string, training, reliability bool, report *BuildBlocksReport) error {
+	if strings.ToLower(filepath.Ext(source.AudioPath)) != ".wav" {
+		report.Skipped = append(report.Skipped, source.ClanPath+": audio isn't a WAV file: "+source.AudioPath)
+		return nil
+	}
+	audio, err := openWAV(source.AudioPath)
+	if err != nil {
+		return fmt.Errorf("%s: %v", source.AudioPath, err)
+	}
+	defer audio.Close()
+
+	evaluations := make(map[int]BlockEvaluation)
+	for _, eval := range selection.Blocks {
+		evaluations[eval.Block] = eval
+	}
+	clanFile := filepath.Base(source.ClanPath)
+
+	for _, number := range selection.Selected {
+		eval, exists := evaluations[number]
+		if !exists {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("%s: no Conversation %d", source.ClanPath, number))
+			continue
+		}
+		if eval.clips == nil {
+			report.Skipped = append(report.Skipped, source.ClanPath+": "+strings.Join(eval.Reasons, ", "))
+			continue
+		}
+
+		block := BuiltBlock{ClanFile: selection.ClanFile, Index: number, Clips: len(eval.clips),
+			Path: filepath.Join(outDir, selection.ClanFile, strconv.Itoa(number)+".zip")}
+		blockID := block.ClanFile + ":::" + strconv.Itoa(number)
+		if _, registered := s.workItem(blockID); registered {
+			report.Existing = append(report.Existing, blockID)
+			continue
+		}
+		if _, statErr := os.Stat(block.Path); statErr == nil {
+			report.Skipped = append(report.Skipped, blockID+": "+block.Path+" already exists")
+			continue
+		}
+		labels := labelsCSV{clanFile: clanFile, audioFile: filepath.Base(source.AudioPath),
+			block: number, training: training, reliability: reliability}
+		if err := writeBlockZip(block.Path, audio, eval.clips, labels); err != nil {
+			return err
+		}
+		report.Blocks = append(report.Blocks, block)
+	}
+	return nil
+}
+
+// labelsCSV is what goes in every row of a block's labels csv
+type labelsCSV struct {
+	clanFile    string
+	audioFile   string
+	block       int
+	training    bool
+	reliability bool
+}
+
+// pyBool writes a bool the way makeblocks.py did
+func pyBool(value bool) string {
+	if value {
+		return "True"
+	}
+	return "False"
+}
+
+/*
+writeBlockZip slices the clips out of the audio and writes them,
+along with the labels csv, to a zip at path. The zip is written
+next to path and renamed, so a failed build doesn't leave a
+partial zip behind.
+*/
+func writeBlockZip(path string, audio *wavAudio, clips []blockClip, labels labelsCSV) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	archive := zip.NewWriter(tmp)
+	for _, clip := range clips {
+		entry, err := archive.Create(strconv.Itoa(clip.Index) + ".wav")
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := audio.writeSlice(entry, clip.Bullet.Start, clip.Bullet.End); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	csvName := strings.TrimSuffix(labels.clanFile, filepath.Ext(labels.clanFile)) + "_labels.csv"
+	entry, err := archive.Create(csvName)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	writer := csv.NewWriter(entry)
+	writer.Write(labelsCSVHeader)
+	for _, clip := range clips {
+		parent := "N"
+		if clip.Multiline {
+			parent = clip.MultiTierParent
+		}
+		writer.Write([]string{"", "", labels.clanFile, labels.audioFile,
+			strconv.Itoa(labels.block), clip.Bullet.Timestamp(), strconv.Itoa(clip.Index),
+			clip.Tier, "", parent, pyBool(false), pyBool(labels.training), pyBool(labels.reliability)})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := archive.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// manifestRow is a row of a path_manifest.csv
+type manifestRow struct {
+	clanFile    string
+	index       int
+	path        string
+	training    bool
+	reliability bool
+}
+
+/*
+writeManifest writes the path_manifest.csv of every block in outDir,
+like makeblocks.py did, not just the ones built this time. Blocks
+that were in the manifest already keep their row, blocks found in
+outDir get the flags of their work item (or of this build, if they
+don't have one), and the blocks just built get this build's flags.
+*/
+func (s *Server) writeManifest(path, outDir string, blocks []BuiltBlock, training, reliability bool) error {
+	rows := make(map[string]manifestRow)
+	if dataMap, _, err := readManifest(path, false); err == nil {
+		for _, group := range dataMap {
+			for index, blockPath := range group.BlockPaths {
+				rows[group.ClanFile+":::"+strconv.Itoa(index)] = manifestRow{group.ClanFile,
+					index, blockPath, group.Training, group.Reliability}
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	zips, err := filepath.Glob(filepath.Join(outDir, "*", "*.zip"))
+	if err != nil {
+		return err
+	}
+	for _, zipPath := range zips {
+		clanFile := filepath.Base(filepath.Dir(zipPath))
+		index, indexErr := strconv.Atoi(strings.TrimSuffix(filepath.Base(zipPath), ".zip"))
+		blockID := clanFile + ":::" + strconv.Itoa(index)
+		if _, listed := rows[blockID]; indexErr != nil || listed {
+			continue
+		}
+		row := manifestRow{clanFile, index, zipPath, training, reliability}
+		if item, registered := s.workItem(blockID); registered {
+			row.training, row.reliability = item.Training, item.Reliability
+		}
+		rows[blockID] = row
+	}
+
+	for _, block := range blocks {
+		rows[block.ClanFile+":::"+strconv.Itoa(block.Index)] = manifestRow{block.ClanFile,
+			block.Index, block.Path, training, reliability}
+	}
+
+	sorted := make([]manifestRow, 0, len(rows))
+	for _, row := range rows {
+		sorted = append(sorted, row)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].clanFile != sorted[j].clanFile {
+			return sorted[i].clanFile < sorted[j].clanFile
+		}
+		return sorted[i].index < sorted[j].index
+	})
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(file)
+	writer.Write(manifestHeader)
+	for _, row := range sorted {
+		writer.Write([]string{row.clanFile, strconv.Itoa(row.index), row.path,
+			strconv.FormatBool(row.training), strconv.FormatBool(row.reliability)})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+/*
+builtBlockItems makes the WorkItems for built blocks,
+the same as loading them from a manifest would
+*/
+func builtBlockItems(blocks []BuiltBlock, training, reliability bool) (WorkItemMap, error) {
+	items := make(WorkItemMap)
+	for _, block := range blocks {
+		checksum, err := blockChecksum(block.Path)
+		if err != nil {
+			return nil, err
+		}
+		item := WorkItem{
+			ID:          block.ClanFile + ":::" + strconv.Itoa(block.Index),
+			FileName:    block.ClanFile,
+			Block:       block.Index,
+			BlockPath:   block.Path,
+			Training:    training,
+			Reliability: reliability,
+			BlockSHA256: checksum,
+		}
+		items[item.ID] = item
+	}
+	return items, nil
+}
+
+/*
+buildBlocks builds the blocks the rules select from every CLAN
+file under dataDir into outDir, writes outDir/path_manifest.csv,
+and adds the blocks to the work item map.
+*/
+func (s *Server) buildBlocks(dataDir, outDir string, training, reliability bool, rules BlockRules) (*BuildBlocksReport, error) {
+	report := &BuildBlocksReport{Blocks: make([]BuiltBlock, 0),
+		Skipped: make([]string, 0), Existing: make([]string, 0)}
+	if training && reliability {
+		return report, ErrTrainingAndReliability
+	}
+
+	sources, err := findBlockSources(dataDir)
+	if err != nil {
+		return report, err
+	}
+	for _, source := range sources {
+		if err := s.buildSourceBlocks(source, outDir, training, reliability, rules, report); err != nil {
+			return report, err
+		}
+	}
+	sort.Slice(report.Blocks, func(i, j int) bool {
+		if report.Blocks[i].ClanFile != report.Blocks[j].ClanFile {
+			return report.Blocks[i].ClanFile < report.Blocks[j].ClanFile
+		}
+		return report.Blocks[i].Index < report.Blocks[j].Index
+	})
+
+	report.Manifest = filepath.Join(outDir, "path_manifest.csv")
+	if err := s.writeManifest(report.Manifest, outDir, report.Blocks, training, reliability); err != nil {
+		return report, err
+	}
+
+	items, err := builtBlockItems(report.Blocks, training, reliability)
+	if err != nil {
+		return report, err
+	}
+	added, existing, err := s.addWorkItems(items)
+	report.Registered = len(added)
+	report.Existing = append(report.Existing, existing...)
+	return report, err
+}
+
+/*
+buildBlocksCommand replaces makeblocks.py. It builds the block
+zips and manifest from a directory of CLAN files and their WAV
+audio, and registers them in the WorkDB of a stopped server.
+It leaves work_map_loaded alone, so a server that hasn't
+loaded its manifest yet still does on its next start.
+The blocks are selected with the rules file given with --rules,
+or the config's block_rules_path (see BlockRules):
+
+	$: ./idsserver build-blocks config.json data_dir output_dir [--training|--reliability] [--rules rules.json]
+*/
+func buildBlocksCommand(args []string) error {
+	if len(args) < 3 {
+		return ErrMissingCommandArgs
+	}
+	training, reliability := false, false
+	rulesPath, hasRulesPath := "", false
+	for i := 3; i < len(args); i++ {
+		switch args[i] {
+		case "--training":
+			training = true
+		case "--reliability":
+			reliability = true
+		case "--rules":
+			if i+1 >= len(args) {
+				return ErrMissingCommandArgs
+			}
+			rulesPath, hasRulesPath = args[i+1], true
+			i++
+
+		default:
+			return fmt.Errorf("%w: %s", ErrUnknownCommandFlag, args[i])
+		}
+	}
+	if training && reliability {
+		return ErrTrainingAndReliability
+	}
+
+	server, err := openServer(args[0])
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	if _, err := server.migrateSchema(false); err != nil {
+		return err
+	}
+	server.workItemMap, err = server.work.loadItemMap()
+	if err != nil {
+		return err
+	}
+
+	if !hasRulesPath {
+		rulesPath = server.config.BlockRulesPath
+	}
+	rules, err := readBlockRules(rulesPath)
+	if err != nil {
+		return err
+	}
+
+	report, err := server.buildBlocks(args[1], args[2], training, reliability, rules)
+	if report != nil {
+		for _, skipped := range report.Skipped {
+			fmt.Println("skipped", skipped)
+		}
+		for _, id := range report.Existing {
+			fmt.Println("already registered", id)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("built", len(report.Blocks), "blocks, wrote", report.Manifest,
+		"and registered", report.Registered, "new work items")
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildBlocksCommandFlags(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{
+		Labs:         []string{"lab1"},
+		LabsDBPath:   filepath.Join(dir, "labs.db"),
+		WorkDBPath:   filepath.Join(dir, "work.db"),
+		LabelsDBPath: filepath.Join(dir, "labels.db"),
+	}
+	configPath := filepath.Join(dir, "config.json")
+	if err := config.writeFile(configPath); err != nil {
+		t.Fatal(err)
+	}
+	// no CLAN files to build, just an empty manifest
+	dataDir, outDir := filepath.Join(dir, "data"), filepath.Join(dir, "out")
+	for _, path := range []string{dataDir, outDir} {
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := []string{configPath, dataDir, outDir}
+
+	for _, test := range []struct {
+		flags []string
+		want  error
+	}{
+		{[]string{"--rule", "rules.json"}, ErrUnknownCommandFlag},
+		{[]string{"--training", "--reliability"}, ErrTrainingAndReliability},
+		{[]string{"--rules"}, ErrMissingCommandArgs},
+		{[]string{"--training"}, nil},
+	} {
+		err := buildBlocksCommand(append(args, test.flags...))
+		if !errors.Is(err, test.want) {
+			t.Errorf("%v: got %v, want %v", test.flags, err, test.want)
+		}
+	}
+
+	// the manifest still has to be loaded at startup
+	written, err := readConfigFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written.WorkMapLoaded {
+		t.Error("build-blocks set work_map_loaded")
+	}
+}
@@ -0,0 +1,418 @@
+/*
+Package chat reads CLAN transcripts in the CHAT (.cha) format.
+
+A transcript is read line by line into Lines, which keep the
+exact bytes they were read from (the separator after the tier
+name, continuation lines and line endings), and then grouped
+into Utterances (a main tier and its dependent tiers) and Gems
+(the utterances between an @Bg and its @Eg). Writing a File back
+out gives the same bytes it was parsed from, with any changes
+made to its Lines.
+*/
+package chat
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Kind is the kind of a Line
+type Kind int
+
+const (
+	// Other is a blank line, or anything that isn't a header or tier
+	Other Kind = iota
+
+	// Header is an "@" line, e.g. "@Begin" or "@Bg:	Conversation 1"
+	Header
+
+	// Main is a main tier, e.g. "*CHI:	ba ba ."
+	Main
+
+	// Dependent is a dependent tier, e.g. "%com:	laughing"
+	Dependent
+)
+
+var sigils = map[Kind]string{
+	Header:    "@",
+	Main:      "*",
+	Dependent: "%",
+}
+
+/*
+Line is a single header or tier, along with its continuation
+lines (the lines after it that start with a tab).
+
+	Name     the header or tier name, without the sigil ("Begin", "CHI", "com")
+	Sep      everything between the name and the content, usually ":\t"
+	Content  the rest of the line, including the continuation lines
+	         and the line endings between them
+	EOL      the line ending of the last physical line ("\n", "\r\n",
+	         or "" at the end of a file without a final newline)
+
+Other lines only have Content (and EOL).
+*/
+type Line struct {
+	Kind    Kind
+	Name    string
+	Sep     string
+	Content string
+	EOL     string
+}
+
+// String returns the line exactly as it was read
+func (line *Line) String() string {
+	return sigils[line.Kind] + line.Name + line.Sep + line.Content + line.EOL
+}
+
+/*
+PhysicalLines splits the content into the physical lines it was
+read from, without their line endings or the leading tab of
+the continuation lines.
+*/
+func (line *Line) PhysicalLines() []string {
+	lines := strings.Split(line.Content, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+		if i > 0 {
+			lines[i] = strings.TrimPrefix(lines[i], "\t")
+		}
+	}
+	return lines
+}
+
+// Bullets returns all of the time bullets in the line, in order
+func (line *Line) Bullets() []Bullet {
+	return findBullets(line.Content)
+}
+
+var bulletRegex = regexp.MustCompile("\x15(\\d+)_(\\d+)\x15")
+
+/*
+Bullet is a time bullet, the "\x15start_end\x15" that links
+a tier to its audio. Start and End are in milliseconds.
+*/
+type Bullet struct {
+	Start int
+	End   int
+}
+
+func (bullet Bullet) String() string {
+	return "\x15" + strconv.Itoa(bullet.Start) + "_" + strconv.Itoa(bullet.End) + "\x15"
+}
+
+// Timestamp is the bullet without its delimiters, "start_end"
+func (bullet Bullet) Timestamp() string {
+	return strconv.Itoa(bullet.Start) + "_" + strconv.Itoa(bullet.End)
+}
+
+// Duration is the length of the bullet in milliseconds
+func (bullet Bullet) Duration() int {
+	return bullet.End - bullet.Start
+}
+
+func findBullets(text string) []Bullet {
+	var bullets []Bullet
+	for _, match := range bulletRegex.FindAllStringSubmatch(text, -1) {
+		start, startErr := strconv.Atoi(match[1])
+		end, endErr := strconv.Atoi(match[2])
+		if startErr != nil || endErr != nil {
+			continue
+		}
+		bullets = append(bullets, Bullet{Start: start, End: end})
+	}
+	return bullets
+}
+
+// FirstBullet returns the first bullet in the text, if there is one
+func FirstBullet(text string) (Bullet, bool) {
+	bullets := findBullets(text)
+	if len(bullets) == 0 {
+		return Bullet{}, false
+	}
+	return bullets[0], true
+}
+
+/*
+Utterance is a main tier and the dependent
+tiers that follow it
+*/
+type Utterance struct {
+	Main       *Line
+	Dependents []*Line
+}
+
+// Speaker is the main tier's speaker code, e.g. "CHI" or "FAN"
+func (utt *Utterance) Speaker() string {
+	return utt.Main.Name
+}
+
+/*
+Text is the main tier's words without its time bullets,
+with the continuation lines joined and the whitespace
+collapsed to single spaces
+*/
+func (utt *Utterance) Text() string {
+	text := bulletRegex.ReplaceAllString(utt.Main.Content, " ")
+	return strings.Join(strings.Fields(text), " ")
+}
+
+/*
+Bullet returns the utterance's time bullet, the last
+one on the main tier
+*/
+func (utt *Utterance) Bullet() (Bullet, bool) {
+	bullets := utt.Main.Bullets()
+	if len(bullets) == 0 {
+		return Bullet{}, false
+	}
+	return bullets[len(bullets)-1], true
+}
+
+// Dependent returns the utterance's dependent tier with the name, or nil
+func (utt *Utterance) Dependent(name string) *Line {
+	for _, dependent := range utt.Dependents {
+		if dependent.Name == name {
+			return dependent
+		}
+	}
+	return nil
+}
+
+/*
+Gem is a section of the transcript between an "@Bg:	label"
+and the matching "@Eg:	label". End is nil if the gem was
+never closed. Gems can overlap, an utterance is in every
+gem that's open when it shows up.
+*/
+type Gem struct {
+	Label      string
+	Begin      *Line
+	End        *Line
+	Utterances []*Utterance
+}
+
+var conversationRegex = regexp.MustCompile(`^Conversation\s+(\d+)`)
+
+/*
+Conversation returns the number of a "Conversation N"
+gem, the blocks that get coded
+*/
+func (gem *Gem) Conversation() (int, bool) {
+	match := conversationRegex.FindStringSubmatch(gem.Label)
+	if match == nil {
+		return 0, false
+	}
+	number, err := strconv.Atoi(match[1])
+	return number, err == nil
+}
+
+/*
+File is a parsed transcript. Lines is every line in the file in
+order; Headers, Utterances and Gems point into it.
+*/
+type File struct {
+	// BOM is the byte order mark the file started with, if any
+	BOM        string
+	Lines      []*Line
+	Headers    []*Line
+	Utterances []*Utterance
+	Gems       []*Gem
+}
+
+// Conversations returns the "Conversation N" gems, in order
+func (file *File) Conversations() []*Gem {
+	var conversations []*Gem
+	for _, gem := range file.Gems {
+		if _, isConversation := gem.Conversation(); isConversation {
+			conversations = append(conversations, gem)
+		}
+	}
+	return conversations
+}
+
+/*
+WriteTo writes the transcript back out. An unchanged
+File is written exactly as it was read.
+*/
+func (file *File) WriteTo(w io.Writer) (int64, error) {
+	writer := bufio.NewWriter(w)
+	var written int64
+
+	n, err := writer.WriteString(file.BOM)
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+	for _, line := range file.Lines {
+		n, err := writer.WriteString(line.String())
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, writer.Flush()
+}
+
+// WriteFile writes the transcript to path
+func (file *File) WriteFile(path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteTo(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+const utf8BOM = "\ufeff"
+
+// ParseFile parses the transcript at path
+func ParseFile(path string) (*File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Parse(bufio.NewReader(file))
+}
+
+// Parse parses a transcript
+func Parse(r io.Reader) (*File, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	text := string(data)
+
+	file := &File{}
+	if strings.HasPrefix(text, utf8BOM) {
+		file.BOM = utf8BOM
+		text = text[len(utf8BOM):]
+	}
+
+	for len(text) > 0 {
+		physical, eol := text, ""
+		if newline := strings.IndexByte(text, '\n'); newline >= 0 {
+			physical, eol = text[:newline], "\n"
+			text = text[newline+1:]
+			if strings.HasSuffix(physical, "\r") {
+				physical, eol = physical[:len(physical)-1], "\r\n"
+			}
+		} else {
+			text = ""
+		}
+
+		// continuation lines belong to the line before them
+		if strings.HasPrefix(physical, "\t") && len(file.Lines) > 0 {
+			prev := file.Lines[len(file.Lines)-1]
+			prev.Content += prev.EOL + physical
+			prev.EOL = eol
+			continue
+		}
+
+		line := parseLine(physical)
+		line.EOL = eol
+		file.Lines = append(file.Lines, line)
+	}
+
+	file.group()
+	return file, nil
+}
+
+/*
+parseLine splits a physical line into its name, separator
+and content
+*/
+func parseLine(physical string) *Line {
+	kind := Other
+	if physical != "" {
+		for lineKind, sigil := range sigils {
+			if physical[:1] == sigil {
+				kind = lineKind
+			}
+		}
+	}
+	if kind == Other {
+		return &Line{Kind: Other, Content: physical}
+	}
+
+	rest := physical[1:]
+	colon := strings.IndexByte(rest, ':')
+	if colon < 0 {
+		if kind == Header {
+			// headers like "@Begin" and "@End"
+			return &Line{Kind: Header, Name: rest}
+		}
+		return &Line{Kind: Other, Content: physical}
+	}
+
+	content := rest[colon+1:]
+	trimmed := strings.TrimLeft(content, " \t")
+	return &Line{
+		Kind:    kind,
+		Name:    rest[:colon],
+		Sep:     ":" + content[:len(content)-len(trimmed)],
+		Content: trimmed,
+	}
+}
+
+/*
+group sorts the Lines into Headers,
+Utterances and Gems
+*/
+func (file *File) group() {
+	var (
+		current *Utterance
+		open    []*Gem
+	)
+
+	for _, line := range file.Lines {
+		switch line.Kind {
+		case Header:
+			current = nil
+			switch line.Name {
+			case "Bg":
+				gem := &Gem{Label: strings.TrimSpace(line.Content), Begin: line}
+				file.Gems = append(file.Gems, gem)
+				open = append(open, gem)
+			case "Eg":
+				open = closeGem(open, strings.TrimSpace(line.Content), line)
+			default:
+				file.Headers = append(file.Headers, line)
+			}
+		case Main:
+			current = &Utterance{Main: line}
+			file.Utterances = append(file.Utterances, current)
+			for _, gem := range open {
+				gem.Utterances = append(gem.Utterances, current)
+			}
+		case Dependent:
+			if current != nil {
+				current.Dependents = append(current.Dependents, line)
+			}
+		}
+	}
+}
+
+/*
+closeGem closes the most recently opened gem with the label
+(or just the most recently opened one, for an "@Eg" without a
+label), and returns the gems that are still open
+*/
+func closeGem(open []*Gem, label string, end *Line) []*Gem {
+	for i := len(open) - 1; i >= 0; i-- {
+		if label == "" || open[i].Label == label {
+			open[i].End = end
+			return append(open[:i:i], open[i+1:]...)
+		}
+	}
+	return open
+}
@@ -0,0 +1,227 @@
+package chat
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func parseFixture(t *testing.T, name string) (*File, []byte) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file, data
+}
+
+func writeString(t *testing.T, file *File) string {
+	var out bytes.Buffer
+	n, err := file.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(out.Len()) {
+		t.Fatalf("WriteTo returned %d, wrote %d bytes", n, out.Len())
+	}
+	return out.String()
+}
+
+func TestRoundTripFixtures(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "*.cha"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures")
+	}
+	for _, fixture := range fixtures {
+		file, data := parseFixture(t, filepath.Base(fixture))
+		if out := writeString(t, file); out != string(data) {
+			t.Errorf("%s didn't round trip:\n%q\n%q", fixture, data, out)
+		}
+	}
+}
+
+func TestRoundTripEdgeCases(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"\n",
+		"\r\n\r\n",
+		"@Begin",
+		"@End\n\n\n",
+		"\tstarts with a continuation\n",
+		"*CHI without a colon\n",
+		"*CHI:\n\tcontent on the continuation line\n",
+		"*CHI:   \t  lots of space . \x150_10\x15  \n",
+		"%com:\tdependent before any main tier\r\n",
+		"mixed\nline\r\nendings\r\n\tand a continuation",
+		"@Bg\n@Eg:\tnever opened\n",
+		"\ufeff",
+		"\ufeff*CHI:\tx .\n",
+	} {
+		file, err := Parse(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out := writeString(t, file); out != text {
+			t.Errorf("%q round tripped to %q", text, out)
+		}
+	}
+}
+
+func TestParseLENA(t *testing.T) {
+	file, _ := parseFixture(t, "lena.cha")
+
+	if got := file.Languages(); !reflect.DeepEqual(got, []string{"eng"}) {
+		t.Fatal(got)
+	}
+
+	participants := []Participant{
+		{Code: "CHI", Role: "Target_Child"},
+		{Code: "FAN", Role: "Female_Adult_Near"},
+		{Code: "MAN", Role: "Male_Adult_Near"},
+		{Code: "CXN", Role: "Other_Child_Near"},
+	}
+	if got := file.Participants(); !reflect.DeepEqual(got, participants) {
+		t.Fatal(got)
+	}
+
+	ids := file.IDs()
+	if len(ids) != 2 || ids[0].Code != "CHI" || ids[0].Age != "0;06." ||
+		ids[0].Sex != "female" || ids[0].Role != "Target_Child" || ids[1].Corpus != "Seedlings" {
+		t.Fatalf("%+v", ids)
+	}
+
+	media, hasMedia := file.Media()
+	if !hasMedia || media.File != "01_06_sparse_code" || media.Type != "audio" {
+		t.Fatalf("%+v", media)
+	}
+
+	if len(file.Utterances) != 7 {
+		t.Fatal(len(file.Utterances))
+	}
+	man := file.Utterances[2]
+	if man.Speaker() != "MAN" || man.Text() != "there you go . do you want it ?" {
+		t.Fatalf("%q %q", man.Speaker(), man.Text())
+	}
+	if got := man.Main.PhysicalLines(); len(got) != 2 || got[1] != "do you want it ? \x154100_5020\x15" {
+		t.Fatalf("%q", got)
+	}
+	if bullets := man.Main.Bullets(); !reflect.DeepEqual(bullets, []Bullet{{3410, 4100}, {4100, 5020}}) {
+		t.Fatal(bullets)
+	}
+	if bullet, _ := man.Bullet(); bullet != (Bullet{4100, 5020}) || bullet.Timestamp() != "4100_5020" {
+		t.Fatal(bullet)
+	}
+	if com := man.Dependent("com"); com == nil || com.Content != "baby babbling in the background" {
+		t.Fatal(com)
+	}
+	if xdb := file.Utterances[0].Dependent("xdb"); xdb == nil {
+		t.Fatal("missing the xdb tier")
+	}
+
+	if len(file.Gems) != 3 {
+		t.Fatal(len(file.Gems))
+	}
+	conversations := file.Conversations()
+	if len(conversations) != 2 {
+		t.Fatal(len(conversations))
+	}
+	if number, _ := conversations[0].Conversation(); number != 1 || len(conversations[0].Utterances) != 4 {
+		t.Fatal(number, len(conversations[0].Utterances))
+	}
+	if number, _ := conversations[1].Conversation(); number != 2 || len(conversations[1].Utterances) != 2 {
+		t.Fatal(number, len(conversations[1].Utterances))
+	}
+	if conversations[0].End == nil || conversations[0].End.Content != "Conversation 1" {
+		t.Fatal(conversations[0].End)
+	}
+
+	// gem markers aren't headers
+	if file.Header("Bg") != nil || file.Header("Begin") == nil {
+		t.Fatal(file.Headers)
+	}
+}
+
+func TestParseCRLFAndBOM(t *testing.T) {
+	file, _ := parseFixture(t, "crlf_bom.cha")
+
+	if file.BOM != "\ufeff" || file.Lines[0].Name != "UTF8" {
+		t.Fatalf("%q %q", file.BOM, file.Lines[0].Name)
+	}
+	if got := file.Languages(); !reflect.DeepEqual(got, []string{"eng", "spa"}) {
+		t.Fatal(got)
+	}
+	if got := file.Participants(); !reflect.DeepEqual(got, []Participant{
+		{Code: "CHI", Name: "Ana", Role: "Target_Child"},
+		{Code: "MOT", Role: "Mother"},
+	}) {
+		t.Fatal(got)
+	}
+	if media, _ := file.Media(); !reflect.DeepEqual(media.Options, []string{"unlinked"}) {
+		t.Fatal(media)
+	}
+
+	mot := file.Utterances[0]
+	if mot.Main.Sep != ":  " || mot.Main.EOL != "\r\n" {
+		t.Fatalf("%q %q", mot.Main.Sep, mot.Main.EOL)
+	}
+	if mot.Text() != "hola mi amor . toma ." {
+		t.Fatalf("%q", mot.Text())
+	}
+	if mor := mot.Dependent("mor"); mor == nil || !strings.HasPrefix(mor.Content, "co|hola") {
+		t.Fatal(mor)
+	}
+
+	last := file.Lines[len(file.Lines)-1]
+	if last.Name != "End" || last.EOL != "" {
+		t.Fatalf("%+v", last)
+	}
+}
+
+func TestGems(t *testing.T) {
+	file, _ := parseFixture(t, "gems.cha")
+
+	if len(file.Gems) != 3 {
+		t.Fatal(len(file.Gems))
+	}
+	conversation, reading, unclosed := file.Gems[0], file.Gems[1], file.Gems[2]
+
+	// the gems overlap
+	if len(conversation.Utterances) != 2 || len(reading.Utterances) != 2 {
+		t.Fatal(len(conversation.Utterances), len(reading.Utterances))
+	}
+	if reading.Utterances[0] != conversation.Utterances[1] {
+		t.Fatal("overlapping gems don't share the utterance")
+	}
+
+	// "@Eg" without a label closes the most recent gem
+	if reading.End == nil || reading.End.Name != "Eg" {
+		t.Fatal(reading.End)
+	}
+	if unclosed.End != nil || len(unclosed.Utterances) != 1 {
+		t.Fatal(unclosed.End, len(unclosed.Utterances))
+	}
+	if _, isConversation := reading.Conversation(); isConversation {
+		t.Fatal("reading isn't a conversation")
+	}
+}
+
+func TestEditedLines(t *testing.T) {
+	file, data := parseFixture(t, "lena.cha")
+
+	chi := file.Utterances[1]
+	chi.Main.Content = strings.Replace(chi.Main.Content, "0 .", "ba ba .", 1)
+
+	want := strings.Replace(string(data), "*CHI:\t0 . \x152230_3410\x15", "*CHI:\tba ba . \x152230_3410\x15", 1)
+	if out := writeString(t, file); out != want {
+		t.Fatalf("%q", out)
+	}
+}
@@ -0,0 +1,149 @@
+package chat
+
+import (
+	"strings"
+)
+
+/*
+Participant is one of the speakers in an "@Participants:" header,
+e.g. "CHI Target_Child" or "MOT Mary Mother"
+*/
+type Participant struct {
+	Code string
+	Name string
+	Role string
+}
+
+/*
+ID is an "@ID:" header, the | separated fields
+describing a participant:
+
+	language|corpus|code|age|sex|group|SES|role|education|custom|
+*/
+type ID struct {
+	Language  string
+	Corpus    string
+	Code      string
+	Age       string
+	Sex       string
+	Group     string
+	SES       string
+	Role      string
+	Education string
+	Custom    string
+}
+
+/*
+Media is the "@Media:" header, the audio or video file
+the transcript is linked to and its type ("audio", "video")
+*/
+type Media struct {
+	File    string
+	Type    string
+	Options []string
+}
+
+// Header returns the first header with the name, or nil
+func (file *File) Header(name string) *Line {
+	for _, header := range file.Headers {
+		if header.Name == name {
+			return header
+		}
+	}
+	return nil
+}
+
+// headerText is a header's content with its continuation lines joined
+func headerText(header *Line) string {
+	return strings.Join(header.PhysicalLines(), " ")
+}
+
+// Languages returns the codes in the "@Languages:" header
+func (file *File) Languages() []string {
+	header := file.Header("Languages")
+	if header == nil {
+		return nil
+	}
+	var languages []string
+	for _, language := range strings.Split(headerText(header), ",") {
+		if language = strings.TrimSpace(language); language != "" {
+			languages = append(languages, language)
+		}
+	}
+	return languages
+}
+
+/*
+Participants returns the speakers in the "@Participants:" header.
+Each one is a code, an optional name and a role, separated by
+spaces, and the speakers are separated by commas.
+*/
+func (file *File) Participants() []Participant {
+	header := file.Header("Participants")
+	if header == nil {
+		return nil
+	}
+	var participants []Participant
+	for _, entry := range strings.Split(headerText(header), ",") {
+		fields := strings.Fields(entry)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			participants = append(participants, Participant{Code: fields[0]})
+		case 2:
+			participants = append(participants, Participant{Code: fields[0], Role: fields[1]})
+		default:
+			participants = append(participants, Participant{Code: fields[0],
+				Name: strings.Join(fields[1:len(fields)-1], " "), Role: fields[len(fields)-1]})
+		}
+	}
+	return participants
+}
+
+// IDs returns all of the "@ID:" headers
+func (file *File) IDs() []ID {
+	var ids []ID
+	for _, header := range file.Headers {
+		if header.Name != "ID" {
+			continue
+		}
+		fields := strings.Split(headerText(header), "|")
+		for len(fields) < 10 {
+			fields = append(fields, "")
+		}
+		ids = append(ids, ID{
+			Language:  fields[0],
+			Corpus:    fields[1],
+			Code:      fields[2],
+			Age:       fields[3],
+			Sex:       fields[4],
+			Group:     fields[5],
+			SES:       fields[6],
+			Role:      fields[7],
+			Education: fields[8],
+			Custom:    fields[9],
+		})
+	}
+	return ids
+}
+
+// Media returns the "@Media:" header, if there is one
+func (file *File) Media() (Media, bool) {
+	header := file.Header("Media")
+	if header == nil {
+		return Media{}, false
+	}
+	var fields []string
+	for _, field := range strings.Split(headerText(header), ",") {
+		fields = append(fields, strings.TrimSpace(field))
+	}
+	media := Media{File: fields[0]}
+	if len(fields) > 1 {
+		media.Type = fields[1]
+	}
+	if len(fields) > 2 {
+		media.Options = fields[2:]
+	}
+	return media, true
+}
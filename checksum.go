@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+/*
+blockChecksumHeader is the response header get-block and
+get-specific-block send the block's SHA-256 in. Clients
+send it back in the "block_sha256" of the submitted Block.
+*/
+const blockChecksumHeader = "X-Block-SHA256"
+
+// ErrBlockChecksumMismatch means labels were submitted for a
+// block whose zip has changed since it was sent to the coder
+var ErrBlockChecksumMismatch = errors.New("Block checksum doesn't match the block on the server")
+
+// ErrBlocksDrifted means verify-blocks found blocks that are
+// missing or don't match their checksums
+var ErrBlocksDrifted = errors.New("Blocks are missing or don't match their checksums")
+
+const (
+	// the block_path can't be read
+	driftMissingFile = "missing_file"
+
+	// the WorkItem has no checksum recorded
+	driftNoChecksum = "no_checksum"
+
+	// the zip on disk doesn't match the recorded checksum
+	driftChanged = "changed"
+
+	// labels were submitted against a different
+	// checksum than the WorkItem has now
+	driftLabels = "labels_drift"
+)
+
+// blockChecksum returns the hex encoded SHA-256 of the file at path
+func blockChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/*
+ChecksumDrift is a block whose zip doesn't match what was recorded.
+For labels_drift, Instance is the labeled instance and Recorded is
+the checksum it was coded against.
+*/
+type ChecksumDrift struct {
+	Kind      string `json:"kind"`
+	BlockID   string `json:"block_id"`
+	BlockPath string `json:"block_path"`
+	Instance  int    `json:"block_instance,omitempty"`
+	Recorded  string `json:"recorded"`
+	Actual    string `json:"actual"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+/*
+VerifyReport is the result of re-hashing every block.
+Recorded is the number of missing checksums that were
+filled in.
+*/
+type VerifyReport struct {
+	WorkItems int             `json:"work_items"`
+	Verified  int             `json:"verified"`
+	Recorded  int             `json:"recorded"`
+	Drift     []ChecksumDrift `json:"drift"`
+}
+
+/*
+verifyBlocks re-hashes the zip of every WorkItem and compares it to
+the checksum recorded when the manifest was loaded, and checks the
+labeled instances were coded against the same checksum. If
+recordMissing is set, WorkItems without a checksum (loaded before
+they were recorded) get the current one.
+*/
+func (s *Server) verifyBlocks(recordMissing bool) (*VerifyReport, error) {
+	items := s.workItems()
+	report := &VerifyReport{WorkItems: len(items), Drift: make([]ChecksumDrift, 0)}
+
+	var ids []string
+	for id := range items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	recorded := make(WorkItemMap)
+	for _, id := range ids {
+		item := items[id]
+		drift := ChecksumDrift{BlockID: id, BlockPath: item.BlockPath, Recorded: item.BlockSHA256}
+
+		actual, err := blockChecksum(item.BlockPath)
+		if err != nil {
+			drift.Kind = driftMissingFile
+			drift.Detail = err.Error()
+			report.Drift = append(report.Drift, drift)
+			continue
+		}
+		drift.Actual = actual
+
+		switch {
+		case item.BlockSHA256 == "" && recordMissing:
+			item.BlockSHA256 = actual
+			recorded[id] = item
+			report.Verified++
+		case item.BlockSHA256 == "":
+			drift.Kind = driftNoChecksum
+			report.Drift = append(report.Drift, drift)
+		case item.BlockSHA256 != actual:
+			drift.Kind = driftChanged
+			report.Drift = append(report.Drift, drift)
+		default:
+			report.Verified++
+		}
+	}
+
+	groups, err := s.labels.getAllBlockGroups()
+	if err != nil {
+		return report, err
+	}
+	for _, group := range groups {
+		item, exists := items[group.ID]
+		if !exists || item.BlockSHA256 == "" {
+			continue
+		}
+		for _, block := range group.Blocks {
+			// labels from before checksums were recorded
+			// don't say what they were coded against
+			if block.BlockSHA256 == "" || block.BlockSHA256 == item.BlockSHA256 {
+				continue
+			}
+			report.Drift = append(report.Drift, ChecksumDrift{Kind: driftLabels,
+				BlockID: group.ID, BlockPath: item.BlockPath, Instance: block.Instance,
+				Recorded: block.BlockSHA256, Actual: item.BlockSHA256,
+				Detail: fmt.Sprintf("coded by %s:::%s", block.LabKey, block.Coder)})
+		}
+	}
+
+	if len(recorded) == 0 {
+		return report, nil
+	}
+	for _, item := range recorded {
+		if err := s.work.persistWorkItem(item); err != nil {
+			return report, err
+		}
+		report.Recorded++
+	}
+	return report, s.setWorkItems(recorded)
+}
+
+/*
+verifyBlocksCommand re-hashes every block zip of a stopped
+server and prints the ones that don't match their checksums:
+
+	$: ./idsserver verify-blocks config.json [--record-missing]
+
+It fails with ErrBlocksDrifted, so exits non-zero, if any block
+is missing or has changed, or was labeled against another zip.
+Blocks with no checksum only fail it without --record-missing.
+*/
+func verifyBlocksCommand(args []string) error {
+	if len(args) < 1 {
+		return ErrMissingCommandArgs
+	}
+	recordMissing := len(args) > 1 && args[1] == "--record-missing"
+
+	server, err := openServer(args[0])
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	if _, err := server.migrateSchema(false); err != nil {
+		return err
+	}
+	server.workItemMap, err = server.work.loadItemMap()
+	if err != nil {
+		return err
+	}
+
+	report, err := server.verifyBlocks(recordMissing)
+	if err != nil {
+		return err
+	}
+	for _, drift := range report.Drift {
+		fmt.Printf("%s %s (%s): recorded %q, actual %q %s\n", drift.Kind, drift.BlockID,
+			drift.BlockPath, drift.Recorded, drift.Actual, drift.Detail)
+	}
+	fmt.Printf("verified %d of %d work items, %d drifted", report.Verified, report.WorkItems, len(report.Drift))
+	if recordMissing {
+		fmt.Printf(", recorded %d missing checksums", report.Recorded)
+	}
+	fmt.Println()
+
+	if len(report.Drift) > 0 {
+		return fmt.Errorf("%w: %d drifted", ErrBlocksDrifted, len(report.Drift))
+	}
+	return nil
+}
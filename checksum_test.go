@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyBlocksCommand(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		setup func(t *testing.T, blockPath string, item *WorkItem)
+		args  []string
+		want  error
+	}{
+		{"matching", nil, nil, nil},
+		{"changed", func(t *testing.T, blockPath string, item *WorkItem) {
+			if err := os.WriteFile(blockPath, []byte("another zip"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, nil, ErrBlocksDrifted},
+		{"missing", func(t *testing.T, blockPath string, item *WorkItem) {
+			if err := os.Remove(blockPath); err != nil {
+				t.Fatal(err)
+			}
+		}, nil, ErrBlocksDrifted},
+		{"no checksum", func(t *testing.T, blockPath string, item *WorkItem) {
+			item.BlockSHA256 = ""
+		}, nil, ErrBlocksDrifted},
+		{"no checksum, recorded", func(t *testing.T, blockPath string, item *WorkItem) {
+			item.BlockSHA256 = ""
+		}, []string{"--record-missing"}, nil},
+	} {
+		dir := t.TempDir()
+		config := Config{
+			WorkMapLoaded: true,
+			Labs:          []string{"lab1"},
+			LabsDBPath:    filepath.Join(dir, "labs.db"),
+			WorkDBPath:    filepath.Join(dir, "work.db"),
+			LabelsDBPath:  filepath.Join(dir, "labels.db"),
+		}
+		configPath := filepath.Join(dir, "config.json")
+		if err := config.writeFile(configPath); err != nil {
+			t.Fatal(err)
+		}
+
+		blockPath := filepath.Join(dir, "1.zip")
+		if err := os.WriteFile(blockPath, []byte("block zip"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		checksum, err := blockChecksum(blockPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		item := WorkItem{ID: "a.cha:::1", FileName: "a.cha", Block: 1,
+			BlockPath: blockPath, BlockSHA256: checksum}
+		if test.setup != nil {
+			test.setup(t, blockPath, &item)
+		}
+
+		server, err := openServer(configPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.work.persistWorkItemMap(WorkItemMap{item.ID: item}); err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+
+		err = verifyBlocksCommand(append([]string{configPath}, test.args...))
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
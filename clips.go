@@ -0,0 +1,318 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SeedlingsBabylab/idsserver/chat"
+)
+
+// ErrClipDoesntExist means the block zip has no audio for the clip index
+var ErrClipDoesntExist = errors.New("Clip doesn't exist in the block")
+
+/*
+clipContentTypes are the Content-Types of the clip audio. The
+system mime tables disagree on these (audio/x-wav, audio/wave...),
+so they're fixed here rather than left to mime.TypeByExtension.
+*/
+var clipContentTypes = map[string]string{
+	".wav": "audio/wav",
+	".mp3": "audio/mpeg",
+}
+
+func clipContentType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if contentType, exists := clipContentTypes[ext]; exists {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+/*
+findClipEntry finds the audio for a clip in a block zip, the
+entry named "<index>.<ext>" (in any directory, makeblocks.py
+and build-blocks both put them at the top)
+*/
+func findClipEntry(archive *zip.Reader, index int) (*zip.File, error) {
+	name := strconv.Itoa(index)
+	for _, entry := range archive.File {
+		base := path.Base(entry.Name)
+		ext := path.Ext(base)
+		if strings.TrimSuffix(base, ext) == name && strings.ToLower(ext) != ".csv" {
+			return entry, nil
+		}
+	}
+	return nil, ErrClipDoesntExist
+}
+
+/*
+clipReader returns a seekable reader of a zip entry, so it can
+be served with ranges. Stored entries are read in place from the
+zip file, compressed ones are inflated into memory (clips are a
+few seconds of audio).
+*/
+func clipReader(file *os.File, entry *zip.File) (io.ReadSeeker, error) {
+	if entry.Method == zip.Store {
+		offset, err := entry.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		return io.NewSectionReader(file, offset, int64(entry.CompressedSize64)), nil
+	}
+	reader, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+/*
+clipETag identifies a clip's audio. It's the block's checksum
+when it was recorded, otherwise the CRC-32 and size of the entry
+(which changes when the zip is rebuilt with different audio).
+*/
+func clipETag(workItem WorkItem, entry *zip.File) string {
+	if workItem.BlockSHA256 != "" {
+		return fmt.Sprintf("\"%s-%s\"", workItem.BlockSHA256, path.Base(entry.Name))
+	}
+	return fmt.Sprintf("\"%08x-%d\"", entry.CRC32, entry.UncompressedSize64)
+}
+
+/*
+getClipHandler streams a single clip out of a block zip, so the
+block doesn't have to be downloaded before it can be heard. The
+parameters are in the query string, for an <audio> element:
+
+	/v1/get-clip/?lab_key=...&block_id=<clanfile>:::<block>&clip_index=3
+
+Range, If-Range and If-None-Match requests are handled by
+http.ServeContent.
+*/
+func (s *Server) getClipHandler(w http.ResponseWriter, r *http.Request) {
+	parseFormErr := r.ParseForm()
+	if parseFormErr != nil {
+		writeError(w, r, parseFormErr, 400)
+		return
+	}
+
+	annotateRequest(r, r.Form.Get("lab_key"), "", r.Form.Get("block_id"))
+
+	// make sure the lab is one of the approved labs
+	if !s.config.labIsRegistered(r.Form.Get("lab_key")) {
+		writeError(w, r, ErrLabNotRegistered, 401)
+		requestLogger(r).Warn("unauthorized lab key")
+		return
+	}
+
+	clipIndex, parseErr := strconv.Atoi(r.Form.Get("clip_index"))
+	if parseErr != nil {
+		writeError(w, r, fmt.Errorf("Invalid clip_index: %w", parseErr), 400)
+		return
+	}
+
+	workItem, exists := s.workItem(r.Form.Get("block_id"))
+	if !exists {
+		writeError(w, r, ErrWorkItemDoesntExist, 404)
+		return
+	}
+
+	file, openErr := os.Open(workItem.BlockPath)
+	if openErr != nil {
+		writeError(w, r, openErr, 500)
+		return
+	}
+	defer file.Close()
+
+	info, statErr := file.Stat()
+	if statErr != nil {
+		writeError(w, r, statErr, 500)
+		return
+	}
+	archive, zipErr := zip.NewReader(file, info.Size())
+	if zipErr != nil {
+		writeError(w, r, zipErr, 500)
+		return
+	}
+
+	entry, findErr := findClipEntry(archive, clipIndex)
+	if findErr != nil {
+		writeError(w, r, findErr, 404)
+		return
+	}
+	content, readErr := clipReader(file, entry)
+	if readErr != nil {
+		writeError(w, r, readErr, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", clipContentType(entry.Name))
+	w.Header().Set("ETag", clipETag(workItem, entry))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if workItem.BlockSHA256 != "" {
+		w.Header().Set(blockChecksumHeader, workItem.BlockSHA256)
+	}
+
+	http.ServeContent(w, r, path.Base(entry.Name), entry.Modified, content)
+}
+
+/*
+clipTimes turns a "start_end" timestamp in ms into the
+start_time and offset_time makeblocks.py wrote, the start
+as 00:00:00.000 and the length as a python timedelta
+*/
+func clipTimes(timestamp string) (string, string) {
+	bullet, hasBullet := chat.FirstBullet("\x15" + timestamp + "\x15")
+	if !hasBullet {
+		return "", ""
+	}
+	start := time.Duration(bullet.Start) * time.Millisecond
+	startTime := fmt.Sprintf("%02d:%02d:%02d.%03d", int(start.Hours()), int(start.Minutes())%60,
+		int(start.Seconds())%60, bullet.Start%1000)
+
+	length := bullet.End - bullet.Start
+	offsetTime := fmt.Sprintf("%d:%02d:%02d", length/3600000, length/60000%60, length/1000%60)
+	if length%1000 != 0 {
+		offsetTime += fmt.Sprintf(".%06d", length%1000*1000)
+	}
+	return startTime, offsetTime
+}
+
+/*
+readBlockClips reads the clips of a block from the
+<clan file>_labels.csv in its zip, unlabeled
+*/
+func readBlockClips(blockPath string) ([]Clip, error) {
+	archive, err := zip.OpenReader(blockPath)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	var labelsFile *zip.File
+	for _, entry := range archive.File {
+		if strings.HasSuffix(entry.Name, "_labels.csv") {
+			labelsFile = entry
+			break
+		}
+	}
+	if labelsFile == nil {
+		return nil, ErrClipDoesntExist
+	}
+	reader, err := labelsFile.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	rows, err := csv.NewReader(reader).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, ErrClipDoesntExist
+	}
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[name] = i
+	}
+	field := func(row []string, name string) string {
+		if i, exists := columns[name]; exists && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	clips := make([]Clip, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		index, err := strconv.Atoi(field(row, "clip"))
+		if err != nil {
+			return nil, err
+		}
+		clip := Clip{Index: index, Tier: field(row, "tier"), TimeStamp: field(row, "timestamp")}
+		if parent := field(row, "multi-tier-parent"); parent != "N" && parent != "" {
+			clip.Multiline = true
+			clip.MultiTierParent = parent
+		}
+		clip.StartTime, clip.OffsetTime = clipTimes(clip.TimeStamp)
+		clips = append(clips, clip)
+	}
+	return clips, nil
+}
+
+/*
+BlockClips are the clips of a work item's block,
+for a client that streams them instead of unzipping
+the block
+*/
+type BlockClips struct {
+	ID          string `json:"id"`
+	ClanFile    string `json:"clan_file"`
+	Index       int    `json:"block_index"`
+	Training    bool   `json:"training"`
+	Reliability bool   `json:"reliability"`
+	BlockSHA256 string `json:"block_sha256"`
+	Clips       []Clip `json:"clips"`
+}
+
+/*
+getBlockClipsHandler lists the clips of a block, with the
+same query string as /v1/get-clip/ (without the clip_index)
+*/
+func (s *Server) getBlockClipsHandler(w http.ResponseWriter, r *http.Request) {
+	parseFormErr := r.ParseForm()
+	if parseFormErr != nil {
+		writeError(w, r, parseFormErr, 400)
+		return
+	}
+
+	annotateRequest(r, r.Form.Get("lab_key"), "", r.Form.Get("block_id"))
+
+	// make sure the lab is one of the approved labs
+	if !s.config.labIsRegistered(r.Form.Get("lab_key")) {
+		writeError(w, r, ErrLabNotRegistered, 401)
+		requestLogger(r).Warn("unauthorized lab key")
+		return
+	}
+
+	workItem, exists := s.workItem(r.Form.Get("block_id"))
+	if !exists {
+		writeError(w, r, ErrWorkItemDoesntExist, 404)
+		return
+	}
+
+	clips, readErr := readBlockClips(workItem.BlockPath)
+	if readErr != nil {
+		writeError(w, r, readErr, 500)
+		return
+	}
+	json.NewEncoder(w).Encode(BlockClips{
+		ID:          workItem.ID,
+		ClanFile:    workItem.FileName,
+		Index:       workItem.Block,
+		Training:    workItem.Training,
+		Reliability: workItem.Reliability,
+		BlockSHA256: workItem.BlockSHA256,
+		Clips:       clips,
+	})
+}
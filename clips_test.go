@@ -0,0 +1,131 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+newClipsTestServer is a handler test server whose block zip has
+a stored 1.wav, a compressed 2.mp3 and the labels csv listing them
+*/
+func newClipsTestServer(t *testing.T) *Server {
+	dir := t.TempDir()
+	server := newHandlerTestServer(t, dir)
+
+	blockPath := filepath.Join(dir, "clips.zip")
+	file, err := os.Create(blockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := zip.NewWriter(file)
+	for _, entry := range []struct {
+		name   string
+		method uint16
+		data   string
+	}{
+		{"1.wav", zip.Store, "first clip"},
+		{"2.mp3", zip.Deflate, "second clip"},
+		{"a_labels.csv", zip.Deflate, "date,coder,clan_file,audiofile,block,timestamp,clip,tier,label,multi-tier-parent\n" +
+			",,a.cha,1.wav,1,1500_2750,1,FAN,,N\n,,a.cha,2.mp3,1,2750_3000,2,FAN,,1500_2750\n"},
+	} {
+		writer, err := archive.CreateHeader(&zip.FileHeader{Name: entry.name, Method: entry.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte(entry.data))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	server.updateWorkItem("a.cha:::1", func(item *WorkItem) { item.BlockPath = blockPath })
+	return server
+}
+
+// serveTestGet GETs url from the server, with the request headers
+func serveTestGet(server *Server, url string, headers map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, url, nil)
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	server.routes().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestGetClipHandler(t *testing.T) {
+	server := newClipsTestServer(t)
+	const clip = "/v1/get-clip/?lab_key=lab1&block_id=a.cha:::1&clip_index="
+
+	for _, test := range []struct {
+		url     string
+		headers map[string]string
+		status  int
+		body    string
+		etag    string
+	}{
+		{clip + "1", nil, http.StatusOK, "first clip", `"abc-1.wav"`},
+		{clip + "2", nil, http.StatusOK, "second clip", `"abc-2.mp3"`},
+		{clip + "1", map[string]string{"Range": "bytes=0-4"}, http.StatusPartialContent, "first", `"abc-1.wav"`},
+		{clip + "2", map[string]string{"Range": "bytes=7-"}, http.StatusPartialContent, "clip", `"abc-2.mp3"`},
+		{clip + "1", map[string]string{"If-None-Match": `"abc-1.wav"`}, http.StatusNotModified, "", `"abc-1.wav"`},
+		{clip + "1", map[string]string{"If-None-Match": `"def-1.wav"`}, http.StatusOK, "first clip", `"abc-1.wav"`},
+		// a stale If-Range gets the whole clip, not the range
+		{clip + "1", map[string]string{"Range": "bytes=0-4", "If-Range": `"def-1.wav"`}, http.StatusOK, "first clip", `"abc-1.wav"`},
+	} {
+		recorder := serveTestGet(server, test.url, test.headers)
+		if recorder.Code != test.status || recorder.Body.String() != test.body ||
+			recorder.Header().Get("ETag") != test.etag {
+			t.Errorf("%s %v: got %d %v %q", test.url, test.headers, recorder.Code, recorder.Header(), recorder.Body)
+		}
+	}
+	for url, contentType := range map[string]string{clip + "1": "audio/wav", clip + "2": "audio/mpeg"} {
+		if got := serveTestGet(server, url, nil).Header().Get("Content-Type"); got != contentType {
+			t.Errorf("%s: got Content-Type %s, want %s", url, got, contentType)
+		}
+	}
+
+	for _, test := range []struct {
+		url    string
+		status int
+		code   string
+	}{
+		{clip + "3", http.StatusNotFound, "clip_not_found"},
+		{clip + "one", http.StatusBadRequest, "bad_request"},
+		{"/v1/get-clip/?lab_key=lab1&block_id=x.cha:::1&clip_index=1", http.StatusNotFound, "work_item_not_found"},
+		{"/v1/get-clip/?lab_key=lab3&block_id=a.cha:::1&clip_index=1", http.StatusUnauthorized, "lab_not_registered"},
+	} {
+		checkErrorCode(t, serveTestGet(server, test.url, nil), test.status, test.code)
+	}
+}
+
+func TestGetBlockClipsHandler(t *testing.T) {
+	server := newClipsTestServer(t)
+
+	recorder := serveTestGet(server, "/v1/get-block-clips/?lab_key=lab1&block_id=a.cha:::1", nil)
+	var clips BlockClips
+	json.Unmarshal(recorder.Body.Bytes(), &clips)
+	want := []Clip{
+		{Index: 1, Tier: "FAN", TimeStamp: "1500_2750", StartTime: "00:00:01.500", OffsetTime: "0:00:01.250000"},
+		{Index: 2, Tier: "FAN", TimeStamp: "2750_3000", StartTime: "00:00:02.750", OffsetTime: "0:00:00.250000",
+			Multiline: true, MultiTierParent: "1500_2750"},
+	}
+	if recorder.Code != http.StatusOK || clips.ID != "a.cha:::1" || clips.BlockSHA256 != "abc" || len(clips.Clips) != len(want) {
+		t.Fatalf("got %d %s", recorder.Code, recorder.Body)
+	}
+	for i, clip := range want {
+		if clips.Clips[i] != clip {
+			t.Errorf("clip %d: got %+v, want %+v", i, clips.Clips[i], clip)
+		}
+	}
+
+	recorder = serveTestGet(server, "/v1/get-block-clips/?lab_key=lab1&block_id=x.cha:::1", nil)
+	checkErrorCode(t, recorder, http.StatusNotFound, "work_item_not_found")
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// ErrMissingCommandArgs means a subcommand was run without
+// all of its required arguments
+var ErrMissingCommandArgs = errors.New("Missing arguments for command")
+
+// ErrUnknownCommandFlag means a subcommand was given
+// a flag it doesn't take
+var ErrUnknownCommandFlag = errors.New("Unknown flag for command")
+
+/*
+Command is an idsserver subcommand that's run from the
+command line instead of starting the server:
+
+	$: ./idsserver [command] [args...]
+*/
+type Command struct {
+	Usage string
+	Run   func(args []string) error
+}
+
+/*
+commands is the map of subcommand names to Commands.
+It's filled in init() so that commands can refer to it
+(e.g. for printing usage).
+*/
+var commands map[string]Command
+
+func init() {
+	commands = map[string]Command{
+		"rebuild-indexes": {
+			Usage: "rebuild-indexes [config_file.json]",
+			Run:   rebuildIndexesCommand,
+		},
+		"snapshot": {
+			Usage: "snapshot [config_file.json] [output.tar]",
+			Run:   snapshotCommand,
+		},
+		"build-blocks": {
+			Usage: "build-blocks [config_file.json] [data_dir] [output_dir] [--training|--reliability] [--rules rules.json]",
+			Run:   buildBlocksCommand,
+		},
+		"dump": {
+			Usage: "dump [config_file.json] [output.json]",
+			Run:   dumpCommand,
+		},
+		"fsck": {
+			Usage: "fsck [config_file.json] [--repair]",
+			Run:   fsckCommand,
+		},
+		"import": {
+			Usage: "import [config_file.json] [export.ndjson|export.json]",
+			Run:   importCommand,
+		},
+		"migrate-schema": {
+			Usage: "migrate-schema [config_file.json] [--dry-run]",
+			Run:   migrateSchemaCommand,
+		},
+		"migrate-to-sqlite": {
+			Usage: "migrate-to-sqlite [config_file.json] [output.sqlite]",
+			Run:   migrateToSQLiteCommand,
+		},
+		"restore": {
+			Usage: "restore [config_file.json] [dump.json]",
+			Run:   restoreCommand,
+		},
+		"restore-snapshot": {
+			Usage: "restore-snapshot [config_file.json] [snapshot.tar]",
+			Run:   restoreSnapshotCommand,
+		},
+		"validate-manifest": {
+			Usage: "validate-manifest [path/to/path_manifest.csv]",
+			Run:   validateManifestCommand,
+		},
+		"verify-blocks": {
+			Usage: "verify-blocks [config_file.json] [--record-missing]",
+			Run:   verifyBlocksCommand,
+		},
+	}
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	fmt.Fprintln(os.Stderr, "  idsserver [config_file.json] [path/to/path_manifest.csv]")
+
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  idsserver "+commands[name].Usage)
+	}
+}
+
+func rebuildIndexesCommand(args []string) error {
+	if len(args) < 1 {
+		return ErrMissingCommandArgs
+	}
+
+	server, err := openServer(args[0])
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	numGroups, err := server.labels.rebuildIndexes()
+	if err != nil {
+		return err
+	}
+	fmt.Println("rebuilt label indexes for", numGroups, "block groups")
+	return nil
+}
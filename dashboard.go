@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+/*
+DashboardReq asks for the numbers behind the admin dashboard
+*/
+type DashboardReq struct {
+	AdminLabKey string `json:"admin_lab_key"`
+}
+
+/*
+PassCount is how many regular blocks have been coded Passes times
+*/
+type PassCount struct {
+	Passes int `json:"passes"`
+	Blocks int `json:"blocks"`
+}
+
+/*
+CoderProgress is what a single coder (or, with no Username,
+a whole lab) has coded, by kind of block, and how many
+blocks they have checked out
+*/
+type CoderProgress struct {
+	LabKey      string `json:"lab_key"`
+	LabName     string `json:"lab_name"`
+	Username    string `json:"username,omitempty"`
+	Users       int    `json:"users,omitempty"`
+	Regular     int    `json:"regular"`
+	Training    int    `json:"training"`
+	Reliability int    `json:"reliability"`
+	Active      int    `json:"active"`
+}
+
+/*
+ActiveCheckout is a block a user has checked out. CheckedOut
+is nil for checkouts from before the time was recorded.
+*/
+type ActiveCheckout struct {
+	BlockID     string     `json:"block_id"`
+	LabKey      string     `json:"lab_key"`
+	LabName     string     `json:"lab_name"`
+	Username    string     `json:"username"`
+	Training    bool       `json:"training"`
+	Reliability bool       `json:"reliability"`
+	CheckedOut  *time.Time `json:"checked_out"`
+	AgeSeconds  int64      `json:"age_seconds"`
+}
+
+/*
+SpecialBlockStatus is a training or reliability
+block and who has coded it
+*/
+type SpecialBlockStatus struct {
+	BlockID     string   `json:"block_id"`
+	Training    bool     `json:"training"`
+	Reliability bool     `json:"reliability"`
+	PackNum     int      `json:"train_pack_num"`
+	Instances   int      `json:"instances"`
+	Coders      []string `json:"coders"`
+}
+
+/*
+DashboardReport is everything the admin dashboard shows
+*/
+type DashboardReport struct {
+	Generated         time.Time            `json:"generated"`
+	RegularBlocks     int                  `json:"regular_blocks"`
+	TrainingBlocks    int                  `json:"training_blocks"`
+	ReliabilityBlocks int                  `json:"reliability_blocks"`
+	Passes            []PassCount          `json:"passes"`
+	Labs              []CoderProgress      `json:"labs"`
+	Coders            []CoderProgress      `json:"coders"`
+	Active            []ActiveCheckout     `json:"active"`
+	Special           []SpecialBlockStatus `json:"special"`
+}
+
+/*
+dashboard aggregates the work item map, labs and labels
+into a DashboardReport
+*/
+func (s *Server) dashboard() (*DashboardReport, error) {
+	labs, err := s.labs.getAllLabs()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.labels.getAllBlockGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	items := s.workItems()
+	now := time.Now().UTC()
+	report := &DashboardReport{Generated: now,
+		Passes:  passCounts(items),
+		Labs:    make([]CoderProgress, 0),
+		Coders:  make([]CoderProgress, 0),
+		Active:  make([]ActiveCheckout, 0),
+		Special: make([]SpecialBlockStatus, 0)}
+
+	for _, item := range items {
+		switch {
+		case item.Training:
+			report.TrainingBlocks++
+		case item.Reliability:
+			report.ReliabilityBlocks++
+		default:
+			report.RegularBlocks++
+		}
+	}
+
+	labNames := make(map[string]string)
+	coders := make(map[string]*CoderProgress)
+	coder := func(labKey, username string) *CoderProgress {
+		key := labKey + ":::" + username
+		if progress, exists := coders[key]; exists {
+			return progress
+		}
+		progress := &CoderProgress{LabKey: labKey, LabName: labNames[labKey], Username: username}
+		coders[key] = progress
+		return progress
+	}
+
+	for _, lab := range labs {
+		labNames[lab.Key] = lab.LabName
+		for username, user := range lab.Users {
+			progress := coder(lab.Key, username)
+			progress.Active = len(user.ActiveWorkItems)
+
+			for _, blockID := range user.ActiveWorkItems {
+				item := items[blockID]
+				checkout := ActiveCheckout{BlockID: blockID, LabKey: lab.Key, LabName: lab.LabName,
+					Username: username, Training: item.Training, Reliability: item.Reliability}
+				if checkedOut, exists := user.checkedOutAt(blockID); exists {
+					checkout.CheckedOut = &checkedOut
+					checkout.AgeSeconds = int64(now.Sub(checkedOut) / time.Second)
+				}
+				report.Active = append(report.Active, checkout)
+			}
+		}
+	}
+
+	labeled := make(map[string]bool)
+	for _, group := range groups {
+		labeled[group.ID] = true
+		item := items[group.ID]
+		special := item.Training || item.Reliability
+		status := SpecialBlockStatus{BlockID: group.ID, Training: item.Training,
+			Reliability: item.Reliability, PackNum: item.TrainingPackNum,
+			Instances: len(group.Blocks), Coders: make([]string, 0)}
+
+		for _, block := range group.Blocks {
+			progress := coder(block.LabKey, block.Coder)
+			switch {
+			case block.Training:
+				progress.Training++
+			case block.Reliability:
+				progress.Reliability++
+			default:
+				progress.Regular++
+			}
+			if special {
+				status.Coders = append(status.Coders, block.LabName+"/"+block.Coder)
+			}
+		}
+		if special {
+			report.Special = append(report.Special, status)
+		}
+	}
+
+	// training and reliability blocks nobody has coded yet
+	for _, item := range items {
+		if (!item.Training && !item.Reliability) || labeled[item.ID] {
+			continue
+		}
+		report.Special = append(report.Special, SpecialBlockStatus{BlockID: item.ID,
+			Training: item.Training, Reliability: item.Reliability,
+			PackNum: item.TrainingPackNum, Coders: make([]string, 0)})
+	}
+
+	labTotals := make(map[string]*CoderProgress)
+	for _, progress := range coders {
+		report.Coders = append(report.Coders, *progress)
+
+		total, exists := labTotals[progress.LabKey]
+		if !exists {
+			total = &CoderProgress{LabKey: progress.LabKey, LabName: labNames[progress.LabKey]}
+			labTotals[progress.LabKey] = total
+		}
+		total.Users++
+		total.Regular += progress.Regular
+		total.Training += progress.Training
+		total.Reliability += progress.Reliability
+		total.Active += progress.Active
+	}
+	for _, total := range labTotals {
+		report.Labs = append(report.Labs, *total)
+	}
+
+	sort.Slice(report.Labs, func(i, j int) bool {
+		return report.Labs[i].LabKey < report.Labs[j].LabKey
+	})
+	sort.Slice(report.Coders, func(i, j int) bool {
+		if report.Coders[i].LabKey != report.Coders[j].LabKey {
+			return report.Coders[i].LabKey < report.Coders[j].LabKey
+		}
+		return report.Coders[i].Username < report.Coders[j].Username
+	})
+	// oldest checkouts first
+	sort.Slice(report.Active, func(i, j int) bool {
+		if report.Active[i].AgeSeconds != report.Active[j].AgeSeconds {
+			return report.Active[i].AgeSeconds > report.Active[j].AgeSeconds
+		}
+		return report.Active[i].BlockID < report.Active[j].BlockID
+	})
+	sort.Slice(report.Special, func(i, j int) bool {
+		return report.Special[i].BlockID < report.Special[j].BlockID
+	})
+	return report, nil
+}
+
+func (s *Server) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	var dashboardReq DashboardReq
+	if !s.decodeRequest(w, r, &dashboardReq) {
+		return
+	}
+	annotateRequest(r, dashboardReq.AdminLabKey, "", "")
+
+	if !s.config.labIsAdmin(dashboardReq.AdminLabKey) {
+		writeError(w, r, ErrAdminKeyRequired, 403)
+		requestLogger(r).Warn("unauthorized lab key")
+		return
+	}
+
+	report, dashboardErr := s.dashboard()
+	if dashboardErr != nil {
+		writeError(w, r, dashboardErr, 500)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -1,11 +1,7 @@
 package main
 
 import (
-	"bufio"
-	"encoding/csv"
-	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"strconv"
 )
 
@@ -19,6 +15,8 @@ type DataGroup struct {
 	Training    bool
 	Reliability bool
 	BlockPaths  map[int]string
+	// SHA-256 of each block's zip, by block index
+	BlockSHA256s map[int]string
 }
 
 /*
@@ -42,70 +40,23 @@ WorkItemMap is a map of WorkItem ID's to WorkItems.
 type WorkItemMap map[string]WorkItem
 
 /*
-fillDataMap reads a path_manifest.csv file and
+fillDataMap reads the path_manifest.csv file and
 fills a DataMap with all the paths to the CLAN
-files and blocks
+files and blocks. The manifest is validated (see
+readManifest) and the report logged; if it has any
+errors, nothing is loaded.
 */
-func fillDataMap() DataMap {
-	file, _ := os.Open(manifestFile)
-	reader := csv.NewReader(bufio.NewReader(file))
-
-	lines, err := reader.ReadAll()
+func fillDataMap(manifestPath string) (DataMap, error) {
+	dataMap, report, err := readManifest(manifestPath, true)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
-	dataMap := make(DataMap)
-	var currDataGroup = &DataGroup{}
-	var currFile = ""
-
-	for i, line := range lines {
-		// skip the header
-		if i == 0 {
-			continue
-		}
-
-		// we're on a new CLAN file
-		if line[0] != currFile {
-			// reset currFile
-			currFile = line[0]
-			// construct new DataGroup for the new file
-			currDataGroup = &DataGroup{ClanFile: currFile, BlockPaths: make(map[int]string)}
-			// assign a key/value to the dataMap for this new group
-			dataMap[currFile] = currDataGroup
-			// set the value of the first block of this new file
-			index, err := strconv.Atoi(line[1])
-			if err != nil {
-				log.Fatal(err)
-			}
-			// set new BlockPaths index/path
-			currDataGroup.BlockPaths[index] = line[2]
-			// set Training and Reliability variables
-			training, trainErr := strconv.ParseBool(line[3])
-
-			currDataGroup.Training = training
-			if trainErr != nil {
-				log.Fatal("training parsing error")
-			}
-			reliability, reliaErr := strconv.ParseBool(line[4])
-			if reliaErr != nil {
-				log.Fatal("reliability parsing error")
-			}
-			currDataGroup.Reliability = reliability
-
-		} else {
-			index, err := strconv.Atoi(line[1])
-			if err != nil {
-				log.Fatal(err)
-			}
-			currDataGroup.BlockPaths[index] = line[2]
-
-		}
-		if currDataGroup.Training {
-			fmt.Println(currDataGroup)
-		}
+	if report.hasErrors() {
+		slog.Error("manifest is invalid", "path", manifestPath, "report", report.String())
+		return nil, ErrManifestInvalid
 	}
-	return dataMap
+	slog.Info("manifest loaded", "path", manifestPath, "report", report.String())
+	return dataMap, nil
 }
 
 /*
@@ -132,12 +83,13 @@ func (dataMap DataMap) partitionIntoWorkItemsMap() WorkItemMap {
 			currWorkItem.Active = false
 			currWorkItem.FileName = value.ClanFile
 			currWorkItem.BlockPath = blockValue
+			currWorkItem.BlockSHA256 = value.BlockSHA256s[blockKey]
 			currWorkItem.Training = value.Training
 			currWorkItem.Reliability = value.Reliability
 
 			workItems[currWorkItem.ID] = currWorkItem
 			if currWorkItem.Training {
-				fmt.Println(currWorkItem)
+				slog.Debug("training work item", "block_id", currWorkItem.ID)
 			}
 		}
 	}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// defaultMaxRequestBytes is the largest request body taken without "max_request_bytes"
+const defaultMaxRequestBytes = 1 << 20
+
+var (
+	// ErrMalformedRequest means the body of a request isn't a single JSON object
+	ErrMalformedRequest = errors.New("Malformed request body")
+
+	// ErrUnknownField means the body of a request has a field the endpoint doesn't take
+	ErrUnknownField = errors.New("Unknown field in request body")
+
+	// ErrRequestTooLarge means the body of a request is over max_request_bytes
+	ErrRequestTooLarge = errors.New("Request body too large")
+
+	// ErrMissingFields means the body of a request is missing fields the endpoint needs
+	ErrMissingFields = errors.New("Request is missing required fields")
+
+	// ErrUnknownDeleteType means a delete-block request's delete_type isn't single, user or lab
+	ErrUnknownDeleteType = errors.New("Unknown delete_type (must be \"single\", \"user\" or \"lab\")")
+
+	// ErrMethodNotAllowed means an endpoint was called with a method it doesn't take
+	ErrMethodNotAllowed = errors.New("Method not allowed")
+)
+
+// maxRequestBytes is the largest request body the handlers read
+func (conf *Config) maxRequestBytes() int64 {
+	if conf.MaxRequestBytes <= 0 {
+		return defaultMaxRequestBytes
+	}
+	return conf.MaxRequestBytes
+}
+
+/*
+validatedRequest is a request body that can say which of
+its fields were set, by their JSON names, so decodeRequest
+can check the ones an endpoint needs are there
+*/
+type validatedRequest interface {
+	present() map[string]bool
+}
+
+func (req *IDSRequest) present() map[string]bool {
+	return map[string]bool{
+		"lab_key":  req.LabKey != "",
+		"lab_name": req.LabName != "",
+		"username": req.Username != "",
+	}
+}
+
+func (req *BlockReq) present() map[string]bool {
+	return map[string]bool{
+		"block_id": req.ItemID != "",
+		"lab_key":  req.LabKey != "",
+		"lab_name": req.LabName != "",
+		"username": req.Username != "",
+	}
+}
+
+func (req *WorkItemReleaseReq) present() map[string]bool {
+	return map[string]bool{
+		"lab_key":  req.LabKey != "",
+		"lab_name": req.LabName != "",
+		"username": req.Username != "",
+		"blocks":   len(req.BlockIds) > 0,
+	}
+}
+
+func (req *DeleteBlockRequest) present() map[string]bool {
+	return map[string]bool{
+		"lab_key":     req.LabKey != "",
+		"coder":       req.Coder != "",
+		"delete_type": req.Type != "",
+		"block_id":    req.BlockID != "",
+	}
+}
+
+/*
+required are the fields a delete needs, which
+depend on what's being deleted
+*/
+func (req *DeleteBlockRequest) required() ([]string, error) {
+	switch req.Type {
+	case "single":
+		return []string{"lab_key", "delete_type", "coder", "block_id"}, nil
+	case "user":
+		return []string{"lab_key", "delete_type", "coder"}, nil
+	case "lab", "":
+		return []string{"lab_key", "delete_type"}, nil
+	}
+	return nil, ErrUnknownDeleteType
+}
+
+func (req *AddBlockReq) present() map[string]bool {
+	return map[string]bool{
+		"block_id":      req.ItemID != "",
+		"admin_lab_key": req.AdminLabKey != "",
+		"lab_key":       req.LabKey != "",
+		"username":      req.Username != "",
+		"block":         req.Block.ID != "",
+	}
+}
+
+// missingFields are the required fields req doesn't have
+func missingFields(req validatedRequest, required []string) []string {
+	present := req.present()
+	missing := []string{}
+	for _, field := range required {
+		if !present[field] {
+			missing = append(missing, field)
+		}
+	}
+	return missing
+}
+
+/*
+unknownField finds a field in the JSON data that the type t doesn't
+have, looking inside the objects and arrays of the fields it does
+have. It matches names the way encoding/json does (case insensitive).
+*/
+func unknownField(data json.RawMessage, t reflect.Type) (string, bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		var object map[string]json.RawMessage
+		if json.Unmarshal(data, &object) != nil {
+			return "", false
+		}
+		fields := jsonFields(t)
+		for name, value := range object {
+			field, known := fields[strings.ToLower(name)]
+			if !known {
+				return name, true
+			}
+			if inner, found := unknownField(value, field.Type); found {
+				return name + "." + inner, true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		var elems []json.RawMessage
+		if json.Unmarshal(data, &elems) != nil {
+			return "", false
+		}
+		for _, elem := range elems {
+			if inner, found := unknownField(elem, t.Elem()); found {
+				return inner, true
+			}
+		}
+	case reflect.Map:
+		var values map[string]json.RawMessage
+		if json.Unmarshal(data, &values) != nil {
+			return "", false
+		}
+		for _, value := range values {
+			if inner, found := unknownField(value, t.Elem()); found {
+				return inner, true
+			}
+		}
+	}
+	return "", false
+}
+
+/*
+jsonFields are the exported fields of a struct by their lowercased
+JSON name. The fields of an embedded struct without a JSON name are
+taken as the struct's own, unless it has a field of the same name,
+the way encoding/json promotes them.
+*/
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	promoted := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		embedded := field.Type
+		if embedded.Kind() == reflect.Ptr {
+			embedded = embedded.Elem()
+		}
+		if field.Anonymous && name == "" && embedded.Kind() == reflect.Struct {
+			for innerName, inner := range jsonFields(embedded) {
+				promoted[innerName] = inner
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[strings.ToLower(name)] = field
+	}
+	for name, field := range promoted {
+		if _, shadowed := fields[name]; !shadowed {
+			fields[name] = field
+		}
+	}
+	return fields
+}
+
+/*
+readRequest decodes a request body into v. The body has to be
+one JSON object (an empty body is taken as {}), with only the
+fields v has, and no bigger than max_request_bytes.
+*/
+func (s *Server) readRequest(w http.ResponseWriter, r *http.Request, v interface{}) (interface{}, error) {
+	limit := s.config.maxRequestBytes()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return map[string]int64{"limit": limit}, ErrRequestTooLarge
+		}
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if err := decoder.Decode(v); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: more than one JSON value", ErrMalformedRequest)
+	}
+	if field, found := unknownField(body, reflect.TypeOf(v)); found {
+		return map[string]string{"field": field}, fmt.Errorf("%w: %q", ErrUnknownField, field)
+	}
+	return nil, nil
+}
+
+/*
+decodeRequest is how the handlers read their request. It decodes
+the body into v (see readRequest) and checks the required fields
+are set. If anything's wrong it sends the error and returns false,
+and the handler should just return.
+*/
+func (s *Server) decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}, required ...string) bool {
+	details, err := s.readRequest(w, r, v)
+	if err != nil {
+		writeErrorDetails(w, r, err, http.StatusBadRequest, details)
+		return false
+	}
+
+	req, canValidate := v.(validatedRequest)
+	if len(required) == 0 || !canValidate {
+		return true
+	}
+	return requireFields(w, r, req, required...)
+}
+
+/*
+requireFields sends a missing_fields error, and returns
+false, if any of the required fields of req aren't set
+*/
+func requireFields(w http.ResponseWriter, r *http.Request, req validatedRequest, required ...string) bool {
+	missing := missingFields(req, required)
+	if len(missing) == 0 {
+		return true
+	}
+	writeErrorDetails(w, r, fmt.Errorf("%w: %s", ErrMissingFields, strings.Join(missing, ", ")),
+		http.StatusBadRequest, map[string][]string{"fields": missing})
+	return false
+}
+
+/*
+allowMethods only lets requests with one of the methods
+through to h, anything else gets a 405 with the methods
+that are allowed. Allowing GET allows HEAD too.
+*/
+func allowMethods(h http.Handler, methods ...string) http.Handler {
+	allowed := make(map[string]bool)
+	for _, method := range methods {
+		allowed[method] = true
+	}
+	if allowed[http.MethodGet] && !allowed[http.MethodHead] {
+		allowed[http.MethodHead] = true
+		methods = append(methods, http.MethodHead)
+	}
+	allow := strings.Join(methods, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed[r.Method] {
+			w.Header().Set("Allow", allow)
+			writeErrorDetails(w, r, fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+				http.StatusMethodNotAllowed, map[string][]string{"allowed": methods})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readTestRequest runs body through readRequest into v
+func readTestRequest(t *testing.T, body string, v interface{}) (interface{}, error) {
+	server := newServer(Config{}, NewMemLabsDB(), NewMemWorkDB(), NewMemLabelsDB())
+	request := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	return server.readRequest(httptest.NewRecorder(), request, v)
+}
+
+func TestReadRequestUnknownFields(t *testing.T) {
+	for _, test := range []struct {
+		body  string
+		field string
+	}{
+		{`{"lab_key": "lab1", "bogus": 1}`, "bogus"},
+		{`{"id": "a.cha:::1", "clips": [{"clip_index": 1}, {"clip_index": 2, "bogus": true}]}`, "clips.bogus"},
+	} {
+		var block Block
+		details, err := readTestRequest(t, test.body, &block)
+		if !errors.Is(err, ErrUnknownField) {
+			t.Fatalf("%s: got %v, want an unknown field", test.body, err)
+		}
+		if field := details.(map[string]string)["field"]; field != test.field {
+			t.Errorf("%s: got field %q, want %q", test.body, field, test.field)
+		}
+	}
+
+	// field names match case insensitively, like encoding/json
+	var blockReq BlockReq
+	if _, err := readTestRequest(t, `{"LAB_KEY": "lab1", "Username": "alice"}`, &blockReq); err != nil {
+		t.Fatal(err)
+	}
+	if blockReq.LabKey != "lab1" || blockReq.Username != "alice" {
+		t.Errorf("got %+v", blockReq)
+	}
+}
+
+func TestReadRequestSingleValue(t *testing.T) {
+	for _, body := range []string{
+		`{"lab_key": "lab1"}}`,
+		`{"lab_key": "lab1"}]`,
+		`{"lab_key": "lab1"} {}`,
+		`{"lab_key": "lab1"`,
+		`["lab1"]`,
+	} {
+		var request IDSRequest
+		if _, err := readTestRequest(t, body, &request); !errors.Is(err, ErrMalformedRequest) {
+			t.Errorf("%s: got %v, want a malformed request", body, err)
+		}
+	}
+
+	for _, body := range []string{"", " \n", `{"lab_key": "lab1"}` + "\n"} {
+		var request IDSRequest
+		if _, err := readTestRequest(t, body, &request); err != nil {
+			t.Errorf("%q: %v", body, err)
+		}
+	}
+}
+
+func TestReadRequestEmbeddedFields(t *testing.T) {
+	// the fields of the embedded IDSRequest are PageReq's own
+	var pageReq PageReq
+	body := `{"lab_key": "lab1", "lab_name": "Lab 1", "train_pack_num": 2, "limit": 10}`
+	if _, err := readTestRequest(t, body, &pageReq); err != nil {
+		t.Fatal(err)
+	}
+	if pageReq.LabKey != "lab1" || pageReq.TrainingPackNum != 2 || pageReq.Limit != 10 {
+		t.Errorf("got %+v", pageReq)
+	}
+
+	details, err := readTestRequest(t, `{"lab_key": "lab1", "bogus": 1}`, &PageReq{})
+	if !errors.Is(err, ErrUnknownField) || details.(map[string]string)["field"] != "bogus" {
+		t.Errorf("got %v %v, want bogus to be an unknown field", details, err)
+	}
+}
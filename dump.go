@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// dumpFormat identifies an idsserver dump archive
+	dumpFormat = "idsserver-dump"
+
+	/*
+		dumpVersion is the version of the archive layout (not of
+		the records in it, that's the schema_version). Bump it
+		when fields are added to or removed from Dump.
+	*/
+	dumpVersion = 1
+)
+
+var (
+	// ErrNotADump means the file isn't an idsserver dump archive
+	ErrNotADump = errors.New("Not an idsserver dump archive")
+
+	// ErrDumpTooNew means the archive was written by a newer
+	// version of idsserver than this one
+	ErrDumpTooNew = errors.New("Dump archive is newer than this binary, upgrade idsserver")
+
+	// ErrDumpLeaseMismatch means a work item's leases in the archive
+	// don't match the active work items of the archive's users
+	ErrDumpLeaseMismatch = errors.New("Dump archive's leases don't match its users' active work items")
+
+	// ErrRestoreNotEmpty means the stores a dump would be
+	// restored into already have data in them
+	ErrRestoreNotEmpty = errors.New("Stores to restore into aren't empty")
+)
+
+/*
+Dump is the archive written by "idsserver dump". It holds
+the entire state of a server:
+
+	format          always "idsserver-dump"
+	version         the layout of the archive (dumpVersion)
+	schema_version  the schema version of the records (see schema.go)
+	created         when the dump was taken
+	config          the server's Config
+	labs            every Lab, with all of its Users and their block lists
+	work_items      every WorkItem, in ID order, each with "leased_to",
+	                the users that currently have it checked out
+	block_groups    every BlockGroup of labels, in block ID order
+
+The leases are redundant with the users' active_work_items, they
+are there so the archive can be read without cross referencing,
+and are checked against the users on restore.
+*/
+type Dump struct {
+	Format        string          `json:"format"`
+	Version       int             `json:"version"`
+	SchemaVersion int             `json:"schema_version"`
+	Created       time.Time       `json:"created"`
+	Config        Config          `json:"config"`
+	Labs          []*Lab          `json:"labs"`
+	WorkItems     []DumpWorkItem  `json:"work_items"`
+	BlockGroups   BlockGroupArray `json:"block_groups"`
+}
+
+// DumpWorkItem is a WorkItem along with the users it's leased to
+type DumpWorkItem struct {
+	WorkItem
+	LeasedTo []DumpLease `json:"leased_to"`
+}
+
+// DumpLease is a user that has a WorkItem checked out
+type DumpLease struct {
+	LabKey   string `json:"lab_key"`
+	Username string `json:"username"`
+}
+
+/*
+leases returns the users that have each WorkItem checked
+out, according to their active work item lists
+*/
+func leases(labs []*Lab) map[string][]DumpLease {
+	itemLeases := make(map[string][]DumpLease)
+	for _, lab := range labs {
+		var usernames []string
+		for username := range lab.Users {
+			usernames = append(usernames, username)
+		}
+		sort.Strings(usernames)
+
+		for _, username := range usernames {
+			for _, itemID := range lab.Users[username].ActiveWorkItems {
+				itemLeases[itemID] = append(itemLeases[itemID],
+					DumpLease{LabKey: lab.Key, Username: username})
+			}
+		}
+	}
+	return itemLeases
+}
+
+/*
+dump reads the entire state of the server's stores
+*/
+func (s *Server) dump() (*Dump, error) {
+	labs, err := s.labs.getAllLabs()
+	if err != nil {
+		return nil, err
+	}
+	itemMap, err := s.work.loadItemMap()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.labels.getAllBlockGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	dump := &Dump{
+		Format:        dumpFormat,
+		Version:       dumpVersion,
+		SchemaVersion: currentSchemaVersion,
+		Created:       time.Now().UTC(),
+		Config:        s.config,
+		Labs:          labs,
+		WorkItems:     make([]DumpWorkItem, 0, len(itemMap)),
+		BlockGroups:   groups,
+	}
+	if dump.Labs == nil {
+		dump.Labs = make([]*Lab, 0)
+	}
+	if dump.BlockGroups == nil {
+		dump.BlockGroups = make(BlockGroupArray, 0)
+	}
+
+	itemLeases := leases(labs)
+	for _, item := range itemMap {
+		itemLease := itemLeases[item.ID]
+		if itemLease == nil {
+			itemLease = make([]DumpLease, 0)
+		}
+		dump.WorkItems = append(dump.WorkItems, DumpWorkItem{WorkItem: item, LeasedTo: itemLease})
+	}
+	sort.Slice(dump.WorkItems, func(i, j int) bool {
+		return dump.WorkItems[i].ID < dump.WorkItems[j].ID
+	})
+	return dump, nil
+}
+
+func writeDump(w io.Writer, dump *Dump) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", " ")
+	return encoder.Encode(dump)
+}
+
+/*
+rawDump is a Dump whose records haven't been decoded yet,
+so the ones from older schema versions can be migrated first
+*/
+type rawDump struct {
+	Format        string            `json:"format"`
+	Version       int               `json:"version"`
+	SchemaVersion int               `json:"schema_version"`
+	Created       time.Time         `json:"created"`
+	Config        Config            `json:"config"`
+	Labs          []json.RawMessage `json:"labs"`
+	WorkItems     []json.RawMessage `json:"work_items"`
+	BlockGroups   []json.RawMessage `json:"block_groups"`
+}
+
+/*
+readDump reads a dump archive, bringing its records
+up to the current schema version
+*/
+func readDump(r io.Reader) (*Dump, error) {
+	var raw rawDump
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	if raw.Format != dumpFormat {
+		return nil, ErrNotADump
+	}
+	if raw.Version > dumpVersion {
+		return nil, ErrDumpTooNew
+	}
+	if err := checkSchemaVersion(raw.SchemaVersion); err != nil {
+		return nil, err
+	}
+	steps := pendingMigrations(raw.SchemaVersion)
+
+	dump := &Dump{
+		Format:        raw.Format,
+		Version:       raw.Version,
+		SchemaVersion: currentSchemaVersion,
+		Created:       raw.Created,
+		Config:        raw.Config,
+	}
+
+	for i, data := range raw.Labs {
+		migrated, _, err := migrateRecord(labRecords, steps, fmt.Sprintf("labs[%d]", i), data)
+		if err != nil {
+			return nil, err
+		}
+		lab, err := decodeLabJSON(migrated)
+		if err != nil {
+			return nil, err
+		}
+		dump.Labs = append(dump.Labs, lab)
+	}
+
+	for i, data := range raw.WorkItems {
+		// migrateRecord drops the leases along with any
+		// other field a WorkItem doesn't have
+		var itemLeases struct {
+			LeasedTo []DumpLease `json:"leased_to"`
+		}
+		if err := json.Unmarshal(data, &itemLeases); err != nil {
+			return nil, err
+		}
+		migrated, _, err := migrateRecord(workItemRecords, steps, fmt.Sprintf("work_items[%d]", i), data)
+		if err != nil {
+			return nil, err
+		}
+		item, err := decodeWorkItemJSON(migrated)
+		if err != nil {
+			return nil, err
+		}
+		dump.WorkItems = append(dump.WorkItems, DumpWorkItem{WorkItem: *item, LeasedTo: itemLeases.LeasedTo})
+	}
+
+	for i, data := range raw.BlockGroups {
+		migrated, _, err := migrateRecord(blockGroupRecords, steps, fmt.Sprintf("block_groups[%d]", i), data)
+		if err != nil {
+			return nil, err
+		}
+		group, err := decodeBlockGroupJSON(migrated)
+		if err != nil {
+			return nil, err
+		}
+		dump.BlockGroups.addBlockGroup(*group)
+	}
+
+	return dump, dump.checkLeases()
+}
+
+// checkLeases makes sure the leases match the users' active work items
+func (dump *Dump) checkLeases() error {
+	itemLeases := leases(dump.Labs)
+	for _, item := range dump.WorkItems {
+		if len(item.LeasedTo) != len(itemLeases[item.ID]) {
+			return fmt.Errorf("%v: %s", ErrDumpLeaseMismatch, item.ID)
+		}
+		for _, lease := range item.LeasedTo {
+			found := false
+			for _, userLease := range itemLeases[item.ID] {
+				if lease == userLease {
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("%v: %s", ErrDumpLeaseMismatch, item.ID)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+storesAreEmpty checks that there's nothing in
+any of the server's stores
+*/
+func (s *Server) storesAreEmpty() (bool, error) {
+	labs, err := s.labs.getAllLabs()
+	if err != nil || len(labs) > 0 {
+		return false, err
+	}
+	items, _, err := s.work.getWorkItemPage("", 1)
+	if err != nil || len(items) > 0 {
+		return false, err
+	}
+	groups, _, err := s.labels.getBlockGroupPage("", 1)
+	if err != nil || len(groups) > 0 {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+restoreDump writes everything in the dump into the
+server's stores, which have to be empty.
+*/
+func (s *Server) restoreDump(dump *Dump) error {
+	isEmpty, err := s.storesAreEmpty()
+	if err != nil {
+		return err
+	}
+	if !isEmpty {
+		return ErrRestoreNotEmpty
+	}
+
+	// stamp the (empty) stores with the current
+	// schema version before writing into them
+	if _, err := s.migrateSchema(false); err != nil {
+		return err
+	}
+
+	itemMap := make(WorkItemMap)
+	for _, item := range dump.WorkItems {
+		itemMap[item.ID] = item.WorkItem
+	}
+	if err := s.writeRecords(dump.Labs, dump.BlockGroups, itemMap); err != nil {
+		return err
+	}
+	return s.setWorkItems(itemMap)
+}
+
+/*
+restoredConfig is the config a restored server runs with. It's
+the config from the dump, except for where the databases and
+backups are kept and where blocks are built, which come from the
+config on the new machine (if there is one yet).
+*/
+func restoredConfig(dumped Config, configPath string) (Config, error) {
+	config := dumped
+	config.WorkMapLoaded = true
+
+	local, err := readConfigFile(configPath)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+
+	config.Store = local.Store
+	config.SQLitePath = local.SQLitePath
+	config.LabsDBPath = local.LabsDBPath
+	config.WorkDBPath = local.WorkDBPath
+	config.LabelsDBPath = local.LabelsDBPath
+	config.BackupDir = local.BackupDir
+	config.BlocksDir = local.BlocksDir
+	return config, nil
+}
+
+/*
+dumpCommand writes a dump archive of a stopped server:
+
+	$: ./idsserver dump config.json ids-dump.json
+*/
+func dumpCommand(args []string) error {
+	if len(args) < 2 {
+		return ErrMissingCommandArgs
+	}
+
+	server, err := openServer(args[0])
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	if _, err := server.migrateSchema(false); err != nil {
+		return err
+	}
+	dump, err := server.dump()
+	if err != nil {
+		return err
+	}
+
+	outPath := args[1]
+	out, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := writeDump(out, dump); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	fmt.Println("dumped", len(dump.Labs), "labs,", len(dump.WorkItems), "work items and",
+		len(dump.BlockGroups), "block groups to", outPath)
+	return nil
+}
+
+/*
+restoreCommand rebuilds all three stores from a dump archive
+and writes the config. The stores the config points to have
+to be empty (or not exist yet):
+
+	$: ./idsserver restore config.json ids-dump.json
+*/
+func restoreCommand(args []string) error {
+	if len(args) < 2 {
+		return ErrMissingCommandArgs
+	}
+	configPath := args[0]
+
+	file, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	dump, err := readDump(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	config, err := restoredConfig(dump.Config, configPath)
+	if err != nil {
+		return err
+	}
+	server, err := openConfiguredServer(config)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	if err := server.restoreDump(dump); err != nil {
+		return err
+	}
+	if err := config.writeFile(configPath); err != nil {
+		return err
+	}
+	fmt.Println("restored", len(dump.Labs), "labs,", len(dump.WorkItems), "work items and",
+		len(dump.BlockGroups), "block groups from", args[1])
+	return nil
+}
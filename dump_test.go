@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/*
+newDumpTestServer writes a config for a bolt backed server
+in dir, and fills its stores with a bit of everything
+*/
+func newDumpTestServer(t *testing.T, dir string) string {
+	config := Config{
+		AdminKey:          "admin",
+		WorkMapLoaded:     true,
+		Labs:              []string{"lab1", "lab2"},
+		LabsDBPath:        filepath.Join(dir, "labs.db"),
+		WorkDBPath:        filepath.Join(dir, "work.db"),
+		LabelsDBPath:      filepath.Join(dir, "labels.db"),
+		MaxPassesPerCoder: 2,
+	}
+	configPath := filepath.Join(dir, "config.json")
+	if err := config.writeFile(configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := openServer(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.workItemMap = WorkItemMap{
+		"a.cha:::1": {ID: "a.cha:::1", FileName: "a.cha", Block: 1, BlockPath: "data/a/1.zip"},
+		"a.cha:::2": {ID: "a.cha:::2", FileName: "a.cha", Block: 2, BlockPath: "data/a/2.zip"},
+		"t.cha:::1": {ID: "t.cha:::1", FileName: "t.cha", Block: 1, BlockPath: "data/t/1.zip",
+			Training: true, TrainingPackNum: 3},
+	}
+	if err := server.work.persistWorkItemMap(server.workItemMap); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []struct{ lab, name string }{
+		{"lab1", "alice"}, {"lab1", "bob"}, {"lab2", "carol"},
+	} {
+		if err := server.addUser(user.lab, "Lab "+user.lab, user.name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// alice codes a.cha:::1 and has a.cha:::2 checked out
+	alice := BlockReq{LabKey: "lab1", Username: "alice"}
+	for _, id := range []string{"a.cha:::1", "a.cha:::2"} {
+		if err := server.activateWorkItem(server.workItemMap[id], alice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	block := Block{ID: "a.cha:::1", ClanFile: "a.cha", Index: 1,
+		Coder: "alice", LabKey: "lab1", LabName: "Lab lab1", Username: "alice",
+		Clips: []Clip{
+			{Index: 0, Tier: "CHN", StartTime: "1.5", OffsetTime: "2.0", Classification: "1"},
+			{Index: 1, Tier: "FAN", Multiline: true, MultiTierParent: "CHN", GenderLabel: "F"},
+		}}
+	if err := server.addLabeledBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	request := IDSRequest{LabKey: "lab1", Username: "alice"}
+	if err := server.inactivateWorkItem(server.workItemMap["a.cha:::1"], request); err != nil {
+		t.Fatal(err)
+	}
+
+	// carol codes the training block
+	training := Block{ID: "t.cha:::1", ClanFile: "t.cha", Index: 1, Training: true,
+		Coder: "carol", LabKey: "lab2", Username: "carol"}
+	if err := server.addLabeledBlock(training); err != nil {
+		t.Fatal(err)
+	}
+	carol, _ := server.getUser("lab2", "carol")
+	carol.addCompleteTrainBlock(training)
+	if err := server.setUser(carol); err != nil {
+		t.Fatal(err)
+	}
+
+	return configPath
+}
+
+func TestDumpRestoreRoundTrip(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	srcConfig := newDumpTestServer(t, srcDir)
+
+	dumpPath := filepath.Join(srcDir, "dump.json")
+	if err := dumpCommand([]string{srcConfig, dumpPath}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new machine keeps its databases somewhere else
+	dstConfig := filepath.Join(dstDir, "config.json")
+	local := Config{
+		LabsDBPath:   filepath.Join(dstDir, "labs.db"),
+		WorkDBPath:   filepath.Join(dstDir, "work.db"),
+		LabelsDBPath: filepath.Join(dstDir, "labels.db"),
+	}
+	if err := local.writeFile(dstConfig); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreCommand([]string{dstConfig, dumpPath}); err != nil {
+		t.Fatal(err)
+	}
+
+	// dumping the restored server has to give back the same archive
+	redumpPath := filepath.Join(dstDir, "dump.json")
+	if err := dumpCommand([]string{dstConfig, redumpPath}); err != nil {
+		t.Fatal(err)
+	}
+	original := readDumpFile(t, dumpPath)
+	restored := readDumpFile(t, redumpPath)
+
+	if restored.Config.LabsDBPath != local.LabsDBPath {
+		t.Errorf("restored config uses %s, want the local %s", restored.Config.LabsDBPath, local.LabsDBPath)
+	}
+	restored.Config.LabsDBPath = original.Config.LabsDBPath
+	restored.Config.WorkDBPath = original.Config.WorkDBPath
+	restored.Config.LabelsDBPath = original.Config.LabelsDBPath
+	restored.Created = original.Created
+
+	if !reflect.DeepEqual(original, restored) {
+		originalJSON, _ := json.MarshalIndent(original, "", " ")
+		restoredJSON, _ := json.MarshalIndent(restored, "", " ")
+		t.Fatalf("restored server doesn't match\noriginal: %s\nrestored: %s", originalJSON, restoredJSON)
+	}
+
+	// spot check that the interesting state made it through
+	leased := false
+	for _, item := range original.WorkItems {
+		if item.ID == "a.cha:::2" {
+			leased = item.Active && len(item.LeasedTo) == 1 && item.LeasedTo[0].Username == "alice"
+		}
+		if item.ID == "a.cha:::1" && item.TimesCoded != 1 {
+			t.Errorf("a.cha:::1 TimesCoded = %d, want 1", item.TimesCoded)
+		}
+	}
+	if !leased {
+		t.Error("a.cha:::2 should be leased to alice")
+	}
+	if len(original.BlockGroups) != 2 || len(original.BlockGroups[0].Blocks[0].Clips) != 2 {
+		t.Errorf("unexpected block groups: %+v", original.BlockGroups)
+	}
+	if original.Config.MaxPassesPerCoder != 2 {
+		t.Error("config wasn't dumped")
+	}
+}
+
+func TestRestoreIntoNonEmptyStores(t *testing.T) {
+	dir := t.TempDir()
+	configPath := newDumpTestServer(t, dir)
+
+	dumpPath := filepath.Join(dir, "dump.json")
+	if err := dumpCommand([]string{configPath, dumpPath}); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreCommand([]string{configPath, dumpPath}); err != ErrRestoreNotEmpty {
+		t.Fatalf("restore into a used server returned %v, want %v", err, ErrRestoreNotEmpty)
+	}
+}
+
+func TestRestoreIntoMemStores(t *testing.T) {
+	dir := t.TempDir()
+	configPath := newDumpTestServer(t, dir)
+	dumpPath := filepath.Join(dir, "dump.json")
+	if err := dumpCommand([]string{configPath, dumpPath}); err != nil {
+		t.Fatal(err)
+	}
+	original := readDumpFile(t, dumpPath)
+
+	server := newServer(original.Config, NewMemLabsDB(), NewMemWorkDB(), NewMemLabelsDB())
+	if err := server.restoreDump(original); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := server.dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.Created = original.Created
+	if !reflect.DeepEqual(original, restored) {
+		t.Fatal("restored mem server doesn't match the dump")
+	}
+	if !server.workItemMap["a.cha:::2"].Active {
+		t.Error("restore didn't set the workItemMap")
+	}
+}
+
+func TestReadDumpChecksLeases(t *testing.T) {
+	dir := t.TempDir()
+	configPath := newDumpTestServer(t, dir)
+	dumpPath := filepath.Join(dir, "dump.json")
+	if err := dumpCommand([]string{configPath, dumpPath}); err != nil {
+		t.Fatal(err)
+	}
+
+	dump := readDumpFile(t, dumpPath)
+	for i := range dump.WorkItems {
+		dump.WorkItems[i].LeasedTo = nil
+	}
+	var buf bytes.Buffer
+	if err := writeDump(&buf, dump); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readDump(&buf); err == nil || !strings.Contains(err.Error(), ErrDumpLeaseMismatch.Error()) {
+		t.Fatalf("readDump returned %v, want a lease mismatch", err)
+	}
+
+	if _, err := readDump(strings.NewReader(`{"format": "something-else"}`)); err != ErrNotADump {
+		t.Fatalf("readDump returned %v, want %v", err, ErrNotADump)
+	}
+}
+
+func readDumpFile(t *testing.T, path string) *Dump {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	dump, err := readDump(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dump
+}
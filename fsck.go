@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+/*
+	fsck cross-checks the state that's duplicated between the stores:
+
+		WorkItem.TimesCoded and Active        (WorkDB)
+		User.ActiveWorkItems, PastWorkItems,
+		CompleteTrainBlocks, CompleteRelBlocks (LabsDB)
+		BlockGroup instances                   (LabelsDB)
+
+	The labels in the LabelsDB are the source of truth, so
+	repairs always change the other two to match them.
+*/
+
+const (
+	// a BlockGroup for a block that isn't in the workItemMap
+	fsckUnknownGroup = "unknown_group"
+
+	// a BlockGroup whose instances aren't numbered 0..n-1
+	fsckInstanceNumbers = "instance_numbers"
+
+	// labels coded by a user that doesn't exist
+	fsckUnknownCoder = "unknown_coder"
+
+	// labels that aren't in the coder's past/training/reliability list
+	fsckUnlistedLabels = "unlisted_labels"
+
+	// a user's active, past, training or reliability list has a
+	// block that isn't in the workItemMap
+	fsckUnknownBlock = "unknown_block"
+
+	// a user's past, training or reliability list has a block
+	// they have no labels for
+	fsckMissingLabels = "missing_labels"
+
+	// a block the user has already labeled is still in their active
+	// list (only repaired when they couldn't code it again anyway)
+	fsckCodedButActive = "coded_but_active"
+
+	// a block in a user's active list isn't marked Active
+	fsckInactiveLease = "inactive_lease"
+
+	// a WorkItem is marked Active but no user has it checked out
+	fsckOrphanedActive = "orphaned_active"
+
+	// a WorkItem's TimesCoded doesn't match its number of instances
+	fsckTimesCoded = "times_coded"
+)
+
+/*
+ErrRepairWhileRunning means a repair was asked for through /v1/fsck/. The
+repair writes back whole copies of the labs read at the start of the scan,
+which would lose the checkouts and submits made while it ran, so it's only
+done by the fsck command, with the server stopped.
+*/
+var ErrRepairWhileRunning = errors.New("Can't repair a running server, stop it and run \"idsserver fsck config.json --repair\"")
+
+/*
+FsckIssue is a single inconsistency between the stores.
+Repairable issues are fixed by a repairing fsck.
+*/
+type FsckIssue struct {
+	Kind       string `json:"kind"`
+	BlockID    string `json:"block_id"`
+	LabKey     string `json:"lab_key,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Detail     string `json:"detail"`
+	Repairable bool   `json:"repairable"`
+}
+
+/*
+FsckReport is the result of an fsck. Repaired is the number
+of issues that were fixed (0 unless it was a repairing fsck).
+*/
+type FsckReport struct {
+	Labs        int         `json:"labs"`
+	Users       int         `json:"users"`
+	WorkItems   int         `json:"work_items"`
+	BlockGroups int         `json:"block_groups"`
+	Issues      []FsckIssue `json:"issues"`
+	Repaired    int         `json:"repaired"`
+}
+
+func (report *FsckReport) add(issue FsckIssue) {
+	report.Issues = append(report.Issues, issue)
+}
+
+/*
+FsckReq is a request to check the stores. Repair
+has to be false, see ErrRepairWhileRunning.
+*/
+type FsckReq struct {
+	AdminLabKey string `json:"admin_lab_key"`
+	Repair      bool   `json:"repair"`
+}
+
+// removeID removes every occurrence of the ID from the list
+func removeID(list *BlockIDList, blockID string) {
+	var newList BlockIDList
+	for _, id := range *list {
+		if id != blockID {
+			newList.addID(id)
+		}
+	}
+	if newList == nil && *list != nil {
+		newList = make(BlockIDList, 0)
+	}
+	*list = newList
+}
+
+/*
+repeatForbidden is whether the user can't code the block again, so
+their lease on it is left over from their submit. Training blocks
+can be checked out again, and so can regular blocks (through
+/v1/get-specific-block/) while the pass limits allow it.
+*/
+func repeatForbidden(item WorkItem, group *BlockGroup, labKey, username string, limits PassLimits) bool {
+	if item.Training || item.Reliability || group == nil {
+		return false
+	}
+	return group.checkPassLimits(labKey, username, limits) != nil
+}
+
+func containsID(list BlockIDList, blockID string) bool {
+	for _, id := range list {
+		if id == blockID {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+fsck checks the stores against each other. It works on copies
+of the labs, work items and block groups, applying the repair
+for each issue as it's found, so later checks see the repaired
+state. If repair is set, the copies that changed are written back.
+*/
+func (s *Server) fsck(repair bool) (*FsckReport, error) {
+	labs, err := s.labs.getAllLabs()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.labels.getAllBlockGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	items := s.workItems()
+	report := &FsckReport{Labs: len(labs),
+		WorkItems:   len(items),
+		BlockGroups: len(groups),
+		Issues:      make([]FsckIssue, 0)}
+
+	changedLabs := make(map[string]*Lab)
+	changedGroups := make(map[string]bool)
+	changedItems := make(WorkItemMap)
+
+	// which users have labels for each block
+	coded := make(map[string]map[string]bool)
+	groupMap := make(map[string]*BlockGroup)
+
+	// BlockGroups
+	for i := range groups {
+		group := &groups[i]
+		groupMap[group.ID] = group
+
+		if _, exists := items[group.ID]; !exists {
+			report.add(FsckIssue{Kind: fsckUnknownGroup, BlockID: group.ID,
+				Detail: "labeled block isn't in the work item map"})
+		}
+
+		for instance := range group.Blocks {
+			if group.Blocks[instance].Instance != instance {
+				report.add(FsckIssue{Kind: fsckInstanceNumbers, BlockID: group.ID,
+					Detail:     fmt.Sprintf("instance %d is numbered %d", instance, group.Blocks[instance].Instance),
+					Repairable: true})
+				group.Blocks[instance].Instance = instance
+				changedGroups[group.ID] = true
+			}
+		}
+
+		coded[group.ID] = make(map[string]bool)
+		for _, block := range group.Blocks {
+			coded[group.ID][block.LabKey+":::"+block.Coder] = true
+		}
+	}
+
+	labMap := make(map[string]*Lab)
+	for _, lab := range labs {
+		labMap[lab.Key] = lab
+	}
+
+	// Users
+	for _, lab := range labs {
+		var usernames []string
+		for username := range lab.Users {
+			usernames = append(usernames, username)
+		}
+		sort.Strings(usernames)
+		report.Users += len(usernames)
+
+		for _, username := range usernames {
+			user := lab.Users[username]
+			userKey := lab.Key + ":::" + username
+			changed := false
+			issue := func(kind, blockID, detail string) {
+				report.add(FsckIssue{Kind: kind, BlockID: blockID,
+					LabKey: lab.Key, Username: username,
+					Detail: detail, Repairable: true})
+				changed = true
+			}
+
+			for _, blockID := range append(BlockIDList{}, user.ActiveWorkItems...) {
+				item, exists := items[blockID]
+				if !exists {
+					issue(fsckUnknownBlock, blockID, "active block isn't in the work item map")
+					removeID(&user.ActiveWorkItems, blockID)
+					delete(user.CheckedOut, blockID)
+				} else if coded[blockID][userKey] &&
+					repeatForbidden(item, groupMap[blockID], lab.Key, username, s.config.passLimits()) {
+					issue(fsckCodedButActive, blockID, "user has already labeled their active block, and can't code it again")
+					user.inactivateWorkItem(item)
+				} else {
+					if coded[blockID][userKey] {
+						report.add(FsckIssue{Kind: fsckCodedButActive, BlockID: blockID,
+							LabKey: lab.Key, Username: username,
+							Detail: "user has already labeled their active block (they may code it again, so it's left alone)"})
+					}
+					if !item.Active {
+						issue(fsckInactiveLease, blockID, "user's active block isn't marked active")
+						item.Active = true
+						items[blockID] = item
+						changedItems[blockID] = item
+					}
+				}
+			}
+
+			lists := []struct {
+				name string
+				list *BlockIDList
+			}{
+				{"finished", &user.PastWorkItems},
+				{"training", &user.CompleteTrainBlocks},
+				{"reliability", &user.CompleteRelBlocks},
+			}
+			for _, list := range lists {
+				for _, blockID := range append(BlockIDList{}, *list.list...) {
+					if _, exists := items[blockID]; !exists {
+						issue(fsckUnknownBlock, blockID, list.name+" block isn't in the work item map")
+						removeID(list.list, blockID)
+					} else if !coded[blockID][userKey] {
+						issue(fsckMissingLabels, blockID, "user has no labels for their "+list.name+" block")
+						removeID(list.list, blockID)
+					}
+				}
+			}
+
+			if changed {
+				lab.Users[username] = user
+				changedLabs[lab.Key] = lab
+			}
+		}
+	}
+
+	// labels that aren't listed on their coder
+	for _, group := range groups {
+		for _, block := range group.Blocks {
+			lab, labExists := labMap[block.LabKey]
+			var user User
+			userExists := false
+			if labExists {
+				user, userExists = lab.Users[block.Coder]
+			}
+			if !userExists {
+				report.add(FsckIssue{Kind: fsckUnknownCoder, BlockID: group.ID,
+					LabKey: block.LabKey, Username: block.Coder,
+					Detail: fmt.Sprintf("instance %d was coded by a user that doesn't exist", block.Instance)})
+				continue
+			}
+
+			list, listName := &user.PastWorkItems, "finished"
+			if block.Training {
+				list, listName = &user.CompleteTrainBlocks, "training"
+			} else if block.Reliability {
+				list, listName = &user.CompleteRelBlocks, "reliability"
+			}
+			if containsID(*list, group.ID) {
+				continue
+			}
+			report.add(FsckIssue{Kind: fsckUnlistedLabels, BlockID: group.ID,
+				LabKey: block.LabKey, Username: block.Coder,
+				Detail:     "labeled block isn't in the user's " + listName + " list",
+				Repairable: true})
+			list.addID(group.ID)
+			lab.Users[block.Coder] = user
+			changedLabs[lab.Key] = lab
+		}
+	}
+
+	// WorkItems
+	leased := make(map[string]bool)
+	for _, lab := range labs {
+		for _, user := range lab.Users {
+			for _, blockID := range user.ActiveWorkItems {
+				leased[blockID] = true
+			}
+		}
+	}
+
+	var itemIDs []string
+	for id := range items {
+		itemIDs = append(itemIDs, id)
+	}
+	sort.Strings(itemIDs)
+
+	for _, id := range itemIDs {
+		item := items[id]
+		if item.Active && !leased[id] {
+			report.add(FsckIssue{Kind: fsckOrphanedActive, BlockID: id,
+				Detail:     "work item is marked active but no user has it",
+				Repairable: true})
+			item.Active = false
+			changedItems[id] = item
+		}
+
+		timesCoded := 0
+		if group, exists := groupMap[id]; exists {
+			timesCoded = len(group.Blocks)
+		}
+		if item.TimesCoded != timesCoded {
+			report.add(FsckIssue{Kind: fsckTimesCoded, BlockID: id,
+				Detail:     fmt.Sprintf("times_coded is %d, but it has %d labeled instances", item.TimesCoded, timesCoded),
+				Repairable: true})
+			item.TimesCoded = timesCoded
+			changedItems[id] = item
+		}
+		items[id] = item
+	}
+
+	if !repair {
+		return report, nil
+	}
+
+	var writeLabs []*Lab
+	for _, lab := range changedLabs {
+		writeLabs = append(writeLabs, lab)
+	}
+	var writeGroups BlockGroupArray
+	for id := range changedGroups {
+		writeGroups.addBlockGroup(*groupMap[id])
+	}
+	if err := s.writeRecords(writeLabs, writeGroups, changedItems); err != nil {
+		return report, err
+	}
+
+	for _, issue := range report.Issues {
+		if issue.Repairable {
+			report.Repaired++
+		}
+	}
+	return report, s.setWorkItems(changedItems)
+}
+
+func (s *Server) fsckHandler(w http.ResponseWriter, r *http.Request) {
+	var fsckReq FsckReq
+	if !s.decodeRequest(w, r, &fsckReq) {
+		return
+	}
+	annotateRequest(r, fsckReq.AdminLabKey, "", "")
+
+	if !s.config.labIsAdmin(fsckReq.AdminLabKey) {
+		writeError(w, r, ErrAdminKeyRequired, 403)
+		requestLogger(r).Warn("unauthorized lab key")
+		return
+	}
+
+	if fsckReq.Repair {
+		writeError(w, r, ErrRepairWhileRunning, 409)
+		return
+	}
+
+	report, fsckErr := s.fsck(false)
+	if fsckErr != nil {
+		writeError(w, r, fsckErr, 500)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+/*
+fsckCommand checks (and with --repair, fixes)
+the stores of a stopped server:
+
+	$: ./idsserver fsck config.json --repair
+*/
+func fsckCommand(args []string) error {
+	if len(args) < 1 {
+		return ErrMissingCommandArgs
+	}
+	repair := len(args) > 1 && args[1] == "--repair"
+
+	server, err := openServer(args[0])
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	if repair {
+		if _, err := server.migrateSchema(false); err != nil {
+			return err
+		}
+	}
+	server.workItemMap, err = server.work.loadItemMap()
+	if err != nil {
+		return err
+	}
+
+	report, err := server.fsck(repair)
+	if err != nil {
+		return err
+	}
+
+	for _, issue := range report.Issues {
+		who := ""
+		if issue.Username != "" {
+			who = " " + issue.LabKey + ":::" + issue.Username
+		}
+		fmt.Printf("%s %s%s: %s\n", issue.Kind, issue.BlockID, who, issue.Detail)
+	}
+	fmt.Printf("checked %d labs, %d users, %d work items and %d block groups: %d issues",
+		report.Labs, report.Users, report.WorkItems, report.BlockGroups, len(report.Issues))
+	if repair {
+		fmt.Printf(", %d repaired", report.Repaired)
+	}
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFsckRepairs(t *testing.T) {
+	for _, test := range []struct {
+		kind    string
+		corrupt func(t *testing.T, server *Server, alice *User)
+		also    []string // the issues repairing it leads to
+	}{
+		{fsckTimesCoded, func(t *testing.T, server *Server, alice *User) {
+			server.updateWorkItem("a.cha:::1", func(item *WorkItem) { item.TimesCoded = 3 })
+		}, nil},
+		{fsckOrphanedActive, func(t *testing.T, server *Server, alice *User) {
+			server.updateWorkItem("a.cha:::1", func(item *WorkItem) { item.Active = true })
+		}, nil},
+		{fsckInactiveLease, func(t *testing.T, server *Server, alice *User) {
+			alice.ActiveWorkItems.addID("a.cha:::1")
+		}, nil},
+		{fsckUnknownBlock, func(t *testing.T, server *Server, alice *User) {
+			alice.ActiveWorkItems.addID("x.cha:::1")
+		}, nil},
+		{fsckMissingLabels, func(t *testing.T, server *Server, alice *User) {
+			alice.PastWorkItems.addID("a.cha:::1")
+		}, nil},
+		{fsckUnlistedLabels, func(t *testing.T, server *Server, alice *User) {
+			block := Block{ID: "a.cha:::1", ClanFile: "a.cha", Index: 1,
+				LabKey: "lab1", Coder: "alice", Username: "alice"}
+			if err := server.addLabeledBlock(block); err != nil {
+				t.Fatal(err)
+			}
+		}, nil},
+		// alice can't code the block again, so her lease on it is left over
+		{fsckCodedButActive, func(t *testing.T, server *Server, alice *User) {
+			server.config.MaxPassesPerCoder = 1
+			block := Block{ID: "a.cha:::1", ClanFile: "a.cha", Index: 1,
+				LabKey: "lab1", Coder: "alice", Username: "alice"}
+			if err := server.addLabeledBlock(block); err != nil {
+				t.Fatal(err)
+			}
+			server.updateWorkItem("a.cha:::1", func(item *WorkItem) { item.Active = true })
+			alice.ActiveWorkItems.addID("a.cha:::1")
+			alice.PastWorkItems.addID("a.cha:::1")
+		}, []string{fsckOrphanedActive}},
+	} {
+		server := newHandlerTestServer(t, t.TempDir())
+		alice, err := server.getUser("lab1", "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.corrupt(t, server, &alice)
+		if err := server.setUser(alice); err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := server.fsck(false)
+		if err != nil {
+			t.Fatalf("%s: %v", test.kind, err)
+		}
+		want := append([]string{test.kind}, test.also...)
+		var got []string
+		for _, issue := range report.Issues {
+			if issue.Repairable {
+				got = append(got, issue.Kind)
+			}
+		}
+		if len(report.Issues) != len(want) || strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: got %+v", test.kind, report.Issues)
+			continue
+		}
+		if report.Repaired != 0 {
+			t.Errorf("%s: repaired %d without repair", test.kind, report.Repaired)
+		}
+
+		if report, err = server.fsck(true); err != nil || report.Repaired != len(want) {
+			t.Errorf("%s: repaired %d, %v", test.kind, report.Repaired, err)
+		}
+		if report, err = server.fsck(false); err != nil || len(report.Issues) != 0 {
+			t.Errorf("%s: after the repair got %+v, %v", test.kind, report.Issues, err)
+		}
+	}
+}
+
+func TestFsckHandler(t *testing.T) {
+	server := newHandlerTestServer(t, t.TempDir())
+	server.config.AdminKey = "admin"
+
+	for _, test := range []struct {
+		request FsckReq
+		status  int
+		code    string
+	}{
+		{FsckReq{AdminLabKey: "lab1"}, http.StatusForbidden, "admin_key_required"},
+		{FsckReq{AdminLabKey: "admin", Repair: true}, http.StatusConflict, "repair_while_running"},
+	} {
+		recorder := serveTestRequest(t, server, "/v1/fsck/", test.request)
+		checkErrorCode(t, recorder, test.status, test.code)
+	}
+
+	if recorder := serveTestRequest(t, server, "/v1/fsck/", FsckReq{AdminLabKey: "admin"}); recorder.Code != http.StatusOK {
+		t.Errorf("got %d %s", recorder.Code, recorder.Body)
+	}
+}
@@ -2,15 +2,17 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
 	"net/http"
 	"path"
+	"time"
 )
 
-func mainHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "this is the mainHandler")
-
+/*
+mainHandler serves the browser coding interface (web/coder),
+for labs without the desktop client
+*/
+func (s *Server) mainHandler(w http.ResponseWriter, r *http.Request) {
+	coderUI.ServeHTTP(w, r)
 }
 
 /*
@@ -33,6 +35,7 @@ for a particular work item from the database.
 type BlockReq struct {
 	ItemID      string `json:"block_id"`
 	LabKey      string `json:"lab_key"`
+	LabName     string `json:"lab_name"`
 	Username    string `json:"username"`
 	Training    bool   `json:"training"`
 	Reliability bool   `json:"reliability"`
@@ -67,18 +70,17 @@ func (br *IDSRequest) userID() string {
 	return br.LabKey + ":::" + br.Username
 }
 
-func (br *IDSRequest) userFromDB() (User, error) {
-	user, err := labsDB.getUser(br.LabKey, br.Username)
-	return user, err
-}
-
 func (br *BlockReq) userID() string {
 	return br.LabKey + ":::" + br.Username
 }
 
-func (br *BlockReq) userFromDB() (User, error) {
-	user, err := labsDB.getUser(br.LabKey, br.Username)
-	return user, err
+/*
+FileLabelsReq is a request for all the labeled
+blocks that come from a single CLAN file
+*/
+type FileLabelsReq struct {
+	LabKey   string `json:"lab_key"`
+	ClanFile string `json:"clan_file"`
 }
 
 /*
@@ -90,32 +92,18 @@ type ShutdownRequest struct {
 	AdminKey string `json:"admin_key"`
 }
 
-func getBlockHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-	if err != nil {
-		http.Error(w, err.Error(), 400)
-		return
-	}
-
+func (s *Server) getBlockHandler(w http.ResponseWriter, r *http.Request) {
 	var blockReq BlockReq
-
-	jsonDataFromHTTP, err := ioutil.ReadAll(r.Body)
-
-	if err != nil {
-		panic(err)
+	if !s.decodeRequest(w, r, &blockReq, "lab_key", "username") {
+		return
 	}
 
-	fmt.Println()
-	json.Unmarshal(jsonDataFromHTTP, &blockReq)
-
-	fmt.Println(blockReq)
-
-	fmt.Println(blockReq.userID())
+	annotateRequest(r, blockReq.LabKey, blockReq.Username, blockReq.ItemID)
 
 	// make sure the lab is one of the approved labs
-	if !mainConfig.labIsRegistered(blockReq.LabKey) {
-		http.Error(w, ErrLabNotRegistered.Error(), 400)
-		fmt.Println("Unauthorized Lab Key")
+	if !s.config.labIsRegistered(blockReq.LabKey) {
+		writeError(w, r, ErrLabNotRegistered, 401)
+		requestLogger(r).Warn("unauthorized lab key")
 		return
 	}
 
@@ -123,119 +111,95 @@ func getBlockHandler(w http.ResponseWriter, r *http.Request) {
 	var chooseWIErr error
 
 	if blockReq.Training {
-		workItem, chooseWIErr = chooseTrainingWorkItem(blockReq)
-		fmt.Println("got past chooseTrainingWorkItem()")
+		workItem, chooseWIErr = s.chooseTrainingWorkItem(blockReq)
 		if chooseWIErr != nil {
-			fmt.Println("returning error http code from chooseTrainingWorkItem()")
-			http.Error(w, chooseWIErr.Error(), 404)
+			writeError(w, r, chooseWIErr, 500)
 			return
 		}
 	} else if blockReq.Reliability {
-		workItem, chooseWIErr = chooseReliabilityWorkItem(blockReq)
+		workItem, chooseWIErr = s.chooseReliabilityWorkItem(blockReq)
 		if chooseWIErr != nil {
-			http.Error(w, chooseWIErr.Error(), 404)
+			writeError(w, r, chooseWIErr, 500)
 			return
 		}
 	} else {
-		workItem, chooseWIErr = chooseRegularWorkItem(blockReq)
+		workItem, chooseWIErr = s.chooseRegularWorkItem(blockReq)
 		if chooseWIErr != nil {
-			http.Error(w, chooseWIErr.Error(), 404)
+			writeError(w, r, chooseWIErr, 500)
 			return
 		}
 	}
 
-	fmt.Println(workItem)
+	annotateRequest(r, "", "", workItem.ID)
+	requestLogger(r).Info("checked out block", "training", workItem.Training,
+		"reliability", workItem.Reliability)
 	blockPath := workItem.BlockPath
 	blockName := path.Base(blockPath)
 	filename := path.Join(workItem.FileName, blockName)
 
 	dispositionString := "attachment; filename=" + filename
 
-	fmt.Println(workItem)
-
 	w.Header().Set("Content-Type", "application/zip")
 	w.Header().Set("Content-Disposition", dispositionString)
+	w.Header().Set(blockIDHeader, workItem.ID)
+	if workItem.BlockSHA256 != "" {
+		w.Header().Set(blockChecksumHeader, workItem.BlockSHA256)
+	}
 
 	http.ServeFile(w, r, workItem.BlockPath)
 
 }
 
-func getSpecificBlockHandler(w http.ResponseWriter, r *http.Request) {
-	parseFormErr := r.ParseForm()
-	if parseFormErr != nil {
-		http.Error(w, parseFormErr.Error(), 400)
-		return
-	}
-
-	fmt.Println("got a request to download a specific block")
+func (s *Server) getSpecificBlockHandler(w http.ResponseWriter, r *http.Request) {
 	var blockReq BlockReq
-
-	jsonDataFromHTTP, readBodyErr := ioutil.ReadAll(r.Body)
-	if readBodyErr != nil {
-		http.Error(w, readBodyErr.Error(), 400)
-		return
-	}
-
-	fmt.Println()
-	unmarshalErr := json.Unmarshal(jsonDataFromHTTP, &blockReq)
-	if unmarshalErr != nil {
-		http.Error(w, unmarshalErr.Error(), 400)
+	if !s.decodeRequest(w, r, &blockReq, "lab_key", "username", "block_id") {
 		return
 	}
-	fmt.Println(blockReq)
+	annotateRequest(r, blockReq.LabKey, blockReq.Username, blockReq.ItemID)
 
 	// make sure the lab is one of the approved labs
-	if !mainConfig.labIsRegistered(blockReq.LabKey) {
-		http.Error(w, ErrLabNotRegistered.Error(), 400)
-		fmt.Println("Unauthorized Lab Key")
+	if !s.config.labIsRegistered(blockReq.LabKey) {
+		writeError(w, r, ErrLabNotRegistered, 401)
+		requestLogger(r).Warn("unauthorized lab key")
 		return
 	}
 
-	workItem, chooseWIErr := chooseSpecificBlock(blockReq)
+	workItem, chooseWIErr := s.chooseSpecificBlock(blockReq)
 
 	if chooseWIErr != nil {
-		fmt.Println("returning error http code from chooseSpecificBlock()")
-		http.Error(w, chooseWIErr.Error(), 404)
+		writeError(w, r, chooseWIErr, 500)
 		return
 	}
 
-	fmt.Println(workItem)
+	annotateRequest(r, "", "", workItem.ID)
+	requestLogger(r).Info("checked out block", "training", workItem.Training,
+		"reliability", workItem.Reliability)
 	blockPath := workItem.BlockPath
 	blockName := path.Base(blockPath)
 	filename := path.Join(workItem.FileName, blockName)
 
 	dispositionString := "attachment; filename=" + filename
 
-	fmt.Println(workItem)
-
 	w.Header().Set("Content-Type", "application/zip")
 	w.Header().Set("Content-Disposition", dispositionString)
+	w.Header().Set(blockIDHeader, workItem.ID)
+	if workItem.BlockSHA256 != "" {
+		w.Header().Set(blockChecksumHeader, workItem.BlockSHA256)
+	}
 
 	http.ServeFile(w, r, workItem.BlockPath)
 
 }
 
-func labInfoHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-	if err != nil {
-		http.Error(w, err.Error(), 400)
-		return
-	}
-
+func (s *Server) labInfoHandler(w http.ResponseWriter, r *http.Request) {
 	var labInfoReq IDSRequest
-
-	jsonDataFromHTTP, err := ioutil.ReadAll(r.Body)
-
-	if err != nil {
-		panic(err)
+	if !s.decodeRequest(w, r, &labInfoReq, "lab_key") {
+		return
 	}
 
-	fmt.Println()
-	json.Unmarshal(jsonDataFromHTTP, &labInfoReq)
-
-	lab, getLabErr := labsDB.getLab(labInfoReq.LabKey)
+	lab, getLabErr := s.labs.getLab(labInfoReq.LabKey)
 	if getLabErr != nil {
-		http.Error(w, getLabErr.Error(), 500)
+		writeError(w, r, getLabErr, 500)
 		return
 	}
 
@@ -243,342 +207,318 @@ func labInfoHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func allLabInfoHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-	if err != nil {
-		http.Error(w, err.Error(), 400)
+func (s *Server) allLabInfoHandler(w http.ResponseWriter, r *http.Request) {
+	var labInfoReq IDSRequest
+	if !s.decodeRequest(w, r, &labInfoReq) {
 		return
 	}
 
-	var labInfoReq IDSRequest
-
-	jsonDataFromHTTP, err := ioutil.ReadAll(r.Body)
-
-	if err != nil {
-		panic(err)
+	labs, getLabsErr := s.labs.getAllLabs()
+	if getLabsErr != nil {
+		writeError(w, r, getLabsErr, 500)
+		return
 	}
 
-	fmt.Println()
-	json.Unmarshal(jsonDataFromHTTP, &labInfoReq)
-
-	labs := labsDB.getAllLabs()
-
-	fmt.Println(labsDB)
-
 	json.NewEncoder(w).Encode(labs)
 
 }
 
-func addUserHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-	if err != nil {
-		http.Error(w, err.Error(), 400)
-		return
-	}
-
+func (s *Server) addUserHandler(w http.ResponseWriter, r *http.Request) {
 	var addUserReq IDSRequest
-
-	jsonDataFromHTTP, err := ioutil.ReadAll(r.Body)
-
-	if err != nil {
-		panic(err)
+	if !s.decodeRequest(w, r, &addUserReq, "lab_key", "username") {
+		return
 	}
-
-	fmt.Println()
-	json.Unmarshal(jsonDataFromHTTP, &addUserReq)
-	fmt.Println(addUserReq)
+	annotateRequest(r, addUserReq.LabKey, addUserReq.Username, "")
 
 	// make sure the lab is one of the approved labs
-	if !mainConfig.labIsRegistered(addUserReq.LabKey) {
-		http.Error(w, ErrLabNotRegistered.Error(), 400)
-		fmt.Println("Unauthorized Lab Key")
+	if !s.config.labIsRegistered(addUserReq.LabKey) {
+		writeError(w, r, ErrLabNotRegistered, 401)
+		requestLogger(r).Warn("unauthorized lab key")
 		return
 	}
-	labsDB.addUser(addUserReq.LabKey, addUserReq.LabName, addUserReq.Username)
-
-}
-
-func submitLabelsHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-	if err != nil {
-		http.Error(w, err.Error(), 400)
+	addUserErr := s.addUser(addUserReq.LabKey, addUserReq.LabName, addUserReq.Username)
+	if addUserErr != nil {
+		writeError(w, r, addUserErr, 500)
 		return
 	}
 
-	fmt.Println("got a submission request")
-	var block Block
-	jsonDataFromHTTP, err := ioutil.ReadAll(r.Body)
-
-	fmt.Println()
+}
 
-	if err != nil {
-		panic(err)
+func (s *Server) submitLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	var block Block
+	if !s.decodeRequest(w, r, &block) {
+		return
 	}
+	annotateRequest(r, block.LabKey, block.Coder, block.ID)
 
-	json.Unmarshal(jsonDataFromHTTP, &block)
-	fmt.Printf("\n%#v", block)
-
-	if !labsDB.userExists(block.LabKey, block.Coder) {
-		fmt.Println("userExists failed")
-		http.Error(w, ErrUserDoesntExist.Error(), 500)
+	if !s.userExists(block.LabKey, block.Coder) {
+		writeError(w, r, ErrUserDoesntExist, 404)
 		return
 	}
 
-	workItem := workItemMap[block.ID]
+	workItem, _ := s.workItem(block.ID)
 	request := IDSRequest{
 		LabKey:   block.LabKey,
 		LabName:  block.LabName,
 		Username: block.Coder,
 	}
 
+	// the labels were made against the zip with the checksum the
+	// client got, if that's not the one on disk the audio changed
+	if block.BlockSHA256 != "" && workItem.BlockSHA256 != "" &&
+		block.BlockSHA256 != workItem.BlockSHA256 {
+		requestLogger(r).Warn("block checksum mismatch", "submitted", block.BlockSHA256,
+			"recorded", workItem.BlockSHA256)
+		writeError(w, r, ErrBlockChecksumMismatch, 409)
+		return
+	}
+	block.BlockSHA256 = workItem.BlockSHA256
+	block.Submitted = time.Now().UTC()
+	if user, getUserErr := s.getUser(block.LabKey, block.Coder); getUserErr == nil {
+		block.CheckedOut, _ = user.checkedOutAt(block.ID)
+	}
+
 	if block.Training {
 
-		user, getUserErr := labsDB.getUser(block.LabKey, block.Username)
+		user, getUserErr := s.getUser(block.LabKey, block.Username)
 		if getUserErr != nil {
-			fmt.Println("getUser failed")
-			http.Error(w, getUserErr.Error(), 400)
+			writeError(w, r, getUserErr, 400)
 			return
 		}
 		user.addCompleteTrainBlock(block)
 
-		setUserErr := labsDB.setUser(user)
+		setUserErr := s.setUser(user)
 		if setUserErr != nil {
-			fmt.Println("setUser failed")
-			http.Error(w, getUserErr.Error(), 400)
+			writeError(w, r, setUserErr, 500)
 			return
 		}
 
 	} else if block.Reliability {
 
-		user, getUserErr := labsDB.getUser(block.LabKey, block.Username)
+		user, getUserErr := s.getUser(block.LabKey, block.Username)
 		if getUserErr != nil {
-			fmt.Println("getUser failed")
-			http.Error(w, getUserErr.Error(), 400)
+			writeError(w, r, getUserErr, 400)
 			return
 		}
 
 		user.addCompleteRelBlock(block)
 
-		setUserErr := labsDB.setUser(user)
+		setUserErr := s.setUser(user)
 		if setUserErr != nil {
-			fmt.Println("setUser failed")
-			http.Error(w, getUserErr.Error(), 400)
+			writeError(w, r, setUserErr, 500)
 			return
 		}
 	}
 
-	addBlockErr := labelsDB.addBlock(block)
+	addBlockErr := s.addLabeledBlock(block)
 	if addBlockErr != nil {
-		http.Error(w, addBlockErr.Error(), 400)
+		writeError(w, r, addBlockErr, 400)
 		return
 	}
-	inactivateWorkItem(workItem, request)
-}
-
-func getLabelsHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-	if err != nil {
-		http.Error(w, err.Error(), 400)
+	inactivateErr := s.inactivateWorkItem(workItem, request)
+	if inactivateErr != nil {
+		writeError(w, r, inactivateErr, 500)
 		return
 	}
+	s.metrics.countWorkItem(submitEvent, workItem)
+	requestLogger(r).Info("submitted labels", "instance", block.Instance, "clips", len(block.Clips))
+}
 
-	fmt.Println("got a request for work item data")
+func (s *Server) getLabelsHandler(w http.ResponseWriter, r *http.Request) {
 	var blockReq BlockReq
-
-	jsonDataFromHTTP, err := ioutil.ReadAll(r.Body)
-
-	fmt.Println()
-
-	if err != nil {
-		panic(err)
+	if !s.decodeRequest(w, r, &blockReq, "lab_key", "username", "block_id") {
+		return
 	}
+	annotateRequest(r, blockReq.LabKey, blockReq.Username, blockReq.ItemID)
 
-	fmt.Println()
-	json.Unmarshal(jsonDataFromHTTP, &blockReq)
-	fmt.Println(blockReq)
-
-	blockGroup, getBlockErr := labelsDB.getBlock(blockReq.ItemID)
+	blockGroup, getBlockErr := s.labels.getBlock(blockReq.ItemID)
 	if getBlockErr != nil {
-		http.Error(w, ErrWorkItemDoesntExist.Error(), 400)
+		writeError(w, r, ErrWorkItemDoesntExist, 404)
 		return
 	}
 	blocks := blockGroup.getUsersBlocks(blockReq.LabKey, blockReq.Username)
-
-	fmt.Println(blocks)
 	json.NewEncoder(w).Encode(blocks)
 }
 
-func getLabLabelsHandler(w http.ResponseWriter, r *http.Request) {
-	parseErr := r.ParseForm()
-	if parseErr != nil {
-		http.Error(w, parseErr.Error(), 400)
-		return
-	}
-
-	fmt.Println("got a request for all labeled blocks")
+func (s *Server) getLabLabelsHandler(w http.ResponseWriter, r *http.Request) {
 	var idsRequest IDSRequest
-
-	jsonDataFromHTTP, err := ioutil.ReadAll(r.Body)
-
-	fmt.Println()
-
-	if err != nil {
-		panic(err)
+	if !s.decodeRequest(w, r, &idsRequest, "lab_key") {
+		return
 	}
-
-	fmt.Println()
-	json.Unmarshal(jsonDataFromHTTP, &idsRequest)
-	fmt.Println(idsRequest)
+	annotateRequest(r, idsRequest.LabKey, idsRequest.Username, "")
 
 	// make sure the lab is one of the approved labs
-	if !mainConfig.labIsRegistered(idsRequest.LabKey) {
-		http.Error(w, ErrLabNotRegistered.Error(), 400)
-		fmt.Println("Unauthorized Lab Key")
+	if !s.config.labIsRegistered(idsRequest.LabKey) {
+		writeError(w, r, ErrLabNotRegistered, 401)
+		requestLogger(r).Warn("unauthorized lab key")
 		return
 	}
 
-	blockIDs, getIdsErr := labsDB.getCompletedBlocks(idsRequest.LabKey)
+	blockIDs, getIdsErr := s.labels.getLabBlockIDs(idsRequest.LabKey)
 	if getIdsErr != nil {
-		http.Error(w, getIdsErr.Error(), 400)
-		fmt.Println("getCompletedBlocks failed")
+		writeError(w, r, getIdsErr, 400)
 		return
 	}
 
-	blocks, getBlocksErr := labelsDB.getBlockGroup(blockIDs)
+	blocks, getBlocksErr := s.labels.getBlockGroup(blockIDs)
 	if getBlocksErr != nil {
-		http.Error(w, getBlocksErr.Error(), 400)
+		writeError(w, r, getBlocksErr, 400)
 		return
 	}
 
 	labBlocks, labBlocksErr := blocks.filterLab(idsRequest.LabKey)
 	if labBlocksErr != nil {
-		http.Error(w, labBlocksErr.Error(), 400)
+		writeError(w, r, labBlocksErr, 400)
 		return
 	}
 
 	json.NewEncoder(w).Encode(labBlocks)
 }
 
-func getAllLabelsHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-	if err != nil {
-		http.Error(w, err.Error(), 400)
+func (s *Server) getFileLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	var fileLabelsReq FileLabelsReq
+	if !s.decodeRequest(w, r, &fileLabelsReq) {
 		return
 	}
-
-	fmt.Println("got a request for all labeled blocks")
-	var idsRequest IDSRequest
-
-	jsonDataFromHTTP, err := ioutil.ReadAll(r.Body)
-
-	fmt.Println()
-
-	if err != nil {
-		panic(err)
-	}
-
-	fmt.Println()
-	json.Unmarshal(jsonDataFromHTTP, &idsRequest)
-	fmt.Println(idsRequest)
+	annotateRequest(r, fileLabelsReq.LabKey, "", "")
 
 	// make sure the lab is one of the approved labs
-	if !mainConfig.labIsRegistered(idsRequest.LabKey) {
-		http.Error(w, ErrLabNotRegistered.Error(), 400)
-		fmt.Println("Unauthorized Lab Key")
+	if !s.config.labIsRegistered(fileLabelsReq.LabKey) {
+		writeError(w, r, ErrLabNotRegistered, 401)
+		requestLogger(r).Warn("unauthorized lab key")
 		return
 	}
 
-	//blockIDs := getAllCompleteBlockIDs()
-	blocks, getBlocksErr := labelsDB.getAllBlockGroups()
+	blockIDs, getIdsErr := s.labels.getFileBlockIDs(fileLabelsReq.ClanFile)
+	if getIdsErr != nil {
+		writeError(w, r, getIdsErr, 400)
+		return
+	}
 
+	blocks, getBlocksErr := s.labels.getBlockGroup(blockIDs)
 	if getBlocksErr != nil {
-		http.Error(w, getBlocksErr.Error(), 400)
+		writeError(w, r, getBlocksErr, 400)
 		return
 	}
 
 	json.NewEncoder(w).Encode(blocks)
 }
 
-func submitWOLabelsHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-	if err != nil {
-		http.Error(w, err.Error(), 400)
+func (s *Server) getAllLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	var pageReq PageReq
+	if !s.decodeRequest(w, r, &pageReq) {
 		return
 	}
+	annotateRequest(r, pageReq.LabKey, "", "")
 
-	fmt.Println("got a request for work item data")
-	var workItemRelReq WorkItemReleaseReq
+	// make sure the lab is one of the approved labs
+	if !s.config.labIsRegistered(pageReq.LabKey) {
+		writeError(w, r, ErrLabNotRegistered, 401)
+		requestLogger(r).Warn("unauthorized lab key")
+		return
+	}
+	if pageErr := pageReq.validate(); pageErr != nil {
+		writeError(w, r, pageErr, 400)
+		return
+	}
+
+	if pageReq.streaming() {
+		streamErr := streamNDJSON(w, pageReq.After, pageReq.Limit,
+			func(after string, limit int, encoder *json.Encoder) (string, int, error) {
+				blocks, next, getBlocksErr := s.labels.getBlockGroupPage(after, limit)
+				if getBlocksErr != nil {
+					return "", 0, getBlocksErr
+				}
+				for _, block := range blocks {
+					if encodeErr := encoder.Encode(block); encodeErr != nil {
+						return "", 0, encodeErr
+					}
+				}
+				return next, len(blocks), nil
+			})
+		if streamErr != nil {
+			requestLogger(r).Error("streaming labeled blocks failed", "error", streamErr)
+		}
+		return
+	}
 
-	jsonDataFromHTTP, err := ioutil.ReadAll(r.Body)
+	if pageReq.paginated() {
+		blocks, next, getBlocksErr := s.labels.getBlockGroupPage(pageReq.After, pageReq.pageSize())
+		if getBlocksErr != nil {
+			writeError(w, r, getBlocksErr, 400)
+			return
+		}
+		json.NewEncoder(w).Encode(BlockGroupPage{BlockGroups: blocks, Next: next})
+		return
+	}
 
-	fmt.Println()
+	//blockIDs := getAllCompleteBlockIDs()
+	blocks, getBlocksErr := s.labels.getAllBlockGroups()
 
-	if err != nil {
-		panic(err)
+	if getBlocksErr != nil {
+		writeError(w, r, getBlocksErr, 400)
+		return
 	}
 
-	fmt.Println()
-	json.Unmarshal(jsonDataFromHTTP, &workItemRelReq)
-	fmt.Println(workItemRelReq)
+	json.NewEncoder(w).Encode(blocks)
+}
 
-	if !labsDB.userExists(workItemRelReq.LabKey, workItemRelReq.Username) {
-		http.Error(w, ErrUserDoesntExist.Error(), 500)
+func (s *Server) submitWOLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	var workItemRelReq WorkItemReleaseReq
+	if !s.decodeRequest(w, r, &workItemRelReq, "lab_key", "username", "blocks") {
+		return
+	}
+	annotateRequest(r, workItemRelReq.LabKey, workItemRelReq.Username, "")
+
+	if !s.userExists(workItemRelReq.LabKey, workItemRelReq.Username) {
+		writeError(w, r, ErrUserDoesntExist, 404)
 		return
 	}
 
 	for _, block := range workItemRelReq.BlockIds {
 
-		workItem := workItemMap[block]
+		workItem, _ := s.workItem(block)
 		request := IDSRequest{
 			LabKey:   workItemRelReq.LabKey,
 			LabName:  workItemRelReq.LabName,
 			Username: workItemRelReq.Username,
 		}
 
-		inactivateIncompleteWorkItem(workItem, request)
+		inactivateErr := s.inactivateIncompleteWorkItem(workItem, request)
+		if inactivateErr != nil {
+			writeError(w, r, inactivateErr, 500)
+			return
+		}
 	}
+	requestLogger(r).Info("released blocks", "blocks", workItemRelReq.BlockIds)
 }
 
-func getTrainingLabelsHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-	if err != nil {
-		http.Error(w, err.Error(), 400)
-		return
-	}
-
-	fmt.Println("got a request for all training blocks")
+func (s *Server) getTrainingLabelsHandler(w http.ResponseWriter, r *http.Request) {
 	var idsRequest IDSRequest
-
-	jsonDataFromHTTP, err := ioutil.ReadAll(r.Body)
-
-	fmt.Println()
-
-	if err != nil {
-		panic(err)
+	if !s.decodeRequest(w, r, &idsRequest, "lab_key") {
+		return
 	}
-
-	fmt.Println()
-	json.Unmarshal(jsonDataFromHTTP, &idsRequest)
-	fmt.Println(idsRequest)
+	annotateRequest(r, idsRequest.LabKey, idsRequest.Username, "")
 
 	// make sure the lab is one of the approved labs
-	if !mainConfig.labIsRegistered(idsRequest.LabKey) {
-		http.Error(w, ErrLabNotRegistered.Error(), 400)
-		fmt.Println("Unauthorized Lab Key")
+	if !s.config.labIsRegistered(idsRequest.LabKey) {
+		writeError(w, r, ErrLabNotRegistered, 401)
+		requestLogger(r).Warn("unauthorized lab key")
 		return
 	}
 
 	// Get Block ID's for all training blocks completed by lab users
-	blockIDs, getBlockIDsErr := labsDB.getCompleteTrainBlocks(idsRequest.LabKey)
-	if getBlockIDsErr != nil {
-		http.Error(w, getBlockIDsErr.Error(), 400)
+	lab, getLabErr := s.labs.getLab(idsRequest.LabKey)
+	if getLabErr != nil {
+		writeError(w, r, getLabErr, 400)
 		return
 	}
+	blockIDs := lab.getCompleteTrainBlocks()
 
 	// Get all the BlockGroups with those ID's
-	blockGroups, getGroupsErr := labelsDB.getBlockGroup(blockIDs)
+	blockGroups, getGroupsErr := s.labels.getBlockGroup(blockIDs)
 	if getGroupsErr != nil {
-		http.Error(w, getGroupsErr.Error(), 400)
+		writeError(w, r, getGroupsErr, 400)
 		return
 	}
 
@@ -586,52 +526,38 @@ func getTrainingLabelsHandler(w http.ResponseWriter, r *http.Request) {
 	// labBlocks is a BlockArray (array of Block)
 	labBlocks, labBlocksErr := blockGroups.filterLab(idsRequest.LabKey)
 	if labBlocksErr != nil {
-		http.Error(w, labBlocksErr.Error(), 400)
+		writeError(w, r, labBlocksErr, 400)
 		return
 	}
 	json.NewEncoder(w).Encode(labBlocks)
 }
 
-func getReliabilityHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-	if err != nil {
-		http.Error(w, err.Error(), 400)
-		return
-	}
-
-	fmt.Println("got a request for all training blocks")
+func (s *Server) getReliabilityHandler(w http.ResponseWriter, r *http.Request) {
 	var idsRequest IDSRequest
-
-	jsonDataFromHTTP, err := ioutil.ReadAll(r.Body)
-
-	fmt.Println()
-
-	if err != nil {
-		panic(err)
+	if !s.decodeRequest(w, r, &idsRequest, "lab_key") {
+		return
 	}
-
-	fmt.Println()
-	json.Unmarshal(jsonDataFromHTTP, &idsRequest)
-	fmt.Println(idsRequest)
+	annotateRequest(r, idsRequest.LabKey, idsRequest.Username, "")
 
 	// make sure the lab is one of the approved labs
-	if !mainConfig.labIsRegistered(idsRequest.LabKey) {
-		http.Error(w, ErrLabNotRegistered.Error(), 400)
-		fmt.Println("Unauthorized Lab Key")
+	if !s.config.labIsRegistered(idsRequest.LabKey) {
+		writeError(w, r, ErrLabNotRegistered, 401)
+		requestLogger(r).Warn("unauthorized lab key")
 		return
 	}
 
 	// Get Block ID's for all reliability blocks completed by lab users
-	blockIDs, getBlockIDsErr := labsDB.getCompleteReliaBlocks(idsRequest.LabKey)
-	if getBlockIDsErr != nil {
-		http.Error(w, getBlockIDsErr.Error(), 400)
+	lab, getLabErr := s.labs.getLab(idsRequest.LabKey)
+	if getLabErr != nil {
+		writeError(w, r, getLabErr, 400)
 		return
 	}
+	blockIDs := lab.getCompleteReliaBlocks()
 
 	// Get all the BlockGroups with those ID's
-	blockGroups, getGroupsErr := labelsDB.getBlockGroup(blockIDs)
+	blockGroups, getGroupsErr := s.labels.getBlockGroup(blockIDs)
 	if getGroupsErr != nil {
-		http.Error(w, getGroupsErr.Error(), 400)
+		writeError(w, r, getGroupsErr, 400)
 		return
 	}
 
@@ -639,36 +565,27 @@ func getReliabilityHandler(w http.ResponseWriter, r *http.Request) {
 	// labBlocks is a BlockArray (array of Block)
 	labBlocks, labBlocksErr := blockGroups.filterLab(idsRequest.LabKey)
 	if labBlocksErr != nil {
-		http.Error(w, labBlocksErr.Error(), 400)
+		writeError(w, r, labBlocksErr, 400)
 		return
 	}
 
 	json.NewEncoder(w).Encode(labBlocks)
 }
 
-func deleteBlockHandler(w http.ResponseWriter, r *http.Request) {
-	parseFormErr := r.ParseForm()
-	if parseFormErr != nil {
-		http.Error(w, parseFormErr.Error(), 400)
+func (s *Server) deleteBlockHandler(w http.ResponseWriter, r *http.Request) {
+	var deleteBlockReq DeleteBlockRequest
+	if !s.decodeRequest(w, r, &deleteBlockReq) {
 		return
 	}
-
-	fmt.Println("got a delete blocks request")
-	var deleteBlockReq DeleteBlockRequest
-
-	jsonDataFromHTTP, readBodyErr := ioutil.ReadAll(r.Body)
-	if readBodyErr != nil {
-		http.Error(w, readBodyErr.Error(), 400)
+	required, deleteTypeErr := deleteBlockReq.required()
+	if deleteTypeErr != nil {
+		writeError(w, r, deleteTypeErr, 400)
 		return
 	}
-
-	fmt.Println()
-	unmarshalErr := json.Unmarshal(jsonDataFromHTTP, &deleteBlockReq)
-	if unmarshalErr != nil {
-		http.Error(w, unmarshalErr.Error(), 400)
+	if !requireFields(w, r, &deleteBlockReq, required...) {
 		return
 	}
-	fmt.Println(deleteBlockReq)
+	annotateRequest(r, deleteBlockReq.LabKey, deleteBlockReq.Coder, deleteBlockReq.BlockID)
 
 	labKey := deleteBlockReq.LabKey
 	coder := deleteBlockReq.Coder
@@ -677,101 +594,103 @@ func deleteBlockHandler(w http.ResponseWriter, r *http.Request) {
 	deleteType := deleteBlockReq.Type
 
 	// make sure the lab is one of the approved labs
-	if !mainConfig.labIsRegistered(labKey) {
-		http.Error(w, ErrLabNotRegistered.Error(), 400)
-		fmt.Println("Unauthorized Lab Key")
+	if !s.config.labIsRegistered(labKey) {
+		writeError(w, r, ErrLabNotRegistered, 401)
+		requestLogger(r).Warn("unauthorized lab key")
 		return
 	}
 
 	if deleteType == "single" {
-		deleteSingleBlockErr := labelsDB.deleteSingleBlock(labKey, coder, blockID, instance)
+		deleteSingleBlockErr := s.deleteSingleBlock(labKey, coder, blockID, instance)
 		if deleteSingleBlockErr != nil {
-			http.Error(w, deleteSingleBlockErr.Error(), 400)
+			writeError(w, r, deleteSingleBlockErr, 400)
 			return
 		}
 	} else if deleteType == "user" {
 
-		deleteUserErr := labelsDB.deleteUserBlocks(labKey, coder)
+		deleteUserErr := s.deleteUserBlocks(labKey, coder)
 		if deleteUserErr != nil {
-			http.Error(w, deleteUserErr.Error(), 400)
+			writeError(w, r, deleteUserErr, 400)
 			return
 		}
 	} else if deleteType == "lab" {
-		deleteLabErr := labelsDB.deleteLabBlocks(labKey)
+		deleteLabErr := s.deleteLabBlocks(labKey)
 		if deleteLabErr != nil {
-			http.Error(w, deleteLabErr.Error(), 400)
+			writeError(w, r, deleteLabErr, 400)
 		}
 	}
 }
 
-func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
-	parseFormErr := r.ParseForm()
-	if parseFormErr != nil {
-		http.Error(w, parseFormErr.Error(), 400)
-		return
-	}
-
-	fmt.Println("got a delete blocks request")
+func (s *Server) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	var deleteUserReq IDSRequest
-
-	jsonDataFromHTTP, readBodyErr := ioutil.ReadAll(r.Body)
-	if readBodyErr != nil {
-		http.Error(w, readBodyErr.Error(), 400)
+	if !s.decodeRequest(w, r, &deleteUserReq, "lab_key", "username") {
 		return
 	}
-
-	fmt.Println()
-	unmarshalErr := json.Unmarshal(jsonDataFromHTTP, &deleteUserReq)
-	if unmarshalErr != nil {
-		http.Error(w, unmarshalErr.Error(), 400)
-		return
-	}
-	fmt.Println(deleteUserReq)
+	annotateRequest(r, deleteUserReq.LabKey, deleteUserReq.Username, "")
 
 	// make sure the lab is one of the approved labs
-	if !mainConfig.labIsRegistered(deleteUserReq.LabKey) {
-		http.Error(w, ErrLabNotRegistered.Error(), 400)
-		fmt.Println("Unauthorized Lab Key")
+	if !s.config.labIsRegistered(deleteUserReq.LabKey) {
+		writeError(w, r, ErrLabNotRegistered, 401)
+		requestLogger(r).Warn("unauthorized lab key")
 		return
 	}
 
-	deleteUserErr := labsDB.deleteUser(deleteUserReq.LabKey, deleteUserReq.Username)
+	deleteUserErr := s.deleteUser(deleteUserReq.LabKey, deleteUserReq.Username)
 	if deleteUserErr != nil {
-		http.Error(w, deleteUserErr.Error(), 400)
+		writeError(w, r, deleteUserErr, 400)
 		return
 	}
 }
 
-func getWorkItemMapHandler(w http.ResponseWriter, r *http.Request) {
-	parseFormErr := r.ParseForm()
-	if parseFormErr != nil {
-		http.Error(w, parseFormErr.Error(), 400)
+func (s *Server) getWorkItemMapHandler(w http.ResponseWriter, r *http.Request) {
+	var pageReq PageReq
+	if !s.decodeRequest(w, r, &pageReq) {
 		return
 	}
+	annotateRequest(r, pageReq.LabKey, "", "")
 
-	fmt.Println("got a request for the WorkItem map")
-	var idsRequest IDSRequest
-
-	jsonDataFromHTTP, readBodyErr := ioutil.ReadAll(r.Body)
-
-	fmt.Println()
-
-	if readBodyErr != nil {
-		http.Error(w, readBodyErr.Error(), 400)
+	// make sure the lab is one of the approved labs
+	if !s.config.labIsRegistered(pageReq.LabKey) {
+		writeError(w, r, ErrLabNotRegistered, 401)
+		requestLogger(r).Warn("unauthorized lab key")
+		return
+	}
+	if pageErr := pageReq.validate(); pageErr != nil {
+		writeError(w, r, pageErr, 400)
+		return
+	}
+
+	if pageReq.streaming() {
+		streamErr := streamNDJSON(w, pageReq.After, pageReq.Limit,
+			func(after string, limit int, encoder *json.Encoder) (string, int, error) {
+				items, next, getItemsErr := s.work.getWorkItemPage(after, limit)
+				if getItemsErr != nil {
+					return "", 0, getItemsErr
+				}
+				for _, item := range items {
+					if encodeErr := encoder.Encode(item); encodeErr != nil {
+						return "", 0, encodeErr
+					}
+				}
+				return next, len(items), nil
+			})
+		if streamErr != nil {
+			requestLogger(r).Error("streaming the WorkItem map failed", "error", streamErr)
+		}
 		return
 	}
 
-	fmt.Println()
-	json.Unmarshal(jsonDataFromHTTP, &idsRequest)
-	fmt.Println(idsRequest)
-
-	// make sure the lab is one of the approved labs
-	if !mainConfig.labIsRegistered(idsRequest.LabKey) {
-		http.Error(w, ErrLabNotRegistered.Error(), 400)
-		fmt.Println("Unauthorized Lab Key")
+	if pageReq.paginated() {
+		items, next, getItemsErr := s.work.getWorkItemPage(pageReq.After, pageReq.pageSize())
+		if getItemsErr != nil {
+			writeError(w, r, getItemsErr, 400)
+			return
+		}
+		json.NewEncoder(w).Encode(WorkItemPage{WorkItems: items, Next: next})
 		return
 	}
-	w.Write(workItemMapEncoded)
+
+	w.Write(s.encodedWorkItemMap())
 
 	// json.NewEncoder(w).Encode(labBlocks)
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+newHandlerTestServer is a server on the in-memory stores with
+one regular block, whose zip is in dir, and a user in each of
+lab1 (alice) and lab2 (bob)
+*/
+func newHandlerTestServer(t *testing.T, dir string) *Server {
+	server := newServer(Config{Labs: []string{"lab1", "lab2"}, WorkMapLoaded: true},
+		NewMemLabsDB(), NewMemWorkDB(), NewMemLabelsDB())
+
+	blockPath := filepath.Join(dir, "1.zip")
+	if err := os.WriteFile(blockPath, []byte("block zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	items := WorkItemMap{
+		"a.cha:::1": {ID: "a.cha:::1", FileName: "a.cha", Block: 1, BlockPath: blockPath,
+			BlockSHA256: "abc"},
+	}
+	if err := server.work.persistWorkItemMap(items); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.setWorkItems(items); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []struct{ lab, name string }{{"lab1", "alice"}, {"lab2", "bob"}} {
+		if err := server.addUser(user.lab, "Lab "+user.lab, user.name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return server
+}
+
+// serveTestRequest POSTs v, as JSON, to the server's endpoint at url
+func serveTestRequest(t *testing.T, server *Server, url string, v interface{}) *httptest.ResponseRecorder {
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	server.routes().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, url, bytes.NewReader(body)))
+	return recorder
+}
+
+// checkErrorCode fails the test if the response isn't the error with the status and code
+func checkErrorCode(t *testing.T, recorder *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	var apiErr APIError
+	json.Unmarshal(recorder.Body.Bytes(), &apiErr)
+	if recorder.Code != status || apiErr.Code != code {
+		t.Errorf("got %d %s, want %d %s", recorder.Code, recorder.Body, status, code)
+	}
+}
+
+func TestGetBlockHandler(t *testing.T) {
+	server := newHandlerTestServer(t, t.TempDir())
+
+	recorder := serveTestRequest(t, server, "/v1/get-block/", BlockReq{LabKey: "lab1", Username: "alice"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got %d %s", recorder.Code, recorder.Body)
+	}
+	if recorder.Body.String() != "block zip" ||
+		recorder.Header().Get(blockIDHeader) != "a.cha:::1" ||
+		recorder.Header().Get(blockChecksumHeader) != "abc" {
+		t.Errorf("got %v %q", recorder.Header(), recorder.Body)
+	}
+	if item, _ := server.workItem("a.cha:::1"); !item.Active {
+		t.Error("block isn't active after get-block")
+	}
+	if alice, _ := server.getUser("lab1", "alice"); !alice.hasThisBlock("a.cha:::1") {
+		t.Errorf("alice doesn't have the block: %+v", alice)
+	}
+
+	// the only block is checked out
+	recorder = serveTestRequest(t, server, "/v1/get-block/", BlockReq{LabKey: "lab2", Username: "bob"})
+	checkErrorCode(t, recorder, http.StatusNotFound, "no_blocks_available")
+
+	recorder = serveTestRequest(t, server, "/v1/get-block/", BlockReq{LabKey: "lab3", Username: "bob"})
+	checkErrorCode(t, recorder, http.StatusUnauthorized, "lab_not_registered")
+
+	recorder = serveTestRequest(t, server, "/v1/get-block/", BlockReq{LabKey: "lab1"})
+	checkErrorCode(t, recorder, http.StatusBadRequest, "missing_fields")
+}
+
+func TestSubmitLabelsHandler(t *testing.T) {
+	server := newHandlerTestServer(t, t.TempDir())
+	if recorder := serveTestRequest(t, server, "/v1/get-block/",
+		BlockReq{LabKey: "lab1", Username: "alice"}); recorder.Code != http.StatusOK {
+		t.Fatalf("got %d %s", recorder.Code, recorder.Body)
+	}
+
+	block := Block{ID: "a.cha:::1", ClanFile: "a.cha", Index: 1, BlockSHA256: "abc",
+		LabKey: "lab1", LabName: "Lab lab1", Coder: "alice", Username: "alice",
+		Clips: []Clip{{Index: 0, Tier: "CHN", Classification: "IDS"}}}
+
+	// labels for a different zip than the one on the server
+	mismatched := block
+	mismatched.BlockSHA256 = "def"
+	recorder := serveTestRequest(t, server, "/v1/submit-labels/", mismatched)
+	checkErrorCode(t, recorder, http.StatusConflict, "block_checksum_mismatch")
+
+	unknown := block
+	unknown.Coder = "nobody"
+	recorder = serveTestRequest(t, server, "/v1/submit-labels/", unknown)
+	checkErrorCode(t, recorder, http.StatusNotFound, "user_not_found")
+
+	recorder = serveTestRequest(t, server, "/v1/submit-labels/", block)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got %d %s", recorder.Code, recorder.Body)
+	}
+	item, _ := server.workItem("a.cha:::1")
+	if item.Active || item.TimesCoded != 1 {
+		t.Errorf("got %+v after submit-labels", item)
+	}
+	alice, _ := server.getUser("lab1", "alice")
+	if alice.hasThisBlock("a.cha:::1") || !alice.prevCoded("a.cha:::1") {
+		t.Errorf("alice still has the block: %+v", alice)
+	}
+	group, err := server.labels.getBlock("a.cha:::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(group.Blocks) != 1 || group.Blocks[0].Coder != "alice" ||
+		len(group.Blocks[0].Clips) != 1 || group.Blocks[0].Submitted.IsZero() {
+		t.Errorf("got %+v", group.Blocks)
+	}
+}
+
+func TestSubmitWOLabelsHandler(t *testing.T) {
+	server := newHandlerTestServer(t, t.TempDir())
+	if recorder := serveTestRequest(t, server, "/v1/get-block/",
+		BlockReq{LabKey: "lab1", Username: "alice"}); recorder.Code != http.StatusOK {
+		t.Fatalf("got %d %s", recorder.Code, recorder.Body)
+	}
+
+	recorder := serveTestRequest(t, server, "/v1/submit-wo-labels/",
+		WorkItemReleaseReq{LabKey: "lab1", Username: "alice"})
+	checkErrorCode(t, recorder, http.StatusBadRequest, "missing_fields")
+
+	recorder = serveTestRequest(t, server, "/v1/submit-wo-labels/",
+		WorkItemReleaseReq{LabKey: "lab1", Username: "nobody", BlockIds: []string{"a.cha:::1"}})
+	checkErrorCode(t, recorder, http.StatusNotFound, "user_not_found")
+
+	recorder = serveTestRequest(t, server, "/v1/submit-wo-labels/",
+		WorkItemReleaseReq{LabKey: "lab1", Username: "alice", BlockIds: []string{"a.cha:::1"}})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got %d %s", recorder.Code, recorder.Body)
+	}
+	item, _ := server.workItem("a.cha:::1")
+	if item.Active || item.TimesCoded != 0 {
+		t.Errorf("got %+v after submit-wo-labels", item)
+	}
+	if alice, _ := server.getUser("lab1", "alice"); alice.hasThisBlock("a.cha:::1") {
+		t.Errorf("alice still has the block: %+v", alice)
+	}
+
+	// the released block can be checked out again
+	recorder = serveTestRequest(t, server, "/v1/get-block/", BlockReq{LabKey: "lab2", Username: "bob"})
+	if recorder.Code != http.StatusOK || recorder.Header().Get(blockIDHeader) != "a.cha:::1" {
+		t.Errorf("got %d %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestPagedEndpointsTakeIDSRequests(t *testing.T) {
+	server := newHandlerTestServer(t, t.TempDir())
+
+	// what clients sent before the endpoints could page
+	request := IDSRequest{LabKey: "lab1", LabName: "Lab lab1", Username: "alice",
+		Training: true, Reliability: true, TrainingPackNum: 1}
+	for _, url := range []string{"/v1/get-all-labels/", "/v1/get-block-list/"} {
+		if recorder := serveTestRequest(t, server, url, request); recorder.Code != http.StatusOK {
+			t.Errorf("%s: got %d %s", url, recorder.Code, recorder.Body)
+		}
+	}
+}
+
+// failingWorkStore is a WorkStore that can't store WorkItems
+type failingWorkStore struct {
+	WorkStore
+}
+
+func (store failingWorkStore) persistWorkItem(item WorkItem) error {
+	return errStoreFailed
+}
+
+func TestGetBlockHandlerErrors(t *testing.T) {
+	for _, test := range []struct {
+		url     string
+		request BlockReq
+		broken  bool
+		status  int
+		code    string
+	}{
+		{"/v1/get-block/", BlockReq{LabKey: "lab1", Username: "nobody"}, false, http.StatusNotFound, "user_not_found"},
+		{"/v1/get-block/", BlockReq{LabKey: "lab1", Username: "alice", Training: true}, false, http.StatusNotFound, "no_blocks_available"},
+		{"/v1/get-block/", BlockReq{LabKey: "lab1", Username: "alice"}, true, http.StatusInternalServerError, "internal_error"},
+		{"/v1/get-specific-block/", BlockReq{ItemID: "x.cha:::1", LabKey: "lab1", Username: "alice"}, false, http.StatusNotFound, "work_item_not_found"},
+		{"/v1/get-specific-block/", BlockReq{ItemID: "a.cha:::1", LabKey: "lab1", Username: "alice"}, true, http.StatusInternalServerError, "internal_error"},
+	} {
+		server := newHandlerTestServer(t, t.TempDir())
+		if test.broken {
+			server.work = failingWorkStore{server.work}
+		}
+		recorder := serveTestRequest(t, server, test.url, test.request)
+		checkErrorCode(t, recorder, test.status, test.code)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// ErrDatabaseReadOnly means a database was opened read only, so nothing can be submitted
+	ErrDatabaseReadOnly = errors.New("Database is read only")
+
+	// ErrManifestNotLoaded means the server has no work items to hand out
+	ErrManifestNotLoaded = errors.New("Manifest isn't loaded, there are no work items")
+)
+
+/*
+healthChecker is implemented by the stores that can check
+they're open and weren't opened read only. The in memory
+stores always are, so they don't.
+
+The checks don't write anything: readiness is probed every
+few seconds, and a write would commit (and fsync) each time,
+holding up submits waiting on the single writer.
+*/
+type healthChecker interface {
+	checkOpen() error
+}
+
+/*
+checkBoltOpen runs an empty read transaction, which
+fails if the database was closed
+*/
+func checkBoltOpen(db *bolt.DB, metrics *Metrics, store string) error {
+	if db.IsReadOnly() {
+		return ErrDatabaseReadOnly
+	}
+	return metrics.timeTx(store, "view", db.View, func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+func (db *LabsDB) checkOpen() error   { return checkBoltOpen(db.db, db.metrics, "labs") }
+func (db *WorkDB) checkOpen() error   { return checkBoltOpen(db.db, db.metrics, "work") }
+func (db *LabelsDB) checkOpen() error { return checkBoltOpen(db.db, db.metrics, "labels") }
+
+/*
+checkOpen reads the schema version, which fails if the
+database was closed, and makes sure it isn't query only
+*/
+func (db *SQLiteDB) checkOpen() error {
+	if _, err := db.schemaVersion(); err != nil {
+		return err
+	}
+	var queryOnly bool
+	if err := db.db.QueryRow("PRAGMA query_only").Scan(&queryOnly); err != nil {
+		return err
+	}
+	if queryOnly {
+		return ErrDatabaseReadOnly
+	}
+	return nil
+}
+
+/*
+HealthCheck is the result of one of the readiness checks.
+Error is why it failed, Detail what it found otherwise.
+*/
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+/*
+ReadinessReport is whether the server can take traffic,
+and the checks that decided it
+*/
+type ReadinessReport struct {
+	Ready   bool          `json:"ready"`
+	Checked time.Time     `json:"checked"`
+	Checks  []HealthCheck `json:"checks"`
+}
+
+func newHealthCheck(name, detail string, err error) HealthCheck {
+	if err != nil {
+		return HealthCheck{Name: name, Error: err.Error()}
+	}
+	return HealthCheck{Name: name, OK: true, Detail: detail}
+}
+
+/*
+checkStores checks each of the stores is open, once
+per database (the SQLite store is all three)
+*/
+func (s *Server) checkStores() []HealthCheck {
+	if interface{}(s.labs) == interface{}(s.work) && interface{}(s.labs) == interface{}(s.labels) {
+		return []HealthCheck{checkStore("db", s.labs)}
+	}
+	return []HealthCheck{
+		checkStore("labs_db", s.labs),
+		checkStore("work_db", s.work),
+		checkStore("labels_db", s.labels),
+	}
+}
+
+func checkStore(name string, store interface{}) HealthCheck {
+	checker, canCheck := store.(healthChecker)
+	if !canCheck {
+		return newHealthCheck(name, "in memory", nil)
+	}
+	return newHealthCheck(name, "open", checker.checkOpen())
+}
+
+// checkManifest makes sure there are work items to hand out
+func (s *Server) checkManifest() HealthCheck {
+	numItems := s.numWorkItems()
+	if !s.config.WorkMapLoaded || numItems == 0 {
+		return newHealthCheck("manifest", "", ErrManifestNotLoaded)
+	}
+	return newHealthCheck("manifest", fmt.Sprintf("%d work items", numItems), nil)
+}
+
+/*
+checkBlockData makes sure the directories the blocks
+are served from (and blocks_dir, if blocks are built
+into it) are there
+*/
+func (s *Server) checkBlockData() HealthCheck {
+	dirs := make(map[string]bool)
+	for _, item := range s.workItems() {
+		dirs[filepath.Dir(item.BlockPath)] = true
+	}
+	if s.config.BlocksDir != "" {
+		dirs[s.config.BlocksDir] = true
+	}
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+
+	for _, dir := range sorted {
+		info, err := os.Stat(dir)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s isn't a directory", dir)
+		}
+		if err != nil {
+			return newHealthCheck("block_data", "", err)
+		}
+	}
+	return newHealthCheck("block_data", fmt.Sprintf("%d directories", len(sorted)), nil)
+}
+
+// readiness runs all of the readiness checks
+func (s *Server) readiness() ReadinessReport {
+	report := ReadinessReport{Ready: true, Checked: time.Now().UTC()}
+	report.Checks = append(s.checkStores(), s.checkManifest(), s.checkBlockData())
+	for _, check := range report.Checks {
+		if !check.OK {
+			report.Ready = false
+		}
+	}
+	return report
+}
+
+/*
+healthzHandler answers as long as the process is up
+and serving requests
+*/
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+/*
+readyzHandler is a 200 when the server can take traffic and
+a 503 when it can't, with the checks either way
+*/
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := s.readiness()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.Ready {
+		for _, check := range report.Checks {
+			if !check.OK {
+				requestLogger(r).Warn("readiness check failed", "check", check.Name, "error", check.Error)
+			}
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
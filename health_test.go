@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadyzHandler(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		unready func(t *testing.T, server *Server, dir string)
+		status  int
+		failed  string // the check that fails
+	}{
+		{"ready", func(t *testing.T, server *Server, dir string) {}, http.StatusOK, ""},
+		{"manifest not loaded", func(t *testing.T, server *Server, dir string) {
+			server.config.WorkMapLoaded = false
+		}, http.StatusServiceUnavailable, "manifest"},
+		{"no work items", func(t *testing.T, server *Server, dir string) {
+			// a manifest with nothing in it
+			server.workItemMap = WorkItemMap{}
+		}, http.StatusServiceUnavailable, "manifest"},
+		{"no blocks dir", func(t *testing.T, server *Server, dir string) {
+			server.config.BlocksDir = filepath.Join(dir, "missing")
+		}, http.StatusServiceUnavailable, "block_data"},
+		{"blocks dir is a file", func(t *testing.T, server *Server, dir string) {
+			server.config.BlocksDir = filepath.Join(dir, "1.zip")
+		}, http.StatusServiceUnavailable, "block_data"},
+		{"closed work db", func(t *testing.T, server *Server, dir string) {
+			work, err := LoadWorkDB(filepath.Join(dir, "work.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			work.Close()
+			server.work = work
+		}, http.StatusServiceUnavailable, "work_db"},
+	} {
+		dir := t.TempDir()
+		server := newHandlerTestServer(t, dir)
+		test.unready(t, server, dir)
+
+		recorder := serveTestGet(server, "/readyz", nil)
+		var report ReadinessReport
+		if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+			t.Fatalf("%s: %v: %s", test.name, err, recorder.Body)
+		}
+		if recorder.Code != test.status || report.Ready != (test.status == http.StatusOK) {
+			t.Errorf("%s: got %d %s", test.name, recorder.Code, recorder.Body)
+		}
+		for _, check := range report.Checks {
+			if check.OK != (check.Name != test.failed) {
+				t.Errorf("%s: got %+v", test.name, check)
+			}
+		}
+	}
+}
+
+func TestHealthzHandler(t *testing.T) {
+	server := newHandlerTestServer(t, t.TempDir())
+	// healthz is up even when the server isn't ready
+	server.config.WorkMapLoaded = false
+
+	recorder := serveTestGet(server, "/healthz", nil)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "{\"status\":\"ok\"}\n" {
+		t.Errorf("got %d %s", recorder.Code, recorder.Body)
+	}
+	recorder = serveTestRequest(t, server, "/healthz", nil)
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST got %d %s", recorder.Code, recorder.Body)
+	}
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// the types of records in an NDJSON import
+	importUserType       = "user"
+	importActiveItemType = "active_item"
+	importBlockType      = "block"
+)
+
+var (
+	// ErrImportFormat means the import data was neither
+	// NDJSON records nor a JSON export
+	ErrImportFormat = errors.New("Import data must be NDJSON records or a JSON export")
+
+	// ErrImportUnknownType means an import record has an unknown "type"
+	ErrImportUnknownType = errors.New("Unknown import record type")
+
+	// ErrImportMissingField means an import record is
+	// missing one of the fields its type requires
+	ErrImportMissingField = errors.New("Import record is missing a required field")
+
+	// ErrImportTypeMismatch means a Block's training/reliability
+	// flags don't match the WorkItem it belongs to
+	ErrImportTypeMismatch = errors.New("Block's training/reliability flags don't match its work item")
+
+	// ErrImportLeaseHeld means an active_item record checks a regular
+	// block out to a user while another user has it checked out
+	ErrImportLeaseHeld = errors.New("Block is already checked out by another user")
+
+	// ErrWorkMapNotLoaded means the WorkItems haven't been
+	// read from the manifest into the WorkDB yet
+	ErrWorkMapNotLoaded = errors.New("Work item map hasn't been loaded yet, start the server with the manifest first")
+)
+
+/*
+ImportRecord is a single record of an NDJSON import. Which
+fields are needed depends on the Type:
+
+	user:        lab_key, lab_name, username
+	active_item: lab_key, username, block_id
+	block:       block (a submitted Block, with its lab_key and coder)
+*/
+type ImportRecord struct {
+	Type     string `json:"type"`
+	LabKey   string `json:"lab_key"`
+	LabName  string `json:"lab_name"`
+	Username string `json:"username"`
+	ItemID   string `json:"block_id"`
+	Block    *Block `json:"block"`
+}
+
+/*
+ImportExport is a full JSON export of an old server, i.e. the
+output of /v1/all-lab-info/ and /v1/get-all-labels/ together.
+*/
+type ImportExport struct {
+	Labs        []*Lab          `json:"labs"`
+	BlockGroups BlockGroupArray `json:"block_groups"`
+}
+
+/*
+ImportConflict is an import record that couldn't be imported.
+Record is the (1 based) number of the record in the import.
+*/
+type ImportConflict struct {
+	Record int    `json:"record"`
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+/*
+ImportReport is the outcome of an import. Skipped records
+were already in the databases, conflicting ones were not
+imported for the reason given in their ImportConflict.
+*/
+type ImportReport struct {
+	Inserted    int              `json:"inserted"`
+	Skipped     int              `json:"skipped"`
+	Conflicting int              `json:"conflicting"`
+	Conflicts   []ImportConflict `json:"conflicts"`
+}
+
+func (report ImportReport) String() string {
+	return fmt.Sprintf("inserted %d, skipped %d, conflicting %d records",
+		report.Inserted, report.Skipped, report.Conflicting)
+}
+
+/*
+readImportRecords reads either NDJSON ImportRecords or a
+single ImportExport, which is turned into ImportRecords.
+*/
+func readImportRecords(r io.Reader) ([]ImportRecord, error) {
+	decoder := json.NewDecoder(r)
+
+	var first json.RawMessage
+	if err := decoder.Decode(&first); err != nil {
+		return nil, ErrImportFormat
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(first, &fields); err != nil {
+		return nil, ErrImportFormat
+	}
+
+	// a JSON export
+	if _, isRecord := fields["type"]; !isRecord {
+		var export ImportExport
+		if err := json.Unmarshal(first, &export); err != nil {
+			return nil, err
+		}
+		if decoder.More() {
+			return nil, ErrImportFormat
+		}
+		return export.records(), nil
+	}
+
+	// NDJSON records
+	var records []ImportRecord
+	var record ImportRecord
+	if err := json.Unmarshal(first, &record); err != nil {
+		return nil, err
+	}
+	records = append(records, record)
+	for decoder.More() {
+		var record ImportRecord
+		if err := decoder.Decode(&record); err != nil {
+			return nil, fmt.Errorf("record %d: %v", len(records)+1, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+/*
+records turns the export into user records, then
+active item records, then block records
+*/
+func (export *ImportExport) records() []ImportRecord {
+	var users, activeItems, blocks []ImportRecord
+
+	for _, lab := range export.Labs {
+		var usernames []string
+		for username := range lab.Users {
+			usernames = append(usernames, username)
+		}
+		sort.Strings(usernames)
+
+		for _, username := range usernames {
+			users = append(users, ImportRecord{Type: importUserType,
+				LabKey:   lab.Key,
+				LabName:  lab.LabName,
+				Username: username})
+			for _, itemID := range lab.Users[username].ActiveWorkItems {
+				activeItems = append(activeItems, ImportRecord{Type: importActiveItemType,
+					LabKey:   lab.Key,
+					Username: username,
+					ItemID:   itemID})
+			}
+		}
+	}
+
+	for _, group := range export.BlockGroups {
+		for i := range group.Blocks {
+			blocks = append(blocks, ImportRecord{Type: importBlockType,
+				Block: &group.Blocks[i]})
+		}
+	}
+
+	return append(append(users, activeItems...), blocks...)
+}
+
+/*
+importBatch holds the working copies of everything an import
+changes, so that every record is validated against the state
+left by the records before it, and nothing is written until
+they've all been checked.
+*/
+type importBatch struct {
+	s      *Server
+	labs   map[string]*Lab
+	groups map[string]*BlockGroup
+	items  WorkItemMap
+
+	// storedLabs are all the labs as they were before the import
+	storedLabs []*Lab
+}
+
+func (batch *importBatch) getLab(labKey string) (*Lab, error) {
+	if lab, exists := batch.labs[labKey]; exists {
+		return lab, nil
+	}
+	lab, err := batch.s.labs.getLab(labKey)
+	if err != nil {
+		return nil, err
+	}
+	batch.labs[labKey] = lab
+	return lab, nil
+}
+
+func (batch *importBatch) getUser(labKey, username string) (*Lab, User, error) {
+	lab, err := batch.getLab(labKey)
+	if err == ErrLabDoesntExist {
+		return nil, User{}, ErrUserDoesntExist
+	} else if err != nil {
+		return nil, User{}, err
+	}
+	user, exists := lab.Users[username]
+	if !exists {
+		return nil, User{}, ErrUserDoesntExist
+	}
+	return lab, user, nil
+}
+
+func (batch *importBatch) getItem(itemID string) (WorkItem, bool) {
+	if item, exists := batch.items[itemID]; exists {
+		return item, true
+	}
+	return batch.s.workItem(itemID)
+}
+
+func (batch *importBatch) getGroup(block Block) (*BlockGroup, error) {
+	if group, exists := batch.groups[block.ID]; exists {
+		return group, nil
+	}
+	group, err := batch.s.labels.getBlock(block.ID)
+	if err == ErrWorkItemDoesntExist {
+		group = &BlockGroup{ID: block.ID,
+			Training:    block.Training,
+			Reliability: block.Reliability}
+	} else if err != nil {
+		return nil, err
+	}
+	batch.groups[block.ID] = group
+	return group, nil
+}
+
+/*
+importUser adds the user (and the lab, if it's new).
+It returns true if the user was added, false
+if they already exist.
+*/
+func (batch *importBatch) importUser(record ImportRecord) (bool, error) {
+	if record.LabKey == "" || record.Username == "" {
+		return false, ErrImportMissingField
+	}
+	if !batch.s.config.labIsRegistered(record.LabKey) {
+		return false, ErrLabNotRegistered
+	}
+
+	lab, err := batch.getLab(record.LabKey)
+	if err == ErrLabDoesntExist {
+		lab = &Lab{Key: record.LabKey,
+			LabName: record.LabName,
+			Users:   make(map[string]User)}
+		batch.labs[record.LabKey] = lab
+	} else if err != nil {
+		return false, err
+	}
+
+	if _, exists := lab.Users[record.Username]; exists {
+		return false, nil
+	}
+	lab.addUser(User{Name: record.Username,
+		ParentLab:       record.LabKey,
+		ActiveWorkItems: make(BlockIDList, 0)})
+	return true, nil
+}
+
+/*
+otherHolder is true if a user other than labKey's username
+has the block in their ActiveWorkItems, counting the users
+the import has already changed.
+*/
+func (batch *importBatch) otherHolder(blockID, labKey, username string) (bool, error) {
+	if batch.storedLabs == nil {
+		stored, err := batch.s.labs.getAllLabs()
+		if err != nil {
+			return false, err
+		}
+		batch.storedLabs = append(make([]*Lab, 0, len(stored)), stored...)
+	}
+	labs := append([]*Lab{}, batch.storedLabs...)
+	for _, lab := range batch.labs {
+		labs = append(labs, lab)
+	}
+	for _, lab := range labs {
+		if changed, exists := batch.labs[lab.Key]; exists && changed != lab {
+			// the import's copy of the lab is checked instead
+			continue
+		}
+		for name, user := range lab.Users {
+			if lab.Key == labKey && name == username {
+				continue
+			}
+			if user.hasThisBlock(blockID) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+/*
+importActiveItem checks the block out to the user, the way
+/v1/get-block/ would. A regular block can't be checked out
+if another user has it, it's been coded through all its
+passes, or the user's lab or the user would go over the pass limits.
+*/
+func (batch *importBatch) importActiveItem(record ImportRecord) (bool, error) {
+	if record.ItemID == "" {
+		return false, ErrImportMissingField
+	}
+	item, exists := batch.getItem(record.ItemID)
+	if !exists {
+		return false, ErrWorkItemDoesntExist
+	}
+	lab, user, err := batch.getUser(record.LabKey, record.Username)
+	if err != nil {
+		return false, err
+	}
+
+	if user.hasThisBlock(item.ID) {
+		return false, nil
+	}
+	if !item.Training && !item.Reliability {
+		held, err := batch.otherHolder(item.ID, record.LabKey, record.Username)
+		if err != nil {
+			return false, err
+		}
+		if held {
+			return false, ErrImportLeaseHeld
+		}
+		if item.TimesCoded >= numRealBlockPasses {
+			return false, ErrBlockGroupFull
+		}
+		group, err := batch.getGroup(Block{ID: item.ID})
+		if err != nil {
+			return false, err
+		}
+		if err := group.checkPassLimits(record.LabKey, record.Username, batch.s.config.passLimits()); err != nil {
+			return false, err
+		}
+	}
+	user.addWorkItem(item.ID)
+	lab.Users[user.Name] = user
+
+	item.Active = true
+	batch.items[item.ID] = item
+	return true, nil
+}
+
+/*
+importBlock adds the Block to its BlockGroup, the same way
+a submission through /v1/submit-labels/ would. Blocks that
+are already in the group (under any instance number) are skipped.
+*/
+func (batch *importBatch) importBlock(record ImportRecord) (bool, error) {
+	if record.Block == nil || record.Block.ID == "" {
+		return false, ErrImportMissingField
+	}
+	block := *record.Block
+
+	item, exists := batch.getItem(block.ID)
+	if !exists {
+		return false, ErrWorkItemDoesntExist
+	}
+	if block.Training != item.Training || block.Reliability != item.Reliability {
+		return false, ErrImportTypeMismatch
+	}
+	lab, user, err := batch.getUser(block.LabKey, block.Coder)
+	if err != nil {
+		return false, err
+	}
+	group, err := batch.getGroup(block)
+	if err != nil {
+		return false, err
+	}
+
+	for _, existing := range group.Blocks {
+		if sameBlock(existing, block) {
+			return false, nil
+		}
+	}
+	if err := group.addBlock(block, batch.s.config.passLimits()); err != nil {
+		return false, err
+	}
+
+	if block.Training {
+		user.addCompleteTrainBlock(block)
+	} else if block.Reliability {
+		user.addCompleteRelBlock(block)
+	}
+	if user.inactivateWorkItem(item) != nil && !block.Training &&
+		!block.Reliability && !user.prevCoded(block.ID) {
+		// legacy blocks that were never checked out
+		user.PastWorkItems.addID(block.ID)
+	}
+	lab.Users[user.Name] = user
+
+	// someone else may still have a training or reliability block checked out
+	held, err := batch.otherHolder(item.ID, block.LabKey, block.Coder)
+	if err != nil {
+		return false, err
+	}
+	item.Active = held
+	item.TimesCoded = len(group.Blocks)
+	batch.items[item.ID] = item
+	return true, nil
+}
+
+// sameBlock compares two Blocks, ignoring their instance numbers
+// and when they were checked out and submitted
+func sameBlock(a, b Block) bool {
+	a.Instance = 0
+	b.Instance = 0
+	a.CheckedOut, a.Submitted = time.Time{}, time.Time{}
+	b.CheckedOut, b.Submitted = time.Time{}, time.Time{}
+	encodedA, errA := a.encode()
+	encodedB, errB := b.encode()
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
+
+/*
+write stores everything the import changed
+*/
+func (batch *importBatch) write() error {
+	var labs []*Lab
+	for _, lab := range batch.labs {
+		labs = append(labs, lab)
+	}
+	var groups BlockGroupArray
+	for _, group := range batch.groups {
+		if len(group.Blocks) > 0 {
+			groups.addBlockGroup(*group)
+		}
+	}
+	return batch.s.writeRecords(labs, groups, batch.items)
+}
+
+/*
+importRecords validates and imports the records, users first,
+then active items, then blocks, so that the users a record
+refers to can come later in the import. The databases are only
+written once every record has been checked.
+*/
+func (s *Server) importRecords(records []ImportRecord) (ImportReport, error) {
+	report := ImportReport{Conflicts: make([]ImportConflict, 0)}
+	batch := &importBatch{s: s,
+		labs:   make(map[string]*Lab),
+		groups: make(map[string]*BlockGroup),
+		items:  make(WorkItemMap)}
+
+	phases := []struct {
+		recordType string
+		apply      func(ImportRecord) (bool, error)
+	}{
+		{importUserType, batch.importUser},
+		{importActiveItemType, batch.importActiveItem},
+		{importBlockType, batch.importBlock},
+	}
+
+	conflict := func(i int, record ImportRecord, err error) {
+		id := record.ItemID
+		if record.Type == importUserType {
+			id = record.LabKey + ":::" + record.Username
+		} else if record.Block != nil {
+			id = record.Block.ID
+		}
+		report.Conflicting++
+		report.Conflicts = append(report.Conflicts, ImportConflict{Record: i + 1,
+			Type:   record.Type,
+			ID:     id,
+			Reason: err.Error()})
+	}
+
+	for i, record := range records {
+		switch record.Type {
+		case importUserType, importActiveItemType, importBlockType:
+		default:
+			conflict(i, record, ErrImportUnknownType)
+		}
+	}
+
+	for _, phase := range phases {
+		for i, record := range records {
+			if record.Type != phase.recordType {
+				continue
+			}
+			inserted, err := phase.apply(record)
+			if err != nil {
+				conflict(i, record, err)
+			} else if inserted {
+				report.Inserted++
+			} else {
+				report.Skipped++
+			}
+		}
+	}
+	sort.Slice(report.Conflicts, func(i, j int) bool {
+		return report.Conflicts[i].Record < report.Conflicts[j].Record
+	})
+
+	if report.Inserted == 0 {
+		return report, nil
+	}
+	if err := batch.write(); err != nil {
+		return report, err
+	}
+
+	return report, s.setWorkItems(batch.items)
+}
+
+/*
+importHandler imports an NDJSON or JSON export body. The admin
+key goes in the query string since the body is the import:
+
+	POST /v1/import/?admin_lab_key=...
+*/
+func (s *Server) importHandler(w http.ResponseWriter, r *http.Request) {
+	annotateRequest(r, r.URL.Query().Get("admin_lab_key"), "", "")
+	if !s.config.labIsAdmin(r.URL.Query().Get("admin_lab_key")) {
+		writeError(w, r, ErrAdminKeyRequired, 403)
+		requestLogger(r).Warn("unauthorized lab key")
+		return
+	}
+
+	records, readErr := readImportRecords(r.Body)
+	if readErr != nil {
+		writeError(w, r, readErr, 400)
+		return
+	}
+
+	report, importErr := s.importRecords(records)
+	if importErr != nil {
+		writeError(w, r, importErr, 500)
+		return
+	}
+	requestLogger(r).Info("imported records", "report", report.String())
+	json.NewEncoder(w).Encode(report)
+}
+
+/*
+importCommand imports a file while the server is stopped:
+
+	$: ./idsserver import config.json export.ndjson
+*/
+func importCommand(args []string) error {
+	if len(args) < 2 {
+		return ErrMissingCommandArgs
+	}
+
+	server, err := openServer(args[0])
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	if !server.config.WorkMapLoaded {
+		return ErrWorkMapNotLoaded
+	}
+	if _, err := server.migrateSchema(false); err != nil {
+		return err
+	}
+	server.workItemMap, err = server.work.loadItemMap()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	records, err := readImportRecords(file)
+	if err != nil {
+		return err
+	}
+	report, err := server.importRecords(records)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(report)
+	for _, conflict := range report.Conflicts {
+		fmt.Printf("  record %d (%s %s): %s\n", conflict.Record, conflict.Type, conflict.ID, conflict.Reason)
+	}
+	return nil
+}
@@ -3,17 +3,12 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
-	"log"
+	"log/slog"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
 
-var (
-	// path to the LabsDB file
-	labelsDBPath = mainConfig.LabelsDBPath
-)
-
 var (
 	// ErrCouldntFindLabeledBlock means a block ID wasn't
 	// found in the database
@@ -37,6 +32,14 @@ var (
 	// ErrInstanceNotInGroup means that the instance number was not found when
 	// scanning the group's blocks
 	ErrInstanceNotInGroup = errors.New("Instance not in group")
+
+	// ErrLabPassLimitReached means that this lab has already coded this
+	// block the maximum number of times allowed by max_passes_per_lab
+	ErrLabPassLimitReached = errors.New("This block has already been coded the maximum number of times by this lab")
+
+	// ErrCoderPassLimitReached means that this coder has already coded this
+	// block the maximum number of times allowed by max_passes_per_coder
+	ErrCoderPassLimitReached = errors.New("This block has already been coded the maximum number of times by this coder")
 )
 
 const (
@@ -51,7 +54,8 @@ const (
 
 // LabelsDB is a wrapper around a boltDB
 type LabelsDB struct {
-	db *bolt.DB
+	db      *bolt.DB
+	metrics *Metrics
 }
 
 /*
@@ -156,7 +160,7 @@ type BlockGroup struct {
 	Reliability bool       `json:"reliability"`
 }
 
-func (group *BlockGroup) addBlock(block Block) error {
+func (group *BlockGroup) addBlock(block Block, limits PassLimits) error {
 	if block.ID != group.ID {
 		return ErrAddBlockFailed
 	}
@@ -165,6 +169,9 @@ func (group *BlockGroup) addBlock(block Block) error {
 		if len(group.Blocks) == numRealBlockPasses {
 			return ErrBlockGroupFull
 		}
+		if err := group.checkPassLimits(block.LabKey, block.Coder, limits); err != nil {
+			return err
+		}
 		block.Instance = len(group.Blocks)
 		group.Blocks.addBlock(block)
 		return nil
@@ -235,6 +242,62 @@ func (group *BlockGroup) coderPresent(labKey, coder string) bool {
 	return false
 }
 
+/*
+labPasses returns the number of instances in the group
+that were coded by this lab
+*/
+func (group *BlockGroup) labPasses(labKey string) int {
+	var passes int
+	for _, block := range group.Blocks {
+		if block.LabKey == labKey {
+			passes++
+		}
+	}
+	return passes
+}
+
+/*
+coderPasses returns the number of instances in the group
+that were coded by this coder
+*/
+func (group *BlockGroup) coderPasses(labKey, coder string) int {
+	var passes int
+	for _, block := range group.Blocks {
+		if block.LabKey == labKey && block.Coder == coder {
+			passes++
+		}
+	}
+	return passes
+}
+
+/*
+PassLimits are the limits on how many of the numRealBlockPasses
+codings of a single regular block can come from the same lab or
+the same coder. 0 means no limit.
+*/
+type PassLimits struct {
+	PerLab   int
+	PerCoder int
+}
+
+/*
+checkPassLimits makes sure that another coding of this block by
+the given coder wouldn't exceed the pass limits. These only
+apply to regular blocks, so that a single lab can't fill every
+pass of a block and defeat cross-lab comparison.
+*/
+func (group *BlockGroup) checkPassLimits(labKey, coder string, limits PassLimits) error {
+	if limits.PerCoder > 0 &&
+		group.coderPasses(labKey, coder) >= limits.PerCoder {
+		return ErrCoderPassLimitReached
+	}
+	if limits.PerLab > 0 &&
+		group.labPasses(labKey) >= limits.PerLab {
+		return ErrLabPassLimitReached
+	}
+	return nil
+}
+
 func (group *BlockGroup) encode() ([]byte, error) {
 	data, err := json.MarshalIndent(group, "", "  ")
 	if err != nil {
@@ -267,6 +330,12 @@ type Block struct {
 	Username    string `json:"username"`
 	Training    bool   `json:"training"`
 	Reliability bool   `json:"reliability"`
+	BlockSHA256 string `json:"block_sha256"`
+
+	// CheckedOut is when the coder checked the block out, and
+	// Submitted when the server got the labels
+	CheckedOut time.Time `json:"checked_out"`
+	Submitted  time.Time `json:"submitted"`
 }
 
 func (block *Block) encode() ([]byte, error) {
@@ -305,182 +374,220 @@ type Clip struct {
 	GenderLabel     string `json:"gender_label"`
 }
 
-// LoadLabelsDB loads the global workDB
-func LoadLabelsDB() *LabelsDB {
-	localLabelsDB := &LabelsDB{db: new(bolt.DB)}
-	err := localLabelsDB.Open()
+// LoadLabelsDB opens the LabelsDB stored at path
+func LoadLabelsDB(path string) (*LabelsDB, error) {
+	localLabelsDB := &LabelsDB{}
+	err := localLabelsDB.Open(path)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	return localLabelsDB
+	return localLabelsDB, nil
 }
 
 // Open opens the database and returns error on failure
-func (db *LabelsDB) Open() error {
-	labelsDB, openErr := bolt.Open(labelsDBPath, 0600, nil)
-
+func (db *LabelsDB) Open(path string) error {
+	labelsDB, openErr := bolt.Open(path, 0600, nil)
 	if openErr != nil {
-		log.Fatal(openErr)
 		return openErr
 	}
 
 	db.db = labelsDB
 
-	err := db.db.Update(func(tx *bolt.Tx) error {
+	var missingIndexes bool
+
+	err := db.metrics.timeTx("labels", "update", db.db.Update, func(tx *bolt.Tx) error {
 		_, updateErr := tx.CreateBucketIfNotExists([]byte(labelsBucket))
 		if updateErr != nil {
-			log.Fatal(updateErr)
 			return updateErr
 		}
+		for _, index := range indexBuckets {
+			if tx.Bucket([]byte(index)) == nil {
+				missingIndexes = true
+			}
+			_, updateErr = tx.CreateBucketIfNotExists([]byte(index))
+			if updateErr != nil {
+				return updateErr
+			}
+		}
 		return updateErr
 	})
+	if err != nil {
+		db.db.Close()
+		return err
+	}
+
+	// databases created before the indexes existed need
+	// to have them built from the Labels bucket
+	if missingIndexes {
+		numGroups, rebuildErr := db.rebuildIndexes()
+		if rebuildErr != nil {
+			db.db.Close()
+			return rebuildErr
+		}
+		slog.Info("built LabelsDB indexes", "block_groups", numGroups)
+	}
 
-	return err
+	return nil
 }
 
 // Close closes the database
-func (db *LabelsDB) Close() {
-	db.db.Close()
+func (db *LabelsDB) Close() error {
+	return db.db.Close()
+}
+
+func (db *LabelsDB) boltDB() *bolt.DB {
+	return db.db
 }
 
 func (db *LabelsDB) getBlockGroup(blockIDs []string) (BlockGroupArray, error) {
 	var blocks BlockGroupArray
 
-	for _, id := range blockIDs {
-		block, err := db.getBlock(id)
-		if err != nil {
-			return blocks, ErrCouldntFindLabeledBlock
+	err := db.metrics.timeTx("labels", "view", db.db.View, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(labelsBucket))
+		for _, id := range blockIDs {
+			groupData := bucket.Get([]byte(id))
+			if groupData == nil {
+				return ErrCouldntFindLabeledBlock
+			}
+			block, err := decodeBlockGroupJSON(groupData)
+			if err != nil {
+				return ErrCouldntFindLabeledBlock
+			}
+			blocks.addBlockGroup(*block)
 		}
-		blocks.addBlockGroup(*block)
-	}
-	return blocks, nil
+		return nil
+	})
+	return blocks, err
 }
 
-func (db *LabelsDB) addBlock(block Block) error {
-	fmt.Println("Trying to retrieve block data: ")
-	fmt.Println(block.ID)
+func (db *LabelsDB) addBlock(block Block, limits PassLimits) (*BlockGroup, error) {
+	var blockGroup *BlockGroup
 
-	var exists bool
-	var groupData []byte
-
-	db.db.View(func(tx *bolt.Tx) error {
+	updateErr := db.metrics.timeTx("labels", "update", db.db.Update, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(labelsBucket))
-		groupData = bucket.Get([]byte(block.ID))
+		groupData := bucket.Get([]byte(block.ID))
 
 		// block group doesn't exist
 		if groupData == nil {
-			exists = false
+			blockGroup = &BlockGroup{ID: block.ID}
+			if block.Training {
+				blockGroup.Training = true
+			}
+			if block.Reliability {
+				blockGroup.Reliability = true
+			}
 		} else {
-			exists = true
+			var blockDecodeErr error
+			blockGroup, blockDecodeErr = decodeBlockGroupJSON(groupData)
+			if blockDecodeErr != nil {
+				return blockDecodeErr
+			}
+			// drop the old index entries before the group changes
+			unindexErr := unindexBlockGroup(tx, blockGroup)
+			if unindexErr != nil {
+				return unindexErr
+			}
 		}
-		return nil
-	})
 
-	if !exists {
-		newBlockGroup := BlockGroup{ID: block.ID}
-		newBlockGroup.addBlock(block)
-		if block.Training {
-			newBlockGroup.Training = true
-		}
-		if block.Reliability {
-			newBlockGroup.Reliability = true
+		addBlockErr := blockGroup.addBlock(block, limits)
+		if addBlockErr != nil {
+			return addBlockErr
 		}
 
-		newEncodedBlockGroup, newBlockEncodeErr := newBlockGroup.encode()
-		if newBlockEncodeErr != nil {
-			return newBlockEncodeErr
+		encodedBlockGroup, blockEncodeErr := blockGroup.encode()
+		if blockEncodeErr != nil {
+			return blockEncodeErr
 		}
 
-		updateErr := db.db.Update(func(tx *bolt.Tx) error {
-			bucket := tx.Bucket([]byte(labelsBucket))
-			err := bucket.Put([]byte(newBlockGroup.ID), newEncodedBlockGroup)
-			return err
-		})
-		blockWorkItem := workItemMap[block.ID]
-		blockWorkItem.TimesCoded = len(newBlockGroup.Blocks)
-		workItemMap[block.ID] = blockWorkItem
-		workDB.persistWorkItem(blockWorkItem)
-		return updateErr
-	}
-
-	blockGroup, blockDecodeErr := decodeBlockGroupJSON(groupData)
-	if blockDecodeErr != nil {
-		return blockDecodeErr
-	}
-
-	addBlockErr := blockGroup.addBlock(block)
-	if addBlockErr != nil {
-		return addBlockErr
-	}
-
-	encodedBlockGroup, blockEncodeErr := blockGroup.encode()
-	if blockEncodeErr != nil {
-		return blockEncodeErr
-	}
-
-	updateErr := db.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(labelsBucket))
-		err := bucket.Put([]byte(blockGroup.ID), encodedBlockGroup)
-		return err
+		putErr := bucket.Put([]byte(blockGroup.ID), encodedBlockGroup)
+		if putErr != nil {
+			return putErr
+		}
+		return indexBlockGroup(tx, blockGroup)
 	})
-
-	blockWorkItem := workItemMap[block.ID]
-	blockWorkItem.TimesCoded = len(blockGroup.Blocks)
-	workItemMap[block.ID] = blockWorkItem
-	workDB.persistWorkItem(blockWorkItem)
-
-	return updateErr
+	if updateErr != nil {
+		return nil, updateErr
+	}
+	return blockGroup, nil
 }
 
 func (db *LabelsDB) getBlock(blockID string) (*BlockGroup, error) {
-	fmt.Println("Trying to retrieve block data: ")
-	fmt.Println(blockID)
-
-	var exists bool
-	var groupData []byte
+	var blockGroup *BlockGroup
 
-	db.db.View(func(tx *bolt.Tx) error {
+	err := db.metrics.timeTx("labels", "view", db.db.View, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(labelsBucket))
-		groupData = bucket.Get([]byte(blockID))
+		groupData := bucket.Get([]byte(blockID))
 
 		// block group doesn't exist
 		if groupData == nil {
-			exists = false
-		} else {
-			exists = true
+			return ErrWorkItemDoesntExist
+		}
+
+		var decodeErr error
+		blockGroup, decodeErr = decodeBlockGroupJSON(groupData)
+		if decodeErr != nil {
+			return ErrWorkItemDoesntExist
 		}
 		return nil
 	})
-
-	if !exists {
-		return &BlockGroup{}, ErrWorkItemDoesntExist
-	}
-
-	blockGroup, err := decodeBlockGroupJSON(groupData)
 	if err != nil {
-		return &BlockGroup{}, ErrWorkItemDoesntExist
+		return &BlockGroup{}, err
 	}
 	return blockGroup, nil
 }
 
 func (db *LabelsDB) setBlockGroup(group BlockGroup) error {
+	return db.metrics.timeTx("labels", "update", db.db.Update, func(tx *bolt.Tx) error {
+		return putBlockGroup(tx, group)
+	})
+}
+
+func (db *LabelsDB) setBlockGroups(groups BlockGroupArray) error {
+	return db.metrics.timeTx("labels", "update", db.db.Update, func(tx *bolt.Tx) error {
+		for _, group := range groups {
+			if err := putBlockGroup(tx, group); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+putBlockGroup replaces the group in the Labels
+bucket and updates its index entries
+*/
+func putBlockGroup(tx *bolt.Tx, group BlockGroup) error {
 	encodedBlockGroup, encodeErr := group.encode()
 	if encodeErr != nil {
 		return encodeErr
 	}
 
-	updateErr := db.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(labelsBucket))
-		err := bucket.Put([]byte(group.ID), encodedBlockGroup)
+	bucket := tx.Bucket([]byte(labelsBucket))
+
+	// drop the index entries of the version being replaced
+	if oldGroupData := bucket.Get([]byte(group.ID)); oldGroupData != nil {
+		oldGroup, decodeErr := decodeBlockGroupJSON(oldGroupData)
+		if decodeErr != nil {
+			return decodeErr
+		}
+		unindexErr := unindexBlockGroup(tx, oldGroup)
+		if unindexErr != nil {
+			return unindexErr
+		}
+	}
+
+	err := bucket.Put([]byte(group.ID), encodedBlockGroup)
+	if err != nil {
 		return err
-	})
-	return updateErr
+	}
+	return indexBlockGroup(tx, &group)
 }
 
 func (db *LabelsDB) getAllBlockGroups() (BlockGroupArray, error) {
 	var blockGroupArray BlockGroupArray
 
-	scanErr := db.db.View(func(tx *bolt.Tx) error {
+	scanErr := db.metrics.timeTx("labels", "view", db.db.View, func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(labelsBucket))
 		c := b.Cursor()
 
@@ -500,25 +607,55 @@ func (db *LabelsDB) getAllBlockGroups() (BlockGroupArray, error) {
 	return blockGroupArray, nil
 }
 
-func (db *LabelsDB) deleteBlocks(instanceMap InstanceMap) (bool, error) {
-	keyWasDeleted := false
+/*
+getBlockGroupPage returns up to limit BlockGroups, in block ID
+order, starting after the given block ID. The returned string is
+the ID to pass as "after" to get the next page, or "" if this
+was the last page.
+*/
+func (db *LabelsDB) getBlockGroupPage(after string, limit int) (BlockGroupArray, string, error) {
+	var blockGroupArray BlockGroupArray
+	var next string
+
+	scanErr := db.metrics.timeTx("labels", "view", db.db.View, func(tx *bolt.Tx) error {
+		var pageErr error
+		next, pageErr = scanBucketPage(tx, labelsBucket, after, limit, func(value []byte) error {
+			blockGroup, groupDecodeErr := decodeBlockGroupJSON(value)
+			if groupDecodeErr != nil {
+				return groupDecodeErr
+			}
+			blockGroupArray.addBlockGroup(*blockGroup)
+			return nil
+		})
+		return pageErr
+	})
+	return blockGroupArray, next, scanErr
+}
+
+func (db *LabelsDB) deleteInstances(blockID string, instances *InstanceList) (*BlockGroup, error) {
+	var blockGroup *BlockGroup
+
+	// The group, its index entries and (possibly) its key are
+	// all updated in the same transaction
+	updateErr := db.metrics.timeTx("labels", "update", db.db.Update, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(labelsBucket))
 
-	for blockID, instanceList := range instanceMap {
-		fmt.Println("\n\n\ndealing with block: ", blockID)
-		fmt.Printf("\n\n")
 		// Get the requested BlockGroup
-		blockGroup, getGroupErr := labelsDB.getBlock(blockID)
-		if getGroupErr != nil {
-			return false, getGroupErr
+		groupData := bucket.Get([]byte(blockID))
+		if groupData == nil {
+			return ErrWorkItemDoesntExist
+		}
+		var decodeErr error
+		blockGroup, decodeErr = decodeBlockGroupJSON(groupData)
+		if decodeErr != nil {
+			return decodeErr
 		}
 
-		fmt.Println("before blockGroup.deleteInstances()")
-		fmt.Printf("\n\n")
-		fmt.Println(blockGroup)
-		blockGroup.deleteInstances(instanceList)
-		fmt.Println("\n\nafter blockGroup.deleteInstances()")
-		fmt.Printf("\n\n")
-		fmt.Println(blockGroup)
+		unindexErr := unindexBlockGroup(tx, blockGroup)
+		if unindexErr != nil {
+			return unindexErr
+		}
+		blockGroup.deleteInstances(instances)
 
 		/*
 			If there are no more instances of the block left, then we
@@ -526,40 +663,70 @@ func (db *LabelsDB) deleteBlocks(instanceMap InstanceMap) (bool, error) {
 			We delete the Block ID from the keys of the LabelsDB
 		*/
 		if len(blockGroup.Blocks) == 0 {
-			deleteKeyErr := db.db.Update(func(tx *bolt.Tx) error {
-				bucket := tx.Bucket([]byte(labelsBucket))
-				delKeyErr := bucket.Delete([]byte(blockGroup.ID))
-				return delKeyErr
-			})
-
-			if deleteKeyErr != nil {
-				return false, deleteKeyErr
-			}
-			fmt.Println("\n\nblockGroup key delete worked")
-			keyWasDeleted = true
-
-			blockWorkItem := workItemMap[blockGroup.ID]
-			blockWorkItem.TimesCoded = len(blockGroup.Blocks)
-			workItemMap[blockGroup.ID] = blockWorkItem
-			workDB.persistWorkItem(blockWorkItem)
-
-			continue
+			return bucket.Delete([]byte(blockGroup.ID))
 		}
 
 		// Set the updated version of the group, with instance deleted
-		setNewGroupErr := labelsDB.setBlockGroup(*blockGroup)
-		if setNewGroupErr != nil {
-			return keyWasDeleted, setNewGroupErr
+		encodedBlockGroup, encodeErr := blockGroup.encode()
+		if encodeErr != nil {
+			return encodeErr
 		}
+		putErr := bucket.Put([]byte(blockGroup.ID), encodedBlockGroup)
+		if putErr != nil {
+			return putErr
+		}
+		return indexBlockGroup(tx, blockGroup)
+	})
+	if updateErr != nil {
+		return nil, updateErr
+	}
+	return blockGroup, nil
+}
 
-		blockWorkItem := workItemMap[blockGroup.ID]
-		blockWorkItem.TimesCoded = len(blockGroup.Blocks)
-		workItemMap[blockGroup.ID] = blockWorkItem
-		workDB.persistWorkItem(blockWorkItem)
+/*
+	addLabeledBlock stores a submitted Block in the LabelsDB and
+	updates its WorkItem's TimesCoded to match the number of
+	instances in the BlockGroup.
+*/
+func (s *Server) addLabeledBlock(block Block) error {
+	blockGroup, addBlockErr := s.labels.addBlock(block, s.config.passLimits())
+	if addBlockErr != nil {
+		return addBlockErr
+	}
+	return s.setTimesCoded(block.ID, len(blockGroup.Blocks))
+}
+
+func (s *Server) setTimesCoded(blockID string, timesCoded int) error {
+	blockWorkItem := s.updateWorkItem(blockID, func(item *WorkItem) {
+		item.TimesCoded = timesCoded
+	})
+	return s.work.persistWorkItem(blockWorkItem)
+}
+
+/*
+	deleteBlocks deletes all the instances in the InstanceMap from
+	the LabelsDB. It returns true if any BlockGroup was left without
+	instances (and so was deleted entirely).
+*/
+func (s *Server) deleteBlocks(instanceMap InstanceMap) (bool, error) {
+	keyWasDeleted := false
+
+	for blockID, instanceList := range instanceMap {
+		blockGroup, deleteErr := s.labels.deleteInstances(blockID, instanceList)
+		if deleteErr != nil {
+			return keyWasDeleted, deleteErr
+		}
+
+		if len(blockGroup.Blocks) == 0 {
+			slog.Debug("deleted block group", "block_id", blockID)
+			keyWasDeleted = true
+		}
 
-		fmt.Println("\n\ngot past labelsDB.setBlockGroup()")
+		setTimesCodedErr := s.setTimesCoded(blockGroup.ID, len(blockGroup.Blocks))
+		if setTimesCodedErr != nil {
+			return keyWasDeleted, setTimesCodedErr
+		}
 	}
-	fmt.Println("outside of labelsDB.deleteBlocks() for loop, about to return")
 	return keyWasDeleted, nil
 }
 
@@ -570,18 +737,20 @@ func (db *LabelsDB) deleteBlocks(instanceMap InstanceMap) (bool, error) {
 	then we leave the ID in the PastWorkItems list (only deleted one
 	instance of it).
 */
-func (db *LabelsDB) deleteSingleBlock(labKey, coder, blockID string, instance int) error {
+func (s *Server) deleteSingleBlock(labKey, coder, blockID string, instance int) error {
 	// make map
 	singleInstanceMap := make(InstanceMap)
 	singleInstanceMap[blockID] = NewInstanceList(instance)
 
 	// Delete from labelsDB. Function might also delete the BlockGroup entirely,
 	// so it returns a flag
-	groupWasDeleted, _ := db.deleteBlocks(singleInstanceMap)
+	groupWasDeleted, deleteErr := s.deleteBlocks(singleInstanceMap)
+	if deleteErr != nil {
+		return deleteErr
+	}
 
 	if !groupWasDeleted {
-		fmt.Println("\n\ninside !groupWasDeleted")
-		blockGroup, getGroupErr := db.getBlock(blockID)
+		blockGroup, getGroupErr := s.labels.getBlock(blockID)
 		if getGroupErr != nil {
 			return getGroupErr
 		}
@@ -589,49 +758,45 @@ func (db *LabelsDB) deleteSingleBlock(labKey, coder, blockID string, instance in
 		// more than one instance of the same block, so we keep the PastWorkItem entry,
 		// otherwise we delete it
 		if !blockGroup.coderPresent(labKey, coder) {
-			user, getUserErr := labsDB.getUser(labKey, coder)
+			user, getUserErr := s.getUser(labKey, coder)
 			if getUserErr != nil {
 				return getUserErr
 			}
 			user.deletePastItem(blockID)
-			labsDB.setUser(user)
+			return s.setUser(user)
 		}
 	} else {
-		fmt.Println("inside groupWasDeleted")
-		user, getUserErr := labsDB.getUser(labKey, coder)
-		fmt.Println("\n\nuser from labsDB.getUser():")
-		fmt.Println("\n\n", user)
-
+		user, getUserErr := s.getUser(labKey, coder)
 		if getUserErr != nil {
 			return getUserErr
 		}
 		user.deletePastItem(blockID)
-		labsDB.setUser(user)
+		return s.setUser(user)
 	}
 	return nil
 }
 
 /*
 	deleteUserBlocks builds an InstanceMap of all the user's completed
-	instances of blocks, and then pass that map to labelsDB.deleteBlocks()
+	instances of blocks, and then pass that map to deleteBlocks()
 	function. Then we need to delete all of those block entries from the
 	user's PastWorkItems list.
 */
-func (db *LabelsDB) deleteUserBlocks(labKey, username string) error {
+func (s *Server) deleteUserBlocks(labKey, username string) error {
 	// get the user
-	user, getUserErr := labsDB.getUser(labKey, username)
+	user, getUserErr := s.getUser(labKey, username)
 	if getUserErr != nil {
 		return getUserErr
 	}
 
 	// build user's block instance map
-	userInstances, userInstanceErr := user.getPastBlockInstanceMap()
+	userInstances, userInstanceErr := s.labels.getCoderInstanceMap(user.ParentLab, user.Name)
 	if userInstanceErr != nil {
 		return userInstanceErr
 	}
 
 	// delete those instances
-	_, deleteUserInstErr := labelsDB.deleteBlocks(userInstances)
+	_, deleteUserInstErr := s.deleteBlocks(userInstances)
 	if deleteUserInstErr != nil {
 		return deleteUserInstErr
 	}
@@ -640,33 +805,31 @@ func (db *LabelsDB) deleteUserBlocks(labKey, username string) error {
 	user.PastWorkItems = nil
 	user.CompleteTrainBlocks = nil
 	user.CompleteRelBlocks = nil
-	labsDB.setUser(user)
-	return nil
+	return s.setUser(user)
 }
 
 /*
 	deleteLabBlocks builds an InstanceMap of all the lab's completed
-	instances of blocks, and then pass that map to labelsDB.deleteBlocks()
+	instances of blocks, and then pass that map to deleteBlocks()
 	function. Then we need to delete all block entries from all of the lab's
 	user's PastWorkItems lists.
 */
-func (db *LabelsDB) deleteLabBlocks(labKey string) error {
+func (s *Server) deleteLabBlocks(labKey string) error {
 
 	// get the lab
-	lab, getLabErr := labsDB.getLab(labKey)
+	lab, getLabErr := s.labs.getLab(labKey)
 	if getLabErr != nil {
 		return getLabErr
 	}
 
-	fmt.Println("inside labelsDB.deleteLabBlocks() ----- got the lab")
 	// get all block instances submitted by the lab
-	labInstanceMap, labInstanceErr := lab.getPastBlockInstanceMap()
+	labInstanceMap, labInstanceErr := s.labels.getLabInstanceMap(lab.Key)
 	if labInstanceErr != nil {
 		return labInstanceErr
 	}
 
 	// delete all those instances from LabelsDB
-	_, deleteLabInstErr := db.deleteBlocks(labInstanceMap)
+	_, deleteLabInstErr := s.deleteBlocks(labInstanceMap)
 	if deleteLabInstErr != nil {
 		return deleteLabInstErr
 	}
@@ -680,6 +843,5 @@ func (db *LabelsDB) deleteLabBlocks(labKey string) error {
 		lab.Users[index] = user
 	}
 
-	labsDB.setLab(lab.Key, lab)
-	return nil
+	return s.labs.setLab(lab.Key, lab)
 }
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestBlockGroupAddBlockPassLimits(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		limits PassLimits
+		labKey string
+		coder  string
+		want   error
+	}{
+		{"lab limit", PassLimits{PerLab: 1}, "lab1", "amy", ErrLabPassLimitReached},
+		{"lab limit, other lab", PassLimits{PerLab: 1}, "lab2", "bob", nil},
+		{"lab limit not reached", PassLimits{PerLab: 2}, "lab1", "amy", nil},
+		{"coder limit", PassLimits{PerCoder: 1}, "lab1", "alice", ErrCoderPassLimitReached},
+		{"coder limit, other coder", PassLimits{PerCoder: 1}, "lab1", "amy", nil},
+		{"no limits", PassLimits{}, "lab1", "alice", nil},
+	} {
+		// alice of lab1 has coded the block once
+		group := BlockGroup{ID: "a.cha:::1"}
+		if err := group.addBlock(Block{ID: "a.cha:::1", LabKey: "lab1", Coder: "alice"}, test.limits); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		err := group.addBlock(Block{ID: "a.cha:::1", LabKey: test.labKey, Coder: test.coder}, test.limits)
+		if err != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+		wantBlocks := 2
+		if test.want != nil {
+			wantBlocks = 1
+		}
+		if len(group.Blocks) != wantBlocks {
+			t.Errorf("%s: got %d blocks, want %d", test.name, len(group.Blocks), wantBlocks)
+		}
+	}
+
+	// the limits don't apply to training or reliability blocks
+	limits := PassLimits{PerLab: 1, PerCoder: 1}
+	group := BlockGroup{ID: "t.cha:::1", Training: true}
+	for i := 0; i < 2; i++ {
+		block := Block{ID: "t.cha:::1", LabKey: "lab1", Coder: "alice", Training: true}
+		if err := group.addBlock(block, limits); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+	The LabelsDB keeps a few secondary index buckets next to the
+	Labels bucket so that we don't have to scan (and decode) every
+	BlockGroup, or walk every User's PastWorkItems, to answer simple
+	questions like "which blocks has this lab coded?".
+
+	All of the indexes are nested buckets, and they're always updated
+	in the same bolt transaction as the BlockGroup they describe:
+
+	LabIndex:       lab_key -> { block_id : "" }
+	CoderIndex:     lab_key:::coder -> { block_id : [instances] }
+	ClanFileIndex:  clan_file -> { block_id : "" }
+*/
+
+const (
+	// name of the lab -> block ID index bucket
+	labIndexBucket = "LabIndex"
+
+	// name of the coder -> block ID/instance index bucket
+	coderIndexBucket = "CoderIndex"
+
+	// name of the CLAN file -> block ID index bucket
+	clanFileIndexBucket = "ClanFileIndex"
+)
+
+var indexBuckets = []string{labIndexBucket, coderIndexBucket, clanFileIndexBucket}
+
+/*
+coderIndexKey is the key of a coder's bucket in the
+CoderIndex. It's the same format as IDSRequest.userID()
+*/
+func coderIndexKey(labKey, coder string) string {
+	return labKey + ":::" + coder
+}
+
+/*
+indexBlockGroup adds entries for every instance in the
+group to the index buckets.
+*/
+func indexBlockGroup(tx *bolt.Tx, group *BlockGroup) error {
+	coderInstances := make(InstanceMap)
+
+	for _, block := range group.Blocks {
+		if block.LabKey != "" {
+			labBucket, err := tx.Bucket([]byte(labIndexBucket)).CreateBucketIfNotExists([]byte(block.LabKey))
+			if err != nil {
+				return err
+			}
+			if err := labBucket.Put([]byte(group.ID), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		if block.ClanFile != "" {
+			fileBucket, err := tx.Bucket([]byte(clanFileIndexBucket)).CreateBucketIfNotExists([]byte(block.ClanFile))
+			if err != nil {
+				return err
+			}
+			if err := fileBucket.Put([]byte(group.ID), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		key := coderIndexKey(block.LabKey, block.Coder)
+		if _, exists := coderInstances[key]; exists {
+			coderInstances[key].addInstance(block.Instance)
+		} else {
+			coderInstances[key] = NewInstanceList(block.Instance)
+		}
+	}
+
+	for key, instances := range coderInstances {
+		coderBucket, err := tx.Bucket([]byte(coderIndexBucket)).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		encodedInstances, err := json.Marshal(instances)
+		if err != nil {
+			return err
+		}
+		if err := coderBucket.Put([]byte(group.ID), encodedInstances); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+unindexBlockGroup removes all the index entries for the
+group. It has to be called with the group as it is on disk,
+before it gets modified.
+*/
+func unindexBlockGroup(tx *bolt.Tx, group *BlockGroup) error {
+	for _, block := range group.Blocks {
+		if err := deleteIndexEntry(tx, labIndexBucket, block.LabKey, group.ID); err != nil {
+			return err
+		}
+		if err := deleteIndexEntry(tx, clanFileIndexBucket, block.ClanFile, group.ID); err != nil {
+			return err
+		}
+		coderKey := coderIndexKey(block.LabKey, block.Coder)
+		if err := deleteIndexEntry(tx, coderIndexBucket, coderKey, group.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+deleteIndexEntry deletes the blockID from the nested bucket
+indexKey in the index bucket. Nested buckets that end up empty
+are removed.
+*/
+func deleteIndexEntry(tx *bolt.Tx, index, indexKey, blockID string) error {
+	if indexKey == "" {
+		return nil
+	}
+	indexBucket := tx.Bucket([]byte(index))
+	nested := indexBucket.Bucket([]byte(indexKey))
+	if nested == nil {
+		return nil
+	}
+	if err := nested.Delete([]byte(blockID)); err != nil {
+		return err
+	}
+	if key, _ := nested.Cursor().First(); key == nil {
+		return indexBucket.DeleteBucket([]byte(indexKey))
+	}
+	return nil
+}
+
+/*
+rebuildIndexes drops all the index buckets and rebuilds them
+from the contents of the Labels bucket.
+*/
+func (db *LabelsDB) rebuildIndexes() (int, error) {
+	var numGroups int
+
+	err := db.metrics.timeTx("labels", "update", db.db.Update, func(tx *bolt.Tx) error {
+		for _, index := range indexBuckets {
+			if tx.Bucket([]byte(index)) != nil {
+				if err := tx.DeleteBucket([]byte(index)); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.CreateBucket([]byte(index)); err != nil {
+				return err
+			}
+		}
+
+		cursor := tx.Bucket([]byte(labelsBucket)).Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			blockGroup, err := decodeBlockGroupJSON(value)
+			if err != nil {
+				return err
+			}
+			if err := indexBlockGroup(tx, blockGroup); err != nil {
+				return err
+			}
+			numGroups++
+		}
+		return nil
+	})
+	return numGroups, err
+}
+
+/*
+indexedBlockIDs returns all the block ID's in the nested
+bucket indexKey of the index bucket.
+*/
+func (db *LabelsDB) indexedBlockIDs(index, indexKey string) (BlockIDList, error) {
+	var blockIDs BlockIDList
+
+	err := db.metrics.timeTx("labels", "view", db.db.View, func(tx *bolt.Tx) error {
+		nested := tx.Bucket([]byte(index)).Bucket([]byte(indexKey))
+		if nested == nil {
+			return nil
+		}
+		return nested.ForEach(func(key, _ []byte) error {
+			blockIDs.addID(string(key))
+			return nil
+		})
+	})
+	return blockIDs, err
+}
+
+/*
+getLabBlockIDs returns the ID's of all the blocks which
+have at least one instance coded by this lab
+*/
+func (db *LabelsDB) getLabBlockIDs(labKey string) (BlockIDList, error) {
+	return db.indexedBlockIDs(labIndexBucket, labKey)
+}
+
+/*
+getFileBlockIDs returns the ID's of all the labeled
+blocks from this CLAN file
+*/
+func (db *LabelsDB) getFileBlockIDs(clanFile string) (BlockIDList, error) {
+	return db.indexedBlockIDs(clanFileIndexBucket, clanFile)
+}
+
+/*
+getCoderInstanceMap returns an InstanceMap of all the block
+instances submitted by this coder.
+*/
+func (db *LabelsDB) getCoderInstanceMap(labKey, coder string) (InstanceMap, error) {
+	instanceMap := make(InstanceMap)
+
+	err := db.metrics.timeTx("labels", "view", db.db.View, func(tx *bolt.Tx) error {
+		nested := tx.Bucket([]byte(coderIndexBucket)).Bucket([]byte(coderIndexKey(labKey, coder)))
+		if nested == nil {
+			return nil
+		}
+		return addCoderInstances(nested, instanceMap)
+	})
+	return instanceMap, err
+}
+
+/*
+getLabInstanceMap returns an InstanceMap of all the block
+instances submitted by every coder in this lab.
+*/
+func (db *LabelsDB) getLabInstanceMap(labKey string) (InstanceMap, error) {
+	instanceMap := make(InstanceMap)
+	prefix := []byte(coderIndexKey(labKey, ""))
+
+	err := db.metrics.timeTx("labels", "view", db.db.View, func(tx *bolt.Tx) error {
+		coderIndex := tx.Bucket([]byte(coderIndexBucket))
+		cursor := coderIndex.Cursor()
+
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			nested := coderIndex.Bucket(key)
+			if nested == nil {
+				continue
+			}
+			if err := addCoderInstances(nested, instanceMap); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return instanceMap, err
+}
+
+func addCoderInstances(coderBucket *bolt.Bucket, instanceMap InstanceMap) error {
+	return coderBucket.ForEach(func(key, value []byte) error {
+		var instances InstanceList
+		if err := json.Unmarshal(value, &instances); err != nil {
+			return err
+		}
+		blockID := string(key)
+		if _, exists := instanceMap[blockID]; !exists {
+			instanceMap[blockID] = &InstanceList{}
+		}
+		for _, instance := range instances {
+			instanceMap[blockID].addInstance(instance)
+		}
+		return nil
+	})
+}
@@ -3,17 +3,12 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
-	"log"
+	"log/slog"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
 
-var (
-	// path to the LabsDB file
-	labsDBPath = mainConfig.LabsDBPath
-)
-
 const (
 	labsBucket = "Labs"
 )
@@ -60,6 +55,12 @@ type User struct {
 	PastWorkItems       BlockIDList `json:"finished_work_items"`
 	CompleteTrainBlocks BlockIDList `json:"complete_train_blocks"`
 	CompleteRelBlocks   BlockIDList `json:"complete_reliability_blocks"`
+
+	// CheckedOut is when each of the ActiveWorkItems was checked out
+	CheckedOut map[string]time.Time `json:"checked_out"`
+
+	// Released is how many blocks the user gave back without labels
+	Released int `json:"released"`
 }
 
 func (user *User) addWorkItem(itemID string) {
@@ -70,6 +71,19 @@ func (user *User) addWorkItem(itemID string) {
 		}
 	}
 	user.ActiveWorkItems.addID(itemID)
+	if user.CheckedOut == nil {
+		user.CheckedOut = make(map[string]time.Time)
+	}
+	user.CheckedOut[itemID] = time.Now().UTC()
+}
+
+/*
+checkedOutAt is when the user checked out the active
+block, false for blocks checked out before it was recorded
+*/
+func (user *User) checkedOutAt(blockID string) (time.Time, bool) {
+	checkedOut, exists := user.CheckedOut[blockID]
+	return checkedOut, exists
 }
 
 func (user *User) addCompleteTrainBlock(block Block) {
@@ -115,6 +129,7 @@ func (user *User) inactivateWorkItem(item WorkItem) error {
 			user.PastWorkItems.addID(item.ID)
 		}
 		user.ActiveWorkItems = newActiveItems
+		delete(user.CheckedOut, item.ID)
 	} else {
 		return ErrUserNotAssignedWorkItem
 	}
@@ -134,44 +149,15 @@ func (user *User) inactivateIncompleteWorkItem(item WorkItem) error {
 	}
 	//user.PastWorkItems = append(user.PastWorkItems, item)
 	user.ActiveWorkItems = newActiveItems
+	delete(user.CheckedOut, item.ID)
 
 	if !foundItem {
 		return ErrUserNotAssignedWorkItem
 	}
+	user.Released++
 	return nil
 }
 
-func (user *User) getPastBlockInstanceMap() (InstanceMap, error) {
-	instanceMap := make(InstanceMap)
-	fmt.Println("inside user.getPastBlockInstanceMap ----- made the map")
-	for _, blockID := range user.PastWorkItems {
-		blockGroup, blockGroupErr := labelsDB.getBlock(blockID)
-		if blockGroupErr != nil {
-			return instanceMap, blockGroupErr
-		}
-		fmt.Println("inside user.getPastBlockInstanceMap ----- got a blockGroup")
-		userInstances := blockGroup.getUsersBlocks(user.ParentLab, user.Name)
-		for _, block := range userInstances {
-
-			if _, exists := instanceMap[block.ID]; exists {
-				instanceMap[block.ID].addInstance(block.Instance)
-			} else {
-				instanceMap[block.ID] = &InstanceList{}
-				instanceMap[block.ID].addInstance(block.Instance)
-			}
-			fmt.Println("inside user.getPastBlockInstanceMap ----- added instance to map")
-		}
-	}
-	fmt.Println("The instanceMap being returned from user.getPastBlockInstanceMap(): ")
-	for key, value := range instanceMap {
-		for _, instance := range *value {
-			fmt.Println("\nkey: ", key, "\t", "inst: ", instance)
-		}
-	}
-	fmt.Println("\n\n", instanceMap)
-	return instanceMap, nil
-}
-
 func (user *User) deletePastItem(blockID string) {
 	var newBlockIDList BlockIDList
 	var newTrainIDList BlockIDList
@@ -261,324 +247,217 @@ func (lab *Lab) deleteUser(user string) {
 	delete(lab.Users, user)
 }
 
-func (lab *Lab) getPastBlockInstanceMap() (InstanceMap, error) {
-	instanceMap := make(InstanceMap)
-
+func (lab *Lab) getCompletedBlocks() BlockIDList {
+	var blocks BlockIDList
 	for _, user := range lab.Users {
 		for _, blockID := range user.PastWorkItems {
-			blockGroup, blockGroupErr := labelsDB.getBlock(blockID)
-			if blockGroupErr != nil {
-				fmt.Println("\nlabelsDB.getBlock() failed in lab.getPastBlockInstanceMap()")
-				return instanceMap, blockGroupErr
-			}
-			userInstances := blockGroup.getUsersBlocks(user.ParentLab, user.Name)
-			for _, block := range userInstances {
-				if _, exists := instanceMap[block.ID]; exists {
-					instanceMap[block.ID].addInstance(block.Instance)
-				} else {
-					instanceMap[block.ID] = &InstanceList{}
-					instanceMap[block.ID].addInstance(block.Instance)
-				}
-
-				// fmt.Println("\n\n\nbefore map access in getPastBlockInstanceMap")
-				// instanceMap[block.ID].addInstance(block.Instance)
-				// fmt.Println("\n\n\nafter map access in getPastBlockInstanceMap")
-			}
-			fmt.Printf("\nthe instanceMap from lab.getPastBlockInstanceMap():  \n\n")
-			fmt.Println(instanceMap)
+			blocks.addID(blockID)
+		}
+	}
+	return blocks
+}
+
+func (lab *Lab) getCompleteTrainBlocks() BlockIDList {
+	var blocks BlockIDList
+	for _, user := range lab.Users {
+		for _, block := range user.CompleteTrainBlocks {
+			blocks.addID(block)
 		}
 	}
-	return instanceMap, nil
+	return blocks
+}
+
+func (lab *Lab) getCompleteReliaBlocks() BlockIDList {
+	var blocks BlockIDList
+	for _, user := range lab.Users {
+		for _, block := range user.CompleteRelBlocks {
+			blocks.addID(block)
+		}
+	}
+	return blocks
 }
 
 // LabsDB is a wrapper around a boltdb
 type LabsDB struct {
-	db *bolt.DB
+	db      *bolt.DB
+	metrics *Metrics
 }
 
-// LoadLabsDB loads the global LabsDB
-func LoadLabsDB() *LabsDB {
-	localLabsDB := &LabsDB{db: new(bolt.DB)}
-	err := localLabsDB.Open()
+// LoadLabsDB opens the LabsDB stored at path
+func LoadLabsDB(path string) (*LabsDB, error) {
+	localLabsDB := &LabsDB{}
+	err := localLabsDB.Open(path)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	return localLabsDB
+	return localLabsDB, nil
 }
 
 // Open opens the database and returns error on failure
-func (db *LabsDB) Open() error {
-	labsDB, openErr := bolt.Open(labsDBPath, 0600, nil)
-
+func (db *LabsDB) Open(path string) error {
+	labsDB, openErr := bolt.Open(path, 0600, nil)
 	if openErr != nil {
-		log.Fatal(openErr)
 		return openErr
 	}
 
 	db.db = labsDB
 
-	err := db.db.Update(func(tx *bolt.Tx) error {
+	err := db.metrics.timeTx("labs", "update", db.db.Update, func(tx *bolt.Tx) error {
 		_, updateErr := tx.CreateBucketIfNotExists([]byte(labsBucket))
-		if updateErr != nil {
-			log.Fatal(updateErr)
-			return updateErr
-		}
 		return updateErr
 	})
-
+	if err != nil {
+		db.db.Close()
+	}
 	return err
 }
 
 // Close closes the database
-func (db *LabsDB) Close() {
-	db.db.Close()
+func (db *LabsDB) Close() error {
+	return db.db.Close()
 }
 
-func (db *LabsDB) addUser(labKey, labName, username string) {
-	newUser := User{Name: username,
-		ParentLab:       labKey,
-		ActiveWorkItems: make(BlockIDList, 0)}
-
-	if db.labExists(labKey) {
-		if db.userExists(labKey, username) {
-			fmt.Println("This user already exists")
-			return
-		}
-		lab, _ := db.getLab(labKey)
-		lab.addUser(newUser)
-		db.setLab(labKey, lab)
-	} else {
-		db.createLabAddUser(labKey, labName, username)
-	}
+func (db *LabsDB) boltDB() *bolt.DB {
+	return db.db
 }
 
-func (db *LabsDB) labExists(labKey string) bool {
-	var exists bool
-
-	fmt.Println("Check for lab key existence: ")
-	fmt.Println(labKey)
+func (db *LabsDB) getLab(labKey string) (*Lab, error) {
+	var labData *Lab
 
-	db.db.View(func(tx *bolt.Tx) error {
+	err := db.metrics.timeTx("labs", "view", db.db.View, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(labsBucket))
 		lab := bucket.Get([]byte(labKey))
 
 		// lab key doesn't exist
 		if lab == nil {
-			exists = false
-		} else {
-			exists = true
+			return ErrLabDoesntExist
 		}
-		return nil
-	})
-	return exists
-}
 
-// userExists assumes that the lab exists
-func (db *LabsDB) userExists(labKey, username string) bool {
-	var userExists = false
-	err := db.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(labsBucket))
-		lab := bucket.Get([]byte(labKey))
-
-		labData, err := decodeLabJSON(lab)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		_, exists := labData.Users[username]
-		if exists {
-			userExists = true
-			fmt.Println("inside labsDB.userExists(): userExists = true")
-		} else {
-			userExists = false
-		}
-		return err
+		var decodeErr error
+		labData, decodeErr = decodeLabJSON(lab)
+		return decodeErr
 	})
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return userExists
+	return labData, err
 }
 
-func (db *LabsDB) getLab(labKey string) (*Lab, error) {
-	if !db.labExists(labKey) {
-		return nil, ErrLabDoesntExist
-	}
-	var lab []byte
-	db.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(labsBucket))
-		lab = bucket.Get([]byte(labKey))
-		return nil
-	})
-
-	labData, err := decodeLabJSON(lab)
-	//fmt.Println(labData)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return labData, nil
-}
-
-func (db *LabsDB) setLab(labKey string, data *Lab) {
+func (db *LabsDB) setLab(labKey string, data *Lab) error {
 	encodedLab, err := data.encode()
 	if err != nil {
-		log.Fatal(err)
-		return
+		return err
 	}
 
-	db.db.Update(func(tx *bolt.Tx) error {
+	return db.metrics.timeTx("labs", "update", db.db.Update, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(labsBucket))
 		err := bucket.Put([]byte(labKey), encodedLab)
 		return err
 	})
 }
 
-func (db *LabsDB) createLab(labKey, labName string) {
-	newLab := Lab{Key: labKey,
-		LabName: labName,
-		Users:   make(map[string]User)}
-	encodedLab, err := newLab.encode()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	db.db.Update(func(tx *bolt.Tx) error {
+func (db *LabsDB) setLabs(labs []*Lab) error {
+	return db.metrics.timeTx("labs", "update", db.db.Update, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(labsBucket))
-		err := bucket.Put([]byte(labKey), encodedLab)
-		return err
+		for _, lab := range labs {
+			encodedLab, err := lab.encode()
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(lab.Key), encodedLab); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 }
 
-func (db *LabsDB) createLabAddUser(labKey, labName, username string) {
-	newLab := Lab{Key: labKey,
-		LabName: labName,
-		Users:   make(map[string]User)}
-
-	newUser := User{Name: username}
-	newLab.addUser(newUser)
-	encodedLab, err := newLab.encode()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	db.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(labsBucket))
-		err := bucket.Put([]byte(labKey), encodedLab)
-		return err
+func (db *LabsDB) deleteLab(labKey string) error {
+	return db.metrics.timeTx("labs", "update", db.db.Update, func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(labsBucket)).Delete([]byte(labKey))
 	})
 }
 
-func (db *LabsDB) getAllLabs() []*Lab {
+func (db *LabsDB) getAllLabs() ([]*Lab, error) {
 	var labs []*Lab
-	err := db.db.View(func(tx *bolt.Tx) error {
+	err := db.metrics.timeTx("labs", "view", db.db.View, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(labsBucket))
 
 		cursor := bucket.Cursor()
 
 		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
-			fmt.Printf("key=%s, value=%s\n", k, v)
 			currLab, err := decodeLabJSON(v)
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
 			labs = append(labs, currLab)
 		}
 
 		return nil
 	})
-	if err != nil {
-		log.Fatal(err)
+	return labs, err
+}
+
+func (s *Server) addUser(labKey, labName, username string) error {
+	newUser := User{Name: username,
+		ParentLab:       labKey,
+		ActiveWorkItems: make(BlockIDList, 0)}
+
+	lab, getLabErr := s.labs.getLab(labKey)
+	if getLabErr == ErrLabDoesntExist {
+		lab = &Lab{Key: labKey,
+			LabName: labName,
+			Users:   make(map[string]User)}
+	} else if getLabErr != nil {
+		return getLabErr
 	}
-	return labs
+
+	if _, exists := lab.Users[username]; exists {
+		slog.Debug("user already exists", "lab_key_hash", labKeyHash(labKey), "username", username)
+		return nil
+	}
+	lab.addUser(newUser)
+	return s.labs.setLab(labKey, lab)
+}
+
+func (s *Server) labExists(labKey string) bool {
+	_, err := s.labs.getLab(labKey)
+	return err == nil
 }
 
-func (db *LabsDB) getUser(labKey, username string) (User, error) {
-	fmt.Println("\n\n\ntrying to get lab:  " + labKey)
-	lab, err := db.getLab(labKey)
+func (s *Server) userExists(labKey, username string) bool {
+	_, err := s.getUser(labKey, username)
+	return err == nil
+}
+
+func (s *Server) getUser(labKey, username string) (User, error) {
+	lab, err := s.labs.getLab(labKey)
 	if err != nil {
-		fmt.Println("\ngetLab in getUser failed")
 		return User{}, err
 	}
 
-	fmt.Println("\n\nthe lab from db.getLab():")
-	fmt.Println(lab)
-
 	user, exists := lab.Users[username]
 	if !exists {
-		fmt.Println("lab[username] map access failed")
-		fmt.Printf("tried to find username: ")
-		fmt.Println(username)
 		return user, ErrUserDoesntExist
 	}
 	return user, nil
 }
 
-func (db *LabsDB) setUser(user User) error {
-	lab, getLabErr := db.getLab(user.ParentLab)
+func (s *Server) setUser(user User) error {
+	lab, getLabErr := s.labs.getLab(user.ParentLab)
 	if getLabErr != nil {
 		return ErrLabDoesntExist
 	}
 	lab.Users[user.Name] = user
-	db.setLab(lab.Key, lab)
-	return nil
+	return s.labs.setLab(lab.Key, lab)
 }
 
-func (db *LabsDB) getCompletedBlocks(labKey string) (BlockIDList, error) {
-	var blocks BlockIDList
-
-	lab, getLabErr := db.getLab(labKey)
-	if getLabErr != nil {
-		return blocks, getLabErr
-	}
-
-	for _, user := range lab.Users {
-		for _, blockID := range user.PastWorkItems {
-			blocks.addID(blockID)
-		}
-	}
-	return blocks, nil
-}
-
-func (db *LabsDB) getCompleteTrainBlocks(labKey string) (BlockIDList, error) {
-	var blocks BlockIDList
-	lab, err := db.getLab(labKey)
-	if err != nil {
-		return blocks, err
-	}
-	for _, user := range lab.Users {
-		for _, block := range user.CompleteTrainBlocks {
-			blocks.addID(block)
-		}
-	}
-	return blocks, nil
-}
-
-func (db *LabsDB) getCompleteReliaBlocks(labKey string) (BlockIDList, error) {
-	var blocks BlockIDList
-	lab, err := db.getLab(labKey)
-	if err != nil {
-		return blocks, err
-	}
-	for _, user := range lab.Users {
-		for _, block := range user.CompleteRelBlocks {
-			blocks.addID(block)
-		}
-	}
-	return blocks, nil
-}
-
-func (db *LabsDB) deleteUser(labKey, username string) error {
-	deleteBlocksErr := labelsDB.deleteUserBlocks(labKey, username)
+func (s *Server) deleteUser(labKey, username string) error {
+	deleteBlocksErr := s.deleteUserBlocks(labKey, username)
 	if deleteBlocksErr != nil {
 		return deleteBlocksErr
 	}
-	lab, getLabErr := db.getLab(labKey)
+	lab, getLabErr := s.labs.getLab(labKey)
 	if getLabErr != nil {
 		return getLabErr
 	}
 	lab.deleteUser(username)
-	labsDB.setLab(labKey, lab)
-	return nil
+	return s.labs.setLab(labKey, lab)
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// requestIDHeader carries the request ID, taken from the
+	// request if a proxy in front set it, and sent back
+	requestIDHeader = "X-Request-ID"
+
+	// names of the log formats for the config's "log_format"
+	jsonLogFormat = "json"
+	textLogFormat = "text"
+)
+
+/*
+quietRoutes are polled by monitoring, so their
+successful requests are only logged at debug
+*/
+var quietRoutes = map[string]bool{
+	"/metrics": true,
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+var (
+	// ErrUnknownLogLevel means the config's log_level isn't one of debug, info, warn or error
+	ErrUnknownLogLevel = errors.New("Unknown log_level in config (must be \"debug\", \"info\", \"warn\" or \"error\")")
+
+	// ErrUnknownLogFormat means the config's log_format isn't json or text
+	ErrUnknownLogFormat = errors.New("Unknown log_format in config (must be \"json\" or \"text\")")
+)
+
+/*
+newLogger makes the logger the config asks for: JSON lines by
+default, or logfmt with "log_format": "text", at log_level
+(info by default)
+*/
+func (conf *Config) newLogger(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	switch strings.ToLower(conf.LogLevel) {
+	case "debug":
+		level = slog.LevelDebug
+	case "", "info":
+		level = slog.LevelInfo
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		return nil, ErrUnknownLogLevel
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	switch conf.LogFormat {
+	case "", jsonLogFormat:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	case textLogFormat:
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	}
+	return nil, ErrUnknownLogFormat
+}
+
+/*
+setupLogging makes the configured logger the default one, which
+everything logs through (the logger of a request adds its fields)
+*/
+func (conf *Config) setupLogging() error {
+	logger, err := conf.newLogger(os.Stderr)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+/*
+labKeyHash identifies a lab key in the logs
+without writing the key itself there
+*/
+func labKeyHash(labKey string) string {
+	if labKey == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(labKey))
+	return hex.EncodeToString(sum[:6])
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
+
+/*
+requestInfo is who a request is from and what it's about, for
+its log lines. The route and ID are known when it comes in, the
+rest once the handler has read the body (see annotateRequest).
+*/
+type requestInfo struct {
+	mu       sync.Mutex
+	id       string
+	route    string
+	labKey   string
+	username string
+	blockID  string
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFrom(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+/*
+annotateRequest records the lab key, user and block a request
+is about, so they're on its log lines from then on. Empty values
+don't overwrite what's already there.
+*/
+func annotateRequest(r *http.Request, labKey, username, blockID string) {
+	info := requestInfoFrom(r)
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if labKey != "" {
+		info.labKey = labKey
+	}
+	if username != "" {
+		info.username = username
+	}
+	if blockID != "" {
+		info.blockID = blockID
+	}
+}
+
+func (info *requestInfo) attrs() []interface{} {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	attrs := []interface{}{"request_id", info.id, "route", info.route}
+	if info.labKey != "" {
+		attrs = append(attrs, "lab_key_hash", labKeyHash(info.labKey))
+	}
+	if info.username != "" {
+		attrs = append(attrs, "username", info.username)
+	}
+	if info.blockID != "" {
+		attrs = append(attrs, "block_id", info.blockID)
+	}
+	return attrs
+}
+
+/*
+requestLogger is the default logger with the request's
+ID, route, lab key hash, username and block ID
+*/
+func requestLogger(r *http.Request) *slog.Logger {
+	info := requestInfoFrom(r)
+	if info == nil {
+		return slog.Default()
+	}
+	return slog.Default().With(info.attrs()...)
+}
+
+/*
+logRequests gives every request an ID and logs it once it's
+been handled, with its status and how long it took
+*/
+func (s *Server) logRequests(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		info := &requestInfo{id: id, route: route}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		w.Header().Set(requestIDHeader, id)
+
+		recorder := &statusRecorder{ResponseWriter: w, code: 200}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+
+		level := slog.LevelInfo
+		switch {
+		case recorder.code >= 500:
+			level = slog.LevelError
+		case recorder.code >= 400:
+			level = slog.LevelWarn
+		case quietRoutes[route]:
+			level = slog.LevelDebug
+		}
+		requestLogger(r).Log(r.Context(), level, "request",
+			"method", r.Method, "path", r.URL.Path, "status", recorder.code,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000)
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	for _, test := range []struct {
+		level, format string
+		want          error
+		logsDebug     bool
+		logsInfo      bool
+		json          bool
+	}{
+		{"", "", nil, false, true, true},
+		{"debug", "", nil, true, true, true},
+		{"INFO", "json", nil, false, true, true},
+		{"warn", "text", nil, false, false, false},
+		{"error", "", nil, false, false, true},
+		{"verbose", "", ErrUnknownLogLevel, false, false, false},
+		{"", "xml", ErrUnknownLogFormat, false, false, false},
+	} {
+		var out bytes.Buffer
+		config := Config{LogLevel: test.level, LogFormat: test.format}
+		logger, err := config.newLogger(&out)
+		if err != test.want {
+			t.Errorf("%q %q: got %v, want %v", test.level, test.format, err, test.want)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		logger.Debug("debug line")
+		logger.Info("info line")
+		logger.Error("error line")
+		logged := out.String()
+		if strings.Contains(logged, "debug line") != test.logsDebug ||
+			strings.Contains(logged, "info line") != test.logsInfo ||
+			!strings.Contains(logged, "error line") {
+			t.Errorf("%q %q: logged %s", test.level, test.format, logged)
+		}
+		if json.Valid([]byte(strings.Split(logged, "\n")[0])) != test.json {
+			t.Errorf("%q %q: got %s, want JSON %v", test.level, test.format, logged, test.json)
+		}
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	server := newHandlerTestServer(t, t.TempDir())
+	var out bytes.Buffer
+	server.config.LogLevel = "debug"
+	logger, err := server.config.newLogger(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultLogger := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(defaultLogger)
+
+	for _, test := range []struct {
+		method, url string
+		body        interface{}
+		requestID   string
+		level       string
+		fields      map[string]interface{}
+	}{
+		{http.MethodPost, "/v1/get-block/", BlockReq{LabKey: "lab1", Username: "alice"}, "", "INFO",
+			map[string]interface{}{"route": "/v1/get-block/", "status": 200.0,
+				"lab_key_hash": labKeyHash("lab1"), "username": "alice", "block_id": "a.cha:::1"}},
+		{http.MethodPost, "/v1/get-block/", BlockReq{LabKey: "lab3", Username: "alice"}, "from-the-proxy", "WARN",
+			map[string]interface{}{"request_id": "from-the-proxy", "status": 401.0,
+				"lab_key_hash": labKeyHash("lab3")}},
+		{http.MethodGet, "/healthz", nil, "", "DEBUG",
+			map[string]interface{}{"route": "/healthz", "status": 200.0}},
+	} {
+		out.Reset()
+		var body bytes.Buffer
+		if test.body != nil {
+			json.NewEncoder(&body).Encode(test.body)
+		}
+		request := httptest.NewRequest(test.method, test.url, &body)
+		if test.requestID != "" {
+			request.Header.Set(requestIDHeader, test.requestID)
+		}
+		recorder := httptest.NewRecorder()
+		server.handler().ServeHTTP(recorder, request)
+
+		// the request line is the last one logged
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		var logged map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &logged); err != nil {
+			t.Fatalf("%s: %v: %s", test.url, err, out.String())
+		}
+		if logged["msg"] != "request" || logged["level"] != test.level ||
+			logged["request_id"] != recorder.Header().Get(requestIDHeader) {
+			t.Errorf("%s: logged %v", test.url, logged)
+		}
+		for name, want := range test.fields {
+			if logged[name] != want {
+				t.Errorf("%s: logged %s %v, want %v", test.url, name, logged[name], want)
+			}
+		}
+		if strings.Contains(out.String(), `"lab1"`) || strings.Contains(out.String(), `"lab3"`) {
+			t.Errorf("%s: a lab key was logged: %s", test.url, out.String())
+		}
+	}
+}
@@ -1,91 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
-)
-
-var (
-	/*
-		labsDB is the wrapper around the lab user info database.
-		It keeps track of all the users and the current jobs that
-		have been handed out to them.
-	*/
-	labsDB *LabsDB
-
-	/*
-		workDB is the wrapper around the database that keeps track of
-		all the jobs that have been assigned and yet to be assigned.
-	*/
-	workDB *WorkDB
-
-	/*
-		labelsDB is the wrapper around the database that stores all the
-		classifications that the users send back to the server. Keys are
-		Block ID's, values are Block JSONs
-	*/
-	labelsDB *LabelsDB
-
-	/*
-		manifestFile is the path to the path_manifests.csv file.
-		This contains the name of the clan files and the paths to
-		all the blocks that are a part of them.
-
-		format:
-
-		[clan_file, block_index, path_to_block]
-
-	*/
-	manifestFile string
-
-	/*
-		configFile is the path to the main config file,
-		which has the server admin keys and other metadata
-	*/
-	configFile string
-
-	/*
-		mainConfig is the Config struct produced from reading
-		the configFile
-	*/
-	mainConfig Config
-
-	/*
-		dataMap is the global map of CLAN files to block paths
-	*/
-	dataMap DataMap
-
-	/*
-		workItemMap is a map of WorkItem to bool.
-		The boolean value represents whether or not
-		the particular work item is active or not.
-		Active means it's been sent out for coding
-		and has not been submitted back yet.
-	*/
-	workItemMap WorkItemMap
-
-	/*
-		workItemMapEncoded is a json encoded version of the workItemMap
-	*/
-	workItemMapEncoded []byte
-
-	/*
-		activeWorkItems is a map of WorkItem ID's. All the ID's
-		represent blocks which have been sent out to be worked on.
-		(i.e. active blocks)
-
-		format:
-
-		map["30_13_coderJS_final-2:::6" : true , "32_13_coderJS_final-5:::16" : true, ......]
-
-		The ID's are a concatenation of the name of the CLAN file of origin
-		and the block index, separated by ":::".
-	*/
-	activeWorkItems ActiveDataQueue
+	"os/signal"
+	"syscall"
 )
 
 const (
@@ -116,6 +40,58 @@ type Config struct {
 	LabsDBPath    string   `json:"labs_db_path"`
 	WorkDBPath    string   `json:"work_db_path"`
 	LabelsDBPath  string   `json:"labels_db_path"`
+
+	// Store is the storage backend, either "bolt" (the
+	// default) or "sqlite". The bolt backend uses the three
+	// *_db_path files, the sqlite backend uses SQLitePath.
+	Store      string `json:"store"`
+	SQLitePath string `json:"sqlite_path"`
+
+	// MaxPassesPerLab is the maximum number of codings of a single
+	// regular block that may come from the same lab, counting the ones
+	// still checked out. 0 means no limit.
+	MaxPassesPerLab int `json:"max_passes_per_lab"`
+
+	// MaxPassesPerCoder is the maximum number of codings of a single
+	// regular block that may come from the same coder. 0 means no limit.
+	MaxPassesPerCoder int `json:"max_passes_per_coder"`
+
+	// BackupDir is the directory scheduled snapshots of the
+	// databases are written to. No snapshots are taken if it's empty.
+	BackupDir string `json:"backup_dir"`
+
+	// BackupInterval is the time between scheduled snapshots,
+	// as a Go duration string (e.g. "6h"). Defaults to 24h.
+	BackupInterval string `json:"backup_interval"`
+
+	// BackupRetention is the number of scheduled snapshots to
+	// keep in BackupDir. 0 keeps all of them.
+	BackupRetention int `json:"backup_retention"`
+
+	// BlockRulesPath is the JSON file of BlockRules that pick which
+	// conversation blocks get built. Without one, every block with
+	// a FAN or MAN tier is.
+	BlockRulesPath string `json:"block_rules_path"`
+
+	// BlocksDir is where blocks added through /v1/select-blocks/
+	// are built. Blocks can't be added through the server without it.
+	BlocksDir string `json:"blocks_dir"`
+
+	// Classifications are the labels coders using the browser
+	// interface choose from. Defaults to IDS, ADS and Junk.
+	Classifications []string `json:"classifications"`
+
+	// LogLevel is the lowest level logged: "debug", "info"
+	// (the default), "warn" or "error".
+	LogLevel string `json:"log_level"`
+
+	// LogFormat is "json" (the default) for JSON lines,
+	// or "text" for logfmt.
+	LogFormat string `json:"log_format"`
+
+	// MaxRequestBytes is the largest JSON request body the
+	// server reads. Defaults to 1 MiB.
+	MaxRequestBytes int64 `json:"max_request_bytes"`
 }
 
 func (conf *Config) encode() ([]byte, error) {
@@ -126,16 +102,13 @@ func (conf *Config) encode() ([]byte, error) {
 	return enc, nil
 }
 
-func (conf *Config) writeFile() {
-	fmt.Println("tried to update the config file")
+func (conf *Config) writeFile(path string) error {
+	slog.Debug("writing the config file", "path", path)
 	encodedConf, err := conf.encode()
 	if err != nil {
-		log.Fatal(err)
-	}
-	writeErr := ioutil.WriteFile(configFile, encodedConf, 0644)
-	if err != nil {
-		log.Fatal(writeErr)
+		return err
 	}
+	return ioutil.WriteFile(path, encodedConf, 0644)
 }
 
 func (conf *Config) labIsRegistered(labKey string) bool {
@@ -155,88 +128,101 @@ func (conf *Config) labIsAdmin(labKey string) bool {
 	return false
 }
 
-func readConfigFile(path string) Config {
-	file, err := ioutil.ReadFile(path)
-	if err != nil {
-		log.Fatal(err)
+func (conf *Config) passLimits() PassLimits {
+	return PassLimits{
+		PerLab:   conf.MaxPassesPerLab,
+		PerCoder: conf.MaxPassesPerCoder,
 	}
-
-	var config Config
-	json.Unmarshal(file, &config)
-
-	return config
 }
 
-func shutDown() {
+func readConfigFile(path string) (Config, error) {
+	var config Config
 
-}
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
 
-func setDBPaths() {
-	workDBPath = mainConfig.WorkDBPath
-	labsDBPath = mainConfig.LabsDBPath
-	labelsDBPath = mainConfig.LabelsDBPath
+	err = json.Unmarshal(file, &config)
+	return config, err
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, exists := commands[os.Args[1]]; exists {
+			if err := command.Run(os.Args[2:]); err != nil {
+				printUsage()
+				log.Fatal(err)
+			}
+			return
+		}
+	}
 
-	configFile = os.Args[1]
-	manifestFile = os.Args[2]
-
-	mainConfig = readConfigFile(configFile)
-	setDBPaths()
+	if len(os.Args) < 3 {
+		printUsage()
+		os.Exit(1)
+	}
 
-	fmt.Println("mainConfig: ")
-	fmt.Println(mainConfig)
+	configFile := os.Args[1]
+	manifestFile := os.Args[2]
 
-	// Open the LabsDB
-	labsDB = LoadLabsDB()
-	defer labsDB.Close()
+	// set up logging first, so opening the databases is logged with it
+	config, configErr := readConfigFile(configFile)
+	if configErr != nil {
+		log.Fatal(configErr)
+	}
+	if logErr := config.setupLogging(); logErr != nil {
+		log.Fatal(logErr)
+	}
 
-	workDB = LoadWorkDB()
-	defer workDB.Close()
+	server, openErr := openServer(configFile)
+	if openErr != nil {
+		log.Fatal(openErr)
+	}
+	defer server.Close()
 
-	labelsDB = LoadLabelsDB()
-	defer labelsDB.Close()
+	slog.Info("starting", "config", configFile, "store", server.config.Store,
+		"labs", len(server.config.Labs), "log_level", server.config.LogLevel)
 
-	dataMap := fillDataMap()
+	// bring the databases up to the current schema
+	// before anything reads from them
+	reports, migrateErr := server.migrateSchema(false)
+	for _, report := range reports {
+		slog.Info("schema migration", "report", report.String())
+	}
+	if migrateErr != nil {
+		log.Fatal(migrateErr)
+	}
 
-	//	get the WorkItemMap, either from the dataMap,
+	//	get the WorkItemMap, either from the manifest,
 	//	or from the workDB on disk.
+	loadErr := server.loadWorkItemMap(manifestFile)
+	if loadErr != nil {
+		log.Fatal(loadErr)
+	}
 
-	if !mainConfig.WorkMapLoaded {
-		workItemMap = dataMap.partitionIntoWorkItemsMap()
-		workItemMapEncoded, _ = json.Marshal(workItemMap)
-		workDB.persistWorkItemMap(workItemMap)
-		mainConfig.WorkMapLoaded = true
-		mainConfig.writeFile()
-	} else {
-		workItemMap = workDB.loadItemMap()
-		workItemMapEncoded, _ = json.Marshal(workItemMap)
-	}
-
-	fmt.Println("# of work items map: ", len(workItemMap))
-
-	http.HandleFunc("/", mainHandler)
-	http.HandleFunc("/v1/get-block/", getBlockHandler)
-	http.HandleFunc("/v1/get-specific-block/", getSpecificBlockHandler)
-	http.HandleFunc("/v1/get-block-list/", getWorkItemMapHandler)
-	http.HandleFunc("/v1/delete-block/", deleteBlockHandler)
-	http.HandleFunc("/v1/delete-user/", deleteUserHandler)
-	http.HandleFunc("/v1/lab-info/", labInfoHandler)
-	http.HandleFunc("/v1/all-lab-info/", allLabInfoHandler)
-	http.HandleFunc("/v1/add-user/", addUserHandler)
-	http.HandleFunc("/v1/submit-labels/", submitLabelsHandler)
-	http.HandleFunc("/v1/submit-wo-labels/", submitWOLabelsHandler)
-	http.HandleFunc("/v1/get-labels/", getLabelsHandler)
-	http.HandleFunc("/v1/get-lab-labels/", getLabLabelsHandler)
-	http.HandleFunc("/v1/get-all-labels/", getAllLabelsHandler)
-	http.HandleFunc("/v1/get-train-labels/", getTrainingLabelsHandler)
-	http.HandleFunc("/v1/get-relia-labels/", getReliabilityHandler)
-
-	http.HandleFunc("/v1/migrate-add-block-labels/", migrateAddLabeledBlockHandler)
-	http.HandleFunc("/v1/migrate-add-user/", migrateAddUserHandler)
-	http.HandleFunc("/v1/migrate-set-active-work-item/", migrateSetActiveWorkItemHandler)
-
-	http.ListenAndServe(":8080", nil)
+	slog.Info("loaded work items", "work_items", len(server.workItemMap))
 
+	if backupErr := server.startScheduledBackups(); backupErr != nil {
+		log.Fatal(backupErr)
+	}
+
+	// on SIGINT or SIGTERM, finish the requests in flight and return,
+	// so the deferred Close stops the backups and closes the databases
+	httpServer := &http.Server{Addr: ":8080", Handler: server.handler()}
+	shutDown := make(chan struct{})
+	go func() {
+		defer close(shutDown)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		slog.Info("shutting down")
+		if shutdownErr := httpServer.Shutdown(context.Background()); shutdownErr != nil {
+			slog.Error("shutting down failed", "error", shutdownErr)
+		}
+	}()
+	if serveErr := httpServer.ListenAndServe(); serveErr != http.ErrServerClosed {
+		log.Fatal(serveErr)
+	}
+	<-shutDown
 }
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrManifestInvalid means the path_manifest.csv had errors
+// in it, and no work items were loaded from it
+var ErrManifestInvalid = errors.New("Manifest has errors, see the report")
+
+const (
+	manifestError   = "error"
+	manifestWarning = "warning"
+)
+
+/*
+manifestHeader is the header row written by makeblocks.py
+(group_manifest.py adds a "group" column after these, which
+is ignored)
+*/
+var manifestHeader = []string{"clanfile", "block_index", "block_path", "training", "reliability"}
+
+/*
+ManifestProblem is a single problem found in a manifest.
+Line is the line number in the CSV (starting at 1).
+*/
+type ManifestProblem struct {
+	Severity string `json:"severity"`
+	Line     int    `json:"line"`
+	ClanFile string `json:"clanfile,omitempty"`
+	Detail   string `json:"detail"`
+}
+
+func (problem ManifestProblem) String() string {
+	return fmt.Sprintf("%s: line %d: %s", problem.Severity, problem.Line, problem.Detail)
+}
+
+/*
+ManifestReport is the result of reading and
+validating a path_manifest.csv
+*/
+type ManifestReport struct {
+	Path      string            `json:"path"`
+	Rows      int               `json:"rows"`
+	ClanFiles int               `json:"clan_files"`
+	Problems  []ManifestProblem `json:"problems"`
+}
+
+func (report *ManifestReport) add(severity string, line int, clanFile, detail string) {
+	report.Problems = append(report.Problems, ManifestProblem{
+		Severity: severity, Line: line, ClanFile: clanFile, Detail: detail})
+}
+
+// hasErrors is true if any of the problems are errors (not warnings)
+func (report *ManifestReport) hasErrors() bool {
+	for _, problem := range report.Problems {
+		if problem.Severity == manifestError {
+			return true
+		}
+	}
+	return false
+}
+
+func (report *ManifestReport) String() string {
+	var errs, warnings int
+	var lines []string
+	for _, problem := range report.Problems {
+		if problem.Severity == manifestError {
+			errs++
+		} else {
+			warnings++
+		}
+		lines = append(lines, "  "+problem.String())
+	}
+	summary := fmt.Sprintf("%s: %d rows, %d clan files, %d errors, %d warnings",
+		report.Path, report.Rows, report.ClanFiles, errs, warnings)
+	return strings.Join(append([]string{summary}, lines...), "\n")
+}
+
+/*
+readManifest reads a path_manifest.csv into a DataMap,
+checking every row as it goes:
+
+  - each row has the clanfile, block_index, block_path,
+    training and reliability columns, and they parse
+  - no (clanfile, block_index) pair shows up twice
+  - a block isn't marked as both training and reliability,
+    and every block of a CLAN file has the same flags
+  - the rows for a CLAN file are next to each other (only
+    a warning, they're grouped by clanfile either way)
+  - if checkZips is set, every block_path is a zip file
+    that can be read all the way through (and its SHA-256
+    is recorded in the DataGroup)
+
+The returned error is only for failing to read the file
+at all, everything else ends up in the report. Rows with
+errors are left out of the DataMap.
+*/
+func readManifest(manifestPath string, checkZips bool) (DataMap, *ManifestReport, error) {
+	report := &ManifestReport{Path: manifestPath, Problems: make([]ManifestProblem, 0)}
+
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, report, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(bufio.NewReader(file))
+	// rows are checked for their columns below
+	reader.FieldsPerRecord = -1
+
+	dataMap := make(DataMap)
+	// the line each CLAN file was first seen on
+	firstLines := make(map[string]int)
+	// the line each (clanfile, block_index) was first seen on
+	blockLines := make(map[string]int)
+	var prevFile string
+
+	for i := 0; ; i++ {
+		line, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, report, err
+		}
+		lineNum, _ := reader.FieldPos(0)
+
+		// the header
+		if i == 0 {
+			for col, name := range manifestHeader {
+				if col >= len(line) || strings.TrimSpace(strings.ToLower(line[col])) != name {
+					report.add(manifestWarning, lineNum, "",
+						"header doesn't match "+strings.Join(manifestHeader, ","))
+					break
+				}
+			}
+			continue
+		}
+		report.Rows++
+
+		if len(line) < len(manifestHeader) {
+			report.add(manifestError, lineNum, "",
+				fmt.Sprintf("expected at least %d columns, found %d", len(manifestHeader), len(line)))
+			continue
+		}
+
+		clanFile, blockPath := line[0], line[2]
+		rowOK := true
+		if clanFile == "" {
+			report.add(manifestError, lineNum, "", "clanfile is empty")
+			rowOK = false
+		}
+		index, indexErr := strconv.Atoi(line[1])
+		if indexErr != nil {
+			report.add(manifestError, lineNum, clanFile, "block_index isn't a number: "+strconv.Quote(line[1]))
+			rowOK = false
+		}
+		if blockPath == "" {
+			report.add(manifestError, lineNum, clanFile, "block_path is empty")
+			rowOK = false
+		}
+		training, trainErr := strconv.ParseBool(line[3])
+		if trainErr != nil {
+			report.add(manifestError, lineNum, clanFile, "training isn't true or false: "+strconv.Quote(line[3]))
+			rowOK = false
+		}
+		reliability, reliaErr := strconv.ParseBool(line[4])
+		if reliaErr != nil {
+			report.add(manifestError, lineNum, clanFile, "reliability isn't true or false: "+strconv.Quote(line[4]))
+			rowOK = false
+		}
+		if training && reliability {
+			report.add(manifestError, lineNum, clanFile, "block is marked as both training and reliability")
+			rowOK = false
+		}
+		if !rowOK {
+			continue
+		}
+
+		blockKey := clanFile + ":::" + strconv.Itoa(index)
+		if firstLine, exists := blockLines[blockKey]; exists {
+			report.add(manifestError, lineNum, clanFile,
+				fmt.Sprintf("block %d is a duplicate of line %d", index, firstLine))
+			continue
+		}
+		blockLines[blockKey] = lineNum
+
+		var checksum string
+		if checkZips {
+			if zipErr := checkBlockZip(blockPath); zipErr != nil {
+				report.add(manifestError, lineNum, clanFile, zipErr.Error())
+				continue
+			}
+			checksum, err = blockChecksum(blockPath)
+			if err != nil {
+				report.add(manifestError, lineNum, clanFile, "block_path can't be hashed: "+err.Error())
+				continue
+			}
+		}
+
+		group, exists := dataMap[clanFile]
+		if !exists {
+			group = &DataGroup{ClanFile: clanFile, Training: training,
+				Reliability: reliability, BlockPaths: make(map[int]string),
+				BlockSHA256s: make(map[int]string)}
+			dataMap[clanFile] = group
+			firstLines[clanFile] = lineNum
+		} else {
+			if clanFile != prevFile {
+				report.add(manifestWarning, lineNum, clanFile,
+					fmt.Sprintf("rows for this clan file aren't contiguous (first seen on line %d)", firstLines[clanFile]))
+			}
+			if group.Training != training || group.Reliability != reliability {
+				report.add(manifestError, lineNum, clanFile,
+					fmt.Sprintf("training/reliability flags conflict with line %d", firstLines[clanFile]))
+				continue
+			}
+		}
+		prevFile = clanFile
+
+		group.BlockPaths[index] = blockPath
+		group.BlockSHA256s[index] = checksum
+	}
+
+	report.ClanFiles = len(dataMap)
+	return dataMap, report, nil
+}
+
+/*
+checkBlockZip makes sure the block at path exists, and is
+a zip file whose entries can all be read (which checks
+their CRCs)
+*/
+func checkBlockZip(path string) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("block_path doesn't exist: %s", path)
+		}
+		return fmt.Errorf("block_path isn't a readable zip: %s: %v", path, err)
+	}
+	defer archive.Close()
+
+	for _, entry := range archive.File {
+		contents, err := entry.Open()
+		if err != nil {
+			return fmt.Errorf("block_path has a corrupt entry: %s: %s: %v", path, entry.Name, err)
+		}
+		_, err = io.Copy(ioutil.Discard, contents)
+		contents.Close()
+		if err != nil {
+			return fmt.Errorf("block_path has a corrupt entry: %s: %s: %v", path, entry.Name, err)
+		}
+	}
+	return nil
+}
+
+/*
+validateManifestCommand checks a manifest (and all of its
+block zips) without loading it:
+
+	$: ./idsserver validate-manifest path_manifest.csv
+*/
+func validateManifestCommand(args []string) error {
+	if len(args) < 1 {
+		return ErrMissingCommandArgs
+	}
+
+	_, report, err := readManifest(args[0], true)
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	if report.hasErrors() {
+		return ErrManifestInvalid
+	}
+	return nil
+}
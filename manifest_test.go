@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeTestZip writes a block zip with a single clip in it to path
+func writeTestZip(t *testing.T, path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := zip.NewWriter(file)
+	entry, err := archive.Create("1.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Write([]byte("clip"))
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"1.zip", "2.zip"} {
+		writeTestZip(t, filepath.Join(dir, name))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bad.zip"), []byte("not a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const header = "clanfile,block_index,block_path,training,reliability\n"
+	for _, test := range []struct {
+		name      string
+		rows      string
+		clanFiles int
+		problems  []string // "severity:line"
+	}{
+		{"valid", "a.cha,1,{dir}/1.zip,false,false\na.cha,2,{dir}/2.zip,false,false\n", 1, nil},
+		{"short row", "a.cha,1,1.zip\n", 0, []string{"error:2"}},
+		{"bad block_index", "a.cha,one,{dir}/1.zip,false,false\n", 0, []string{"error:2"}},
+		{"bad training", "a.cha,1,{dir}/1.zip,maybe,false\n", 0, []string{"error:2"}},
+		{"training and reliability", "a.cha,1,{dir}/1.zip,true,true\n", 0, []string{"error:2"}},
+		{"duplicate", "a.cha,1,{dir}/1.zip,false,false\na.cha,1,{dir}/2.zip,false,false\n", 1, []string{"error:3"}},
+		{"conflicting flags", "a.cha,1,{dir}/1.zip,true,false\na.cha,2,{dir}/2.zip,false,false\n", 1, []string{"error:3"}},
+		{"not contiguous", "a.cha,1,{dir}/1.zip,false,false\nb.cha,1,{dir}/2.zip,false,false\na.cha,2,{dir}/2.zip,false,false\n",
+			2, []string{"warning:4"}},
+		{"missing zip", "a.cha,1,{dir}/3.zip,false,false\n", 0, []string{"error:2"}},
+		{"corrupt zip", "a.cha,1,{dir}/bad.zip,false,false\n", 0, []string{"error:2"}},
+	} {
+		rows := strings.ReplaceAll(test.rows, "{dir}", dir)
+		manifestPath := filepath.Join(dir, "path_manifest.csv")
+		if err := os.WriteFile(manifestPath, []byte(header+rows), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		dataMap, report, err := readManifest(manifestPath, true)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var problems []string
+		for _, problem := range report.Problems {
+			problems = append(problems, problem.Severity+":"+strconv.Itoa(problem.Line))
+		}
+		if strings.Join(problems, ",") != strings.Join(test.problems, ",") {
+			t.Errorf("%s: got problems %v", test.name, report.Problems)
+		}
+		if len(dataMap) != test.clanFiles || report.ClanFiles != test.clanFiles {
+			t.Errorf("%s: got %d clan files, want %d", test.name, len(dataMap), test.clanFiles)
+		}
+
+		err = validateManifestCommand([]string{manifestPath})
+		if hasErrors := strings.Contains(strings.Join(test.problems, ","), manifestError); hasErrors != errors.Is(err, ErrManifestInvalid) {
+			t.Errorf("%s: validate-manifest returned %v", test.name, err)
+		}
+	}
+}
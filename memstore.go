@@ -0,0 +1,405 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+/*
+	In-memory implementations of LabStore, WorkStore and LabelStore.
+	They're meant for tests (build a Server with newServer and hit
+	its handlers with httptest), not for production.
+
+	Records are kept JSON encoded, the same way they are in the bolt
+	databases, so callers never share memory with the store.
+*/
+
+// MemLabsDB is an in-memory LabStore
+type MemLabsDB struct {
+	mu   sync.RWMutex
+	labs map[string][]byte
+}
+
+// NewMemLabsDB returns an empty MemLabsDB
+func NewMemLabsDB() *MemLabsDB {
+	return &MemLabsDB{labs: make(map[string][]byte)}
+}
+
+func (db *MemLabsDB) getLab(labKey string) (*Lab, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	lab, exists := db.labs[labKey]
+	if !exists {
+		return nil, ErrLabDoesntExist
+	}
+	return decodeLabJSON(lab)
+}
+
+func (db *MemLabsDB) setLab(labKey string, data *Lab) error {
+	encodedLab, err := data.encode()
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.labs[labKey] = encodedLab
+	return nil
+}
+
+func (db *MemLabsDB) setLabs(labs []*Lab) error {
+	for _, lab := range labs {
+		if err := db.setLab(lab.Key, lab); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *MemLabsDB) deleteLab(labKey string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.labs, labKey)
+	return nil
+}
+
+func (db *MemLabsDB) getAllLabs() ([]*Lab, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var labs []*Lab
+	for _, key := range sortedKeys(db.labs) {
+		currLab, err := decodeLabJSON(db.labs[key])
+		if err != nil {
+			return labs, err
+		}
+		labs = append(labs, currLab)
+	}
+	return labs, nil
+}
+
+// Close is a no-op
+func (db *MemLabsDB) Close() error {
+	return nil
+}
+
+// MemWorkDB is an in-memory WorkStore
+type MemWorkDB struct {
+	mu    sync.RWMutex
+	items map[string][]byte
+}
+
+// NewMemWorkDB returns an empty MemWorkDB
+func NewMemWorkDB() *MemWorkDB {
+	return &MemWorkDB{items: make(map[string][]byte)}
+}
+
+func (db *MemWorkDB) loadItemMap() (WorkItemMap, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	itemMap := make(WorkItemMap)
+	for _, value := range db.items {
+		currItem, err := decodeWorkItemJSON(value)
+		if err != nil {
+			return itemMap, err
+		}
+		itemMap[currItem.ID] = *currItem
+	}
+	return itemMap, nil
+}
+
+func (db *MemWorkDB) persistWorkItem(item WorkItem) error {
+	encodedItem, err := item.encode()
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.items[item.ID] = encodedItem
+	return nil
+}
+
+func (db *MemWorkDB) persistWorkItemMap(itemMap WorkItemMap) error {
+	for _, item := range itemMap {
+		if err := db.persistWorkItem(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *MemWorkDB) getWorkItemPage(after string, limit int) ([]WorkItem, string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var items []WorkItem
+	values, next := memPage(db.items, after, limit)
+	for _, value := range values {
+		currItem, err := decodeWorkItemJSON(value)
+		if err != nil {
+			return items, "", err
+		}
+		items = append(items, *currItem)
+	}
+	return items, next, nil
+}
+
+// Close is a no-op
+func (db *MemWorkDB) Close() error {
+	return nil
+}
+
+/*
+MemLabelsDB is an in-memory LabelStore. It doesn't keep
+any indexes, the index lookups scan every BlockGroup.
+*/
+type MemLabelsDB struct {
+	mu     sync.RWMutex
+	groups map[string][]byte
+}
+
+// NewMemLabelsDB returns an empty MemLabelsDB
+func NewMemLabelsDB() *MemLabelsDB {
+	return &MemLabelsDB{groups: make(map[string][]byte)}
+}
+
+func (db *MemLabelsDB) addBlock(block Block, limits PassLimits) (*BlockGroup, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var blockGroup *BlockGroup
+	if groupData, exists := db.groups[block.ID]; exists {
+		var err error
+		blockGroup, err = decodeBlockGroupJSON(groupData)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		blockGroup = &BlockGroup{ID: block.ID,
+			Training:    block.Training,
+			Reliability: block.Reliability}
+	}
+
+	if err := blockGroup.addBlock(block, limits); err != nil {
+		return nil, err
+	}
+	return blockGroup, db.put(blockGroup)
+}
+
+func (db *MemLabelsDB) getBlock(blockID string) (*BlockGroup, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	groupData, exists := db.groups[blockID]
+	if !exists {
+		return &BlockGroup{}, ErrWorkItemDoesntExist
+	}
+	blockGroup, err := decodeBlockGroupJSON(groupData)
+	if err != nil {
+		return &BlockGroup{}, ErrWorkItemDoesntExist
+	}
+	return blockGroup, nil
+}
+
+func (db *MemLabelsDB) getBlockGroup(blockIDs []string) (BlockGroupArray, error) {
+	var blocks BlockGroupArray
+	for _, id := range blockIDs {
+		block, err := db.getBlock(id)
+		if err != nil {
+			return blocks, ErrCouldntFindLabeledBlock
+		}
+		blocks.addBlockGroup(*block)
+	}
+	return blocks, nil
+}
+
+func (db *MemLabelsDB) setBlockGroup(group BlockGroup) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.put(&group)
+}
+
+func (db *MemLabelsDB) setBlockGroups(groups BlockGroupArray) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i := range groups {
+		if err := db.put(&groups[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *MemLabelsDB) deleteInstances(blockID string, instances *InstanceList) (*BlockGroup, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	groupData, exists := db.groups[blockID]
+	if !exists {
+		return nil, ErrWorkItemDoesntExist
+	}
+	blockGroup, err := decodeBlockGroupJSON(groupData)
+	if err != nil {
+		return nil, err
+	}
+
+	blockGroup.deleteInstances(instances)
+	if len(blockGroup.Blocks) == 0 {
+		delete(db.groups, blockID)
+		return blockGroup, nil
+	}
+	return blockGroup, db.put(blockGroup)
+}
+
+func (db *MemLabelsDB) getAllBlockGroups() (BlockGroupArray, error) {
+	groups, _, err := db.getBlockGroupPage("", -1)
+	return groups, err
+}
+
+func (db *MemLabelsDB) getBlockGroupPage(after string, limit int) (BlockGroupArray, string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var blockGroupArray BlockGroupArray
+	values, next := memPage(db.groups, after, limit)
+	for _, value := range values {
+		blockGroup, err := decodeBlockGroupJSON(value)
+		if err != nil {
+			return blockGroupArray, "", err
+		}
+		blockGroupArray.addBlockGroup(*blockGroup)
+	}
+	return blockGroupArray, next, nil
+}
+
+func (db *MemLabelsDB) getLabBlockIDs(labKey string) (BlockIDList, error) {
+	return db.findBlockIDs(func(block Block) bool {
+		return block.LabKey == labKey
+	})
+}
+
+func (db *MemLabelsDB) getFileBlockIDs(clanFile string) (BlockIDList, error) {
+	return db.findBlockIDs(func(block Block) bool {
+		return block.ClanFile == clanFile
+	})
+}
+
+func (db *MemLabelsDB) getCoderInstanceMap(labKey, coder string) (InstanceMap, error) {
+	return db.findInstances(func(block Block) bool {
+		return block.LabKey == labKey && block.Coder == coder
+	})
+}
+
+func (db *MemLabelsDB) getLabInstanceMap(labKey string) (InstanceMap, error) {
+	return db.findInstances(func(block Block) bool {
+		return block.LabKey == labKey
+	})
+}
+
+// rebuildIndexes is a no-op, there are no indexes to rebuild
+func (db *MemLabelsDB) rebuildIndexes() (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.groups), nil
+}
+
+// Close is a no-op
+func (db *MemLabelsDB) Close() error {
+	return nil
+}
+
+/*
+put encodes and stores the group. The caller
+must be holding the write lock.
+*/
+func (db *MemLabelsDB) put(group *BlockGroup) error {
+	encodedBlockGroup, err := group.encode()
+	if err != nil {
+		return err
+	}
+	db.groups[group.ID] = encodedBlockGroup
+	return nil
+}
+
+/*
+findBlockIDs returns the ID's of all the groups with
+at least one instance that matches.
+*/
+func (db *MemLabelsDB) findBlockIDs(matches func(Block) bool) (BlockIDList, error) {
+	groups, err := db.getAllBlockGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	var blockIDs BlockIDList
+	for _, group := range groups {
+		for _, block := range group.Blocks {
+			if matches(block) {
+				blockIDs.addID(group.ID)
+				break
+			}
+		}
+	}
+	return blockIDs, nil
+}
+
+/*
+findInstances returns an InstanceMap of all
+the instances that match.
+*/
+func (db *MemLabelsDB) findInstances(matches func(Block) bool) (InstanceMap, error) {
+	instanceMap := make(InstanceMap)
+
+	groups, err := db.getAllBlockGroups()
+	if err != nil {
+		return instanceMap, err
+	}
+
+	for _, group := range groups {
+		for _, block := range group.Blocks {
+			if !matches(block) {
+				continue
+			}
+			if _, exists := instanceMap[group.ID]; exists {
+				instanceMap[group.ID].addInstance(block.Instance)
+			} else {
+				instanceMap[group.ID] = NewInstanceList(block.Instance)
+			}
+		}
+	}
+	return instanceMap, nil
+}
+
+func sortedKeys(records map[string][]byte) []string {
+	var keys []string
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+memPage is the in-memory version of scanBucketPage. It returns
+up to limit values (all of them if limit is negative) in key
+order after the "after" key, and the "after" for the next page.
+*/
+func memPage(records map[string][]byte, after string, limit int) ([][]byte, string) {
+	var values [][]byte
+	var lastKey string
+
+	for _, key := range sortedKeys(records) {
+		if after != "" && key <= after {
+			continue
+		}
+		if len(values) == limit {
+			return values, lastKey
+		}
+		values = append(values, records[key])
+		lastKey = key
+	}
+	return values, ""
+}
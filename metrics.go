@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// what's counted for the work item metrics
+	checkoutEvent = "checkout"
+	submitEvent   = "submit"
+	releaseEvent  = "release"
+)
+
+/*
+latencyBuckets are the upper bounds (in seconds) of the request
+and transaction duration histograms
+*/
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram is a Prometheus histogram, with cumulative buckets
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(seconds float64) {
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+/*
+Metrics are the counters and histograms behind /metrics.
+They're kept by hand, in the Prometheus text format, rather
+than pulling in the client library for a handful of series.
+A nil *Metrics counts nothing.
+*/
+type Metrics struct {
+	mu sync.Mutex
+
+	// requests are counted by "route method code"
+	requests map[string]uint64
+	latency  map[string]*histogram
+
+	// workItems are counted by "event kind" (kind of block)
+	workItems map[string]uint64
+
+	// transactions are timed by "store kind" (update or view)
+	transactions map[string]*histogram
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		requests:     make(map[string]uint64),
+		latency:      make(map[string]*histogram),
+		workItems:    make(map[string]uint64),
+		transactions: make(map[string]*histogram),
+	}
+}
+
+func (m *Metrics) observeRequest(route, method string, code int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[route+" "+method+" "+strconv.Itoa(code)]++
+	if m.latency[route] == nil {
+		m.latency[route] = newHistogram()
+	}
+	m.latency[route].observe(duration.Seconds())
+}
+
+// countWorkItem counts a checkout, submit or release of the item
+func (m *Metrics) countWorkItem(event string, item WorkItem) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.workItems[event+" "+blockKind(item.Training, item.Reliability)]++
+}
+
+/*
+timeTx runs a bolt transaction (tx is db.Update or
+db.View) and records how long it took
+*/
+func (m *Metrics) timeTx(store, kind string, tx func(func(*bolt.Tx) error) error, fn func(*bolt.Tx) error) error {
+	if m == nil {
+		return tx(fn)
+	}
+	start := time.Now()
+	err := tx(fn)
+	seconds := time.Since(start).Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := store + " " + kind
+	if m.transactions[key] == nil {
+		m.transactions[key] = newHistogram()
+	}
+	m.transactions[key].observe(seconds)
+	return err
+}
+
+// blockKind is the "kind" label of a block
+func blockKind(training, reliability bool) string {
+	switch {
+	case training:
+		return "training"
+	case reliability:
+		return "reliability"
+	}
+	return "regular"
+}
+
+/*
+instrumentedStore is a store that records its
+transactions in the server's Metrics
+*/
+type instrumentedStore interface {
+	setMetrics(metrics *Metrics)
+}
+
+func (db *LabsDB) setMetrics(metrics *Metrics)   { db.metrics = metrics }
+func (db *WorkDB) setMetrics(metrics *Metrics)   { db.metrics = metrics }
+func (db *LabelsDB) setMetrics(metrics *Metrics) { db.metrics = metrics }
+
+/*
+statusRecorder remembers the status code a handler wrote
+*/
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (recorder *statusRecorder) WriteHeader(code int) {
+	recorder.code = code
+	recorder.ResponseWriter.WriteHeader(code)
+}
+
+// Flush passes flushes through, for the ndjson streams
+func (recorder *statusRecorder) Flush() {
+	if flusher, canFlush := recorder.ResponseWriter.(http.Flusher); canFlush {
+		flusher.Flush()
+	}
+}
+
+/*
+instrument counts the requests and times them, labeled by
+the route pattern of the mux they matched (not the path,
+so ids in paths don't blow up the number of series)
+*/
+func (s *Server) instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "none"
+		}
+		recorder := &statusRecorder{ResponseWriter: w, code: 200}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		s.metrics.observeRequest(route, r.Method, recorder.code, time.Since(start))
+	})
+}
+
+/*
+handler is the mux of routes with the
+middleware every request goes through
+*/
+func (s *Server) handler() http.Handler {
+	mux := s.routes()
+	return s.logRequests(mux, s.instrument(mux, recoverPanics(mux)))
+}
+
+// labelPairs formats Prometheus labels from name, value pairs
+func labelPairs(pairs ...string) string {
+	labels := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf("%s=%q", pairs[i], pairs[i+1]))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeHistogram writes a histogram's series, with the labels given as pairs
+func writeHistogram(w io.Writer, name string, h *histogram, pairs ...string) {
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name,
+			labelPairs(append(append([]string{}, pairs...), "le", formatFloat(bound))...), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelPairs(append(append([]string{}, pairs...), "le", "+Inf")...), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labelPairs(pairs...), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labelPairs(pairs...), h.count)
+}
+
+// counterKeys are the keys of a set of counters, sorted
+func counterKeys(counters map[string]uint64) []string {
+	keys := make([]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// histogramKeys are the keys of a set of histograms, sorted
+func histogramKeys(histograms map[string]*histogram) []string {
+	keys := make([]string, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// write writes the counters and histograms
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeMetricHeader(w, "idsserver_http_requests_total", "counter", "HTTP requests by route, method and status code.")
+	for _, key := range counterKeys(m.requests) {
+		parts := strings.SplitN(key, " ", 3)
+		fmt.Fprintf(w, "idsserver_http_requests_total%s %d\n",
+			labelPairs("route", parts[0], "method", parts[1], "code", parts[2]), m.requests[key])
+	}
+
+	writeMetricHeader(w, "idsserver_http_request_duration_seconds", "histogram", "HTTP request latency by route.")
+	for _, route := range histogramKeys(m.latency) {
+		writeHistogram(w, "idsserver_http_request_duration_seconds", m.latency[route], "route", route)
+	}
+
+	writeMetricHeader(w, "idsserver_work_items_total", "counter", "Blocks checked out, submitted and released, by kind of block.")
+	for _, key := range counterKeys(m.workItems) {
+		parts := strings.SplitN(key, " ", 2)
+		fmt.Fprintf(w, "idsserver_work_items_total%s %d\n",
+			labelPairs("event", parts[0], "kind", parts[1]), m.workItems[key])
+	}
+
+	writeMetricHeader(w, "idsserver_db_transaction_duration_seconds", "histogram", "Bolt transaction durations by store and kind.")
+	for _, key := range histogramKeys(m.transactions) {
+		parts := strings.SplitN(key, " ", 2)
+		writeHistogram(w, "idsserver_db_transaction_duration_seconds", m.transactions[key],
+			"store", parts[0], "kind", parts[1])
+	}
+}
+
+/*
+dbFiles are the database files of the configured
+backend, by the name of the store
+*/
+func (conf *Config) dbFiles() map[string]string {
+	if conf.Store == sqliteStoreName {
+		return map[string]string{"sqlite": conf.SQLitePath}
+	}
+	return map[string]string{
+		"labs":   conf.LabsDBPath,
+		"work":   conf.WorkDBPath,
+		"labels": conf.LabelsDBPath,
+	}
+}
+
+/*
+writeMetrics writes the counters, then the gauges that
+are worked out when scraped: the regular blocks by how
+many times they've been coded, the blocks checked out
+and the size of the database files
+*/
+func (s *Server) writeMetrics(w io.Writer) {
+	s.metrics.write(w)
+	items := s.workItems()
+
+	writeMetricHeader(w, "idsserver_pool_blocks", "gauge", "Regular blocks by the number of times they've been coded.")
+	for _, count := range passCounts(items) {
+		fmt.Fprintf(w, "idsserver_pool_blocks%s %d\n", labelPairs("passes", strconv.Itoa(count.Passes)), count.Blocks)
+	}
+
+	active := map[string]int{"regular": 0, "training": 0, "reliability": 0}
+	for _, item := range items {
+		if item.Active {
+			active[blockKind(item.Training, item.Reliability)]++
+		}
+	}
+	writeMetricHeader(w, "idsserver_active_blocks", "gauge", "Blocks checked out and not yet submitted or released, by kind.")
+	for _, kind := range []string{"regular", "training", "reliability"} {
+		fmt.Fprintf(w, "idsserver_active_blocks%s %d\n", labelPairs("kind", kind), active[kind])
+	}
+
+	files := s.config.dbFiles()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeMetricHeader(w, "idsserver_db_file_size_bytes", "gauge", "Size of the database files.")
+	for _, name := range names {
+		info, err := os.Stat(files[name])
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "idsserver_db_file_size_bytes%s %d\n", labelPairs("store", name), info.Size())
+	}
+}
+
+/*
+metricsHandler serves the metrics in the Prometheus text
+exposition format. There's no lab key, the scraper is
+expected to reach it from inside the network.
+*/
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.writeMetrics(w)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// maxPageSize is the largest number of records that will
+	// be returned in a single page, and the page size used
+	// when a request sets "after" without a "limit"
+	maxPageSize = 1000
+
+	// streamChunkSize is the number of records that are read
+	// per bolt transaction while streaming, so that a slow
+	// client doesn't keep a read transaction open
+	streamChunkSize = 100
+
+	// ndjsonFormat is the PageReq format for
+	// newline delimited JSON streaming
+	ndjsonFormat = "ndjson"
+)
+
+var (
+	// ErrBadCursor means a page request's "after" isn't a block ID,
+	// which is all that the "next" of a page can be
+	ErrBadCursor = errors.New("\"after\" must be a block ID, the \"next\" of the previous page")
+
+	// ErrUnknownPageFormat means a page request's format isn't "ndjson"
+	ErrUnknownPageFormat = errors.New("Unknown format (must be \"ndjson\" or left out)")
+)
+
+/*
+PageReq is a request for a page of records from one
+of the databases. Records are returned in key (i.e. block ID)
+order, starting after the "after" ID. The "next" field of
+the response is the "after" value for the following page.
+
+If Format is "ndjson" the records are streamed one JSON
+object per line instead.
+
+It's an IDSRequest with the paging fields added, since that's
+what the endpoints took before they could page, and clients
+still send the rest of its fields.
+*/
+type PageReq struct {
+	IDSRequest
+	Limit  int    `json:"limit"`
+	After  string `json:"after"`
+	Format string `json:"format"`
+}
+
+/*
+validate checks the paging fields. A cursor only has to look like a
+block ID, so paging still goes on if the block it names was deleted.
+*/
+func (req *PageReq) validate() error {
+	if req.After != "" && !strings.Contains(req.After, ":::") {
+		return ErrBadCursor
+	}
+	if req.Format != "" && req.Format != ndjsonFormat {
+		return ErrUnknownPageFormat
+	}
+	return nil
+}
+
+func (req *PageReq) paginated() bool {
+	return req.Limit > 0 || req.After != ""
+}
+
+func (req *PageReq) streaming() bool {
+	return req.Format == ndjsonFormat
+}
+
+/*
+pageSize is the number of records to put in a
+single page for this request
+*/
+func (req *PageReq) pageSize() int {
+	if req.Limit <= 0 || req.Limit > maxPageSize {
+		return maxPageSize
+	}
+	return req.Limit
+}
+
+/*
+BlockGroupPage is a single page of BlockGroups from the LabelsDB
+*/
+type BlockGroupPage struct {
+	BlockGroups BlockGroupArray `json:"block_groups"`
+	Next        string          `json:"next"`
+}
+
+/*
+WorkItemPage is a single page of WorkItems from the WorkDB
+*/
+type WorkItemPage struct {
+	WorkItems []WorkItem `json:"work_items"`
+	Next      string     `json:"next"`
+}
+
+/*
+scanBucketPage calls fn on up to limit values from the bucket,
+starting with the first key after "after" (or the first key, if
+after is empty). It returns the last key that was visited if
+there are more keys left in the bucket, or "" when the
+bucket has been exhausted. Callers run it in a View timed
+with their store's metrics, like their other transactions.
+*/
+func scanBucketPage(tx *bolt.Tx, bucketName, after string, limit int, fn func(value []byte) error) (string, error) {
+	cursor := tx.Bucket([]byte(bucketName)).Cursor()
+
+	var key, value []byte
+	if after == "" {
+		key, value = cursor.First()
+	} else {
+		key, value = cursor.Seek([]byte(after))
+		if key != nil && string(key) == after {
+			key, value = cursor.Next()
+		}
+	}
+
+	var lastKey string
+	for count := 0; key != nil; key, value = cursor.Next() {
+		if count == limit {
+			return lastKey, nil
+		}
+		if err := fn(value); err != nil {
+			return "", err
+		}
+		lastKey = string(key)
+		count++
+	}
+	return "", nil
+}
+
+/*
+streamNDJSON streams records to the client as newline delimited
+JSON, one chunk at a time, until the bucket is exhausted or limit
+records have been written. writePage reads a single chunk (with the
+same after/limit/next semantics as scanBucketPage), encodes it and
+returns the number of records it wrote.
+*/
+func streamNDJSON(w http.ResponseWriter, after string, limit int, writePage func(after string, limit int, encoder *json.Encoder) (string, int, error)) error {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	flusher, canFlush := w.(http.Flusher)
+
+	written := 0
+	for {
+		chunkSize := streamChunkSize
+		if limit > 0 && limit-written < chunkSize {
+			chunkSize = limit - written
+		}
+
+		next, numWritten, err := writePage(after, chunkSize, encoder)
+		if err != nil {
+			return err
+		}
+		written += numWritten
+
+		if canFlush {
+			flusher.Flush()
+		}
+		if next == "" || (limit > 0 && written >= limit) {
+			return nil
+		}
+		after = next
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+newPagingTestServer is a handler test server with five
+regular blocks, b.cha:::1 to b.cha:::5, all labeled by alice
+*/
+func newPagingTestServer(t *testing.T) *Server {
+	server := newHandlerTestServer(t, t.TempDir())
+	items := make(WorkItemMap)
+	for index := 1; index <= 5; index++ {
+		id := fmt.Sprintf("b.cha:::%d", index)
+		items[id] = WorkItem{ID: id, FileName: "b.cha", Block: index}
+	}
+	if err := server.work.persistWorkItemMap(items); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.setWorkItems(items); err != nil {
+		t.Fatal(err)
+	}
+	for id, item := range items {
+		block := Block{ID: id, ClanFile: "b.cha", Index: item.Block,
+			LabKey: "lab1", Coder: "alice", Username: "alice"}
+		if err := server.addLabeledBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return server
+}
+
+func TestPagingFollowsNext(t *testing.T) {
+	server := newPagingTestServer(t)
+
+	for _, test := range []struct {
+		url  string
+		want []string
+		ids  func(body []byte) ([]string, string)
+	}{
+		{"/v1/get-block-list/",
+			[]string{"a.cha:::1", "b.cha:::1", "b.cha:::2", "b.cha:::3", "b.cha:::4", "b.cha:::5"},
+			func(body []byte) ([]string, string) {
+				var page WorkItemPage
+				json.Unmarshal(body, &page)
+				var ids []string
+				for _, item := range page.WorkItems {
+					ids = append(ids, item.ID)
+				}
+				return ids, page.Next
+			}},
+		{"/v1/get-all-labels/",
+			[]string{"b.cha:::1", "b.cha:::2", "b.cha:::3", "b.cha:::4", "b.cha:::5"},
+			func(body []byte) ([]string, string) {
+				var page BlockGroupPage
+				json.Unmarshal(body, &page)
+				var ids []string
+				for _, group := range page.BlockGroups {
+					ids = append(ids, group.ID)
+				}
+				return ids, page.Next
+			}},
+	} {
+		var got []string
+		request := PageReq{IDSRequest: IDSRequest{LabKey: "lab1"}, Limit: 2}
+		for pages := 1; ; pages++ {
+			recorder := serveTestRequest(t, server, test.url, request)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("%s: got %d %s", test.url, recorder.Code, recorder.Body)
+			}
+			ids, next := test.ids(recorder.Body.Bytes())
+			if len(ids) > request.Limit {
+				t.Errorf("%s: got %d records on a page of %d", test.url, len(ids), request.Limit)
+			}
+			got = append(got, ids...)
+			if next == "" {
+				break
+			}
+			if pages > len(test.want) {
+				t.Fatalf("%s: next never ran out", test.url)
+			}
+			request.After = next
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: got %v, want %v", test.url, got, test.want)
+		}
+	}
+}
+
+func TestPagingRejectsBadRequests(t *testing.T) {
+	server := newPagingTestServer(t)
+
+	for _, test := range []struct {
+		request PageReq
+		code    string
+	}{
+		{PageReq{After: "not a block id"}, "bad_cursor"},
+		{PageReq{After: "b.cha:::2", Format: "csv"}, "unknown_format"},
+	} {
+		test.request.LabKey = "lab1"
+		for _, url := range []string{"/v1/get-block-list/", "/v1/get-all-labels/"} {
+			recorder := serveTestRequest(t, server, url, test.request)
+			checkErrorCode(t, recorder, http.StatusBadRequest, test.code)
+		}
+	}
+
+	// a cursor for a block that's gone carries on from where it was
+	recorder := serveTestRequest(t, server, "/v1/get-block-list/",
+		PageReq{IDSRequest: IDSRequest{LabKey: "lab1"}, After: "b.cha:::25"})
+	var page WorkItemPage
+	json.Unmarshal(recorder.Body.Bytes(), &page)
+	if recorder.Code != http.StatusOK || len(page.WorkItems) != 3 || page.WorkItems[0].ID != "b.cha:::3" {
+		t.Errorf("got %d %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestPagingNDJSON(t *testing.T) {
+	server := newPagingTestServer(t)
+
+	for _, test := range []struct {
+		request PageReq
+		want    []string
+	}{
+		{PageReq{}, []string{"b.cha:::1", "b.cha:::2", "b.cha:::3", "b.cha:::4", "b.cha:::5"}},
+		{PageReq{Limit: 2}, []string{"b.cha:::1", "b.cha:::2"}},
+		{PageReq{After: "b.cha:::3"}, []string{"b.cha:::4", "b.cha:::5"}},
+	} {
+		test.request.LabKey = "lab1"
+		test.request.Format = ndjsonFormat
+		recorder := serveTestRequest(t, server, "/v1/get-all-labels/", test.request)
+		if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("%+v: got %d %v", test.request, recorder.Code, recorder.Header())
+		}
+
+		var got []string
+		scanner := bufio.NewScanner(recorder.Body)
+		for scanner.Scan() {
+			var group BlockGroup
+			if err := json.Unmarshal(scanner.Bytes(), &group); err != nil {
+				t.Fatalf("%+v: line %q: %v", test.request, scanner.Text(), err)
+			}
+			got = append(got, group.ID)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%+v: got %v, want %v", test.request, got, test.want)
+		}
+	}
+}
+
+func TestBoltPagesAreTimed(t *testing.T) {
+	dir := t.TempDir()
+	work, err := LoadWorkDB(filepath.Join(dir, "work.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer work.Close()
+	labels, err := LoadLabelsDB(filepath.Join(dir, "labels.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer labels.Close()
+	server := newServer(Config{Labs: []string{"lab1"}}, NewMemLabsDB(), work, labels)
+
+	if _, _, err := server.work.getWorkItemPage("", 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := server.labels.getBlockGroupPage("", 10); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"work view", "labels view"} {
+		if server.metrics.transactions[key] == nil {
+			t.Errorf("no %q transactions were timed", key)
+		}
+	}
+}
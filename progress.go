@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	// defaultProgressWindowDays is the throughput window when a
+	// progress request doesn't give one
+	defaultProgressWindowDays = 14
+
+	// defaultStaleHours is how long a block can be checked out
+	// before it counts as stale, when a request doesn't say
+	defaultStaleHours = 24
+)
+
+/*
+ProgressReq asks how far along the coding is. WindowDays is
+how many days of submissions the throughput is measured over,
+and checkouts older than StaleHours are stale.
+*/
+type ProgressReq struct {
+	LabKey     string `json:"lab_key"`
+	WindowDays int    `json:"window_days"`
+	StaleHours int    `json:"stale_hours"`
+}
+
+/*
+FileProgress is how far along the regular blocks
+of a single CLAN file are
+*/
+type FileProgress struct {
+	ClanFile     string  `json:"clan_file"`
+	Blocks       int     `json:"blocks"`
+	Complete     int     `json:"complete"`
+	Passes       int     `json:"passes"`
+	PassesNeeded int     `json:"passes_needed"`
+	Percent      float64 `json:"percent"`
+}
+
+/*
+ProgressEstimate is the completion estimate. PerDay is the regular
+passes submitted per day over the window. ETA is nil when nothing
+was submitted in the window, or there's nothing left to do.
+*/
+type ProgressEstimate struct {
+	WindowDays      int        `json:"window_days"`
+	Submitted       int        `json:"submitted"`
+	PerDay          float64    `json:"per_day"`
+	RemainingPasses int        `json:"remaining_passes"`
+	DaysLeft        *float64   `json:"days_left"`
+	ETA             *time.Time `json:"eta"`
+}
+
+/*
+ProgressReport is how done the corpus is. Passes counts every
+regular block by its TimesCoded, and a block is complete after
+numRealBlockPasses passes.
+*/
+type ProgressReport struct {
+	Generated      time.Time        `json:"generated"`
+	PassesPerBlock int              `json:"passes_per_block"`
+	RegularBlocks  int              `json:"regular_blocks"`
+	CompleteBlocks int              `json:"complete_blocks"`
+	Passes         []PassCount      `json:"passes"`
+	Percent        float64          `json:"percent"`
+	Files          []FileProgress   `json:"files"`
+	Active         int              `json:"active"`
+	Stale          []ActiveCheckout `json:"stale"`
+	Estimate       ProgressEstimate `json:"estimate"`
+}
+
+/*
+passCounts counts the regular blocks in items (a copy of the
+work item map) by TimesCoded, from 0 up to at least numRealBlockPasses
+*/
+func passCounts(items WorkItemMap) []PassCount {
+	passes := make(map[int]int)
+	maxPasses := numRealBlockPasses
+	for _, item := range items {
+		if item.Training || item.Reliability {
+			continue
+		}
+		passes[item.TimesCoded]++
+		if item.TimesCoded > maxPasses {
+			maxPasses = item.TimesCoded
+		}
+	}
+	counts := make([]PassCount, 0, maxPasses+1)
+	for i := 0; i <= maxPasses; i++ {
+		counts = append(counts, PassCount{Passes: i, Blocks: passes[i]})
+	}
+	return counts
+}
+
+// percent is done out of total as a percentage, 100 if there's nothing to do
+func percent(done, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(done) * 100 / float64(total)
+}
+
+/*
+progress aggregates the work item map, the users' checkouts
+and the submission times of the labels into a ProgressReport.
+With onlyLab, the stale checkouts are only that lab's (they
+have the lab keys in them).
+*/
+func (s *Server) progress(windowDays, staleHours int, onlyLab string) (*ProgressReport, error) {
+	if windowDays <= 0 {
+		windowDays = defaultProgressWindowDays
+	}
+	if staleHours <= 0 {
+		staleHours = defaultStaleHours
+	}
+	labs, err := s.labs.getAllLabs()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.labels.getAllBlockGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	items := s.workItems()
+	now := time.Now().UTC()
+	report := &ProgressReport{Generated: now,
+		PassesPerBlock: numRealBlockPasses,
+		Passes:         passCounts(items),
+		Files:          make([]FileProgress, 0),
+		Stale:          make([]ActiveCheckout, 0),
+		Estimate:       ProgressEstimate{WindowDays: windowDays}}
+
+	files := make(map[string]*FileProgress)
+	passesDone := 0
+	for _, item := range items {
+		if item.Training || item.Reliability {
+			continue
+		}
+		file, exists := files[item.FileName]
+		if !exists {
+			file = &FileProgress{ClanFile: item.FileName}
+			files[item.FileName] = file
+		}
+		// passes past the ones needed don't count towards completion
+		passes := item.TimesCoded
+		if passes > numRealBlockPasses {
+			passes = numRealBlockPasses
+		}
+		file.Blocks++
+		file.Passes += passes
+		file.PassesNeeded += numRealBlockPasses
+		if passes == numRealBlockPasses {
+			file.Complete++
+		}
+
+		report.RegularBlocks++
+		passesDone += passes
+	}
+	for _, file := range files {
+		file.Percent = percent(file.Passes, file.PassesNeeded)
+		report.CompleteBlocks += file.Complete
+		report.Files = append(report.Files, *file)
+	}
+	sort.Slice(report.Files, func(i, j int) bool {
+		return report.Files[i].ClanFile < report.Files[j].ClanFile
+	})
+	passesNeeded := report.RegularBlocks * numRealBlockPasses
+	report.Percent = percent(passesDone, passesNeeded)
+
+	stale := time.Duration(staleHours) * time.Hour
+	for _, lab := range labs {
+		for username, user := range lab.Users {
+			report.Active += len(user.ActiveWorkItems)
+			if onlyLab != "" && lab.Key != onlyLab {
+				continue
+			}
+			for _, blockID := range user.ActiveWorkItems {
+				checkedOut, exists := user.checkedOutAt(blockID)
+				if !exists || now.Sub(checkedOut) < stale {
+					continue
+				}
+				item := items[blockID]
+				report.Stale = append(report.Stale, ActiveCheckout{BlockID: blockID,
+					LabKey: lab.Key, LabName: lab.LabName, Username: username,
+					Training: item.Training, Reliability: item.Reliability,
+					CheckedOut: &checkedOut, AgeSeconds: int64(now.Sub(checkedOut) / time.Second)})
+			}
+		}
+	}
+	sort.Slice(report.Stale, func(i, j int) bool {
+		return report.Stale[i].AgeSeconds > report.Stale[j].AgeSeconds
+	})
+
+	// the throughput is the regular passes submitted in the window
+	windowStart := now.AddDate(0, 0, -windowDays)
+	for _, group := range groups {
+		for _, block := range group.Blocks {
+			if block.Training || block.Reliability || block.Submitted.Before(windowStart) {
+				continue
+			}
+			report.Estimate.Submitted++
+		}
+	}
+	estimate := &report.Estimate
+	estimate.PerDay = float64(estimate.Submitted) / float64(windowDays)
+	estimate.RemainingPasses = passesNeeded - passesDone
+	if estimate.RemainingPasses > 0 && estimate.PerDay > 0 {
+		daysLeft := float64(estimate.RemainingPasses) / estimate.PerDay
+		eta := now.Add(time.Duration(daysLeft * float64(24*time.Hour)))
+		estimate.DaysLeft = &daysLeft
+		estimate.ETA = &eta
+	}
+	return report, nil
+}
+
+func (s *Server) progressHandler(w http.ResponseWriter, r *http.Request) {
+	var progressReq ProgressReq
+	if !s.decodeRequest(w, r, &progressReq) {
+		return
+	}
+	annotateRequest(r, progressReq.LabKey, "", "")
+
+	// the admin gets every lab's stale checkouts, a lab only its own
+	onlyLab := ""
+	if !s.config.labIsAdmin(progressReq.LabKey) {
+		if !s.config.labIsRegistered(progressReq.LabKey) {
+			writeError(w, r, ErrLabNotRegistered, 401)
+			requestLogger(r).Warn("unauthorized lab key")
+			return
+		}
+		onlyLab = progressReq.LabKey
+	}
+
+	report, progressErr := s.progress(progressReq.WindowDays, progressReq.StaleHours, onlyLab)
+	if progressErr != nil {
+		writeError(w, r, progressErr, 500)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+/*
+newProgressTestServer is a handler test server with three regular
+blocks and a training block. alice has had b.cha:::1 checked out
+for two days, bob checked a.cha:::1 out just now, and c.cha:::1
+was coded by alice today and by bob a month ago.
+*/
+func newProgressTestServer(t *testing.T) *Server {
+	server := newHandlerTestServer(t, t.TempDir())
+	server.config.AdminKey = "admin"
+	if _, _, err := server.addWorkItems(WorkItemMap{
+		"b.cha:::1": {ID: "b.cha:::1", FileName: "b.cha", Block: 1},
+		"c.cha:::1": {ID: "c.cha:::1", FileName: "c.cha", Block: 1},
+		"t.cha:::1": {ID: "t.cha:::1", FileName: "t.cha", Block: 1, Training: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, checkout := range []BlockReq{
+		{ItemID: "b.cha:::1", LabKey: "lab1", Username: "alice"},
+		{ItemID: "a.cha:::1", LabKey: "lab2", Username: "bob"},
+	} {
+		if _, err := server.chooseSpecificBlock(checkout); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice, err := server.getUser("lab1", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.CheckedOut["b.cha:::1"] = time.Now().Add(-48 * time.Hour)
+	if err := server.setUser(alice); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, block := range []Block{
+		{LabKey: "lab1", Coder: "alice", Submitted: time.Now()},
+		{LabKey: "lab2", Coder: "bob", Submitted: time.Now().AddDate(0, -1, 0)},
+	} {
+		block.ID, block.ClanFile, block.Index, block.Username = "c.cha:::1", "c.cha", 1, block.Coder
+		if err := server.addLabeledBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return server
+}
+
+func TestProgressHandler(t *testing.T) {
+	server := newProgressTestServer(t)
+
+	for _, test := range []struct {
+		request   ProgressReq
+		stale     []string // the stale checkouts, as "lab_key:::username:::block_id"
+		submitted int
+	}{
+		// the admin sees every lab's stale checkouts
+		{ProgressReq{LabKey: "admin"}, []string{"lab1:::alice:::b.cha:::1"}, 1},
+		{ProgressReq{LabKey: "lab1"}, []string{"lab1:::alice:::b.cha:::1"}, 1},
+		{ProgressReq{LabKey: "lab2"}, nil, 1},
+		{ProgressReq{LabKey: "admin", StaleHours: 72}, nil, 1},
+		{ProgressReq{LabKey: "admin", StaleHours: 72, WindowDays: 60}, nil, 2},
+	} {
+		recorder := serveTestRequest(t, server, "/v1/progress/", test.request)
+		var report ProgressReport
+		if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil || recorder.Code != http.StatusOK {
+			t.Fatalf("%+v: got %d %s", test.request, recorder.Code, recorder.Body)
+		}
+
+		var stale []string
+		for _, checkout := range report.Stale {
+			stale = append(stale, checkout.LabKey+":::"+checkout.Username+":::"+checkout.BlockID)
+		}
+		if len(stale) != len(test.stale) || len(stale) > 0 && stale[0] != test.stale[0] {
+			t.Errorf("%+v: got stale %v, want %v", test.request, stale, test.stale)
+		}
+		if report.Estimate.Submitted != test.submitted {
+			t.Errorf("%+v: got %d submitted, want %d", test.request, report.Estimate.Submitted, test.submitted)
+		}
+
+		// the rest doesn't depend on who's asking
+		remaining := 3*numRealBlockPasses - 2
+		if report.RegularBlocks != 3 || report.Active != 2 || report.Passes[2].Blocks != 1 ||
+			len(report.Files) != 3 || report.Files[2].ClanFile != "c.cha" || report.Files[2].Passes != 2 ||
+			report.Estimate.RemainingPasses != remaining || report.Estimate.DaysLeft == nil {
+			t.Errorf("%+v: got %s", test.request, recorder.Body)
+		}
+	}
+
+	recorder := serveTestRequest(t, server, "/v1/progress/", ProgressReq{LabKey: "lab3"})
+	checkErrorCode(t, recorder, http.StatusUnauthorized, "lab_not_registered")
+}
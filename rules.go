@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SeedlingsBabylab/idsserver/chat"
+)
+
+var (
+	// ErrNoBlocksDir means blocks can't be added through the
+	// server because there's no blocks_dir in the config
+	ErrNoBlocksDir = errors.New("No blocks_dir in the config to build blocks into")
+
+	// ErrMissingClanFile means a block selection request
+	// didn't say which CLAN file to select from
+	ErrMissingClanFile = errors.New("Missing clan_file")
+)
+
+/*
+BlockRules decide which conversation blocks of a CLAN file get
+built and coded. They're read from the JSON file at the config's
+block_rules_path (or passed to build-blocks with --rules):
+
+	min_tier_lines     the block needs at least this many main tier lines
+	                   (continuation lines count, they're clips too)
+	speakers           the tiers counted for min_speaker_tiers
+	min_speaker_tiers  the block needs at least this many lines from speakers
+	scrub_tier         blocks that overlap a line of this tier (e.g. "SCR")
+	                   are left out, "" doesn't check
+	exclude_intervals  [onset, offset] ms intervals to leave out, by the
+	                   start of the CLAN file's name (e.g. "01_06")
+	max_blocks         at most this many blocks are selected per file, 0 is all
+	shuffle            pick the max_blocks at random instead of in order,
+	                   with seed (0 picks one, it's returned with the selection)
+
+chooseblocks.py is:
+
+	{"min_tier_lines": 11, "speakers": ["FAN", "MAN"], "min_speaker_tiers": 2,
+	 "scrub_tier": "SCR", "max_blocks": 60, "shuffle": true}
+*/
+type BlockRules struct {
+	MinTierLines     int                 `json:"min_tier_lines"`
+	Speakers         []string            `json:"speakers"`
+	MinSpeakerTiers  int                 `json:"min_speaker_tiers"`
+	ScrubTier        string              `json:"scrub_tier"`
+	ExcludeIntervals map[string][][2]int `json:"exclude_intervals"`
+	MaxBlocks        int                 `json:"max_blocks"`
+	Shuffle          bool                `json:"shuffle"`
+	Seed             int64               `json:"seed"`
+}
+
+/*
+defaultBlockRules are used without a rules file, any
+block with a FAN or MAN tier (what makeblocks.py built)
+*/
+func defaultBlockRules() BlockRules {
+	return BlockRules{Speakers: []string{"FAN", "MAN"}, MinSpeakerTiers: 1}
+}
+
+// readBlockRules reads a rules file, or returns the defaults for ""
+func readBlockRules(path string) (BlockRules, error) {
+	if path == "" {
+		return defaultBlockRules(), nil
+	}
+	var rules BlockRules
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rules, err
+	}
+	err = json.Unmarshal(data, &rules)
+	return rules, err
+}
+
+/*
+BlockEvaluation is how a single conversation block did against
+the rules. Reasons are the rules it failed. Onset and Offset
+are in ms.
+*/
+type BlockEvaluation struct {
+	Block        int      `json:"block"`
+	Onset        int      `json:"onset"`
+	Offset       int      `json:"offset"`
+	TierLines    int      `json:"tier_lines"`
+	SpeakerTiers int      `json:"speaker_tiers"`
+	Passes       bool     `json:"passes"`
+	Reasons      []string `json:"reasons"`
+	Selected     bool     `json:"selected"`
+
+	clips []blockClip
+}
+
+// overlaps is true if the [onset, offset] interval overlaps the block
+func (eval *BlockEvaluation) overlaps(onset, offset int) bool {
+	return onset <= eval.Offset && offset >= eval.Onset
+}
+
+func (eval *BlockEvaluation) fail(reason string) {
+	eval.Passes = false
+	eval.Reasons = append(eval.Reasons, reason)
+}
+
+/*
+BlockSelection is every conversation block of a CLAN
+file, evaluated against the rules, and the ones selected
+*/
+type BlockSelection struct {
+	ClanFile string            `json:"clan_file"`
+	Rules    BlockRules        `json:"rules"`
+	Blocks   []BlockEvaluation `json:"blocks"`
+	Selected []int             `json:"selected"`
+}
+
+/*
+selectBlocks evaluates every "Conversation N" block of the
+transcript against the rules, and selects up to MaxBlocks
+of the ones that pass
+*/
+func (rules BlockRules) selectBlocks(clanFile string, transcript *chat.File) *BlockSelection {
+	if rules.Shuffle && rules.Seed == 0 {
+		rules.Seed = time.Now().UnixNano()
+	}
+	selection := &BlockSelection{ClanFile: clanFile, Rules: rules,
+		Blocks: make([]BlockEvaluation, 0), Selected: make([]int, 0)}
+
+	var scrubs [][2]int
+	if rules.ScrubTier != "" {
+		for _, utt := range transcript.Utterances {
+			if utt.Speaker() != rules.ScrubTier {
+				continue
+			}
+			for _, bullet := range utt.Main.Bullets() {
+				scrubs = append(scrubs, [2]int{bullet.Start, bullet.End})
+			}
+		}
+	}
+	var excludes [][2]int
+	for prefix, intervals := range rules.ExcludeIntervals {
+		if strings.HasPrefix(clanFile, prefix) {
+			excludes = append(excludes, intervals...)
+		}
+	}
+
+	speakers := make(map[string]bool)
+	for _, speaker := range rules.Speakers {
+		speakers[speaker] = true
+	}
+
+	var passing []int
+	for _, gem := range transcript.Conversations() {
+		number, _ := gem.Conversation()
+		eval := BlockEvaluation{Block: number, Passes: true, Reasons: make([]string, 0)}
+
+		clips, err := conversationClips(gem)
+		if err != nil {
+			eval.fail(err.Error())
+			selection.Blocks = append(selection.Blocks, eval)
+			continue
+		}
+		eval.clips = clips
+		eval.TierLines = len(clips)
+		for i, clip := range clips {
+			if speakers[clip.Tier] {
+				eval.SpeakerTiers++
+			}
+			if i == 0 || clip.Bullet.Start < eval.Onset {
+				eval.Onset = clip.Bullet.Start
+			}
+			if clip.Bullet.End > eval.Offset {
+				eval.Offset = clip.Bullet.End
+			}
+		}
+
+		if eval.TierLines < rules.MinTierLines {
+			eval.fail(fmt.Sprintf("has %d tier lines, needs %d", eval.TierLines, rules.MinTierLines))
+		}
+		if eval.SpeakerTiers < rules.MinSpeakerTiers {
+			eval.fail(fmt.Sprintf("has %d %s tiers, needs %d", eval.SpeakerTiers,
+				strings.Join(rules.Speakers, "/"), rules.MinSpeakerTiers))
+		}
+		for _, scrub := range scrubs {
+			if eval.overlaps(scrub[0], scrub[1]) {
+				eval.fail(fmt.Sprintf("overlaps %s %d_%d", rules.ScrubTier, scrub[0], scrub[1]))
+				break
+			}
+		}
+		for _, exclude := range excludes {
+			if eval.overlaps(exclude[0], exclude[1]) {
+				eval.fail(fmt.Sprintf("overlaps excluded interval %d_%d", exclude[0], exclude[1]))
+				break
+			}
+		}
+
+		if eval.Passes {
+			passing = append(passing, len(selection.Blocks))
+		}
+		selection.Blocks = append(selection.Blocks, eval)
+	}
+
+	if rules.Shuffle {
+		random := rand.New(rand.NewSource(rules.Seed))
+		random.Shuffle(len(passing), func(i, j int) {
+			passing[i], passing[j] = passing[j], passing[i]
+		})
+	}
+	if rules.MaxBlocks > 0 && len(passing) > rules.MaxBlocks {
+		passing = passing[:rules.MaxBlocks]
+	}
+	for _, i := range passing {
+		selection.Blocks[i].Selected = true
+		selection.Selected = append(selection.Selected, selection.Blocks[i].Block)
+	}
+	sort.Ints(selection.Selected)
+	return selection
+}
+
+/*
+SelectBlocksReq asks which blocks of a CLAN file (on the server)
+qualify, and with "add", builds them from the audio file into the
+config's blocks_dir and adds them to the work items. Rules default
+to the config's rules file. Blocks, if given, are the blocks to
+add instead of the selection (e.g. the ones from a preview, since
+a shuffled selection changes unless the seed is passed back).
+*/
+type SelectBlocksReq struct {
+	AdminLabKey string      `json:"admin_lab_key"`
+	ClanFile    string      `json:"clan_file"`
+	AudioFile   string      `json:"audio_file"`
+	Rules       *BlockRules `json:"rules"`
+	Blocks      []int       `json:"blocks"`
+	Add         bool        `json:"add"`
+	Training    bool        `json:"training"`
+	Reliability bool        `json:"reliability"`
+}
+
+/*
+SelectBlocksResp is the selection, and for an "add",
+the work items that were added, the ones that were
+already there and the blocks that weren't built
+*/
+type SelectBlocksResp struct {
+	BlockSelection
+	Added    []string `json:"added"`
+	Existing []string `json:"existing"`
+	Skipped  []string `json:"skipped"`
+}
+
+/*
+selectAndAddBlocks runs a SelectBlocksReq
+*/
+func (s *Server) selectAndAddBlocks(req SelectBlocksReq) (*SelectBlocksResp, error) {
+	if req.ClanFile == "" {
+		return nil, ErrMissingClanFile
+	}
+	rules, err := readBlockRules(s.config.BlockRulesPath)
+	if err != nil {
+		return nil, err
+	}
+	if req.Rules != nil {
+		rules = *req.Rules
+	}
+
+	transcript, err := chat.ParseFile(req.ClanFile)
+	if err != nil {
+		return nil, err
+	}
+	clanName := strings.TrimSuffix(filepath.Base(req.ClanFile), filepath.Ext(req.ClanFile))
+	resp := &SelectBlocksResp{BlockSelection: *rules.selectBlocks(clanName, transcript),
+		Added: make([]string, 0), Existing: make([]string, 0), Skipped: make([]string, 0)}
+	if !req.Add {
+		return resp, nil
+	}
+
+	if s.config.BlocksDir == "" {
+		return resp, ErrNoBlocksDir
+	}
+	if req.Training && req.Reliability {
+		return resp, ErrTrainingAndReliability
+	}
+	if req.Blocks != nil {
+		resp.Selected = req.Blocks
+	}
+	report := &BuildBlocksReport{Blocks: make([]BuiltBlock, 0),
+		Skipped: make([]string, 0), Existing: make([]string, 0)}
+	source := BlockSource{ClanPath: req.ClanFile, AudioPath: req.AudioFile}
+	err = s.buildSelectedBlocks(source, transcript, &resp.BlockSelection, s.config.BlocksDir,
+		req.Training, req.Reliability, report)
+	resp.Existing = append(resp.Existing, report.Existing...)
+	resp.Skipped = append(resp.Skipped, report.Skipped...)
+	if err != nil {
+		return resp, err
+	}
+	items, err := builtBlockItems(report.Blocks, req.Training, req.Reliability)
+	if err != nil {
+		return resp, err
+	}
+	added, existing, err := s.addWorkItems(items)
+	resp.Added = append(resp.Added, added...)
+	resp.Existing = append(resp.Existing, existing...)
+	return resp, err
+}
+
+func (s *Server) selectBlocksHandler(w http.ResponseWriter, r *http.Request) {
+	var selectReq SelectBlocksReq
+	if !s.decodeRequest(w, r, &selectReq) {
+		return
+	}
+	annotateRequest(r, selectReq.AdminLabKey, "", "")
+
+	if !s.config.labIsAdmin(selectReq.AdminLabKey) {
+		writeError(w, r, ErrAdminKeyRequired, 403)
+		requestLogger(r).Warn("unauthorized lab key")
+		return
+	}
+
+	resp, selectErr := s.selectAndAddBlocks(selectReq)
+	switch selectErr {
+	case nil:
+	case ErrMissingClanFile, ErrNoBlocksDir:
+		writeError(w, r, selectErr, 400)
+		return
+	default:
+		writeError(w, r, selectErr, 500)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
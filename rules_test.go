@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SeedlingsBabylab/idsserver/chat"
+)
+
+/*
+rulesTestTranscript has three conversation blocks: 1 with a CHI
+and a two line FAN tier (100 to 700ms), 2 with only CHI (800 to
+900ms) and 3 with one MAN line (900 to 950ms), which is scrubbed
+*/
+const rulesTestTranscript = "@UTF8\n@Begin\n@Participants:\tCHI Target_Child, FAN Female_Adult_Near\n" +
+	"@Bg:\tConversation 1\n*CHI:\tba . \x15100_300\x15\n*FAN:\thi . \x15300_600\x15\n\tthere . \x15600_700\x15\n@Eg:\tConversation 1\n" +
+	"@Bg:\tConversation 2\n*CHI:\tba . \x15800_900\x15\n@Eg:\tConversation 2\n" +
+	"@Bg:\tConversation 3\n*MAN:\tyo . \x15900_950\x15\n@Eg:\tConversation 3\n" +
+	"*SCR:\tscrubbed . \x15920_930\x15\n@End\n"
+
+func TestSelectBlocks(t *testing.T) {
+	transcript, err := chat.Parse(strings.NewReader(rulesTestTranscript))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		rules BlockRules
+		want  []int
+	}{
+		{"defaults", defaultBlockRules(), []int{1, 3}},
+		{"no rules", BlockRules{}, []int{1, 2, 3}},
+		{"min tier lines", BlockRules{MinTierLines: 2}, []int{1}},
+		{"min speaker tiers", BlockRules{Speakers: []string{"FAN", "MAN"}, MinSpeakerTiers: 2}, []int{1}},
+		{"scrub tier", BlockRules{ScrubTier: "SCR"}, []int{1, 2}},
+		{"excluded interval", BlockRules{ExcludeIntervals: map[string][][2]int{"01": {{850, 1000}}}}, []int{1}},
+		{"other file's interval", BlockRules{ExcludeIntervals: map[string][][2]int{"02": {{850, 1000}}}}, []int{1, 2, 3}},
+		{"max blocks", BlockRules{MaxBlocks: 2}, []int{1, 2}},
+	} {
+		selection := test.rules.selectBlocks("01_06", transcript)
+		if !reflect.DeepEqual(selection.Selected, test.want) {
+			t.Errorf("%s: selected %v, want %v", test.name, selection.Selected, test.want)
+		}
+		for _, eval := range selection.Blocks {
+			if eval.Passes == (len(eval.Reasons) > 0) {
+				t.Errorf("%s: block %d passes %v with reasons %v", test.name, eval.Block, eval.Passes, eval.Reasons)
+			}
+		}
+	}
+
+	// a shuffled selection picks a seed, and the same seed picks the same blocks
+	selection := BlockRules{Shuffle: true, MaxBlocks: 2}.selectBlocks("01_06", transcript)
+	if len(selection.Selected) != 2 || selection.Rules.Seed == 0 {
+		t.Fatalf("got %+v", selection)
+	}
+	again := selection.Rules.selectBlocks("01_06", transcript)
+	if !reflect.DeepEqual(again.Selected, selection.Selected) {
+		t.Errorf("seed %d selected %v, then %v", selection.Rules.Seed, selection.Selected, again.Selected)
+	}
+}
+
+func TestSelectBlocksHandler(t *testing.T) {
+	dir := t.TempDir()
+	server := newHandlerTestServer(t, dir)
+	server.config.AdminKey = "admin"
+	clanFile := filepath.Join(dir, "01_06.cha")
+	if err := os.WriteFile(clanFile, []byte(rulesTestTranscript), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		request SelectBlocksReq
+		status  int
+		code    string
+	}{
+		{SelectBlocksReq{AdminLabKey: "lab1", ClanFile: clanFile}, http.StatusForbidden, "admin_key_required"},
+		{SelectBlocksReq{AdminLabKey: "admin"}, http.StatusBadRequest, "missing_clan_file"},
+		// adding blocks needs somewhere to build them
+		{SelectBlocksReq{AdminLabKey: "admin", ClanFile: clanFile, Add: true},
+			http.StatusServiceUnavailable, "no_blocks_dir"},
+	} {
+		recorder := serveTestRequest(t, server, "/v1/select-blocks/", test.request)
+		checkErrorCode(t, recorder, test.status, test.code)
+	}
+
+	// a preview only selects, with the request's rules over the config's
+	recorder := serveTestRequest(t, server, "/v1/select-blocks/",
+		SelectBlocksReq{AdminLabKey: "admin", ClanFile: clanFile, Rules: &BlockRules{MinTierLines: 2}})
+	var resp SelectBlocksResp
+	json.Unmarshal(recorder.Body.Bytes(), &resp)
+	if recorder.Code != http.StatusOK || resp.ClanFile != "01_06" || !reflect.DeepEqual(resp.Selected, []int{1}) ||
+		len(resp.Blocks) != 3 || len(resp.Added) != 0 {
+		t.Errorf("got %d %s", recorder.Code, recorder.Body)
+	}
+	if items := server.workItems(); len(items) != 1 {
+		t.Errorf("a preview added work items: %v", items)
+	}
+}
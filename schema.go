@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	/*
+		currentSchemaVersion is the version of the record formats this
+		binary reads and writes. Bump it whenever a Migration is added.
+	*/
+	currentSchemaVersion = 5
+
+	// name of the bucket that holds the schema version in every bolt database
+	metaBucket = "Meta"
+
+	schemaVersionKey = "schema_version"
+)
+
+var (
+	// ErrSchemaTooNew means a database was written by a newer
+	// version of idsserver than this one
+	ErrSchemaTooNew = errors.New("Database schema is newer than this binary, upgrade idsserver")
+
+	// ErrSchemaOutOfDate means a database needs to be migrated
+	// before it can be used for this operation
+	ErrSchemaOutOfDate = errors.New("Database schema is out of date, run migrate-schema first")
+
+	// errDryRun rolls back the transaction of a dry run migration
+	errDryRun = errors.New("dry run")
+)
+
+/*
+Migration is a single step in upgrading the stored records from
+Version-1 to Version. Each function changes a record in place, in
+its raw JSON form, so they can deal with fields that the current
+structs no longer have. Any of them can be nil.
+*/
+type Migration struct {
+	Version     int
+	Description string
+	Lab         func(lab map[string]interface{}) error
+	User        func(labKey string, user map[string]interface{}) error
+	WorkItem    func(item map[string]interface{}) error
+	BlockGroup  func(group map[string]interface{}) error
+
+	// SQLite changes the SQLiteDB's tables before its records are migrated
+	SQLite func(tx *sql.Tx) error
+}
+
+/*
+migrations are all the registered Migrations, in Version order.
+New ones are appended at the end, never changed once released.
+*/
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "fill in missing user maps and parent labs, renumber block instances",
+		Lab: func(lab map[string]interface{}) error {
+			if _, isMap := lab["users"].(map[string]interface{}); !isMap {
+				lab["users"] = map[string]interface{}{}
+			}
+			return nil
+		},
+		User: func(labKey string, user map[string]interface{}) error {
+			if parentLab, _ := user["parent_lab"].(string); parentLab == "" {
+				user["parent_lab"] = labKey
+			}
+			return nil
+		},
+		BlockGroup: func(group map[string]interface{}) error {
+			blocks, _ := group["blocks"].([]interface{})
+			for i, block := range blocks {
+				if block, isMap := block.(map[string]interface{}); isMap {
+					block["block_instance"] = i
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     2,
+		Description: "add block_sha256 to work items and labeled blocks",
+		SQLite: func(tx *sql.Tx) error {
+			if err := sqliteAddColumn(tx, "work_items", "block_sha256", "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+			return sqliteAddColumn(tx, "block_instances", "block_sha256", "TEXT NOT NULL DEFAULT ''")
+		},
+	},
+	{
+		Version:     3,
+		Description: "add checkout times to users' active blocks",
+		SQLite: func(tx *sql.Tx) error {
+			return sqliteAddColumn(tx, "user_blocks", "checked_out_at", "TEXT NOT NULL DEFAULT ''")
+		},
+	},
+	{
+		Version:     4,
+		Description: "add submission times to labeled blocks",
+		SQLite: func(tx *sql.Tx) error {
+			return sqliteAddColumn(tx, "block_instances", "submitted_at", "TEXT NOT NULL DEFAULT ''")
+		},
+	},
+	{
+		Version:     5,
+		Description: "add checkout times to labeled blocks and release counts to users",
+		SQLite: func(tx *sql.Tx) error {
+			if err := sqliteAddColumn(tx, "block_instances", "checked_out_at", "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+			return sqliteAddColumn(tx, "users", "released", "INTEGER NOT NULL DEFAULT 0")
+		},
+	},
+}
+
+/*
+pendingMigrations returns the Migrations that need to be
+run on a database at the given version
+*/
+func pendingMigrations(version int) []Migration {
+	var pending []Migration
+	for _, migration := range migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending
+}
+
+func checkSchemaVersion(version int) error {
+	if version > currentSchemaVersion {
+		return fmt.Errorf("%v (database is at version %d, idsserver supports %d)",
+			ErrSchemaTooNew, version, currentSchemaVersion)
+	}
+	return nil
+}
+
+/*
+MigrationReport is the result of migrating a single store
+*/
+type MigrationReport struct {
+	Store       string `json:"store"`
+	FromVersion int    `json:"from_version"`
+	ToVersion   int    `json:"to_version"`
+	Records     int    `json:"records"`
+	Changed     int    `json:"changed"`
+	DryRun      bool   `json:"dry_run"`
+}
+
+func (report MigrationReport) String() string {
+	if report.FromVersion == report.ToVersion {
+		return fmt.Sprintf("%s: up to date at version %d", report.Store, report.ToVersion)
+	}
+	verb := "migrated"
+	if report.DryRun {
+		verb = "would migrate"
+	}
+	return fmt.Sprintf("%s: %s from version %d to %d, %d of %d records changed",
+		report.Store, verb, report.FromVersion, report.ToVersion, report.Changed, report.Records)
+}
+
+/*
+recordKind is a type of record that gets migrated: how to run
+a Migration's steps on it, and how to re-encode it in the
+current format once all the steps have run.
+*/
+type recordKind struct {
+	migrate func(step Migration, key string, record map[string]interface{}) error
+	encode  func(data []byte) ([]byte, error)
+}
+
+var labRecords = recordKind{
+	migrate: func(step Migration, labKey string, lab map[string]interface{}) error {
+		if step.Lab != nil {
+			if err := step.Lab(lab); err != nil {
+				return err
+			}
+		}
+		if step.User == nil {
+			return nil
+		}
+		users, _ := lab["users"].(map[string]interface{})
+		for _, user := range users {
+			if user, isMap := user.(map[string]interface{}); isMap {
+				if err := step.User(labKey, user); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	},
+	encode: func(data []byte) ([]byte, error) {
+		lab, err := decodeLabJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		return lab.encode()
+	},
+}
+
+var workItemRecords = recordKind{
+	migrate: func(step Migration, key string, item map[string]interface{}) error {
+		if step.WorkItem == nil {
+			return nil
+		}
+		return step.WorkItem(item)
+	},
+	encode: func(data []byte) ([]byte, error) {
+		item, err := decodeWorkItemJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		return item.encode()
+	},
+}
+
+var blockGroupRecords = recordKind{
+	migrate: func(step Migration, key string, group map[string]interface{}) error {
+		if step.BlockGroup == nil {
+			return nil
+		}
+		return step.BlockGroup(group)
+	},
+	encode: func(data []byte) ([]byte, error) {
+		group, err := decodeBlockGroupJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		return group.encode()
+	},
+}
+
+/*
+migrateRecord runs the steps on a single encoded record and
+returns it in the current format, along with whether it changed.
+*/
+func migrateRecord(kind recordKind, steps []Migration, key string, data []byte) ([]byte, bool, error) {
+	var record map[string]interface{}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, false, err
+	}
+	for _, step := range steps {
+		if err := kind.migrate(step, key, record); err != nil {
+			return nil, false, fmt.Errorf("migration %d on %s: %v", step.Version, key, err)
+		}
+	}
+
+	migrated, err := json.Marshal(record)
+	if err != nil {
+		return nil, false, err
+	}
+	encoded, err := kind.encode(migrated)
+	if err != nil {
+		return nil, false, fmt.Errorf("decoding migrated %s: %v", key, err)
+	}
+	return encoded, !bytes.Equal(encoded, data), nil
+}
+
+/*
+versionedStore is implemented by the stores that
+keep a schema version on disk
+*/
+type versionedStore interface {
+	schemaVersion() (int, error)
+	migrateSchema(dryRun bool) (MigrationReport, error)
+}
+
+/*
+boltSchemaVersion reads the schema version of a bolt database.
+Databases from before versioning don't have one, they're version 0.
+*/
+func boltSchemaVersion(tx *bolt.Tx) (int, error) {
+	bucket := tx.Bucket([]byte(metaBucket))
+	if bucket == nil {
+		return 0, nil
+	}
+	version := bucket.Get([]byte(schemaVersionKey))
+	if version == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(version))
+}
+
+func readBoltSchemaVersion(db *bolt.DB) (int, error) {
+	var version int
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = boltSchemaVersion(tx)
+		return err
+	})
+	return version, err
+}
+
+/*
+migrateBolt runs the pending migrations on every record in
+the bucket and sets the database's schema version, all in
+a single transaction. A dry run rolls the transaction back.
+*/
+func migrateBolt(db *bolt.DB, store, bucketName string, kind recordKind, dryRun bool) (MigrationReport, error) {
+	report := MigrationReport{Store: store, ToVersion: currentSchemaVersion, DryRun: dryRun}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		version, err := boltSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		report.FromVersion = version
+		if err := checkSchemaVersion(version); err != nil {
+			return err
+		}
+		if version == currentSchemaVersion {
+			return nil
+		}
+
+		steps := pendingMigrations(version)
+		bucket := tx.Bucket([]byte(bucketName))
+
+		// collect the changes first, bolt cursors don't
+		// like the bucket changing underneath them
+		changed := make(map[string][]byte)
+		cursor := bucket.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			report.Records++
+			migrated, isChanged, err := migrateRecord(kind, steps, string(key), value)
+			if err != nil {
+				return err
+			}
+			if isChanged {
+				changed[string(key)] = migrated
+			}
+		}
+		report.Changed = len(changed)
+
+		for key, value := range changed {
+			if err := bucket.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		err = meta.Put([]byte(schemaVersionKey), []byte(strconv.Itoa(currentSchemaVersion)))
+		if err != nil {
+			return err
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		err = nil
+	}
+	return report, err
+}
+
+func (db *LabsDB) schemaVersion() (int, error) {
+	return readBoltSchemaVersion(db.db)
+}
+
+func (db *LabsDB) migrateSchema(dryRun bool) (MigrationReport, error) {
+	return migrateBolt(db.db, "labs", labsBucket, labRecords, dryRun)
+}
+
+func (db *WorkDB) schemaVersion() (int, error) {
+	return readBoltSchemaVersion(db.db)
+}
+
+func (db *WorkDB) migrateSchema(dryRun bool) (MigrationReport, error) {
+	return migrateBolt(db.db, "work", workBucket, workItemRecords, dryRun)
+}
+
+func (db *LabelsDB) schemaVersion() (int, error) {
+	return readBoltSchemaVersion(db.db)
+}
+
+/*
+migrateSchema migrates the BlockGroups, and rebuilds the
+indexes afterwards if any of them changed.
+*/
+func (db *LabelsDB) migrateSchema(dryRun bool) (MigrationReport, error) {
+	report, err := migrateBolt(db.db, "labels", labelsBucket, blockGroupRecords, dryRun)
+	if err != nil || dryRun || report.Changed == 0 {
+		return report, err
+	}
+	_, err = db.rebuildIndexes()
+	return report, err
+}
+
+// the SQLiteDB keeps its schema version in SQLite's user_version
+func sqliteSchemaVersion(q sqlQuerier) (int, error) {
+	var version int
+	err := q.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+func (db *SQLiteDB) schemaVersion() (int, error) {
+	return sqliteSchemaVersion(db.db)
+}
+
+/*
+migrateSchema runs the migrations on the SQLiteDB's records. They
+work on JSON, so each record is encoded the same way the bolt
+stores keep it, migrated, and written back if it changed.
+*/
+func (db *SQLiteDB) migrateSchema(dryRun bool) (MigrationReport, error) {
+	report := MigrationReport{Store: "sqlite", ToVersion: currentSchemaVersion, DryRun: dryRun}
+
+	err := db.update(func(tx *sql.Tx) error {
+		version, err := sqliteSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		report.FromVersion = version
+		if err := checkSchemaVersion(version); err != nil {
+			return err
+		}
+		if version == currentSchemaVersion {
+			return nil
+		}
+		steps := pendingMigrations(version)
+		for _, step := range steps {
+			if step.SQLite == nil {
+				continue
+			}
+			if err := step.SQLite(tx); err != nil {
+				return err
+			}
+		}
+
+		labs, err := loadLabs(tx, "1 = 1")
+		if err != nil {
+			return err
+		}
+		for _, lab := range labs {
+			encoded, err := lab.encode()
+			if err != nil {
+				return err
+			}
+			migrated, changed, err := migrateSQLiteRecord(&report, labRecords, steps, lab.Key, encoded)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				continue
+			}
+			migratedLab, err := decodeLabJSON(migrated)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("UPDATE labs SET lab_name = ? WHERE lab_key = ?", migratedLab.LabName, lab.Key)
+			if err != nil {
+				return err
+			}
+			for username, user := range migratedLab.Users {
+				if err := putSQLiteUser(tx, lab.Key, username, user); err != nil {
+					return err
+				}
+			}
+		}
+
+		rows, err := tx.Query("SELECT " + workItemColumns + " FROM work_items")
+		if err != nil {
+			return err
+		}
+		var items []WorkItem
+		for rows.Next() {
+			item, err := scanWorkItem(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			items = append(items, item)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, item := range items {
+			encoded, err := item.encode()
+			if err != nil {
+				return err
+			}
+			migrated, changed, err := migrateSQLiteRecord(&report, workItemRecords, steps, item.ID, encoded)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				continue
+			}
+			migratedItem, err := decodeWorkItemJSON(migrated)
+			if err != nil {
+				return err
+			}
+			if err := putSQLiteWorkItem(tx, *migratedItem); err != nil {
+				return err
+			}
+		}
+
+		groups, err := loadBlockGroups(tx, "block_id > ?", "")
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			encoded, err := group.encode()
+			if err != nil {
+				return err
+			}
+			migrated, changed, err := migrateSQLiteRecord(&report, blockGroupRecords, steps, group.ID, encoded)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				continue
+			}
+			migratedGroup, err := decodeBlockGroupJSON(migrated)
+			if err != nil {
+				return err
+			}
+			if err := putSQLiteBlockGroup(tx, *migratedGroup); err != nil {
+				return err
+			}
+		}
+
+		// PRAGMA doesn't take parameters
+		_, err = tx.Exec("PRAGMA user_version = " + strconv.Itoa(currentSchemaVersion))
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		err = nil
+	}
+	return report, err
+}
+
+/*
+sqliteAddColumn adds a column to a table, unless it's already there
+(new databases are created with the current sqliteSchema, before
+they're stamped with a schema version)
+*/
+func sqliteAddColumn(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	exists := false
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     interface{}
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		if name == column {
+			exists = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || exists {
+		return err
+	}
+	_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+func migrateSQLiteRecord(report *MigrationReport, kind recordKind, steps []Migration, key string, data []byte) ([]byte, bool, error) {
+	report.Records++
+	migrated, changed, err := migrateRecord(kind, steps, key, data)
+	if changed {
+		report.Changed++
+	}
+	return migrated, changed, err
+}
+
+/*
+versionedStores returns the server's stores that keep a
+schema version, each one only once (the SQLiteDB is all three).
+*/
+func (s *Server) versionedStores() []versionedStore {
+	var stores []versionedStore
+	seen := make(map[interface{}]bool)
+	for _, store := range []interface{}{s.labs, s.work, s.labels} {
+		versioned, isVersioned := store.(versionedStore)
+		if !isVersioned || seen[store] {
+			continue
+		}
+		seen[store] = true
+		stores = append(stores, versioned)
+	}
+	return stores
+}
+
+/*
+checkSchemaVersions makes sure none of the stores
+were written by a newer version of idsserver
+*/
+func (s *Server) checkSchemaVersions() error {
+	for _, store := range s.versionedStores() {
+		version, err := store.schemaVersion()
+		if err != nil {
+			return err
+		}
+		if err := checkSchemaVersion(version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+migrateSchema brings all of the server's stores up
+to currentSchemaVersion (or reports what it would do,
+for a dry run)
+*/
+func (s *Server) migrateSchema(dryRun bool) ([]MigrationReport, error) {
+	var reports []MigrationReport
+	for _, store := range s.versionedStores() {
+		report, err := store.migrateSchema(dryRun)
+		if err != nil {
+			return reports, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+/*
+migrateSchemaCommand runs the migrations without starting
+the server. With --dry-run nothing is written:
+
+	$: ./idsserver migrate-schema config.json --dry-run
+*/
+func migrateSchemaCommand(args []string) error {
+	if len(args) < 1 {
+		return ErrMissingCommandArgs
+	}
+	dryRun := len(args) > 1 && args[1] == "--dry-run"
+
+	server, err := openServer(args[0])
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	reports, err := server.migrateSchema(dryRun)
+	for _, report := range reports {
+		fmt.Println(report)
+	}
+	return err
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+/*
+Server holds everything the HTTP handlers need. Handlers are
+methods on the Server instead of reaching for package globals,
+so they can be run with httptest against any set of stores.
+*/
+type Server struct {
+	/*
+		config is the Config read from the config file
+		at configPath when the server started
+	*/
+	config     Config
+	configPath string
+
+	/*
+		labs keeps track of all the users and the current jobs
+		that have been handed out to them.
+	*/
+	labs LabStore
+
+	/*
+		work keeps track of all the jobs that have been
+		assigned and yet to be assigned.
+	*/
+	work WorkStore
+
+	/*
+		labels stores all the classifications that the users send
+		back to the server. Keys are Block ID's, values are BlockGroups
+	*/
+	labels LabelStore
+
+	/*
+		workItemMap is a map of WorkItem ID's to WorkItems.
+		A WorkItem is Active if it's been sent out for coding
+		and has not been submitted back yet.
+
+		The ID's are a concatenation of the name of the CLAN file of origin
+		and the block index, separated by ":::".
+	*/
+	workItemMap WorkItemMap
+
+	/*
+		workItemMapEncoded is a json encoded version of the workItemMap
+	*/
+	workItemMapEncoded []byte
+
+	/*
+		itemsMu guards workItemMap and workItemMapEncoded, which
+		requests read and write concurrently. Go through workItem,
+		workItems, updateWorkItem and setWorkItems rather than
+		using the map directly.
+	*/
+	itemsMu sync.RWMutex
+
+	/*
+		metrics are the counters and histograms served
+		on /metrics, shared with the bolt stores
+	*/
+	metrics *Metrics
+
+	/*
+		stopBackups is closed to stop the scheduled backups,
+		which close backupsStopped once they have
+	*/
+	stopBackups    chan struct{}
+	backupsStopped chan struct{}
+}
+
+func newServer(config Config, labs LabStore, work WorkStore, labels LabelStore) *Server {
+	metrics := newMetrics()
+	for _, store := range []interface{}{labs, work, labels} {
+		if instrumented, ok := store.(instrumentedStore); ok {
+			instrumented.setMetrics(metrics)
+		}
+	}
+	return &Server{
+		config:      config,
+		labs:        labs,
+		work:        work,
+		labels:      labels,
+		workItemMap: make(WorkItemMap),
+		metrics:     metrics,
+	}
+}
+
+const (
+	// names of the storage backends for the config's "store"
+	boltStoreName   = "bolt"
+	sqliteStoreName = "sqlite"
+)
+
+// ErrUnknownStore means the config names a storage backend that doesn't exist
+var ErrUnknownStore = errors.New("Unknown store in config (must be \"bolt\" or \"sqlite\")")
+
+/*
+openServer reads the config file and opens the
+stores of the backend it's configured to use.
+*/
+func openServer(configPath string) (*Server, error) {
+	config, err := readConfigFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := openConfiguredServer(config)
+	if err != nil {
+		return nil, err
+	}
+	server.configPath = configPath
+	return server, nil
+}
+
+/*
+openConfiguredServer opens the stores of the
+backend the config is set up to use
+*/
+func openConfiguredServer(config Config) (*Server, error) {
+	var server *Server
+	var err error
+	switch config.Store {
+	case "", boltStoreName:
+		server, err = openBoltServer(config)
+	case sqliteStoreName:
+		server, err = openSQLiteServer(config)
+	default:
+		err = ErrUnknownStore
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// refuse to touch databases written by a newer idsserver
+	if err := server.checkSchemaVersions(); err != nil {
+		server.Close()
+		return nil, err
+	}
+	return server, nil
+}
+
+// openBoltServer opens the bolt databases the config points to
+func openBoltServer(config Config) (*Server, error) {
+	labs, err := LoadLabsDB(config.LabsDBPath)
+	if err != nil {
+		return nil, err
+	}
+	work, err := LoadWorkDB(config.WorkDBPath)
+	if err != nil {
+		labs.Close()
+		return nil, err
+	}
+	labels, err := LoadLabelsDB(config.LabelsDBPath)
+	if err != nil {
+		labs.Close()
+		work.Close()
+		return nil, err
+	}
+	return newServer(config, labs, work, labels), nil
+}
+
+// openSQLiteServer opens the SQLite database the config points to
+func openSQLiteServer(config Config) (*Server, error) {
+	db, err := LoadSQLiteDB(config.SQLitePath)
+	if err != nil {
+		return nil, err
+	}
+	return newServer(config, db, db, db), nil
+}
+
+// Close stops the scheduled backups and closes all of the server's stores
+func (s *Server) Close() {
+	s.stopScheduledBackups()
+	s.labs.Close()
+	s.work.Close()
+	s.labels.Close()
+}
+
+/*
+loadWorkItemMap fills the workItemMap, either from the
+manifest (the first time the server is started), or
+from the WorkStore.
+*/
+func (s *Server) loadWorkItemMap(manifestPath string) error {
+	if !s.config.WorkMapLoaded {
+		dataMap, err := fillDataMap(manifestPath)
+		if err != nil {
+			return err
+		}
+		s.workItemMap = dataMap.partitionIntoWorkItemsMap()
+		if err := s.work.persistWorkItemMap(s.workItemMap); err != nil {
+			return err
+		}
+		s.config.WorkMapLoaded = true
+		if err := s.config.writeFile(s.configPath); err != nil {
+			return err
+		}
+	} else {
+		itemMap, err := s.work.loadItemMap()
+		if err != nil {
+			return err
+		}
+		s.workItemMap = itemMap
+	}
+	return s.encodeWorkItemMap()
+}
+
+// encodeWorkItemMap refreshes the workItemMapEncoded
+func (s *Server) encodeWorkItemMap() error {
+	s.itemsMu.Lock()
+	defer s.itemsMu.Unlock()
+	encoded, err := json.Marshal(s.workItemMap)
+	if err != nil {
+		return err
+	}
+	s.workItemMapEncoded = encoded
+	return nil
+}
+
+// encodedWorkItemMap is the workItemMap as of the last encodeWorkItemMap
+func (s *Server) encodedWorkItemMap() []byte {
+	s.itemsMu.RLock()
+	defer s.itemsMu.RUnlock()
+	return s.workItemMapEncoded
+}
+
+// workItem is the WorkItem with the ID, if there is one
+func (s *Server) workItem(id string) (WorkItem, bool) {
+	s.itemsMu.RLock()
+	defer s.itemsMu.RUnlock()
+	item, exists := s.workItemMap[id]
+	return item, exists
+}
+
+/*
+workItems is a copy of the workItemMap, to range
+over without holding up the requests that write it
+*/
+func (s *Server) workItems() WorkItemMap {
+	s.itemsMu.RLock()
+	defer s.itemsMu.RUnlock()
+	items := make(WorkItemMap, len(s.workItemMap))
+	for id, item := range s.workItemMap {
+		items[id] = item
+	}
+	return items
+}
+
+// numWorkItems is the number of WorkItems in the workItemMap
+func (s *Server) numWorkItems() int {
+	s.itemsMu.RLock()
+	defer s.itemsMu.RUnlock()
+	return len(s.workItemMap)
+}
+
+/*
+updateWorkItem changes the WorkItem with the ID (the zero
+WorkItem if there isn't one) and returns what it's changed to
+*/
+func (s *Server) updateWorkItem(id string, update func(item *WorkItem)) WorkItem {
+	s.itemsMu.Lock()
+	defer s.itemsMu.Unlock()
+	item := s.workItemMap[id]
+	update(&item)
+	s.workItemMap[id] = item
+	return item
+}
+
+/*
+setWorkItems puts the items in the workItemMap, replacing
+what's there for their IDs, and re-encodes it
+*/
+func (s *Server) setWorkItems(items WorkItemMap) error {
+	s.itemsMu.Lock()
+	if s.workItemMap == nil {
+		s.workItemMap = make(WorkItemMap)
+	}
+	for id, item := range items {
+		s.workItemMap[id] = item
+	}
+	s.itemsMu.Unlock()
+	return s.encodeWorkItemMap()
+}
+
+/*
+routes returns the handler for all of the server's endpoints,
+each only taking the methods it's meant to be called with
+*/
+func (s *Server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	get := []string{http.MethodGet}
+	post := []string{http.MethodPost}
+	postOrDelete := []string{http.MethodPost, http.MethodDelete}
+	handle := func(pattern string, h http.Handler, methods []string) {
+		mux.Handle(pattern, allowMethods(h, methods...))
+	}
+	handleFunc := func(pattern string, h http.HandlerFunc, methods []string) {
+		handle(pattern, h, methods)
+	}
+
+	handleFunc("/", s.mainHandler, get)
+	handleFunc("/v1/get-block/", s.getBlockHandler, post)
+	handleFunc("/v1/get-specific-block/", s.getSpecificBlockHandler, post)
+	handleFunc("/v1/get-clip/", s.getClipHandler, get)
+	handleFunc("/v1/get-block-clips/", s.getBlockClipsHandler, get)
+	handleFunc("/v1/coding-config/", s.codingConfigHandler, get)
+	handleFunc("/v1/get-block-list/", s.getWorkItemMapHandler, post)
+	handleFunc("/v1/delete-block/", s.deleteBlockHandler, postOrDelete)
+	handleFunc("/v1/delete-user/", s.deleteUserHandler, postOrDelete)
+	handleFunc("/v1/lab-info/", s.labInfoHandler, post)
+	handleFunc("/v1/all-lab-info/", s.allLabInfoHandler, post)
+	handleFunc("/v1/add-user/", s.addUserHandler, post)
+	handleFunc("/v1/submit-labels/", s.submitLabelsHandler, post)
+	handleFunc("/v1/submit-wo-labels/", s.submitWOLabelsHandler, post)
+	handleFunc("/v1/get-labels/", s.getLabelsHandler, post)
+	handleFunc("/v1/get-lab-labels/", s.getLabLabelsHandler, post)
+	handleFunc("/v1/get-all-labels/", s.getAllLabelsHandler, post)
+	handleFunc("/v1/get-file-labels/", s.getFileLabelsHandler, post)
+	handleFunc("/v1/get-train-labels/", s.getTrainingLabelsHandler, post)
+	handleFunc("/v1/get-relia-labels/", s.getReliabilityHandler, post)
+
+	handleFunc("/v1/migrate-add-block-labels/", s.migrateAddLabeledBlockHandler, post)
+	handleFunc("/v1/migrate-add-user/", s.migrateAddUserHandler, post)
+	handleFunc("/v1/migrate-set-active-work-item/", s.migrateSetActiveWorkItemHandler, post)
+	handleFunc("/v1/rebuild-indexes/", s.rebuildIndexesHandler, post)
+	handleFunc("/v1/snapshot/", s.snapshotHandler, post)
+	handleFunc("/v1/import/", s.importHandler, post)
+	handleFunc("/v1/fsck/", s.fsckHandler, post)
+	handleFunc("/v1/select-blocks/", s.selectBlocksHandler, post)
+	handleFunc("/v1/dashboard/", s.dashboardHandler, post)
+	handleFunc("/v1/progress/", s.progressHandler, post)
+	handleFunc("/v1/stats/", s.statsHandler, post)
+	handleFunc("/metrics", s.metricsHandler, get)
+	handleFunc("/healthz", s.healthzHandler, get)
+	handleFunc("/readyz", s.readyzHandler, get)
+	handle("/admin/", adminUI, get)
+
+	return mux
+}
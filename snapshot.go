@@ -0,0 +1,584 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+	A snapshot is a tarball containing a consistent copy of each of
+	the three bolt databases, taken with Tx.WriteTo while the server
+	keeps running, along with a small snapshot.json describing it.
+
+	snapshot.json
+	labs.db
+	work.db
+	labels.db
+*/
+
+const (
+	// name of the metadata entry in a snapshot tarball
+	snapshotInfoEntry = "snapshot.json"
+
+	// prefix of the scheduled snapshot file names
+	snapshotFilePrefix = "idsserver-snapshot-"
+
+	// timestamp format used in snapshot file names
+	snapshotTimeFormat = "20060102T150405"
+
+	// how long to wait for a bolt file lock before
+	// deciding the database is held by a running server
+	storeLockTimeout = time.Second
+
+	// scheduled snapshot interval used when backup_interval isn't set
+	defaultBackupInterval = 24 * time.Hour
+)
+
+var (
+	// ErrSnapshotMissingStore means a snapshot tarball doesn't
+	// contain one of the three databases
+	ErrSnapshotMissingStore = errors.New("Snapshot is missing a database")
+
+	// ErrSnapshotMissingBucket means a database in a snapshot
+	// doesn't have the bucket the server expects
+	ErrSnapshotMissingBucket = errors.New("Snapshot database is missing its bucket")
+
+	// ErrStoreInUse means a database file is locked by another
+	// process, most likely a running server
+	ErrStoreInUse = errors.New("Database is in use (is the server running?)")
+
+	// ErrNotBoltStore means the server's stores aren't bolt
+	// databases, so they can't be snapshotted
+	ErrNotBoltStore = errors.New("Snapshots are only supported for bolt stores")
+)
+
+/*
+SnapshotInfo is the metadata stored in a snapshot tarball
+*/
+type SnapshotInfo struct {
+	Created time.Time `json:"created"`
+	Stores  []string  `json:"stores"`
+}
+
+/*
+snapshotStore describes one of the databases that
+goes into a snapshot and how to validate its contents
+*/
+type snapshotStore struct {
+	entry  string
+	path   string
+	bucket string
+	decode func(value []byte) error
+}
+
+func snapshotStores(config Config) []snapshotStore {
+	return []snapshotStore{
+		{
+			entry:  "labs.db",
+			path:   config.LabsDBPath,
+			bucket: labsBucket,
+			decode: func(value []byte) error {
+				_, err := decodeLabJSON(value)
+				return err
+			},
+		},
+		{
+			entry:  "work.db",
+			path:   config.WorkDBPath,
+			bucket: workBucket,
+			decode: func(value []byte) error {
+				_, err := decodeWorkItemJSON(value)
+				return err
+			},
+		},
+		{
+			entry:  "labels.db",
+			path:   config.LabelsDBPath,
+			bucket: labelsBucket,
+			decode: func(value []byte) error {
+				_, err := decodeBlockGroupJSON(value)
+				return err
+			},
+		},
+	}
+}
+
+/*
+writeSnapshot writes a tarball of the three databases to w.
+dbs must be in labs, work, labels order. Read transactions
+on all the databases are opened before anything is written, so the
+copies are taken from (nearly) the same point in time, and the
+server can keep handling requests while it's being written.
+*/
+func writeSnapshot(w io.Writer, dbs []*bolt.DB) error {
+	stores := snapshotStores(Config{})
+
+	var txs []*bolt.Tx
+	defer func() {
+		for _, tx := range txs {
+			tx.Rollback()
+		}
+	}()
+	for _, db := range dbs {
+		tx, err := db.Begin(false)
+		if err != nil {
+			return err
+		}
+		txs = append(txs, tx)
+	}
+
+	now := time.Now()
+	tarWriter := tar.NewWriter(w)
+
+	info := SnapshotInfo{Created: now}
+	for _, store := range stores {
+		info.Stores = append(info.Stores, store.entry)
+	}
+	encodedInfo, err := json.MarshalIndent(info, "", " ")
+	if err != nil {
+		return err
+	}
+	err = tarWriter.WriteHeader(&tar.Header{
+		Name:    snapshotInfoEntry,
+		Mode:    0644,
+		Size:    int64(len(encodedInfo)),
+		ModTime: now,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write(encodedInfo); err != nil {
+		return err
+	}
+
+	for i, tx := range txs {
+		err := tarWriter.WriteHeader(&tar.Header{
+			Name:    stores[i].entry,
+			Mode:    0600,
+			Size:    tx.Size(),
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tx.WriteTo(tarWriter); err != nil {
+			return err
+		}
+	}
+	return tarWriter.Close()
+}
+
+/*
+boltDBs returns the server's open bolt databases in
+labs, work, labels order
+*/
+func (s *Server) boltDBs() ([]*bolt.DB, error) {
+	var dbs []*bolt.DB
+	for _, store := range []interface{}{s.labs, s.work, s.labels} {
+		bolted, isBolt := store.(boltStore)
+		if !isBolt {
+			return nil, ErrNotBoltStore
+		}
+		dbs = append(dbs, bolted.boltDB())
+	}
+	return dbs, nil
+}
+
+func snapshotFileName(t time.Time) string {
+	return snapshotFilePrefix + t.Format(snapshotTimeFormat) + ".tar"
+}
+
+/*
+writeSnapshotFile writes a snapshot to a file in dir and
+returns its path. The snapshot is written to a temporary file
+first, so a crash never leaves a partial snapshot behind.
+*/
+func writeSnapshotFile(dir string, dbs []*bolt.DB) (string, error) {
+	snapshotPath := filepath.Join(dir, snapshotFileName(time.Now()))
+	tmpPath := snapshotPath + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	if err := writeSnapshot(file, dbs); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return snapshotPath, os.Rename(tmpPath, snapshotPath)
+}
+
+/*
+pruneSnapshots deletes the oldest scheduled snapshots
+in dir so that only the newest retain are left.
+*/
+func pruneSnapshots(dir string, retain int) error {
+	if retain <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, snapshotFilePrefix+"*.tar"))
+	if err != nil {
+		return err
+	}
+	// the timestamp format sorts chronologically
+	sort.Strings(matches)
+	for len(matches) > retain {
+		if err := os.Remove(matches[0]); err != nil {
+			return err
+		}
+		matches = matches[1:]
+	}
+	return nil
+}
+
+/*
+startScheduledBackups writes a snapshot of the databases to
+the configured backup_dir every backup_interval, keeping the
+newest backup_retention of them, until stopScheduledBackups
+(or Close) is called. It does nothing if there's no
+backup_dir in the config.
+*/
+func (s *Server) startScheduledBackups() error {
+	if s.config.BackupDir == "" {
+		return nil
+	}
+
+	interval := defaultBackupInterval
+	if s.config.BackupInterval != "" {
+		parsed, err := time.ParseDuration(s.config.BackupInterval)
+		if err != nil {
+			return err
+		}
+		interval = parsed
+	}
+
+	dbs, err := s.boltDBs()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.config.BackupDir, 0700); err != nil {
+		return err
+	}
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	s.stopBackups, s.backupsStopped = stop, stopped
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.writeScheduledBackup(dbs)
+			}
+		}
+	}()
+	return nil
+}
+
+// writeScheduledBackup writes one scheduled backup and prunes the old ones
+func (s *Server) writeScheduledBackup(dbs []*bolt.DB) {
+	snapshotPath, err := writeSnapshotFile(s.config.BackupDir, dbs)
+	if err != nil {
+		slog.Error("scheduled backup failed", "error", err)
+		return
+	}
+	slog.Info("wrote scheduled backup", "path", snapshotPath)
+
+	if err := pruneSnapshots(s.config.BackupDir, s.config.BackupRetention); err != nil {
+		slog.Error("pruning old backups failed", "error", err)
+	}
+}
+
+/*
+stopScheduledBackups stops the scheduled backups, waiting
+for one that's being written to finish, so the databases
+can be closed. It does nothing if they aren't running.
+*/
+func (s *Server) stopScheduledBackups() {
+	if s.stopBackups == nil {
+		return
+	}
+	close(s.stopBackups)
+	<-s.backupsStopped
+	s.stopBackups, s.backupsStopped = nil, nil
+}
+
+/*
+openStoreReadOnly opens a bolt file without creating
+anything. It fails with ErrStoreInUse instead of blocking
+if a running server holds the file.
+*/
+func openStoreReadOnly(path string) (*bolt.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: storeLockTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, ErrStoreInUse
+	}
+	return db, err
+}
+
+/*
+validateStoreFile opens a database extracted from a snapshot
+and makes sure every record in its bucket decodes.
+*/
+func validateStoreFile(path string, store snapshotStore) (int, error) {
+	db, err := openStoreReadOnly(path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var numRecords int
+	err = db.View(func(tx *bolt.Tx) error {
+		version, err := boltSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if err := checkSchemaVersion(version); err != nil {
+			return fmt.Errorf("%s: %v", store.entry, err)
+		}
+
+		bucket := tx.Bucket([]byte(store.bucket))
+		if bucket == nil {
+			return ErrSnapshotMissingBucket
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			if value == nil {
+				// nested bucket
+				return nil
+			}
+			if err := store.decode(value); err != nil {
+				return fmt.Errorf("%s: record %q: %v", store.entry, key, err)
+			}
+			numRecords++
+			return nil
+		})
+	})
+	return numRecords, err
+}
+
+/*
+extractSnapshot writes each database in the snapshot tarball next
+to the file it will replace (with a ".restore" suffix) and returns
+the paths of the extracted files, keyed by tarball entry name.
+*/
+func extractSnapshot(snapshotPath string, stores []snapshotStore) (map[string]string, error) {
+	extracted := make(map[string]string)
+
+	file, err := os.Open(snapshotPath)
+	if err != nil {
+		return extracted, err
+	}
+	defer file.Close()
+
+	targets := make(map[string]string)
+	for _, store := range stores {
+		targets[store.entry] = store.path + ".restore"
+	}
+
+	tarReader := tar.NewReader(file)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return extracted, err
+		}
+
+		target, isStore := targets[header.Name]
+		if !isStore {
+			continue
+		}
+
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return extracted, err
+		}
+		extracted[header.Name] = target
+		_, copyErr := io.Copy(out, tarReader)
+		closeErr := out.Close()
+		if copyErr != nil {
+			return extracted, copyErr
+		}
+		if closeErr != nil {
+			return extracted, closeErr
+		}
+	}
+
+	for _, store := range stores {
+		if _, exists := extracted[store.entry]; !exists {
+			return extracted, fmt.Errorf("%v: %s", ErrSnapshotMissingStore, store.entry)
+		}
+	}
+	return extracted, nil
+}
+
+/*
+restoreSnapshot validates every database in the snapshot and only
+then swaps them in place of the current database files. The current
+files are kept with a ".pre-restore-<timestamp>" suffix. If one of
+the swaps fails, the databases already swapped are rolled back, so
+the stores are never left from different snapshots.
+
+The server must be stopped first. The check below only catches a
+server that holds the bolt file locks, and a server that kept running
+would go on using the files that were moved aside.
+*/
+func restoreSnapshot(config Config, snapshotPath string) error {
+	stores := snapshotStores(config)
+
+	// make sure nobody is using the current databases
+	for _, store := range stores {
+		db, err := openStoreReadOnly(store.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		db.Close()
+	}
+
+	extracted, err := extractSnapshot(snapshotPath, stores)
+	defer func() {
+		// only left over if the restore didn't go through
+		for _, path := range extracted {
+			os.Remove(path)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	for _, store := range stores {
+		numRecords, err := validateStoreFile(extracted[store.entry], store)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d records ok\n", store.entry, numRecords)
+	}
+
+	suffix := ".pre-restore-" + time.Now().Format(snapshotTimeFormat)
+	var swapped []swappedStore
+	for _, store := range stores {
+		swap := swappedStore{path: store.path}
+		if _, err := os.Stat(store.path); err == nil {
+			if err := os.Rename(store.path, store.path+suffix); err != nil {
+				return rollbackRestore(swapped, err)
+			}
+			swap.backup = store.path + suffix
+		}
+		if err := os.Rename(extracted[store.entry], store.path); err != nil {
+			return rollbackRestore(append(swapped, swap), err)
+		}
+		swap.restored = true
+		swapped = append(swapped, swap)
+		fmt.Println("restored", store.path)
+	}
+	return nil
+}
+
+// swappedStore is a database file restoreSnapshot has (partly) swapped
+type swappedStore struct {
+	path     string
+	backup   string // where the old file was moved, "" if there wasn't one
+	restored bool   // if the snapshot's file is at path
+}
+
+/*
+rollbackRestore puts the old database files back in place of the
+ones restored so far, and returns the error that stopped the restore
+along with any that stopped the rollback.
+*/
+func rollbackRestore(swapped []swappedStore, restoreErr error) error {
+	for i := len(swapped) - 1; i >= 0; i-- {
+		swap := swapped[i]
+		if swap.restored {
+			if err := os.Remove(swap.path); err != nil {
+				return fmt.Errorf("%w (rolling back %s: %v)", restoreErr, swap.path, err)
+			}
+		}
+		if swap.backup != "" {
+			if err := os.Rename(swap.backup, swap.path); err != nil {
+				return fmt.Errorf("%w (rolling back %s: %v)", restoreErr, swap.path, err)
+			}
+		}
+		fmt.Println("rolled back", swap.path)
+	}
+	return restoreErr
+}
+
+func snapshotCommand(args []string) error {
+	if len(args) < 2 {
+		return ErrMissingCommandArgs
+	}
+	config, err := readConfigFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	var dbs []*bolt.DB
+	defer func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+	}()
+	for _, store := range snapshotStores(config) {
+		db, err := openStoreReadOnly(store.path)
+		if err == ErrStoreInUse {
+			return fmt.Errorf("%v: use the /v1/snapshot/ endpoint instead", err)
+		}
+		if err != nil {
+			return err
+		}
+		dbs = append(dbs, db)
+	}
+
+	outPath := args[1]
+	out, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := writeSnapshot(out, dbs); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	fmt.Println("wrote snapshot: ", outPath)
+	return nil
+}
+
+func restoreSnapshotCommand(args []string) error {
+	if len(args) < 2 {
+		return ErrMissingCommandArgs
+	}
+	config, err := readConfigFile(args[0])
+	if err != nil {
+		return err
+	}
+	return restoreSnapshot(config, args[1])
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backupFiles are the names of the files in the backup dir
+func backupFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// newSnapshotTestServer is a bolt backed server, with its databases in dir
+func newSnapshotTestServer(t *testing.T, dir string, config Config) *Server {
+	config.Labs = []string{"lab1"}
+	config.LabsDBPath = filepath.Join(dir, "labs.db")
+	config.WorkDBPath = filepath.Join(dir, "work.db")
+	config.LabelsDBPath = filepath.Join(dir, "labels.db")
+	configPath := filepath.Join(dir, "config.json")
+	if err := config.writeFile(configPath); err != nil {
+		t.Fatal(err)
+	}
+	server, err := openServer(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestSnapshotHandler(t *testing.T) {
+	server := newSnapshotTestServer(t, t.TempDir(), Config{AdminKey: "admin"})
+	defer server.Close()
+
+	recorder := serveTestRequest(t, server, "/v1/snapshot/", AdminReq{AdminLabKey: "admin"})
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/x-tar" ||
+		recorder.Header().Get("Content-Length") != strconv.Itoa(recorder.Body.Len()) {
+		t.Fatalf("got %d %v", recorder.Code, recorder.Header())
+	}
+	var entries []string
+	tarReader := tar.NewReader(recorder.Body)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, header.Name)
+	}
+	sort.Strings(entries)
+	if got := strings.Join(entries, ","); got != "labels.db,labs.db,snapshot.json,work.db" {
+		t.Errorf("got entries %s", got)
+	}
+
+	recorder = serveTestRequest(t, server, "/v1/snapshot/", AdminReq{AdminLabKey: "lab1"})
+	checkErrorCode(t, recorder, http.StatusForbidden, "admin_key_required")
+}
+
+func TestScheduledBackupsStop(t *testing.T) {
+	dir := t.TempDir()
+	backupDir := filepath.Join(dir, "backups")
+	server := newSnapshotTestServer(t, dir, Config{BackupDir: backupDir, BackupInterval: "10ms"})
+	defer server.Close()
+
+	if err := server.startScheduledBackups(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(backupFiles(t, backupDir)) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("no backup was written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.stopScheduledBackups()
+	for _, name := range backupFiles(t, backupDir) {
+		if err := os.Remove(filepath.Join(backupDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the databases are still open, so a backup would still be written
+	time.Sleep(50 * time.Millisecond)
+	if names := backupFiles(t, backupDir); len(names) > 0 {
+		t.Errorf("backups were written after they were stopped: %v", names)
+	}
+
+	// stopping them again, as Close does, is fine
+	server.stopScheduledBackups()
+}
@@ -0,0 +1,1073 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	// pure Go SQLite driver, registers itself as "sqlite"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// sqliteDriver is the database/sql driver name of the SQLite driver
+	sqliteDriver = "sqlite"
+
+	// names of the User block ID lists in the user_blocks table
+	activeList      = "active"
+	finishedList    = "finished"
+	trainList       = "complete_train"
+	reliabilityList = "complete_reliability"
+)
+
+// ErrSQLiteNotEmpty means the migration target already has data in it
+var ErrSQLiteNotEmpty = errors.New("SQLite database isn't empty")
+
+/*
+sqliteSchema is the relational layout of the stores. Instead of
+a JSON blob per Lab and per BlockGroup, every User, block list
+entry, coded block instance and clip is its own row, so they
+can be queried directly with SQL, e.g.
+
+	SELECT lab_key, coder, COUNT(*) FROM block_instances
+	WHERE NOT training AND NOT reliability
+	GROUP BY lab_key, coder;
+
+Child rows are deleted explicitly by the store, so it doesn't
+depend on foreign key enforcement being turned on.
+*/
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS labs (
+	lab_key  TEXT PRIMARY KEY,
+	lab_name TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS users (
+	lab_key  TEXT NOT NULL REFERENCES labs (lab_key),
+	username TEXT NOT NULL,
+	released INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (lab_key, username)
+);
+
+CREATE TABLE IF NOT EXISTS user_blocks (
+	lab_key  TEXT NOT NULL,
+	username TEXT NOT NULL,
+	list     TEXT NOT NULL,
+	position INTEGER NOT NULL,
+	block_id TEXT NOT NULL,
+	checked_out_at TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (lab_key, username, list, position),
+	FOREIGN KEY (lab_key, username) REFERENCES users (lab_key, username)
+);
+
+CREATE TABLE IF NOT EXISTS work_items (
+	id             TEXT PRIMARY KEY,
+	filename       TEXT NOT NULL,
+	block          INTEGER NOT NULL,
+	active         BOOLEAN NOT NULL,
+	block_path     TEXT NOT NULL,
+	times_coded    INTEGER NOT NULL,
+	training       BOOLEAN NOT NULL,
+	reliability    BOOLEAN NOT NULL,
+	train_pack_num INTEGER NOT NULL,
+	block_sha256   TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS block_groups (
+	block_id    TEXT PRIMARY KEY,
+	training    BOOLEAN NOT NULL,
+	reliability BOOLEAN NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS block_instances (
+	block_id    TEXT NOT NULL REFERENCES block_groups (block_id),
+	instance    INTEGER NOT NULL,
+	clan_file   TEXT NOT NULL,
+	block_index INTEGER NOT NULL,
+	fan_or_man  BOOLEAN NOT NULL,
+	dont_share  BOOLEAN NOT NULL,
+	coder       TEXT NOT NULL,
+	lab_key     TEXT NOT NULL,
+	lab_name    TEXT NOT NULL,
+	username    TEXT NOT NULL,
+	training    BOOLEAN NOT NULL,
+	reliability BOOLEAN NOT NULL,
+	block_sha256 TEXT NOT NULL DEFAULT '',
+	submitted_at TEXT NOT NULL DEFAULT '',
+	checked_out_at TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (block_id, instance)
+);
+
+CREATE INDEX IF NOT EXISTS block_instances_coder ON block_instances (lab_key, coder);
+CREATE INDEX IF NOT EXISTS block_instances_clan_file ON block_instances (clan_file);
+
+CREATE TABLE IF NOT EXISTS clips (
+	block_id          TEXT NOT NULL,
+	instance          INTEGER NOT NULL,
+	position          INTEGER NOT NULL,
+	clip_index        INTEGER NOT NULL,
+	clip_tier         TEXT NOT NULL,
+	multiline         BOOLEAN NOT NULL,
+	multi_tier_parent TEXT NOT NULL,
+	start_time        TEXT NOT NULL,
+	offset_time       TEXT NOT NULL,
+	timestamp         TEXT NOT NULL,
+	classification    TEXT NOT NULL,
+	label_date        TEXT NOT NULL,
+	coder             TEXT NOT NULL,
+	gender_label      TEXT NOT NULL,
+	PRIMARY KEY (block_id, instance, position),
+	FOREIGN KEY (block_id, instance) REFERENCES block_instances (block_id, instance)
+);
+`
+
+/*
+SQLiteDB stores the labs, work items and labels in a single
+SQLite database. It implements LabStore, WorkStore and LabelStore,
+so the same SQLiteDB is passed to newServer for all three.
+*/
+type SQLiteDB struct {
+	db        *sql.DB
+	closeOnce sync.Once
+	closeErr  error
+}
+
+/*
+sqlQuerier is implemented by both *sql.DB and *sql.Tx, so
+the read helpers can be used inside and outside transactions.
+*/
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// LoadSQLiteDB opens the SQLiteDB stored at path
+func LoadSQLiteDB(path string) (*SQLiteDB, error) {
+	localSQLiteDB := &SQLiteDB{}
+	err := localSQLiteDB.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return localSQLiteDB, nil
+}
+
+// Open opens the database, creating the tables if needed
+func (db *SQLiteDB) Open(path string) error {
+	sqliteDB, openErr := sql.Open(sqliteDriver, path)
+	if openErr != nil {
+		return openErr
+	}
+	// SQLite only allows a single writer. Sharing one connection
+	// serializes the transactions instead of failing them with
+	// SQLITE_BUSY.
+	sqliteDB.SetMaxOpenConns(1)
+
+	db.db = sqliteDB
+
+	_, err := db.db.Exec(sqliteSchema)
+	if err != nil {
+		db.db.Close()
+	}
+	return err
+}
+
+/*
+Close closes the database. The Server closes each of its
+stores, so it's safe to call more than once.
+*/
+func (db *SQLiteDB) Close() error {
+	db.closeOnce.Do(func() {
+		db.closeErr = db.db.Close()
+	})
+	return db.closeErr
+}
+
+/*
+update runs fn inside a transaction, committing it if fn
+succeeds and rolling it back otherwise.
+*/
+func (db *SQLiteDB) update(fn func(tx *sql.Tx) error) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+userLists maps the list names in the user_blocks
+table to the User's block ID lists
+*/
+func userLists(user *User) map[string]*BlockIDList {
+	return map[string]*BlockIDList{
+		activeList:      &user.ActiveWorkItems,
+		finishedList:    &user.PastWorkItems,
+		trainList:       &user.CompleteTrainBlocks,
+		reliabilityList: &user.CompleteRelBlocks,
+	}
+}
+
+func sameBlockIDs(a, b BlockIDList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameUserLists(a, b User) bool {
+	if a.Released != b.Released {
+		return false
+	}
+	listsB := userLists(&b)
+	for name, list := range userLists(&a) {
+		if !sameBlockIDs(*list, *listsB[name]) {
+			return false
+		}
+	}
+	for _, blockID := range a.ActiveWorkItems {
+		checkedOutA, _ := a.checkedOutAt(blockID)
+		checkedOutB, _ := b.checkedOutAt(blockID)
+		if !checkedOutA.Equal(checkedOutB) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+sqliteTime and parseSQLiteTime store times as RFC 3339
+text, with "" for a zero time
+*/
+func sqliteTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseSQLiteTime(text string) (time.Time, error) {
+	if text == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, text)
+}
+
+/*
+loadLabs reads the labs whose key matches the where
+clause, along with all of their users.
+*/
+func loadLabs(q sqlQuerier, where string, args ...interface{}) ([]*Lab, error) {
+	var labs []*Lab
+	labMap := make(map[string]*Lab)
+
+	rows, err := q.Query("SELECT lab_key, lab_name FROM labs WHERE "+where+" ORDER BY lab_key", args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		lab := &Lab{Users: make(map[string]User)}
+		if err := rows.Scan(&lab.Key, &lab.LabName); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		labs = append(labs, lab)
+		labMap[lab.Key] = lab
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = q.Query("SELECT lab_key, username, released FROM users WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var labKey, username string
+		var released int
+		if err := rows.Scan(&labKey, &username, &released); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if lab, exists := labMap[labKey]; exists {
+			lab.Users[username] = User{Name: username,
+				ParentLab:       labKey,
+				ActiveWorkItems: make(BlockIDList, 0),
+				Released:        released}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = q.Query(`SELECT lab_key, username, list, block_id, checked_out_at FROM user_blocks
+		WHERE `+where+` ORDER BY lab_key, username, list, position`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var labKey, username, list, blockID, checkedOutAt string
+		if err := rows.Scan(&labKey, &username, &list, &blockID, &checkedOutAt); err != nil {
+			return nil, err
+		}
+		lab, exists := labMap[labKey]
+		if !exists {
+			continue
+		}
+		user, exists := lab.Users[username]
+		if !exists {
+			continue
+		}
+		if ids, known := userLists(&user)[list]; known {
+			ids.addID(blockID)
+		}
+		if list == activeList && checkedOutAt != "" {
+			checkedOut, err := parseSQLiteTime(checkedOutAt)
+			if err != nil {
+				return nil, err
+			}
+			if user.CheckedOut == nil {
+				user.CheckedOut = make(map[string]time.Time)
+			}
+			user.CheckedOut[blockID] = checkedOut
+		}
+		lab.Users[username] = user
+	}
+	return labs, rows.Err()
+}
+
+func (db *SQLiteDB) getLab(labKey string) (*Lab, error) {
+	labs, err := loadLabs(db.db, "lab_key = ?", labKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(labs) == 0 {
+		return nil, ErrLabDoesntExist
+	}
+	return labs[0], nil
+}
+
+func (db *SQLiteDB) setLab(labKey string, data *Lab) error {
+	return db.update(func(tx *sql.Tx) error {
+		return putSQLiteLab(tx, labKey, data)
+	})
+}
+
+func (db *SQLiteDB) setLabs(labs []*Lab) error {
+	return db.update(func(tx *sql.Tx) error {
+		for _, lab := range labs {
+			if err := putSQLiteLab(tx, lab.Key, lab); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *SQLiteDB) deleteLab(labKey string) error {
+	return db.update(func(tx *sql.Tx) error {
+		for _, table := range []string{"user_blocks", "users", "labs"} {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE lab_key = ?", labKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+putSQLiteLab only rewrites the rows of the users that were
+added, changed or deleted, instead of the whole lab.
+*/
+func putSQLiteLab(tx *sql.Tx, labKey string, data *Lab) error {
+	oldUsers := make(map[string]User)
+	labs, err := loadLabs(tx, "lab_key = ?", labKey)
+	if err != nil {
+		return err
+	}
+	if len(labs) > 0 {
+		oldUsers = labs[0].Users
+	}
+
+	_, err = tx.Exec(`INSERT INTO labs (lab_key, lab_name) VALUES (?, ?)
+		ON CONFLICT (lab_key) DO UPDATE SET lab_name = excluded.lab_name`,
+		labKey, data.LabName)
+	if err != nil {
+		return err
+	}
+
+	for username := range oldUsers {
+		if _, exists := data.Users[username]; !exists {
+			if err := deleteSQLiteUser(tx, labKey, username); err != nil {
+				return err
+			}
+		}
+	}
+
+	for username, user := range data.Users {
+		oldUser, exists := oldUsers[username]
+		if exists && sameUserLists(oldUser, user) {
+			continue
+		}
+		if err := putSQLiteUser(tx, labKey, username, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteSQLiteUser(tx *sql.Tx, labKey, username string) error {
+	_, err := tx.Exec("DELETE FROM user_blocks WHERE lab_key = ? AND username = ?", labKey, username)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM users WHERE lab_key = ? AND username = ?", labKey, username)
+	return err
+}
+
+func putSQLiteUser(tx *sql.Tx, labKey, username string, user User) error {
+	if err := deleteSQLiteUser(tx, labKey, username); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO users (lab_key, username, released) VALUES (?, ?, ?)",
+		labKey, username, user.Released)
+	if err != nil {
+		return err
+	}
+
+	for list, ids := range userLists(&user) {
+		for position, blockID := range *ids {
+			checkedOutAt := ""
+			if list == activeList {
+				checkedOut, _ := user.checkedOutAt(blockID)
+				checkedOutAt = sqliteTime(checkedOut)
+			}
+			_, err := tx.Exec(`INSERT INTO user_blocks (lab_key, username, list, position, block_id, checked_out_at)
+				VALUES (?, ?, ?, ?, ?, ?)`, labKey, username, list, position, blockID, checkedOutAt)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *SQLiteDB) getAllLabs() ([]*Lab, error) {
+	return loadLabs(db.db, "1 = 1")
+}
+
+const workItemColumns = `id, filename, block, active, block_path,
+	times_coded, training, reliability, train_pack_num, block_sha256`
+
+func scanWorkItem(rows *sql.Rows) (WorkItem, error) {
+	var item WorkItem
+	err := rows.Scan(&item.ID, &item.FileName, &item.Block, &item.Active,
+		&item.BlockPath, &item.TimesCoded, &item.Training, &item.Reliability,
+		&item.TrainingPackNum, &item.BlockSHA256)
+	return item, err
+}
+
+func putSQLiteWorkItem(q sqlQuerier, item WorkItem) error {
+	_, err := q.Exec(`INSERT OR REPLACE INTO work_items (`+workItemColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		item.ID, item.FileName, item.Block, item.Active, item.BlockPath,
+		item.TimesCoded, item.Training, item.Reliability, item.TrainingPackNum,
+		item.BlockSHA256)
+	return err
+}
+
+func (db *SQLiteDB) loadItemMap() (WorkItemMap, error) {
+	itemMap := make(WorkItemMap)
+
+	rows, err := db.db.Query("SELECT " + workItemColumns + " FROM work_items")
+	if err != nil {
+		return itemMap, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanWorkItem(rows)
+		if err != nil {
+			return itemMap, err
+		}
+		itemMap[item.ID] = item
+	}
+	return itemMap, rows.Err()
+}
+
+func (db *SQLiteDB) persistWorkItem(item WorkItem) error {
+	return putSQLiteWorkItem(db.db, item)
+}
+
+func (db *SQLiteDB) persistWorkItemMap(itemMap WorkItemMap) error {
+	return db.update(func(tx *sql.Tx) error {
+		for _, item := range itemMap {
+			if err := putSQLiteWorkItem(tx, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+pageLimit is the LIMIT for a page query. One extra row is read
+to find out whether there's a next page. A negative limit
+means no limit, like it does in SQLite.
+*/
+func pageLimit(limit int) int {
+	if limit < 0 {
+		return -1
+	}
+	return limit + 1
+}
+
+func (db *SQLiteDB) getWorkItemPage(after string, limit int) ([]WorkItem, string, error) {
+	var items []WorkItem
+
+	rows, err := db.db.Query("SELECT "+workItemColumns+` FROM work_items
+		WHERE id > ? ORDER BY id LIMIT ?`, after, pageLimit(limit))
+	if err != nil {
+		return items, "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanWorkItem(rows)
+		if err != nil {
+			return items, "", err
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return items, "", err
+	}
+
+	if limit >= 0 && len(items) > limit {
+		items = items[:limit]
+		return items, items[limit-1].ID, nil
+	}
+	return items, "", nil
+}
+
+/*
+loadBlockGroups reads the BlockGroups (with all their instances
+and clips) whose block ID matches the where clause. The clause
+may only refer to block_id, since it's used on all three tables.
+*/
+func loadBlockGroups(q sqlQuerier, where string, args ...interface{}) (BlockGroupArray, error) {
+	var groups BlockGroupArray
+	groupIndex := make(map[string]int)
+
+	rows, err := q.Query(`SELECT block_id, training, reliability FROM block_groups
+		WHERE `+where+` ORDER BY block_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var group BlockGroup
+		if err := rows.Scan(&group.ID, &group.Training, &group.Reliability); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		groupIndex[group.ID] = len(groups)
+		groups.addBlockGroup(group)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = q.Query(`SELECT block_id, instance, clan_file, block_index, fan_or_man,
+		dont_share, coder, lab_key, lab_name, username, training, reliability,
+		block_sha256, submitted_at, checked_out_at
+		FROM block_instances WHERE `+where+` ORDER BY block_id, instance`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var block Block
+		var submittedAt, checkedOutAt string
+		err := rows.Scan(&block.ID, &block.Instance, &block.ClanFile, &block.Index,
+			&block.FanOrMan, &block.DontShare, &block.Coder, &block.LabKey,
+			&block.LabName, &block.Username, &block.Training, &block.Reliability,
+			&block.BlockSHA256, &submittedAt, &checkedOutAt)
+		if err == nil {
+			block.Submitted, err = parseSQLiteTime(submittedAt)
+		}
+		if err == nil {
+			block.CheckedOut, err = parseSQLiteTime(checkedOutAt)
+		}
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if i, exists := groupIndex[block.ID]; exists {
+			groups[i].Blocks.addBlock(block)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = q.Query(`SELECT block_id, instance, clip_index, clip_tier, multiline,
+		multi_tier_parent, start_time, offset_time, timestamp, classification,
+		label_date, coder, gender_label
+		FROM clips WHERE `+where+` ORDER BY block_id, instance, position`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var blockID string
+		var instance int
+		var clip Clip
+		err := rows.Scan(&blockID, &instance, &clip.Index, &clip.Tier, &clip.Multiline,
+			&clip.MultiTierParent, &clip.StartTime, &clip.OffsetTime, &clip.TimeStamp,
+			&clip.Classification, &clip.LabelDate, &clip.Coder, &clip.GenderLabel)
+		if err != nil {
+			return nil, err
+		}
+		i, exists := groupIndex[blockID]
+		if !exists || instance < 0 || instance >= len(groups[i].Blocks) {
+			continue
+		}
+		groups[i].Blocks[instance].appendClip(clip)
+	}
+	return groups, rows.Err()
+}
+
+func getSQLiteBlockGroup(q sqlQuerier, blockID string) (*BlockGroup, error) {
+	groups, err := loadBlockGroups(q, "block_id = ?", blockID)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, ErrWorkItemDoesntExist
+	}
+	return &groups[0], nil
+}
+
+func deleteSQLiteBlockGroup(tx *sql.Tx, blockID string) error {
+	for _, table := range []string{"clips", "block_instances", "block_groups"} {
+		_, err := tx.Exec("DELETE FROM "+table+" WHERE block_id = ?", blockID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putSQLiteInstance(tx *sql.Tx, block Block) error {
+	_, err := tx.Exec(`INSERT INTO block_instances (block_id, instance, clan_file,
+		block_index, fan_or_man, dont_share, coder, lab_key, lab_name, username,
+		training, reliability, block_sha256, submitted_at, checked_out_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		block.ID, block.Instance, block.ClanFile, block.Index, block.FanOrMan,
+		block.DontShare, block.Coder, block.LabKey, block.LabName, block.Username,
+		block.Training, block.Reliability, block.BlockSHA256, sqliteTime(block.Submitted),
+		sqliteTime(block.CheckedOut))
+	if err != nil {
+		return err
+	}
+
+	for position, clip := range block.Clips {
+		_, err := tx.Exec(`INSERT INTO clips (block_id, instance, position, clip_index,
+			clip_tier, multiline, multi_tier_parent, start_time, offset_time, timestamp,
+			classification, label_date, coder, gender_label)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			block.ID, block.Instance, position, clip.Index, clip.Tier, clip.Multiline,
+			clip.MultiTierParent, clip.StartTime, clip.OffsetTime, clip.TimeStamp,
+			clip.Classification, clip.LabelDate, clip.Coder, clip.GenderLabel)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+putSQLiteBlockGroup replaces the group and all
+of its instances and clips
+*/
+func putSQLiteBlockGroup(tx *sql.Tx, group BlockGroup) error {
+	if err := deleteSQLiteBlockGroup(tx, group.ID); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO block_groups (block_id, training, reliability) VALUES (?, ?, ?)",
+		group.ID, group.Training, group.Reliability)
+	if err != nil {
+		return err
+	}
+	for _, block := range group.Blocks {
+		if err := putSQLiteInstance(tx, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *SQLiteDB) addBlock(block Block, limits PassLimits) (*BlockGroup, error) {
+	var blockGroup *BlockGroup
+
+	updateErr := db.update(func(tx *sql.Tx) error {
+		var getErr error
+		blockGroup, getErr = getSQLiteBlockGroup(tx, block.ID)
+		if getErr == ErrWorkItemDoesntExist {
+			blockGroup = &BlockGroup{ID: block.ID,
+				Training:    block.Training,
+				Reliability: block.Reliability}
+			_, err := tx.Exec("INSERT INTO block_groups (block_id, training, reliability) VALUES (?, ?, ?)",
+				blockGroup.ID, blockGroup.Training, blockGroup.Reliability)
+			if err != nil {
+				return err
+			}
+		} else if getErr != nil {
+			return getErr
+		}
+
+		addBlockErr := blockGroup.addBlock(block, limits)
+		if addBlockErr != nil {
+			return addBlockErr
+		}
+		// addBlock appends the new instance to the end of the group
+		return putSQLiteInstance(tx, blockGroup.Blocks[len(blockGroup.Blocks)-1])
+	})
+	if updateErr != nil {
+		return nil, updateErr
+	}
+	return blockGroup, nil
+}
+
+func (db *SQLiteDB) getBlock(blockID string) (*BlockGroup, error) {
+	blockGroup, err := getSQLiteBlockGroup(db.db, blockID)
+	if err != nil {
+		return &BlockGroup{}, ErrWorkItemDoesntExist
+	}
+	return blockGroup, nil
+}
+
+func (db *SQLiteDB) getBlockGroup(blockIDs []string) (BlockGroupArray, error) {
+	var blocks BlockGroupArray
+	for _, id := range blockIDs {
+		block, err := getSQLiteBlockGroup(db.db, id)
+		if err != nil {
+			return blocks, ErrCouldntFindLabeledBlock
+		}
+		blocks.addBlockGroup(*block)
+	}
+	return blocks, nil
+}
+
+func (db *SQLiteDB) setBlockGroup(group BlockGroup) error {
+	return db.update(func(tx *sql.Tx) error {
+		return putSQLiteBlockGroup(tx, group)
+	})
+}
+
+func (db *SQLiteDB) setBlockGroups(groups BlockGroupArray) error {
+	return db.update(func(tx *sql.Tx) error {
+		for _, group := range groups {
+			if err := putSQLiteBlockGroup(tx, group); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+writeBatch writes the labs, block groups and work items
+of an import in a single transaction
+*/
+func (db *SQLiteDB) writeBatch(labs []*Lab, groups BlockGroupArray, items WorkItemMap) error {
+	return db.update(func(tx *sql.Tx) error {
+		for _, lab := range labs {
+			if err := putSQLiteLab(tx, lab.Key, lab); err != nil {
+				return err
+			}
+		}
+		for _, group := range groups {
+			if err := putSQLiteBlockGroup(tx, group); err != nil {
+				return err
+			}
+		}
+		for _, item := range items {
+			if err := putSQLiteWorkItem(tx, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *SQLiteDB) deleteInstances(blockID string, instances *InstanceList) (*BlockGroup, error) {
+	var blockGroup *BlockGroup
+
+	updateErr := db.update(func(tx *sql.Tx) error {
+		var getErr error
+		blockGroup, getErr = getSQLiteBlockGroup(tx, blockID)
+		if getErr != nil {
+			return getErr
+		}
+
+		// the remaining instances get renumbered,
+		// so the whole group is rewritten
+		blockGroup.deleteInstances(instances)
+		if len(blockGroup.Blocks) == 0 {
+			return deleteSQLiteBlockGroup(tx, blockID)
+		}
+		return putSQLiteBlockGroup(tx, *blockGroup)
+	})
+	if updateErr != nil {
+		return nil, updateErr
+	}
+	return blockGroup, nil
+}
+
+func (db *SQLiteDB) getAllBlockGroups() (BlockGroupArray, error) {
+	return loadBlockGroups(db.db, "block_id > ?", "")
+}
+
+func (db *SQLiteDB) getBlockGroupPage(after string, limit int) (BlockGroupArray, string, error) {
+	var blockIDs []string
+
+	rows, err := db.db.Query(`SELECT block_id FROM block_groups
+		WHERE block_id > ? ORDER BY block_id LIMIT ?`, after, pageLimit(limit))
+	if err != nil {
+		return nil, "", err
+	}
+	for rows.Next() {
+		var blockID string
+		if err := rows.Scan(&blockID); err != nil {
+			rows.Close()
+			return nil, "", err
+		}
+		blockIDs = append(blockIDs, blockID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if limit >= 0 && len(blockIDs) > limit {
+		blockIDs = blockIDs[:limit]
+		next = blockIDs[limit-1]
+	}
+	if len(blockIDs) == 0 {
+		return nil, "", nil
+	}
+
+	groups, err := loadBlockGroups(db.db, "block_id > ? AND block_id <= ?",
+		after, blockIDs[len(blockIDs)-1])
+	return groups, next, err
+}
+
+func (db *SQLiteDB) queryBlockIDs(where string, args ...interface{}) (BlockIDList, error) {
+	var blockIDs BlockIDList
+
+	rows, err := db.db.Query(`SELECT DISTINCT block_id FROM block_instances
+		WHERE `+where+` ORDER BY block_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var blockID string
+		if err := rows.Scan(&blockID); err != nil {
+			return nil, err
+		}
+		blockIDs.addID(blockID)
+	}
+	return blockIDs, rows.Err()
+}
+
+func (db *SQLiteDB) queryInstances(where string, args ...interface{}) (InstanceMap, error) {
+	instanceMap := make(InstanceMap)
+
+	rows, err := db.db.Query(`SELECT block_id, instance FROM block_instances
+		WHERE `+where+` ORDER BY block_id, instance`, args...)
+	if err != nil {
+		return instanceMap, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var blockID string
+		var instance int
+		if err := rows.Scan(&blockID, &instance); err != nil {
+			return instanceMap, err
+		}
+		if _, exists := instanceMap[blockID]; exists {
+			instanceMap[blockID].addInstance(instance)
+		} else {
+			instanceMap[blockID] = NewInstanceList(instance)
+		}
+	}
+	return instanceMap, rows.Err()
+}
+
+func (db *SQLiteDB) getLabBlockIDs(labKey string) (BlockIDList, error) {
+	return db.queryBlockIDs("lab_key = ?", labKey)
+}
+
+func (db *SQLiteDB) getFileBlockIDs(clanFile string) (BlockIDList, error) {
+	return db.queryBlockIDs("clan_file = ?", clanFile)
+}
+
+func (db *SQLiteDB) getCoderInstanceMap(labKey, coder string) (InstanceMap, error) {
+	return db.queryInstances("lab_key = ? AND coder = ?", labKey, coder)
+}
+
+func (db *SQLiteDB) getLabInstanceMap(labKey string) (InstanceMap, error) {
+	return db.queryInstances("lab_key = ?", labKey)
+}
+
+/*
+rebuildIndexes rebuilds the SQLite indexes. SQLite keeps
+them up to date on its own, so this is rarely needed.
+*/
+func (db *SQLiteDB) rebuildIndexes() (int, error) {
+	if _, err := db.db.Exec("REINDEX block_instances"); err != nil {
+		return 0, err
+	}
+	var numGroups int
+	err := db.db.QueryRow("SELECT COUNT(*) FROM block_groups").Scan(&numGroups)
+	return numGroups, err
+}
+
+/*
+importStores copies everything from the given stores into
+the SQLiteDB in a single transaction. The SQLiteDB has to be
+empty, so a migration is never run twice into the same file.
+*/
+func (db *SQLiteDB) importStores(labs LabStore, work WorkStore, labels LabelStore) (int, int, int, error) {
+	allLabs, err := labs.getAllLabs()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	itemMap, err := work.loadItemMap()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	groups, err := labels.getAllBlockGroups()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	err = db.update(func(tx *sql.Tx) error {
+		for _, table := range []string{"labs", "work_items", "block_groups"} {
+			var count int
+			if err := tx.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrSQLiteNotEmpty
+			}
+		}
+
+		for _, lab := range allLabs {
+			_, err := tx.Exec("INSERT INTO labs (lab_key, lab_name) VALUES (?, ?)", lab.Key, lab.LabName)
+			if err != nil {
+				return err
+			}
+			for username, user := range lab.Users {
+				if err := putSQLiteUser(tx, lab.Key, username, user); err != nil {
+					return err
+				}
+			}
+		}
+		for _, item := range itemMap {
+			if err := putSQLiteWorkItem(tx, item); err != nil {
+				return err
+			}
+		}
+		for _, group := range groups {
+			if err := putSQLiteBlockGroup(tx, group); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec("PRAGMA user_version = " + strconv.Itoa(currentSchemaVersion))
+		return err
+	})
+	return len(allLabs), len(itemMap), len(groups), err
+}
+
+/*
+migrateToSQLiteCommand copies the bolt databases in the config
+into a new SQLite database:
+
+	$: ./idsserver migrate-to-sqlite config.json ids.sqlite
+
+The bolt files are only read, so the server can be switched
+back to them by changing the config's "store" back to "bolt".
+*/
+func migrateToSQLiteCommand(args []string) error {
+	if len(args) < 2 {
+		return ErrMissingCommandArgs
+	}
+	config, err := readConfigFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	var dbs []*bolt.DB
+	defer func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+	}()
+	for _, store := range snapshotStores(config) {
+		db, err := openStoreReadOnly(store.path)
+		if err != nil {
+			return err
+		}
+		dbs = append(dbs, db)
+
+		// the records are copied as they are, so they
+		// have to be in the current format already
+		version, err := readBoltSchemaVersion(db)
+		if err != nil {
+			return err
+		}
+		if version != currentSchemaVersion {
+			return fmt.Errorf("%s: %v", store.path, ErrSchemaOutOfDate)
+		}
+	}
+
+	sqliteDB, err := LoadSQLiteDB(args[1])
+	if err != nil {
+		return err
+	}
+	defer sqliteDB.Close()
+
+	numLabs, numItems, numGroups, err := sqliteDB.importStores(
+		&LabsDB{db: dbs[0]}, &WorkDB{db: dbs[1]}, &LabelsDB{db: dbs[2]})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("copied", numLabs, "labs,", numItems, "work items and", numGroups, "block groups to", args[1])
+	fmt.Println(`set "store": "sqlite" and "sqlite_path": "` + args[1] + `" in the config to use it`)
+	return nil
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+StatsReq asks for the coding statistics. The admin key
+gets every lab, a lab key just its own. Format is "json"
+(the default) or "csv".
+*/
+type StatsReq struct {
+	LabKey string `json:"lab_key"`
+	Format string `json:"format"`
+}
+
+/*
+CoderStats is how a coder (or, with no Username, a whole lab)
+has been coding. The times only cover blocks checked out and
+submitted after they were recorded (TimedBlocks of them), and
+BlocksPerDay is those submitted blocks per day with a submission.
+Agreement is the share of reliability clip labels that match the
+other coders' labels for the same clips, nil without any to compare.
+*/
+type CoderStats struct {
+	LabKey             string   `json:"lab_key"`
+	LabName            string   `json:"lab_name"`
+	Username           string   `json:"username"`
+	Blocks             int      `json:"blocks"`
+	Regular            int      `json:"regular"`
+	Training           int      `json:"training"`
+	Reliability        int      `json:"reliability"`
+	Clips              int      `json:"clips"`
+	ActiveDays         int      `json:"active_days"`
+	BlocksPerDay       float64  `json:"blocks_per_day"`
+	TimedBlocks        int      `json:"timed_blocks"`
+	MedianBlockSeconds float64  `json:"median_block_seconds"`
+	MedianClipSeconds  float64  `json:"median_clip_seconds"`
+	Released           int      `json:"released"`
+	ReleaseRate        float64  `json:"release_rate"`
+	AgreementClips     int      `json:"agreement_clips"`
+	Agreement          *float64 `json:"agreement"`
+}
+
+/*
+StatsReport is the CoderStats of every coder and lab
+*/
+type StatsReport struct {
+	Generated time.Time    `json:"generated"`
+	Coders    []CoderStats `json:"coders"`
+	Labs      []CoderStats `json:"labs"`
+}
+
+// coderTally collects what goes into a CoderStats
+type coderTally struct {
+	stats         CoderStats
+	days          map[string]bool
+	dated         int
+	blockSeconds  []float64
+	clipSeconds   []float64
+	agreed        int
+	comparedClips int
+}
+
+func newCoderTally(labKey, labName, username string) *coderTally {
+	return &coderTally{stats: CoderStats{LabKey: labKey, LabName: labName, Username: username},
+		days: make(map[string]bool)}
+}
+
+func (tally *coderTally) addBlock(block Block) {
+	tally.stats.Blocks++
+	tally.stats.Clips += len(block.Clips)
+	switch {
+	case block.Training:
+		tally.stats.Training++
+	case block.Reliability:
+		tally.stats.Reliability++
+	default:
+		tally.stats.Regular++
+	}
+	if block.Submitted.IsZero() {
+		return
+	}
+	tally.days[block.Submitted.Format("2006-01-02")] = true
+	tally.dated++
+	if block.CheckedOut.IsZero() || block.Submitted.Before(block.CheckedOut) {
+		return
+	}
+	seconds := block.Submitted.Sub(block.CheckedOut).Seconds()
+	tally.blockSeconds = append(tally.blockSeconds, seconds)
+	if len(block.Clips) > 0 {
+		tally.clipSeconds = append(tally.clipSeconds, seconds/float64(len(block.Clips)))
+	}
+}
+
+// merge adds another tally (a coder's, into their lab's)
+func (tally *coderTally) merge(other *coderTally) {
+	tally.stats.Blocks += other.stats.Blocks
+	tally.stats.Regular += other.stats.Regular
+	tally.stats.Training += other.stats.Training
+	tally.stats.Reliability += other.stats.Reliability
+	tally.stats.Clips += other.stats.Clips
+	tally.stats.Released += other.stats.Released
+	for day := range other.days {
+		tally.days[day] = true
+	}
+	tally.dated += other.dated
+	tally.blockSeconds = append(tally.blockSeconds, other.blockSeconds...)
+	tally.clipSeconds = append(tally.clipSeconds, other.clipSeconds...)
+	tally.agreed += other.agreed
+	tally.comparedClips += other.comparedClips
+}
+
+func (tally *coderTally) finish() CoderStats {
+	stats := tally.stats
+	stats.ActiveDays = len(tally.days)
+	if stats.ActiveDays > 0 {
+		stats.BlocksPerDay = float64(tally.dated) / float64(stats.ActiveDays)
+	}
+	stats.TimedBlocks = len(tally.blockSeconds)
+	stats.MedianBlockSeconds = median(tally.blockSeconds)
+	stats.MedianClipSeconds = median(tally.clipSeconds)
+	if stats.Released+stats.Blocks > 0 {
+		stats.ReleaseRate = float64(stats.Released) / float64(stats.Released+stats.Blocks)
+	}
+	stats.AgreementClips = tally.comparedClips
+	if tally.comparedClips > 0 {
+		agreement := float64(tally.agreed) / float64(tally.comparedClips)
+		stats.Agreement = &agreement
+	}
+	return stats
+}
+
+// median of the values, 0 for none
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+/*
+addAgreement compares every instance of a reliability block
+with every other one, clip by clip. Each coder is credited
+with the clips they labeled the same as the other coder.
+*/
+func addAgreement(group BlockGroup, tally func(labKey, coder string) *coderTally) {
+	for i, block := range group.Blocks {
+		coder := tally(block.LabKey, block.Coder)
+		for j, other := range group.Blocks {
+			if i == j {
+				continue
+			}
+			labels := make(map[int]string)
+			for _, clip := range other.Clips {
+				labels[clip.Index] = clip.Classification
+			}
+			for _, clip := range block.Clips {
+				otherLabel, exists := labels[clip.Index]
+				if !exists || otherLabel == "" || clip.Classification == "" {
+					continue
+				}
+				coder.comparedClips++
+				if otherLabel == clip.Classification {
+					coder.agreed++
+				}
+			}
+		}
+	}
+}
+
+/*
+stats works out the CoderStats of every coder and lab,
+or just the ones in onlyLab if it isn't ""
+*/
+func (s *Server) stats(onlyLab string) (*StatsReport, error) {
+	labs, err := s.labs.getAllLabs()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.labels.getAllBlockGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	labNames := make(map[string]string)
+	for _, lab := range labs {
+		labNames[lab.Key] = lab.LabName
+	}
+	tallies := make(map[string]*coderTally)
+	tally := func(labKey, username string) *coderTally {
+		key := labKey + ":::" + username
+		if existing, exists := tallies[key]; exists {
+			return existing
+		}
+		created := newCoderTally(labKey, labNames[labKey], username)
+		tallies[key] = created
+		return created
+	}
+
+	for _, lab := range labs {
+		for username, user := range lab.Users {
+			tally(lab.Key, username).stats.Released = user.Released
+		}
+	}
+	for _, group := range groups {
+		for _, block := range group.Blocks {
+			tally(block.LabKey, block.Coder).addBlock(block)
+		}
+		if item, _ := s.workItem(group.ID); group.Reliability || item.Reliability {
+			addAgreement(group, tally)
+		}
+	}
+
+	report := &StatsReport{Generated: time.Now().UTC(),
+		Coders: make([]CoderStats, 0),
+		Labs:   make([]CoderStats, 0)}
+	labTallies := make(map[string]*coderTally)
+	for _, coder := range tallies {
+		if onlyLab != "" && coder.stats.LabKey != onlyLab {
+			continue
+		}
+		report.Coders = append(report.Coders, coder.finish())
+
+		labTally, exists := labTallies[coder.stats.LabKey]
+		if !exists {
+			labTally = newCoderTally(coder.stats.LabKey, coder.stats.LabName, "")
+			labTallies[coder.stats.LabKey] = labTally
+		}
+		labTally.merge(coder)
+	}
+	for _, labTally := range labTallies {
+		report.Labs = append(report.Labs, labTally.finish())
+	}
+
+	sort.Slice(report.Coders, func(i, j int) bool {
+		if report.Coders[i].LabKey != report.Coders[j].LabKey {
+			return report.Coders[i].LabKey < report.Coders[j].LabKey
+		}
+		return report.Coders[i].Username < report.Coders[j].Username
+	})
+	sort.Slice(report.Labs, func(i, j int) bool {
+		return report.Labs[i].LabKey < report.Labs[j].LabKey
+	})
+	return report, nil
+}
+
+/*
+statsCSVHeader is the header of the stats csv, a row per coder then per
+lab. The csv gets passed around, so labs go by name and key hash, like
+in the logs, and never by their key.
+*/
+var statsCSVHeader = []string{"lab_key_hash", "lab_name", "username", "blocks", "regular",
+	"training", "reliability", "clips", "active_days", "blocks_per_day", "timed_blocks",
+	"median_block_seconds", "median_clip_seconds", "released", "release_rate",
+	"agreement_clips", "agreement"}
+
+/*
+writeCSV writes the stats as a csv, the coders then the labs
+(the lab rows have no username)
+*/
+func (report *StatsReport) writeCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write(statsCSVHeader)
+	float := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', 2, 64)
+	}
+	for _, stats := range append(append([]CoderStats{}, report.Coders...), report.Labs...) {
+		agreement := ""
+		if stats.Agreement != nil {
+			agreement = float(*stats.Agreement)
+		}
+		writer.Write([]string{labKeyHash(stats.LabKey), stats.LabName, stats.Username,
+			strconv.Itoa(stats.Blocks), strconv.Itoa(stats.Regular),
+			strconv.Itoa(stats.Training), strconv.Itoa(stats.Reliability),
+			strconv.Itoa(stats.Clips), strconv.Itoa(stats.ActiveDays),
+			float(stats.BlocksPerDay), strconv.Itoa(stats.TimedBlocks),
+			float(stats.MedianBlockSeconds), float(stats.MedianClipSeconds),
+			strconv.Itoa(stats.Released), float(stats.ReleaseRate),
+			strconv.Itoa(stats.AgreementClips), agreement})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	var statsReq StatsReq
+	if !s.decodeRequest(w, r, &statsReq) {
+		return
+	}
+	annotateRequest(r, statsReq.LabKey, "", "")
+
+	// the admin gets every lab, a lab only itself
+	onlyLab := ""
+	if !s.config.labIsAdmin(statsReq.LabKey) {
+		if !s.config.labIsRegistered(statsReq.LabKey) {
+			writeError(w, r, ErrLabNotRegistered, 401)
+			requestLogger(r).Warn("unauthorized lab key")
+			return
+		}
+		onlyLab = statsReq.LabKey
+	}
+
+	report, statsErr := s.stats(onlyLab)
+	if statsErr != nil {
+		writeError(w, r, statsErr, 500)
+		return
+	}
+
+	if statsReq.Format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=coder_stats.csv")
+		if err := report.writeCSV(w); err != nil {
+			requestLogger(r).Error("writing stats csv failed", "error", err)
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
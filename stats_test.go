@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+newStatsTestServer is a handler test server where alice has coded
+a.cha:::1 in a minute and released a block, and alice and bob
+have both coded reliability block r.cha:::1, agreeing on one of
+its two clips
+*/
+func newStatsTestServer(t *testing.T) *Server {
+	server := newHandlerTestServer(t, t.TempDir())
+	server.config.AdminKey = "admin"
+	if _, _, err := server.addWorkItems(WorkItemMap{
+		"r.cha:::1": {ID: "r.cha:::1", FileName: "r.cha", Block: 1, Reliability: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	submitted := time.Now()
+	for _, block := range []Block{
+		{ID: "a.cha:::1", ClanFile: "a.cha", LabKey: "lab1", Coder: "alice",
+			CheckedOut: submitted.Add(-time.Minute), Submitted: submitted,
+			Clips: []Clip{{Index: 1, Classification: "IDS"}, {Index: 2, Classification: "ADS"}}},
+		{ID: "r.cha:::1", ClanFile: "r.cha", LabKey: "lab1", Coder: "alice", Reliability: true,
+			Clips: []Clip{{Index: 1, Classification: "IDS"}, {Index: 2, Classification: "ADS"}}},
+		{ID: "r.cha:::1", ClanFile: "r.cha", LabKey: "lab2", Coder: "bob", Reliability: true,
+			Clips: []Clip{{Index: 1, Classification: "IDS"}, {Index: 2, Classification: "IDS"}}},
+	} {
+		block.Index, block.Username = 1, block.Coder
+		if err := server.addLabeledBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	alice, err := server.getUser("lab1", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.Released = 1
+	if err := server.setUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestStatsHandler(t *testing.T) {
+	server := newStatsTestServer(t)
+
+	for _, test := range []struct {
+		labKey string
+		coders []string
+		labs   []string
+	}{
+		{"admin", []string{"lab1:::alice", "lab2:::bob"}, []string{"lab1", "lab2"}},
+		{"lab1", []string{"lab1:::alice"}, []string{"lab1"}},
+		{"lab2", []string{"lab2:::bob"}, []string{"lab2"}},
+	} {
+		recorder := serveTestRequest(t, server, "/v1/stats/", StatsReq{LabKey: test.labKey})
+		var report StatsReport
+		if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil || recorder.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %s", test.labKey, recorder.Code, recorder.Body)
+		}
+		var coders, labs []string
+		for _, coder := range report.Coders {
+			coders = append(coders, coder.LabKey+":::"+coder.Username)
+		}
+		for _, lab := range report.Labs {
+			labs = append(labs, lab.LabKey)
+		}
+		if strings.Join(coders, ",") != strings.Join(test.coders, ",") || strings.Join(labs, ",") != strings.Join(test.labs, ",") {
+			t.Errorf("%s: got coders %v and labs %v", test.labKey, coders, labs)
+		}
+	}
+
+	recorder := serveTestRequest(t, server, "/v1/stats/", StatsReq{LabKey: "lab1"})
+	var report StatsReport
+	json.Unmarshal(recorder.Body.Bytes(), &report)
+	alice := report.Coders[0]
+	if alice.Blocks != 2 || alice.Regular != 1 || alice.Reliability != 1 || alice.Clips != 4 ||
+		alice.TimedBlocks != 1 || alice.MedianBlockSeconds != 60 || alice.MedianClipSeconds != 30 ||
+		alice.Released != 1 || alice.AgreementClips != 2 || alice.Agreement == nil || *alice.Agreement != 0.5 {
+		t.Errorf("got %+v", alice)
+	}
+
+	recorder = serveTestRequest(t, server, "/v1/stats/", StatsReq{LabKey: "lab3"})
+	checkErrorCode(t, recorder, http.StatusUnauthorized, "lab_not_registered")
+}
+
+func TestStatsCSV(t *testing.T) {
+	server := newStatsTestServer(t)
+
+	recorder := serveTestRequest(t, server, "/v1/stats/", StatsReq{LabKey: "admin", Format: "csv"})
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("got %d %v", recorder.Code, recorder.Header())
+	}
+	rows, err := csv.NewReader(recorder.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(rows[0], ",") != strings.Join(statsCSVHeader, ",") || len(rows) != 5 {
+		t.Fatalf("got %v", rows)
+	}
+
+	// the coders then the labs, which go by name and key hash, never key
+	for i, want := range [][]string{
+		{labKeyHash("lab1"), "Lab lab1", "alice"},
+		{labKeyHash("lab2"), "Lab lab2", "bob"},
+		{labKeyHash("lab1"), "Lab lab1", ""},
+		{labKeyHash("lab2"), "Lab lab2", ""},
+	} {
+		row := rows[i+1]
+		if len(row) != len(statsCSVHeader) || strings.Join(row[:3], ",") != strings.Join(want, ",") {
+			t.Errorf("row %d: got %v, want %v", i+1, row, want)
+		}
+		for _, field := range row {
+			if field == "lab1" || field == "lab2" {
+				t.Errorf("row %d has a lab key: %v", i+1, row)
+			}
+		}
+	}
+	if alice := rows[1]; alice[3] != "2" || alice[12] != "30.00" || alice[14] != "0.33" || alice[16] != "0.50" {
+		t.Errorf("got alice's row %v", alice)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+/*
+	The Server reaches all of its persistent state through these
+	three interfaces. LabsDB, WorkDB and LabelsDB implement them on
+	top of boltdb, SQLiteDB implements all three on top of a single
+	SQLite database, and memstore.go has in-memory versions that are
+	handy for testing handlers in isolation.
+
+	The stores only deal with storing and looking up records. All
+	the logic that ties them together (e.g. updating a WorkItem's
+	TimesCoded when labels are submitted) lives on the Server.
+*/
+
+/*
+LabStore stores Labs, along with all of their Users.
+getLab returns ErrLabDoesntExist for unknown lab keys.
+setLabs stores all of the labs at once (in a single
+transaction, where the backend has them).
+*/
+type LabStore interface {
+	getLab(labKey string) (*Lab, error)
+	setLab(labKey string, lab *Lab) error
+	setLabs(labs []*Lab) error
+	deleteLab(labKey string) error
+	getAllLabs() ([]*Lab, error)
+	Close() error
+}
+
+/*
+WorkStore persists the WorkItems. The Server keeps
+the working copy of them in memory in its workItemMap.
+*/
+type WorkStore interface {
+	loadItemMap() (WorkItemMap, error)
+	persistWorkItem(item WorkItem) error
+	persistWorkItemMap(itemMap WorkItemMap) error
+	getWorkItemPage(after string, limit int) ([]WorkItem, string, error)
+	Close() error
+}
+
+/*
+LabelStore stores the BlockGroups of labeled blocks,
+keyed by block ID, and keeps them indexed by lab, coder
+and CLAN file.
+
+addBlock adds the Block to its BlockGroup (creating the group
+if needed) and returns the updated group. deleteInstances removes
+instances from a group and returns what's left of it; groups left
+without any instances are deleted. setBlockGroups stores all of
+the groups at once, like setLabs.
+*/
+type LabelStore interface {
+	addBlock(block Block, limits PassLimits) (*BlockGroup, error)
+	getBlock(blockID string) (*BlockGroup, error)
+	getBlockGroup(blockIDs []string) (BlockGroupArray, error)
+	setBlockGroup(group BlockGroup) error
+	setBlockGroups(groups BlockGroupArray) error
+	deleteInstances(blockID string, instances *InstanceList) (*BlockGroup, error)
+	getAllBlockGroups() (BlockGroupArray, error)
+	getBlockGroupPage(after string, limit int) (BlockGroupArray, string, error)
+	getLabBlockIDs(labKey string) (BlockIDList, error)
+	getFileBlockIDs(clanFile string) (BlockIDList, error)
+	getCoderInstanceMap(labKey, coder string) (InstanceMap, error)
+	getLabInstanceMap(labKey string) (InstanceMap, error)
+	rebuildIndexes() (int, error)
+	Close() error
+}
+
+/*
+batchWriter is implemented by stores that can write
+labs, block groups and work items in a single transaction
+*/
+type batchWriter interface {
+	writeBatch(labs []*Lab, groups BlockGroupArray, items WorkItemMap) error
+}
+
+/*
+writeRecords stores the labs, block groups and work items, all
+or nothing. When all three stores are the same database (SQLite)
+they're written in a single transaction. Otherwise each database
+is written in its own transaction, and if one of them fails the
+ones already written are put back the way they were.
+*/
+func (s *Server) writeRecords(labs []*Lab, groups BlockGroupArray, items WorkItemMap) error {
+	writer, isBatchWriter := s.labs.(batchWriter)
+	if isBatchWriter &&
+		interface{}(s.labs) == interface{}(s.work) &&
+		interface{}(s.labs) == interface{}(s.labels) {
+		return writer.writeBatch(labs, groups, items)
+	}
+
+	before, err := s.recordsBefore(labs, groups)
+	if err != nil {
+		return err
+	}
+	if err := s.labs.setLabs(labs); err != nil {
+		return err
+	}
+	if err := s.labels.setBlockGroups(groups); err != nil {
+		return before.rollback(s, err, false)
+	}
+	if err := s.work.persistWorkItemMap(items); err != nil {
+		return before.rollback(s, err, true)
+	}
+	return nil
+}
+
+/*
+storedRecords are the labs and block groups as they were before
+writeRecords, so they can be put back. The new ones are the ones
+that weren't stored at all.
+*/
+type storedRecords struct {
+	labs      []*Lab
+	newLabs   []string
+	groups    BlockGroupArray
+	newGroups BlockGroupArray
+}
+
+// recordsBefore reads the stored versions of the labs and groups
+func (s *Server) recordsBefore(labs []*Lab, groups BlockGroupArray) (*storedRecords, error) {
+	before := &storedRecords{}
+	for _, lab := range labs {
+		stored, err := s.labs.getLab(lab.Key)
+		if err == ErrLabDoesntExist {
+			before.newLabs = append(before.newLabs, lab.Key)
+		} else if err != nil {
+			return nil, err
+		} else {
+			before.labs = append(before.labs, stored)
+		}
+	}
+	for _, group := range groups {
+		stored, err := s.labels.getBlock(group.ID)
+		if err == ErrWorkItemDoesntExist || err == ErrCouldntFindLabeledBlock {
+			before.newGroups = append(before.newGroups, group)
+		} else if err != nil {
+			return nil, err
+		} else {
+			before.groups = append(before.groups, *stored)
+		}
+	}
+	return before, nil
+}
+
+/*
+rollback puts the labs, and the block groups if they were written,
+back the way they were. It returns the error that stopped the write,
+along with the one that stopped the rollback if there was one.
+*/
+func (before *storedRecords) rollback(s *Server, writeErr error, groupsWritten bool) error {
+	rollbackErr := s.labs.setLabs(before.labs)
+	for _, labKey := range before.newLabs {
+		if rollbackErr == nil {
+			rollbackErr = s.labs.deleteLab(labKey)
+		}
+	}
+	if groupsWritten && rollbackErr == nil {
+		rollbackErr = s.labels.setBlockGroups(before.groups)
+		for _, group := range before.newGroups {
+			if rollbackErr != nil {
+				break
+			}
+			var instances InstanceList
+			for _, block := range group.Blocks {
+				instances = append(instances, block.Instance)
+			}
+			_, rollbackErr = s.labels.deleteInstances(group.ID, &instances)
+		}
+	}
+	if rollbackErr != nil {
+		return fmt.Errorf("%w (putting back what was written failed too: %v)", writeErr, rollbackErr)
+	}
+	return writeErr
+}
+
+/*
+boltStore is implemented by the stores that are backed
+by a bolt database, for the features (like snapshots)
+that need to get at the underlying file.
+*/
+type boltStore interface {
+	boltDB() *bolt.DB
+}
+
+// make sure every backend implements all three stores
+var (
+	_ LabStore   = (*LabsDB)(nil)
+	_ WorkStore  = (*WorkDB)(nil)
+	_ LabelStore = (*LabelsDB)(nil)
+	_ LabStore   = (*MemLabsDB)(nil)
+	_ WorkStore  = (*MemWorkDB)(nil)
+	_ LabelStore = (*MemLabelsDB)(nil)
+	_ LabStore   = (*SQLiteDB)(nil)
+	_ WorkStore  = (*SQLiteDB)(nil)
+	_ LabelStore = (*SQLiteDB)(nil)
+)
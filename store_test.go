@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// unwritableWorkStore is a WorkStore whose batch writes fail
+type unwritableWorkStore struct {
+	WorkStore
+}
+
+func (store unwritableWorkStore) persistWorkItemMap(items WorkItemMap) error {
+	return errStoreFailed
+}
+
+// unwritableLabelStore is a LabelStore whose batch writes fail
+type unwritableLabelStore struct {
+	LabelStore
+}
+
+func (store unwritableLabelStore) setBlockGroups(groups BlockGroupArray) error {
+	return errStoreFailed
+}
+
+/*
+storedState is everything in the stores, encoded,
+to compare before and after a write
+*/
+func storedState(t *testing.T, server *Server) string {
+	labs, err := server.labs.getAllLabs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := server.labels.getAllBlockGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := server.work.loadItemMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal([]interface{}{labs, groups, items})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}
+
+func TestImportIsAllOrNothing(t *testing.T) {
+	// a new user in lab1, a new lab, and alice's labels for a.cha:::1
+	records := `{"type": "user", "lab_key": "lab1", "lab_name": "Lab lab1", "username": "carol"}
+{"type": "user", "lab_key": "lab3", "lab_name": "Lab lab3", "username": "dave"}
+{"type": "active_item", "lab_key": "lab1", "username": "carol", "block_id": "b.cha:::1"}
+{"type": "block", "block": {"id": "a.cha:::1", "clan_file": "a.cha", "block_index": 1, "lab_key": "lab1", "coder": "alice", "username": "alice"}}
+`
+	stores := map[string]func(t *testing.T, dir string) (LabStore, WorkStore, LabelStore){
+		"mem": func(t *testing.T, dir string) (LabStore, WorkStore, LabelStore) {
+			return NewMemLabsDB(), NewMemWorkDB(), NewMemLabelsDB()
+		},
+		"bolt": func(t *testing.T, dir string) (LabStore, WorkStore, LabelStore) {
+			labs, err := LoadLabsDB(filepath.Join(dir, "labs.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			work, err := LoadWorkDB(filepath.Join(dir, "work.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			labels, err := LoadLabelsDB(filepath.Join(dir, "labels.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return labs, work, labels
+		},
+	}
+
+	for storeName, newStores := range stores {
+		for _, failing := range []string{"labels", "work"} {
+			dir := t.TempDir()
+			labs, work, labels := newStores(t, dir)
+			server := newServer(Config{Labs: []string{"lab1", "lab2", "lab3"}}, labs, work, labels)
+			items := WorkItemMap{
+				"a.cha:::1": {ID: "a.cha:::1", FileName: "a.cha", Block: 1},
+				"b.cha:::1": {ID: "b.cha:::1", FileName: "b.cha", Block: 1},
+			}
+			if err := server.work.persistWorkItemMap(items); err != nil {
+				t.Fatal(err)
+			}
+			if err := server.setWorkItems(items); err != nil {
+				t.Fatal(err)
+			}
+			if err := server.addUser("lab1", "Lab lab1", "alice"); err != nil {
+				t.Fatal(err)
+			}
+
+			before := storedState(t, server)
+			if failing == "labels" {
+				server.labels = unwritableLabelStore{server.labels}
+			} else {
+				server.work = unwritableWorkStore{server.work}
+			}
+			parsed, err := readImportRecords(strings.NewReader(records))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := server.importRecords(parsed); err != errStoreFailed {
+				t.Errorf("%s, %s failing: got %v, want the store's error", storeName, failing, err)
+			}
+
+			if after := storedState(t, server); after != before {
+				t.Errorf("%s, %s failing: the import was partly written\nbefore %s\nafter  %s",
+					storeName, failing, before, after)
+			}
+			if item, _ := server.workItem("b.cha:::1"); item.Active {
+				t.Errorf("%s, %s failing: the workItemMap was changed", storeName, failing)
+			}
+			labs.Close()
+			work.Close()
+			labels.Close()
+		}
+	}
+}
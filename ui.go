@@ -0,0 +1,63 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+)
+
+/*
+blockIDHeader is the response header get-block and
+get-specific-block send the WorkItem ID in, so a client
+that streams the clips doesn't have to open the zip to
+find out which block it was given
+*/
+const blockIDHeader = "X-Block-ID"
+
+/*
+defaultClassifications are the labels a clip can be
+given when the config has no "classifications"
+*/
+var defaultClassifications = []string{"IDS", "ADS", "Junk"}
+
+// webFiles are the browser UIs the server serves
+//
+//go:embed web
+var webFiles embed.FS
+
+// webHandler serves one of the directories of webFiles
+func webHandler(dir string) http.Handler {
+	files, err := fs.Sub(webFiles, dir)
+	if err != nil {
+		// the directories are embedded, this can't happen
+		panic(err)
+	}
+	return http.FileServer(http.FS(files))
+}
+
+// coderUI is the browser coding interface, served from "/"
+var coderUI = webHandler("web/coder")
+
+// adminUI is the admin dashboard, served from "/admin/"
+var adminUI = http.StripPrefix("/admin/", webHandler("web/admin"))
+
+// classifications is the label vocabulary coders choose from
+func (conf *Config) classifications() []string {
+	if len(conf.Classifications) == 0 {
+		return defaultClassifications
+	}
+	return conf.Classifications
+}
+
+/*
+CodingConfig is what a coding client needs to know
+about how the server is set up
+*/
+type CodingConfig struct {
+	Classifications []string `json:"classifications"`
+}
+
+func (s *Server) codingConfigHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(CodingConfig{Classifications: s.config.classifications()})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+var (
+	// ErrNotWAV means the audio file isn't a RIFF WAVE file
+	ErrNotWAV = errors.New("Audio file isn't a WAV file")
+
+	// ErrWAVNotPCM means the WAV file isn't uncompressed PCM,
+	// so it can't be sliced without decoding it
+	ErrWAVNotPCM = errors.New("WAV file isn't PCM audio")
+)
+
+const (
+	wavFormatPCM        = 1
+	wavFormatExtensible = 0xFFFE
+)
+
+/*
+wavAudio is an open PCM WAV file. Only the header is read,
+slices are copied straight out of the data chunk.
+*/
+type wavAudio struct {
+	file *os.File
+
+	// the fmt chunk, kept as is for the slices
+	format     []byte
+	sampleRate int64
+	blockAlign int64
+
+	dataOffset int64
+	dataSize   int64
+}
+
+func openWAV(path string) (*wavAudio, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	audio := &wavAudio{file: file}
+	if err := audio.readHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return audio, nil
+}
+
+func (audio *wavAudio) Close() error {
+	return audio.file.Close()
+}
+
+// readHeader finds the fmt and data chunks
+func (audio *wavAudio) readHeader() error {
+	var riff [12]byte
+	if _, err := io.ReadFull(audio.file, riff[:]); err != nil {
+		return ErrNotWAV
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return ErrNotWAV
+	}
+
+	offset := int64(12)
+	for {
+		var chunk [8]byte
+		if _, err := audio.file.ReadAt(chunk[:], offset); err != nil {
+			return ErrNotWAV
+		}
+		id := string(chunk[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		offset += 8
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return ErrNotWAV
+			}
+			audio.format = make([]byte, size)
+			if _, err := audio.file.ReadAt(audio.format, offset); err != nil {
+				return ErrNotWAV
+			}
+			formatTag := binary.LittleEndian.Uint16(audio.format[0:2])
+			if formatTag == wavFormatExtensible && size >= 26 {
+				// the real format is the first two bytes of the SubFormat GUID
+				formatTag = binary.LittleEndian.Uint16(audio.format[24:26])
+			}
+			if formatTag != wavFormatPCM {
+				return ErrWAVNotPCM
+			}
+			audio.sampleRate = int64(binary.LittleEndian.Uint32(audio.format[4:8]))
+			audio.blockAlign = int64(binary.LittleEndian.Uint16(audio.format[12:14]))
+		case "data":
+			if audio.format == nil || audio.blockAlign == 0 {
+				return ErrNotWAV
+			}
+			audio.dataOffset = offset
+			audio.dataSize = size
+
+			// some writers leave the size at 0 or 0xFFFFFFFF when streaming
+			info, err := audio.file.Stat()
+			if err != nil {
+				return err
+			}
+			if remaining := info.Size() - offset; size == 0 || size > remaining {
+				audio.dataSize = remaining
+			}
+			audio.dataSize -= audio.dataSize % audio.blockAlign
+			return nil
+		}
+
+		// chunks are padded to an even size
+		offset += size + size%2
+	}
+}
+
+// frameOffset is the byte offset into the data chunk of a time in ms
+func (audio *wavAudio) frameOffset(ms int) int64 {
+	offset := int64(ms) * audio.sampleRate / 1000 * audio.blockAlign
+	if offset < 0 {
+		return 0
+	}
+	if offset > audio.dataSize {
+		return audio.dataSize
+	}
+	return offset
+}
+
+/*
+writeSlice writes the audio from start to end (in ms)
+to w as a WAV file of its own
+*/
+func (audio *wavAudio) writeSlice(w io.Writer, start, end int) error {
+	from, to := audio.frameOffset(start), audio.frameOffset(end)
+	if to < from {
+		to = from
+	}
+	size := to - from
+	// chunks are padded to an even size
+	pad := size % 2
+
+	header := make([]byte, 0, 20+len(audio.format)+8)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(4+8+int64(len(audio.format))+8+size+pad))
+	header = append(header, "WAVE"...)
+	header = append(header, "fmt "...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(audio.format)))
+	header = append(header, audio.format...)
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(size))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, io.NewSectionReader(audio.file, audio.dataOffset+from, size)); err != nil {
+		return err
+	}
+	if pad != 0 {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	return nil
+}
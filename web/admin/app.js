@@ -0,0 +1,275 @@
+// The admin dashboard. The numbers come from /v1/dashboard/, the
+// forms post to the same endpoints the admin scripts use.
+(function () {
+  "use strict";
+
+  // checkouts older than this are highlighted
+  var staleSeconds = 24 * 60 * 60;
+
+  var adminKey = sessionStorage.getItem("ids-admin-key");
+  var report = null;
+
+  function $(id) {
+    return document.getElementById(id);
+  }
+
+  function status(message, isError) {
+    $("status").textContent = message || "";
+    $("status").className = isError ? "error" : "";
+  }
+
+  // failure turns an error response into an Error with the server's message
+  function failure(resp) {
+    return resp.text().then(function (text) {
+      var message = text.trim() || resp.statusText;
+      try {
+        message = JSON.parse(text).message || message;
+      } catch (e) {
+        // not an error envelope, use the text
+      }
+      throw new Error(message);
+    });
+  }
+
+  function post(path, body) {
+    return fetch(path, {
+      method: "POST",
+      headers: {"Content-Type": "application/json"},
+      body: JSON.stringify(body)
+    }).then(function (resp) {
+      if (!resp.ok) {
+        return failure(resp);
+      }
+      return resp;
+    });
+  }
+
+  function age(seconds) {
+    if (seconds < 3600) {
+      return Math.floor(seconds / 60) + "m";
+    }
+    if (seconds < 86400) {
+      return Math.floor(seconds / 3600) + "h";
+    }
+    return Math.floor(seconds / 86400) + "d " + Math.floor(seconds % 86400 / 3600) + "h";
+  }
+
+  function kind(item) {
+    if (item.training) {
+      return "training";
+    }
+    if (item.reliability) {
+      return "reliability";
+    }
+    return "regular";
+  }
+
+  function fillTable(id, rows, columns, decorate) {
+    var body = $(id).tBodies[0];
+    body.innerHTML = "";
+    rows.forEach(function (row) {
+      var tr = body.insertRow();
+      columns.forEach(function (column) {
+        tr.insertCell().textContent = column(row);
+      });
+      if (decorate) {
+        decorate(tr, row);
+      }
+    });
+  }
+
+  function render() {
+    show();
+    if (report === null) {
+      return;
+    }
+    $("generated").textContent = "as of " + new Date(report.generated).toLocaleString();
+    $("totals").textContent = report.regular_blocks + " regular, " +
+      report.training_blocks + " training and " +
+      report.reliability_blocks + " reliability blocks";
+
+    var most = Math.max.apply(null, report.passes.map(function (pass) {
+      return pass.blocks;
+    }).concat([1]));
+    var bars = $("passes");
+    bars.innerHTML = "";
+    report.passes.forEach(function (pass) {
+      var bar = document.createElement("div");
+      bar.className = "bar";
+      var label = document.createElement("span");
+      label.className = "label";
+      label.textContent = pass.passes + (pass.passes === 1 ? " pass" : " passes");
+      var fill = document.createElement("span");
+      fill.className = "fill";
+      fill.style.width = (pass.blocks / most * 60) + "%";
+      var count = document.createElement("span");
+      count.textContent = pass.blocks;
+      bar.appendChild(label);
+      bar.appendChild(fill);
+      bar.appendChild(count);
+      bars.appendChild(bar);
+    });
+
+    fillTable("labs", report.labs, [
+      function (lab) { return lab.lab_name || lab.lab_key; },
+      function (lab) { return lab.users; },
+      function (lab) { return lab.regular; },
+      function (lab) { return lab.training; },
+      function (lab) { return lab.reliability; },
+      function (lab) { return lab.active; }
+    ]);
+    fillTable("coders", report.coders, [
+      function (coder) { return coder.lab_name || coder.lab_key; },
+      function (coder) { return coder.username; },
+      function (coder) { return coder.regular; },
+      function (coder) { return coder.training; },
+      function (coder) { return coder.reliability; },
+      function (coder) { return coder.active; }
+    ]);
+    fillTable("active", report.active, [
+      function (checkout) { return checkout.block_id; },
+      function (checkout) { return checkout.lab_name || checkout.lab_key; },
+      function (checkout) { return checkout.username; },
+      kind,
+      function (checkout) {
+        return checkout.checked_out ? new Date(checkout.checked_out).toLocaleString() : "unknown";
+      },
+      function (checkout) { return checkout.checked_out ? age(checkout.age_seconds) : ""; }
+    ], function (tr, checkout) {
+      if (checkout.age_seconds > staleSeconds) {
+        tr.className = "stale";
+      }
+      var button = document.createElement("button");
+      button.type = "button";
+      button.textContent = "Release";
+      button.addEventListener("click", function () {
+        release(checkout.lab_key, checkout.username, checkout.block_id);
+      });
+      tr.insertCell().appendChild(button);
+    });
+    fillTable("special", report.special, [
+      function (block) { return block.block_id; },
+      kind,
+      function (block) { return block.training ? block.train_pack_num : ""; },
+      function (block) { return block.instances; },
+      function (block) { return block.coders.join(", "); }
+    ]);
+
+    Array.prototype.forEach.call(document.querySelectorAll(".lab-select"), function (select) {
+      var selected = select.value;
+      select.innerHTML = "";
+      report.labs.forEach(function (lab) {
+        select.appendChild(new Option(lab.lab_name || lab.lab_key, lab.lab_key));
+      });
+      select.value = selected;
+    });
+    $("add-user").lab_key.required = report.labs.length > 0;
+  }
+
+  function show() {
+    $("login").hidden = adminKey !== null;
+    $("controls").hidden = adminKey === null;
+    $("dashboard").hidden = report === null;
+  }
+
+  function refresh() {
+    return post("/v1/dashboard/", {admin_lab_key: adminKey}).then(function (resp) {
+      return resp.json();
+    }).then(function (data) {
+      report = data;
+      render();
+    }).catch(function (err) {
+      status(err.message, true);
+    });
+  }
+
+  function done(message) {
+    return function () {
+      status(message);
+      return refresh();
+    };
+  }
+
+  function failed(err) {
+    status(err.message, true);
+  }
+
+  function labName(labKey) {
+    var lab = report.labs.filter(function (lab) {
+      return lab.lab_key === labKey;
+    })[0];
+    return lab ? lab.lab_name : "";
+  }
+
+  function release(labKey, username, blockID) {
+    if (!confirm("Release " + blockID + " from " + username + "?")) {
+      return;
+    }
+    post("/v1/submit-wo-labels/", {
+      lab_key: labKey,
+      lab_name: labName(labKey),
+      username: username,
+      blocks: [blockID]
+    }).then(done("Released " + blockID)).catch(failed);
+  }
+
+  $("login").addEventListener("submit", function (event) {
+    event.preventDefault();
+    adminKey = event.target.admin_lab_key.value;
+    sessionStorage.setItem("ids-admin-key", adminKey);
+    status("");
+    refresh();
+  });
+
+  $("logout").addEventListener("click", function () {
+    adminKey = null;
+    report = null;
+    sessionStorage.removeItem("ids-admin-key");
+    show();
+  });
+
+  $("refresh").addEventListener("click", refresh);
+
+  $("add-user").addEventListener("submit", function (event) {
+    event.preventDefault();
+    var form = event.target;
+    var labKey = form.new_lab_key.value || form.lab_key.value;
+    post("/v1/add-user/", {
+      lab_key: labKey,
+      lab_name: form.lab_name.value || labName(labKey),
+      username: form.username.value
+    }).then(done("Added " + form.username.value)).catch(failed);
+  });
+
+  $("release").addEventListener("submit", function (event) {
+    event.preventDefault();
+    var form = event.target;
+    release(form.lab_key.value, form.username.value, form.block_id.value);
+  });
+
+  $("delete-labels").addEventListener("submit", function (event) {
+    event.preventDefault();
+    var form = event.target;
+    var request = {
+      lab_key: form.lab_key.value,
+      delete_type: form.delete_type.value,
+      coder: form.coder.value,
+      block_id: form.block_id.value,
+      instance: parseInt(form.instance.value, 10) || 0
+    };
+    var what = {
+      single: request.block_id + " instance " + request.instance,
+      user: "every label from " + request.coder,
+      lab: "every label from " + (labName(request.lab_key) || request.lab_key)
+    }[request.delete_type];
+    if (!confirm("Delete " + what + "? This can't be undone.")) {
+      return;
+    }
+    post("/v1/delete-block/", request).then(done("Deleted " + what)).catch(failed);
+  });
+
+  show();
+  if (adminKey !== null) {
+    refresh();
+  }
+})();
@@ -0,0 +1,250 @@
+// The browser coding interface. It only talks to the same
+// endpoints the desktop client does, plus /v1/get-block-clips/
+// and /v1/get-clip/ to stream the audio instead of unzipping it.
+(function () {
+  "use strict";
+
+  var session = JSON.parse(localStorage.getItem("ids-session") || "null");
+  var classifications = [];
+  var block = null;
+
+  function $(id) {
+    return document.getElementById(id);
+  }
+
+  function status(message, isError) {
+    $("status").textContent = message || "";
+    $("status").className = isError ? "error" : "";
+  }
+
+  function show(id, visible) {
+    $(id).hidden = !visible;
+  }
+
+  // failure turns an error response into an Error with the server's message
+  function failure(resp) {
+    return resp.text().then(function (text) {
+      var message = text.trim() || resp.statusText;
+      try {
+        message = JSON.parse(text).message || message;
+      } catch (e) {
+        // not an error envelope, use the text
+      }
+      throw new Error(message);
+    });
+  }
+
+  // post sends a JSON request and fails with the server's error message
+  function post(path, body) {
+    return fetch(path, {
+      method: "POST",
+      headers: {"Content-Type": "application/json"},
+      body: JSON.stringify(body)
+    }).then(function (resp) {
+      if (!resp.ok) {
+        return failure(resp);
+      }
+      return resp;
+    });
+  }
+
+  function query(params) {
+    return Object.keys(params).map(function (key) {
+      return encodeURIComponent(key) + "=" + encodeURIComponent(params[key]);
+    }).join("&");
+  }
+
+  function render() {
+    var loggedIn = session !== null;
+    show("login", !loggedIn);
+    show("whoami", loggedIn);
+    show("checkout", loggedIn && block === null);
+    show("block", loggedIn && block !== null);
+    if (loggedIn) {
+      $("coder-name").textContent = session.username + " (" + session.lab_name + ")";
+    }
+  }
+
+  function login(event) {
+    event.preventDefault();
+    var form = event.target;
+    var request = {
+      lab_key: form.lab_key.value,
+      lab_name: form.lab_name.value,
+      username: form.username.value
+    };
+    post("/v1/add-user/", request).then(function () {
+      session = request;
+      localStorage.setItem("ids-session", JSON.stringify(session));
+      status("");
+      render();
+    }).catch(function (err) {
+      status(err.message, true);
+    });
+  }
+
+  function logout() {
+    session = null;
+    block = null;
+    localStorage.removeItem("ids-session");
+    render();
+  }
+
+  /*
+  getBlock checks a block out. The endpoints send the zip, but
+  only the X-Block-ID header is needed, so the download is
+  cancelled and the clips are streamed one at a time.
+  */
+  function getBlock() {
+    var kind = document.querySelector("input[name=kind]:checked").value;
+    var specificID = $("specific-id").value.trim();
+    var request = {
+      lab_key: session.lab_key,
+      lab_name: session.lab_name,
+      username: session.username,
+      training: kind === "training",
+      reliability: kind === "reliability"
+    };
+    var path = "/v1/get-block/";
+    if (specificID !== "") {
+      path = "/v1/get-specific-block/";
+      request.block_id = specificID;
+    }
+
+    status("Getting a block...");
+    post(path, request).then(function (resp) {
+      var blockID = resp.headers.get("X-Block-ID");
+      if (resp.body) {
+        resp.body.cancel();
+      }
+      return fetch("/v1/get-block-clips/?" + query({lab_key: session.lab_key, block_id: blockID}));
+    }).then(function (resp) {
+      if (!resp.ok) {
+        return failure(resp);
+      }
+      return resp.json();
+    }).then(function (clips) {
+      block = clips;
+      status("");
+      showBlock();
+      render();
+    }).catch(function (err) {
+      status(err.message, true);
+    });
+  }
+
+  function showBlock() {
+    $("block-title").textContent = block.clan_file + " block " + block.block_index +
+      (block.training ? " (training)" : "") + (block.reliability ? " (reliability)" : "");
+    $("fan-or-man").checked = false;
+    $("dont-share").checked = false;
+
+    var body = $("clips").tBodies[0];
+    body.innerHTML = "";
+    block.clips.forEach(function (clip, i) {
+      var row = body.insertRow();
+      if (clip.multiline) {
+        row.className = "multiline";
+      }
+      row.insertCell().textContent = clip.clip_index;
+      row.insertCell().textContent = clip.clip_tier;
+      row.insertCell().textContent = clip.start_time;
+
+      var audio = document.createElement("audio");
+      audio.controls = true;
+      audio.preload = "none";
+      audio.src = "/v1/get-clip/?" + query({
+        lab_key: session.lab_key,
+        block_id: block.id,
+        clip_index: clip.clip_index
+      });
+      audio.addEventListener("play", function () {
+        markCurrent(i);
+      });
+      row.insertCell().appendChild(audio);
+
+      var select = document.createElement("select");
+      select.appendChild(new Option("", ""));
+      classifications.forEach(function (label) {
+        select.appendChild(new Option(label, label));
+      });
+      select.value = clip.classification || "";
+      select.addEventListener("change", function () {
+        clip.classification = select.value;
+      });
+      row.insertCell().appendChild(select);
+    });
+  }
+
+  function markCurrent(index) {
+    Array.prototype.forEach.call($("clips").tBodies[0].rows, function (row, i) {
+      row.classList.toggle("current", i === index);
+    });
+  }
+
+  function submit() {
+    var unlabeled = block.clips.filter(function (clip) {
+      return !clip.classification;
+    });
+    if (unlabeled.length > 0) {
+      status(unlabeled.length + " clips still need a label", true);
+      return;
+    }
+
+    var date = new Date().toISOString().slice(0, 10);
+    var clips = block.clips.map(function (clip) {
+      return Object.assign({}, clip, {label_date: date, coder: session.username});
+    });
+    post("/v1/submit-labels/", {
+      clan_file: block.clan_file,
+      block_index: block.block_index,
+      clips: clips,
+      fan_or_man: $("fan-or-man").checked,
+      dont_share: $("dont-share").checked,
+      id: block.id,
+      coder: session.username,
+      lab_key: session.lab_key,
+      lab_name: session.lab_name,
+      username: session.username,
+      training: block.training,
+      reliability: block.reliability,
+      block_sha256: block.block_sha256
+    }).then(function () {
+      status("Submitted " + block.id);
+      block = null;
+      render();
+    }).catch(function (err) {
+      status(err.message, true);
+    });
+  }
+
+  function release() {
+    post("/v1/submit-wo-labels/", {
+      lab_key: session.lab_key,
+      lab_name: session.lab_name,
+      username: session.username,
+      blocks: [block.id]
+    }).then(function () {
+      status("Gave back " + block.id);
+      block = null;
+      render();
+    }).catch(function (err) {
+      status(err.message, true);
+    });
+  }
+
+  $("login").addEventListener("submit", login);
+  $("logout").addEventListener("click", logout);
+  $("get-block").addEventListener("click", getBlock);
+  $("submit").addEventListener("click", submit);
+  $("release").addEventListener("click", release);
+
+  fetch("/v1/coding-config/").then(function (resp) {
+    return resp.json();
+  }).then(function (config) {
+    classifications = config.classifications;
+  }).catch(function (err) {
+    status(err.message, true);
+  });
+  render();
+})();
@@ -3,17 +3,13 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
+	"log/slog"
+	"sort"
 
 	"github.com/boltdb/bolt"
 )
 
-var (
-	// path to the WorkDB file
-	workDBPath = mainConfig.WorkDBPath
-)
-
 const (
 
 	// name of the database's work bucket
@@ -29,6 +25,10 @@ var (
 	// ErrWorkItemDoesntExist is thrown when a workItemMap access is
 	// made with a key that doesn't exist
 	ErrWorkItemDoesntExist = errors.New("This work Item doesn't exist")
+
+	// errItemTaken means a WorkItem that looked free when it was chosen
+	// couldn't be checked out any more, because of another checkout
+	errItemTaken = errors.New("Block was taken by another checkout")
 )
 
 /*
@@ -46,49 +46,51 @@ type WorkItem struct {
 	Training        bool   `json:"training"`
 	Reliability     bool   `json:"reliability"`
 	TrainingPackNum int    `json:"train_pack_num"`
+	BlockSHA256     string `json:"block_sha256"`
 }
 
 // WorkDB is a wrapper around a boltDB
 type WorkDB struct {
-	db *bolt.DB
+	db      *bolt.DB
+	metrics *Metrics
 }
 
-// LoadWorkDB loads the global workDB
-func LoadWorkDB() *WorkDB {
-	localWorkDB := &WorkDB{db: new(bolt.DB)}
-	err := localWorkDB.Open()
+// LoadWorkDB opens the WorkDB stored at path
+func LoadWorkDB(path string) (*WorkDB, error) {
+	localWorkDB := &WorkDB{}
+	err := localWorkDB.Open(path)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	return localWorkDB
+	return localWorkDB, nil
 }
 
 // Open opens the database and returns error on failure
-func (db *WorkDB) Open() error {
-	workDB, openErr := bolt.Open(workDBPath, 0600, nil)
-
+func (db *WorkDB) Open(path string) error {
+	workDB, openErr := bolt.Open(path, 0600, nil)
 	if openErr != nil {
-		log.Fatal(openErr)
 		return openErr
 	}
 
 	db.db = workDB
 
-	err := db.db.Update(func(tx *bolt.Tx) error {
+	err := db.metrics.timeTx("work", "update", db.db.Update, func(tx *bolt.Tx) error {
 		_, updateErr := tx.CreateBucketIfNotExists([]byte(workBucket))
-		if updateErr != nil {
-			log.Fatal(updateErr)
-			return updateErr
-		}
 		return updateErr
 	})
-
+	if err != nil {
+		db.db.Close()
+	}
 	return err
 }
 
 // Close closes the database
-func (db *WorkDB) Close() {
-	db.db.Close()
+func (db *WorkDB) Close() error {
+	return db.db.Close()
+}
+
+func (db *WorkDB) boltDB() *bolt.DB {
+	return db.db
 }
 
 /*
@@ -110,7 +112,7 @@ func (db *WorkDB) fillWithItemMap(itemMap WorkItemMap) {
 			log.Fatal(encodeErr)
 		}
 
-		updateErr := db.db.Update(func(tx *bolt.Tx) error {
+		updateErr := db.metrics.timeTx("work", "update", db.db.Update, func(tx *bolt.Tx) error {
 			bucket := tx.Bucket([]byte(workBucket))
 			err := bucket.Put([]byte(id), encodedItem)
 			return err
@@ -125,30 +127,50 @@ func (db *WorkDB) fillWithItemMap(itemMap WorkItemMap) {
 /*
 loadItemMap reads the WorkItemMap from the workDB.
 */
-func (db *WorkDB) loadItemMap() WorkItemMap {
+func (db *WorkDB) loadItemMap() (WorkItemMap, error) {
 	var itemMap = make(WorkItemMap)
 
-	err := db.db.View(func(tx *bolt.Tx) error {
+	err := db.metrics.timeTx("work", "view", db.db.View, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(workBucket))
 
 		cursor := bucket.Cursor()
 
 		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
-			//fmt.Println("\nWorkItem from DB:")
-			//fmt.Printf("key=%s, value=%s\n", k, v)
 			currItem, err := decodeWorkItemJSON(v)
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
 			itemMap[currItem.ID] = *currItem
 		}
 
 		return nil
 	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	return itemMap
+	return itemMap, err
+}
+
+/*
+getWorkItemPage returns up to limit WorkItems from the workDB,
+in ID order, starting after the given WorkItem ID. The returned
+string is the ID to pass as "after" to get the next page, or ""
+if this was the last page.
+*/
+func (db *WorkDB) getWorkItemPage(after string, limit int) ([]WorkItem, string, error) {
+	var items []WorkItem
+	var next string
+
+	err := db.metrics.timeTx("work", "view", db.db.View, func(tx *bolt.Tx) error {
+		var scanErr error
+		next, scanErr = scanBucketPage(tx, workBucket, after, limit, func(value []byte) error {
+			currItem, decodeErr := decodeWorkItemJSON(value)
+			if decodeErr != nil {
+				return decodeErr
+			}
+			items = append(items, *currItem)
+			return nil
+		})
+		return scanErr
+	})
+	return items, next, err
 }
 
 func (wi *WorkItem) encode() ([]byte, error) {
@@ -168,12 +190,79 @@ func decodeWorkItemJSON(data []byte) (*WorkItem, error) {
 	return workItem, nil
 }
 
+func (db *WorkDB) compareWithWorkItemMap(itemMap WorkItemMap) []WorkItem {
+	// missmatched WorkItems
+	var diffs []WorkItem
+
+	for key, value := range itemMap {
+		var itemBytes []byte
+		db.metrics.timeTx("work", "view", db.db.View, func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(workBucket))
+			itemBytes = bucket.Get([]byte(key))
+
+			workItem, err := decodeWorkItemJSON(itemBytes)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			switch {
+			case workItem.Block != value.Block:
+				diffs = append(diffs, value)
+				break
+			case workItem.BlockPath != value.BlockPath:
+				diffs = append(diffs, value)
+				break
+			case workItem.FileName != value.FileName:
+				diffs = append(diffs, value)
+				break
+			}
+			return nil
+		})
+	}
+	return diffs
+}
+
+func (db *WorkDB) persistWorkItem(item WorkItem) error {
+
+	// turn WorkItem into []byte
+	encodedItem, err := item.encode()
+	if err != nil {
+		return err
+	}
+
+	return db.metrics.timeTx("work", "update", db.db.Update, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(workBucket))
+		err := bucket.Put([]byte(item.ID), encodedItem)
+		return err
+	})
+}
+
+/*
+persistWorkItemMap writes every WorkItem in the
+map to the workDB in a single transaction
+*/
+func (db *WorkDB) persistWorkItemMap(itemMap WorkItemMap) error {
+	return db.metrics.timeTx("work", "update", db.db.Update, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(workBucket))
+		for _, item := range itemMap {
+			encodedItem, err := item.encode()
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(item.ID), encodedItem); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 /*
 workItemIsActive checks to see if a WorkItem
-is part of the global activeWorkItems map.
+is active in the workItemMap.
 */
-func workItemIsActive(item WorkItem) bool {
-	value := workItemMap[item.ID]
+func (s *Server) workItemIsActive(item WorkItem) bool {
+	value, _ := s.workItem(item.ID)
 	if value.Active {
 		return true
 	}
@@ -184,36 +273,43 @@ func workItemIsActive(item WorkItem) bool {
 inactivateWorkItem sets the WorkItem to false
 in the workItemMap
 */
-func inactivateWorkItem(item WorkItem, request IDSRequest) {
-	value := workItemMap[item.ID]
-	value.Active = false
-	//value.TimesCoded++
-	workItemMap[item.ID] = value
-	workDB.persistWorkItem(value)
+func (s *Server) inactivateWorkItem(item WorkItem, request IDSRequest) error {
+	value := s.updateWorkItem(item.ID, func(value *WorkItem) {
+		value.Active = false
+		//value.TimesCoded++
+	})
+	persistErr := s.work.persistWorkItem(value)
+	if persistErr != nil {
+		return persistErr
+	}
 
 	// update the User's WorkItem list on disk
-	user, getUsrError := labsDB.getUser(request.LabKey, request.Username)
+	user, getUsrError := s.getUser(request.LabKey, request.Username)
 	if getUsrError != nil {
-		return
+		return nil
 	}
 	user.inactivateWorkItem(value)
-	labsDB.setUser(user)
+	return s.setUser(user)
 }
 
-func inactivateIncompleteWorkItem(item WorkItem, request IDSRequest) {
-	value := workItemMap[item.ID]
-	value.Active = false
-	workItemMap[item.ID] = value
-	workDB.persistWorkItem(value)
+func (s *Server) inactivateIncompleteWorkItem(item WorkItem, request IDSRequest) error {
+	value := s.updateWorkItem(item.ID, func(value *WorkItem) {
+		value.Active = false
+	})
+	persistErr := s.work.persistWorkItem(value)
+	if persistErr != nil {
+		return persistErr
+	}
+	s.metrics.countWorkItem(releaseEvent, value)
 
 	// update the User's WorkItem list on disk
-	user, getUsrError := labsDB.getUser(request.LabKey, request.Username)
+	user, getUsrError := s.getUser(request.LabKey, request.Username)
 	if getUsrError != nil {
-		return
+		return nil
 	}
 
 	user.inactivateIncompleteWorkItem(value)
-	labsDB.setUser(user)
+	return s.setUser(user)
 }
 
 /*
@@ -223,67 +319,173 @@ in the workItemMap.
 Also adds the work item to the User's checked out WorkItem
 list
 */
-func activateWorkItem(item WorkItem, request BlockReq) {
-	value := workItemMap[item.ID]
-	value.Active = true
+func (s *Server) activateWorkItem(item WorkItem, request BlockReq) error {
+	_, err := s.checkoutWorkItem(item.ID, request, nil)
+	return err
+}
 
-	// update the workItemMap (in memory)
-	workItemMap[item.ID] = value
+/*
+checkoutWorkItem activates the WorkItem and adds it to the user's
+checked out list, if eligible (when it's given) has no error for the
+item and user as they are now. The check, the WorkItem and the user
+are all done under itemsMu, so two checkouts can't both pass the
+check for what only one of them should get.
+*/
+func (s *Server) checkoutWorkItem(id string, request BlockReq, eligible func(item WorkItem, user User) error) (WorkItem, error) {
+	s.itemsMu.Lock()
+	defer s.itemsMu.Unlock()
 
-	// update the WorkItem value on disk
-	workDB.persistWorkItem(value)
+	item, exists := s.workItemMap[id]
+	if !exists {
+		return item, ErrWorkItemDoesntExist
+	}
+	user, getUsrErr := s.getUser(request.LabKey, request.Username)
+	if getUsrErr != nil {
+		return item, ErrUserDoesntExist
+	}
+	if eligible != nil {
+		if err := eligible(item, user); err != nil {
+			return item, err
+		}
+	}
 
-	// update the User's WorkItem list on disk
-	user, getUsrError := labsDB.getUser(request.LabKey, request.Username)
-	if getUsrError != nil {
-		return
+	// update the WorkItem value on disk, then in the workItemMap
+	item.Active = true
+	if persistErr := s.work.persistWorkItem(item); persistErr != nil {
+		return item, persistErr
 	}
+	s.workItemMap[id] = item
+	s.metrics.countWorkItem(checkoutEvent, item)
+
+	// update the User's WorkItem list on disk
 	user.addWorkItem(item.ID)
-	labsDB.setUser(user)
+	return item, s.setUser(user)
 }
 
-func chooseRegularWorkItem(request BlockReq) (WorkItem, error) {
-	var workItem WorkItem
-	user, getUsrErr := labsDB.getUser(request.LabKey, request.Username)
+func (s *Server) chooseRegularWorkItem(request BlockReq) (WorkItem, error) {
+	return s.checkoutFirst(request, func(item WorkItem, user User) (bool, error) {
+		return s.blockAppropriateForUser(item, request, user)
+	})
+}
+
+/*
+checkoutFirst checks out the first WorkItem that appropriate says the
+user can have. The items are gone through in a copy of the workItemMap,
+so appropriate is asked again by checkoutWorkItem, under the lock, in
+case another request has checked the item out in the meantime.
+*/
+func (s *Server) checkoutFirst(request BlockReq, appropriate func(item WorkItem, user User) (bool, error)) (WorkItem, error) {
+	user, getUsrErr := s.getUser(request.LabKey, request.Username)
 	if getUsrErr != nil {
 		return WorkItem{}, ErrUserDoesntExist
 	}
-	for _, item := range workItemMap {
-		if blockAppropriateForUser(item, request, user) {
-			activateWorkItem(item, request)
-			fmt.Println("Selected Item: ")
-			fmt.Println(item)
-			return item, nil
+	stillAppropriate := func(item WorkItem, user User) error {
+		isAppropriate, err := appropriate(item, user)
+		if err == nil && !isAppropriate {
+			return errItemTaken
+		}
+		return err
+	}
+
+	for _, item := range s.workItems() {
+		isAppropriate, checkErr := appropriate(item, user)
+		if checkErr != nil {
+			return WorkItem{}, checkErr
+		}
+		if !isAppropriate {
+			continue
+		}
+		checkedOut, checkoutErr := s.checkoutWorkItem(item.ID, request, stillAppropriate)
+		if checkoutErr == errItemTaken {
+			continue
 		}
+		if checkoutErr != nil {
+			return WorkItem{}, checkoutErr
+		}
+		slog.Debug("selected block", "lab_key_hash", labKeyHash(request.LabKey),
+			"username", request.Username, "block_id", item.ID)
+		return checkedOut, nil
 	}
 
-	fmt.Println("\nRan out of unique items for this user")
-	return workItem, ErrRanOutOfItems
+	slog.Debug("ran out of blocks for user", "lab_key_hash", labKeyHash(request.LabKey),
+		"username", request.Username)
+	return WorkItem{}, ErrRanOutOfItems
 }
 
-func blockAppropriateForUser(item WorkItem, request BlockReq, user User) bool {
+/*
+blockAppropriateForUser is true if the user can be given the regular
+item. The error is for when that couldn't be worked out, a block
+that's over the pass limits is just not appropriate.
+*/
+func (s *Server) blockAppropriateForUser(item WorkItem, request BlockReq, user User) (bool, error) {
 	if item.Active {
-		return false
+		return false, nil
 	} else if item.TimesCoded >= numRealBlockPasses {
-		fmt.Println("item has been coded already")
-		return false
+		return false, nil
 	} else if item.Training {
-		return false
+		return false, nil
 	} else if item.Reliability {
-		return false
+		return false, nil
 	} else if user.prevCoded(item.ID) {
-		return false
+		return false, nil
 	}
-	return true
+	switch err := s.passLimitsReached(item, user); err {
+	case nil:
+		return true, nil
+	case ErrLabPassLimitReached, ErrCoderPassLimitReached:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+/*
+passLimitsReached checks the instances of a regular WorkItem,
+the submitted ones and the ones still checked out, against the per
+lab and per coder pass limits from the config. It returns the limit
+that would be exceeded if this user were to code the item, nil if
+none would be, or the error that kept it from checking.
+*/
+func (s *Server) passLimitsReached(item WorkItem, user User) error {
+	if item.Training || item.Reliability || (item.TimesCoded == 0 && !item.Active) {
+		return nil
+	}
+	if s.config.passLimits() == (PassLimits{}) {
+		return nil
+	}
+	blockGroup, err := s.labels.getBlock(item.ID)
+	if err == ErrWorkItemDoesntExist || err == ErrCouldntFindLabeledBlock {
+		// nothing has been submitted for this block yet
+		blockGroup = &BlockGroup{ID: item.ID}
+	} else if err != nil {
+		return err
+	}
+
+	passes := BlockGroup{ID: item.ID, Blocks: append(BlockArray{}, blockGroup.Blocks...)}
+	if item.Active {
+		// every checkout is a pass that hasn't been submitted yet
+		labs, err := s.labs.getAllLabs()
+		if err != nil {
+			return err
+		}
+		for _, lab := range labs {
+			for name, holder := range lab.Users {
+				if holder.hasThisBlock(item.ID) {
+					passes.Blocks = append(passes.Blocks, Block{ID: item.ID, LabKey: lab.Key, Coder: name})
+				}
+			}
+		}
+	}
+	return passes.checkPassLimits(user.ParentLab, user.Name, s.config.passLimits())
 }
 
-func userHasBlockFromFile(item WorkItem, request BlockReq, user User) bool {
+func (s *Server) userHasBlockFromFile(item WorkItem, request BlockReq, user User) bool {
 	/*
 		Check if user already has a block
 		from the same file
 	*/
 	for _, userItem := range user.ActiveWorkItems {
-		userWorkItem := workItemMap[userItem]
+		userWorkItem, _ := s.workItem(userItem)
 		if userWorkItem.FileName == item.FileName {
 			return true
 		}
@@ -291,135 +493,35 @@ func userHasBlockFromFile(item WorkItem, request BlockReq, user User) bool {
 	return false
 }
 
-func (db *WorkDB) compareWithWorkItemMap(itemMap WorkItemMap) []WorkItem {
-	// missmatched WorkItems
-	var diffs []WorkItem
-
-	for key, value := range itemMap {
-		var itemBytes []byte
-		db.db.View(func(tx *bolt.Tx) error {
-			bucket := tx.Bucket([]byte(workBucket))
-			itemBytes = bucket.Get([]byte(key))
-
-			workItem, err := decodeWorkItemJSON(itemBytes)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			switch {
-			case workItem.Block != value.Block:
-				diffs = append(diffs, value)
-				break
-			case workItem.BlockPath != value.BlockPath:
-				diffs = append(diffs, value)
-				break
-			case workItem.FileName != value.FileName:
-				diffs = append(diffs, value)
-				break
-			}
-			return nil
-		})
-	}
-	return diffs
-}
-
-func (db *WorkDB) persistWorkItem(item WorkItem) {
-
-	// turn WorkItem into []byte
-	encodedItem, err := item.encode()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	updateErr := db.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(workBucket))
-		err := bucket.Put([]byte(item.ID), encodedItem)
-		return err
+func (s *Server) chooseSpecificBlock(req BlockReq) (WorkItem, error) {
+	return s.checkoutWorkItem(req.ItemID, req, func(workItem WorkItem, user User) error {
+		if !workItem.Training && !workItem.Reliability && workItem.TimesCoded >= numRealBlockPasses {
+			return ErrBlockGroupFull
+		}
+		return s.passLimitsReached(workItem, user)
 	})
-
-	if updateErr != nil {
-		log.Fatal(updateErr)
-	}
 }
 
-func (db *WorkDB) persistWorkItemMap(itemMap WorkItemMap) {
-	for _, item := range itemMap {
-		db.persistWorkItem(item)
-	}
-}
-
-func chooseSpecificBlock(req BlockReq) (WorkItem, error) {
-	var workItem WorkItem
-
-	workItem, exists := workItemMap[req.ItemID]
-	if !exists {
-		return workItem, ErrWorkItemDoesntExist
-	}
-	if !workItem.Training && !workItem.Reliability && workItem.TimesCoded >= numRealBlockPasses {
-		return workItem, ErrBlockGroupFull
-	}
-	activateWorkItem(workItem, req)
-
-	return workItem, nil
-}
-
-func chooseTrainingWorkItem(request BlockReq) (WorkItem, error) {
-	var workItem WorkItem
-	user, getUsrErr := labsDB.getUser(request.LabKey, request.Username)
-	if getUsrErr != nil {
-		return WorkItem{}, ErrUserDoesntExist
-	}
-
-	for _, item := range workItemMap {
-		if blockAppropriateForUserTraining(item, request, user) {
-			activateWorkItem(item, request)
-			fmt.Println("Selected Item: ")
-			fmt.Println(item)
-			return item, nil
-		}
-	}
-
-	fmt.Println("\nRan out of unique items for this user")
-	return workItem, ErrRanOutOfItems
+func (s *Server) chooseTrainingWorkItem(request BlockReq) (WorkItem, error) {
+	return s.checkoutFirst(request, func(item WorkItem, user User) (bool, error) {
+		return blockAppropriateForUserTraining(item, request, user), nil
+	})
 }
 
-func chooseSpecificTrainingBlock(req BlockReq) (WorkItem, error) {
-	var workItem WorkItem
-
-	workItem, exists := workItemMap[req.ItemID]
-	if !exists {
-		return workItem, ErrWorkItemDoesntExist
-	}
-	activateWorkItem(workItem, req)
-
-	return workItem, nil
+func (s *Server) chooseSpecificTrainingBlock(req BlockReq) (WorkItem, error) {
+	return s.checkoutWorkItem(req.ItemID, req, nil)
 }
 
-func chooseReliabilityWorkItem(request BlockReq) (WorkItem, error) {
-	var workItem WorkItem
-	user, getUsrErr := labsDB.getUser(request.LabKey, request.Username)
-	if getUsrErr != nil {
-		return WorkItem{}, ErrUserDoesntExist
-	}
-	for _, item := range workItemMap {
-
-		if blockAppropriateForUserReliability(item, request, user) {
-			activateWorkItem(item, request)
-			fmt.Println("Selected Item: ")
-			fmt.Println(item)
-			return item, nil
-		}
-	}
-
-	fmt.Println("\nRan out of unique items for this user")
-	return workItem, ErrRanOutOfItems
+func (s *Server) chooseReliabilityWorkItem(request BlockReq) (WorkItem, error) {
+	return s.checkoutFirst(request, func(item WorkItem, user User) (bool, error) {
+		return blockAppropriateForUserReliability(item, request, user), nil
+	})
 }
 
 func blockAppropriateForUserTraining(item WorkItem, request BlockReq, user User) bool {
 	if !item.Training {
 		return false
 	} else if user.hasThisBlock(item.ID) {
-		fmt.Println("user has this block already")
 		return false
 	}
 	return true
@@ -429,11 +531,44 @@ func blockAppropriateForUserReliability(item WorkItem, request BlockReq, user Us
 	if !item.Reliability {
 		return false
 	} else if user.prevCodedRelia(item.ID) {
-		fmt.Println("item has been coded already by this user")
 		return false
 	} else if user.hasThisBlock(item.ID) {
-		fmt.Println("user has block from this file")
 		return false
 	}
 	return true
 }
+
+/*
+addWorkItems adds the WorkItems that aren't in the workItemMap
+yet, and persists them. Items that are already there are left
+alone (they have their own coding state) and returned in existing.
+The lock is held from the check to the insert, so two adds of
+the same item can't both add it.
+*/
+func (s *Server) addWorkItems(items WorkItemMap) (added, existing []string, err error) {
+	s.itemsMu.Lock()
+	newItems := make(WorkItemMap)
+	for id, item := range items {
+		if _, exists := s.workItemMap[id]; exists {
+			existing = append(existing, id)
+			continue
+		}
+		newItems[id] = item
+		added = append(added, id)
+	}
+	sort.Strings(added)
+	sort.Strings(existing)
+
+	if err := s.work.persistWorkItemMap(newItems); err != nil {
+		s.itemsMu.Unlock()
+		return nil, existing, err
+	}
+	if s.workItemMap == nil {
+		s.workItemMap = make(WorkItemMap)
+	}
+	for id, item := range newItems {
+		s.workItemMap[id] = item
+	}
+	s.itemsMu.Unlock()
+	return added, existing, s.encodeWorkItemMap()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// errStoreFailed stands in for a database that can't be read
+var errStoreFailed = errors.New("store failed")
+
+// failingLabelStore is a LabelStore whose block lookups fail
+type failingLabelStore struct {
+	LabelStore
+}
+
+func (store failingLabelStore) getBlock(blockID string) (*BlockGroup, error) {
+	return nil, errStoreFailed
+}
+
+// slowLabelStore is a LabelStore whose block lookups take a while
+type slowLabelStore struct {
+	LabelStore
+}
+
+func (store slowLabelStore) getBlock(blockID string) (*BlockGroup, error) {
+	time.Sleep(5 * time.Millisecond)
+	return store.LabelStore.getBlock(blockID)
+}
+
+// slowWorkStore is a WorkStore that takes a while to store WorkItems
+type slowWorkStore struct {
+	WorkStore
+}
+
+func (store slowWorkStore) persistWorkItemMap(items WorkItemMap) error {
+	time.Sleep(5 * time.Millisecond)
+	return store.WorkStore.persistWorkItemMap(items)
+}
+
+func TestPassLimitsAtCheckout(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		limits    PassLimits
+		checkouts []string // users (in lab1) who have the block checked out
+		submitted []string // users (in lab1) who have coded it
+		username  string   // the lab1 user checking it out next
+		want      error
+	}{
+		{"lab limit, checked out", PassLimits{PerLab: 1}, []string{"alice"}, nil, "amy", ErrLabPassLimitReached},
+		{"lab limit, coded", PassLimits{PerLab: 1}, nil, []string{"alice"}, "amy", ErrLabPassLimitReached},
+		{"lab limit not reached", PassLimits{PerLab: 2}, []string{"alice"}, nil, "amy", nil},
+		{"coder limit, checked out", PassLimits{PerCoder: 1}, []string{"alice"}, nil, "alice", ErrCoderPassLimitReached},
+		{"coder limit, coded", PassLimits{PerCoder: 1}, nil, []string{"alice"}, "alice", ErrCoderPassLimitReached},
+		{"coder limit, other coder", PassLimits{PerCoder: 1}, []string{"alice"}, nil, "amy", nil},
+		{"no limits", PassLimits{}, []string{"alice"}, []string{"amy"}, "amy", nil},
+	} {
+		server := newHandlerTestServer(t, t.TempDir())
+		server.config.MaxPassesPerLab = test.limits.PerLab
+		server.config.MaxPassesPerCoder = test.limits.PerCoder
+		if err := server.addUser("lab1", "Lab lab1", "amy"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, username := range test.submitted {
+			block := Block{ID: "a.cha:::1", ClanFile: "a.cha", Index: 1,
+				LabKey: "lab1", Coder: username, Username: username}
+			if err := server.addLabeledBlock(block); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		for _, username := range test.checkouts {
+			if _, err := server.chooseSpecificBlock(BlockReq{ItemID: "a.cha:::1",
+				LabKey: "lab1", Username: username}); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+
+		_, err := server.chooseSpecificBlock(BlockReq{ItemID: "a.cha:::1",
+			LabKey: "lab1", Username: test.username})
+		if err != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+
+		// another lab is never held back by lab1's passes
+		if test.limits.PerLab > 0 {
+			if _, err := server.chooseSpecificBlock(BlockReq{ItemID: "a.cha:::1",
+				LabKey: "lab2", Username: "bob"}); err != nil {
+				t.Errorf("%s: bob got %v", test.name, err)
+			}
+		}
+	}
+}
+
+func TestPassLimitsStoreError(t *testing.T) {
+	server := newHandlerTestServer(t, t.TempDir())
+	server.config.MaxPassesPerLab = 1
+	server.updateWorkItem("a.cha:::1", func(item *WorkItem) {
+		item.TimesCoded = 1
+	})
+	server.labels = failingLabelStore{server.labels}
+
+	// a database that can't be read isn't taken as "under the limit"
+	_, err := server.chooseRegularWorkItem(BlockReq{LabKey: "lab1", Username: "alice"})
+	if err != errStoreFailed {
+		t.Errorf("got %v, want the store's error", err)
+	}
+	if item, _ := server.workItem("a.cha:::1"); item.Active {
+		t.Error("block was checked out")
+	}
+}
+
+/*
+TestConcurrentCheckouts fires checkouts of the same block at once,
+only one of which should get it. Run it with -race too.
+*/
+func TestConcurrentCheckouts(t *testing.T) {
+	const numUsers = 10
+
+	for _, test := range []struct {
+		url     string
+		request func(username string) BlockReq
+	}{
+		{"/v1/get-block/", func(username string) BlockReq {
+			return BlockReq{LabKey: "lab1", Username: username}
+		}},
+		// more than one coder can ask for the same block here,
+		// the lab limit has to keep all but one of them out
+		{"/v1/get-specific-block/", func(username string) BlockReq {
+			return BlockReq{ItemID: "a.cha:::1", LabKey: "lab1", Username: username}
+		}},
+	} {
+		server := newHandlerTestServer(t, t.TempDir())
+		server.config.MaxPassesPerLab = 1
+		// bob has coded the block, so every checkout looks up its passes,
+		// which takes long enough for the checkouts to overlap
+		block := Block{ID: "a.cha:::1", ClanFile: "a.cha", Index: 1,
+			LabKey: "lab2", Coder: "bob", Username: "bob"}
+		if err := server.addLabeledBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		server.labels = slowLabelStore{server.labels}
+		for i := 0; i < numUsers; i++ {
+			if err := server.addUser("lab1", "Lab lab1", fmt.Sprintf("coder%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var wait sync.WaitGroup
+		codes := make(chan int, numUsers)
+		for i := 0; i < numUsers; i++ {
+			wait.Add(1)
+			go func(username string) {
+				defer wait.Done()
+				codes <- serveTestRequest(t, server, test.url, test.request(username)).Code
+			}(fmt.Sprintf("coder%d", i))
+		}
+		wait.Wait()
+		close(codes)
+
+		checkedOut := 0
+		for code := range codes {
+			if code == http.StatusOK {
+				checkedOut++
+			}
+		}
+		if checkedOut != 1 {
+			t.Errorf("%s: %d coders got the block, want 1", test.url, checkedOut)
+		}
+	}
+}
+
+func TestConcurrentAddWorkItems(t *testing.T) {
+	const numAdds = 10
+	server := newHandlerTestServer(t, t.TempDir())
+	server.work = slowWorkStore{server.work}
+
+	var wait sync.WaitGroup
+	added := make(chan []string, numAdds)
+	for i := 0; i < numAdds; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			ids, _, err := server.addWorkItems(WorkItemMap{"n.cha:::1": {ID: "n.cha:::1", FileName: "n.cha", Block: 1}})
+			if err != nil {
+				t.Error(err)
+			}
+			added <- ids
+		}()
+	}
+	wait.Wait()
+	close(added)
+
+	numAdded := 0
+	for ids := range added {
+		numAdded += len(ids)
+	}
+	if numAdded != 1 {
+		t.Errorf("the item was added %d times, want 1", numAdded)
+	}
+}